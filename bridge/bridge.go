@@ -0,0 +1,219 @@
+// Package bridge pipes WebSocket connections to TCP services like
+// websockify, so that browser clients can reach VNC or terminal servers.
+package bridge
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+// Subprotocols of websockify. Data is sent in binary messages with
+// "binary" or without subprotocol, and base64 encoded in text messages
+// with "base64".
+const (
+	ProtocolBinary = "binary"
+	ProtocolBase64 = "base64"
+)
+
+// Defaults of Bridge
+const (
+	DefaultDialTimeout = 10 * time.Second
+	bufferSize         = 32 << 10
+	closeTimeout       = 5 * time.Second
+)
+
+// Errors
+var (
+	ErrTooManyConns  = errors.New("bridge: too many connections")
+	ErrUnknownTarget = errors.New("bridge: unknown target")
+)
+
+// Bridge connects WebSocket connections to backends
+type Bridge struct {
+	// Backend is the default backend address as host:port
+	Backend string
+	// Backends are selected by name, which is given by the "target" query
+	// parameter or the first path segment of the request
+	Backends map[string]string
+	// MaxConns limits the number of bridged connections. 0 means no limit.
+	MaxConns    int
+	DialTimeout time.Duration
+
+	mu    sync.Mutex
+	conns int
+}
+
+// Subprotocols returns subprotocols to be negotiated in the opening
+// handshake
+func (b *Bridge) Subprotocols() []string {
+	return []string{ProtocolBinary, ProtocolBase64}
+}
+
+// Target returns the backend address for the request
+func (b *Bridge) Target(requestURI string) (string, error) {
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return "", err
+	}
+	name := u.Query().Get("target")
+	if name == "" {
+		name = strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	}
+	if addr, ok := b.Backends[name]; ok {
+		return addr, nil
+	}
+	if b.Backend == "" {
+		return "", fmt.Errorf("%w %q", ErrUnknownTarget, name)
+	}
+	return b.Backend, nil
+}
+
+// Active returns the number of bridged connections
+func (b *Bridge) Active() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conns
+}
+
+func (b *Bridge) acquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.MaxConns > 0 && b.conns >= b.MaxConns {
+		return false
+	}
+	b.conns++
+	return true
+}
+
+func (b *Bridge) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns--
+}
+
+// Serve pipes bytes between c and the backend of the request until either
+// side closes. The connection is closed with 1013 if there are too many
+// connections, 1008 if no backend matches and 1014 if the backend can not
+// be reached.
+func (b *Bridge) Serve(c *ws.Conn, requestURI string) error {
+	if !b.acquire() {
+		closeWith(c, ws.StatusTryAgainLater)
+		return ErrTooManyConns
+	}
+	defer b.release()
+
+	addr, err := b.Target(requestURI)
+	if err != nil {
+		closeWith(c, ws.StatusPolicyViolation)
+		return err
+	}
+	timeout := b.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	backend, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		closeWith(c, ws.StatusBadGateway)
+		return err
+	}
+	defer backend.Close()
+
+	client := ws.NewNetConn(c)
+	if c.Subprotocol == ProtocolBase64 {
+		client = &base64Conn{Conn: client, c: c}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(backend, client); errors.Is(err, errInvalidBase64) {
+			c.CloseWithStatus(ws.StatusInvalidFramePayloadData)
+		}
+		// the client has gone, so that the backend loop ends as well
+		backend.Close()
+	}()
+
+	io.Copy(client, backend)
+	// the backend has closed, perform the closing handshake
+	client.Close()
+	<-done
+	return nil
+}
+
+// closeWith closes the connection with the status before bridging, and
+// waits for the reply of the client for a while
+func closeWith(c *ws.Conn, code int) {
+	c.CloseWithStatus(code)
+	c.Rwc.SetReadDeadline(time.Now().Add(closeTimeout))
+	for {
+		if _, _, err := c.NextMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// base64Conn carries data in base64 text messages for the "base64"
+// subprotocol. Each message is padded on its own, so that received text
+// is decoded by 4 byte quanta regardless of message boundaries.
+type base64Conn struct {
+	net.Conn // of ws.NewNetConn
+	c        *ws.Conn
+
+	in    [bufferSize]byte
+	inLen int    // bytes of in not decoded yet, less than a quantum
+	dec   []byte // buffer of decoded data
+	out   []byte // decoded data not read yet
+	err   error
+	enc   []byte // buffer of Write
+}
+
+var errInvalidBase64 = errors.New("bridge: invalid base64 message")
+
+func (bc *base64Conn) Read(p []byte) (int, error) {
+	for len(bc.out) == 0 && bc.err == nil {
+		n, err := bc.Conn.Read(bc.in[bc.inLen:])
+		bc.inLen += n
+		bc.err = err
+		q := bc.inLen / 4 * 4
+		bc.out = bc.dec[:0]
+		for i := 0; i < q; i += 4 {
+			var b [3]byte
+			m, err := base64.StdEncoding.Decode(b[:], bc.in[i:i+4])
+			if err != nil {
+				bc.err = errInvalidBase64
+				break
+			}
+			bc.out = append(bc.out, b[:m]...)
+		}
+		bc.dec = bc.out[:0]
+		bc.inLen = copy(bc.in[:], bc.in[q:bc.inLen])
+	}
+	if len(bc.out) == 0 {
+		return 0, bc.err
+	}
+	n := copy(p, bc.out)
+	bc.out = bc.out[n:]
+	return n, nil
+}
+
+// Write sends p in a base64 text message
+func (bc *base64Conn) Write(p []byte) (int, error) {
+	n := base64.StdEncoding.EncodedLen(len(p))
+	if cap(bc.enc) < n {
+		bc.enc = make([]byte, n)
+	}
+	bc.enc = bc.enc[:n]
+	base64.StdEncoding.Encode(bc.enc, p)
+	if err := bc.c.SendMessage(ws.OpCodeText, bc.enc); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
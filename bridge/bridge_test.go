@@ -0,0 +1,255 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws"
+	"github.com/cou929/minws/ws"
+)
+
+// listen runs a TCP server which replies with the prefix and echoes the
+// upper cased input
+func listen(t *testing.T, prefix string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(prefix))
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == "quit\n" {
+						return
+					}
+					conn.Write([]byte(strings.ToUpper(line)))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serve runs a WebSocket server of b
+func serve(t *testing.T, b *Bridge) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	u := &minws.Upgrader{Subprotocols: b.Subprotocols()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, req, err := u.Upgrade(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				b.Serve(c, req.RequestURI)
+			}()
+		}
+	}()
+	return "ws://" + l.Addr().String()
+}
+
+// read reads data from the bridge until n bytes
+func read(t *testing.T, c *ws.Conn, n int) string {
+	t.Helper()
+	c.Rwc.SetReadDeadline(time.Now().Add(time.Second))
+	var got []byte
+	for len(got) < n {
+		op, msg, err := c.NextMessage()
+		if err != nil {
+			t.Fatalf("NextMessage() error = %v", err)
+		}
+		if op == ws.OpCodeText {
+			if msg, err = base64.StdEncoding.DecodeString(string(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got = append(got, msg...)
+	}
+	return string(got)
+}
+
+func TestBridge_Serve(t *testing.T) {
+	b := &Bridge{
+		Backend:  listen(t, "default\n"),
+		Backends: map[string]string{"vnc": listen(t, "vnc\n"), "ssh": listen(t, "ssh\n")},
+	}
+	url := serve(t, b)
+
+	tests := []struct {
+		path   string
+		proto  string
+		prefix string
+	}{
+		{"/", "", "default\n"},
+		{"/vnc", "binary", "vnc\n"},
+		{"/vnc/websockify", "base64", "vnc\n"},
+		{"/?target=ssh", "base64", "ssh\n"},
+	}
+	for _, tt := range tests {
+		d := &minws.Dialer{}
+		if tt.proto != "" {
+			d.Subprotocols = []string{tt.proto}
+		}
+		c, _, err := d.Dial(url + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Subprotocol != tt.proto {
+			t.Errorf("%s: Subprotocol = %q, want %q", tt.path, c.Subprotocol, tt.proto)
+		}
+		if got := read(t, c, len(tt.prefix)); got != tt.prefix {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.prefix)
+		}
+		send := func(s string) {
+			if tt.proto == ProtocolBase64 {
+				c.SendTextMessage(base64.StdEncoding.EncodeToString([]byte(s)))
+			} else {
+				c.SendBinaryMessage([]byte(s))
+			}
+		}
+		// a line split into messages
+		send("hel")
+		send("lo\n")
+		if got := read(t, c, 6); got != "HELLO\n" {
+			t.Errorf("%s: got %q, want HELLO", tt.path, got)
+		}
+
+		// the backend closes the connection
+		send("quit\n")
+		c.Rwc.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = c.NextMessage()
+		var cerr *ws.CloseError
+		if !errors.As(err, &cerr) || cerr.Code != ws.StatusNormalClosure {
+			t.Errorf("%s: NextMessage() error = %v, want normal closure", tt.path, err)
+		}
+	}
+	waitFor(t, func() bool { return b.Active() == 0 })
+}
+
+func TestBridge_Serve_Text(t *testing.T) {
+	url := serve(t, &Bridge{Backend: listen(t, "")})
+
+	// text messages are not decoded without the base64 subprotocol
+	c, _, err := (&minws.Dialer{Subprotocols: []string{ProtocolBinary}}).Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Rwc.Close()
+	c.SendTextMessage("aGk=\n")
+	if got := read(t, c, 5); got != "AGK=\n" {
+		t.Errorf("got %q, want %q", got, "AGK=\n")
+	}
+
+	// invalid base64 fails the connection with 1007
+	c, _, err = (&minws.Dialer{Subprotocols: []string{ProtocolBase64}}).Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Rwc.Close()
+	c.SendTextMessage("!!!!")
+	c.Rwc.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.NextMessage()
+	var cerr *ws.CloseError
+	if !errors.As(err, &cerr) || cerr.Code != ws.StatusInvalidFramePayloadData {
+		t.Errorf("NextMessage() error = %v, want close %d", err, ws.StatusInvalidFramePayloadData)
+	}
+}
+
+func TestBridge_Reject_OnClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := ws.NewConn(server)
+	closed := make(chan struct{})
+	c.OnClose(func() { close(closed) })
+	go (&Bridge{}).Serve(c, "/unknown")
+
+	df, err := ws.NewDataFrameFromReader(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := df.CloseStatusCode(); df.OpCode != ws.OpCodeClose || code != ws.StatusPolicyViolation {
+		t.Fatalf("got %v %d, want close %d", df.OpCode, code, ws.StatusPolicyViolation)
+	}
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("OnClose hooks did not run")
+	}
+}
+
+func TestBridge_Reject(t *testing.T) {
+	backend := listen(t, "")
+	b := &Bridge{Backends: map[string]string{"a": backend, "down": "127.0.0.1:1"}, MaxConns: 1}
+	url := serve(t, b)
+
+	hold, _, err := minws.Dial(url + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return b.Active() == 1 })
+
+	expectClose := func(path string, code, active int) {
+		t.Helper()
+		c, _, err := minws.Dial(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Rwc.Close()
+		c.Rwc.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = c.NextMessage()
+		var cerr *ws.CloseError
+		if !errors.As(err, &cerr) || cerr.Code != code {
+			t.Errorf("%s: error = %v, want close %d", path, err, code)
+		}
+		// the slot is released after the closing handshake
+		waitFor(t, func() bool { return b.Active() == active })
+	}
+	expectClose("/a", ws.StatusTryAgainLater, 1)
+
+	// the client closes the connection
+	hold.Close()
+	io.Copy(ioutil.Discard, hold.Rwc)
+	waitFor(t, func() bool { return b.Active() == 0 })
+
+	expectClose("/unknown", ws.StatusPolicyViolation, 0)
+	expectClose("/down", ws.StatusBadGateway, 0)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,167 @@
+// Package call correlates requests and replies over a WebSocket
+// connection independently of the message format.
+package call
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+// Handler handles a request from the peer and returns the reply body.
+// No reply is sent if it returns an error.
+type Handler func(ctx context.Context, msg []byte) ([]byte, error)
+
+// Caller sends requests and waits for the replies on a connection.
+// Serve must be running to receive the replies.
+type Caller struct {
+	// Timeout is applied to calls whose context has no deadline.
+	// Zero means no timeout.
+	Timeout time.Duration
+	// OpCode is the opcode of sent messages. Default is binary.
+	OpCode ws.OpCode
+
+	conn *ws.Conn
+	env  Envelope
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan []byte
+	err     error // set when closed
+}
+
+// New is a constructor of Caller. BinaryEnvelope is used if env is nil.
+func New(c *ws.Conn, env Envelope) *Caller {
+	if env == nil {
+		env = BinaryEnvelope{}
+	}
+	return &Caller{
+		OpCode:  ws.OpCodeBinary,
+		conn:    c,
+		env:     env,
+		pending: make(map[uint64]chan []byte),
+	}
+}
+
+// Call sends msg and waits for the reply. It returns the error which
+// closed the connection if it is closed before the reply arrives.
+func (c *Caller) Call(ctx context.Context, msg []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	ch := make(chan []byte, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	b, err := c.env.Request(id, msg)
+	if err == nil {
+		err = c.conn.SendMessage(c.OpCode, b)
+	}
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, c.closeErr()
+		}
+		return reply, nil
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+// Pending returns the number of calls waiting for replies
+func (c *Caller) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func (c *Caller) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *Caller) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Serve reads messages until the connection is closed. Replies are passed
+// to the waiting calls and requests are handled by h concurrently; h may
+// be nil if the peer sends no requests. Messages which the envelope can
+// not open are ignored. When the connection is closed, pending calls fail
+// with the error which closed it.
+func (c *Caller) Serve(h Handler) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		_, msg, err := c.conn.NextMessage()
+		if err != nil {
+			c.fail(err)
+			return err
+		}
+		id, body, reply, err := c.env.Open(msg)
+		if err != nil {
+			continue
+		}
+		if reply {
+			c.deliver(id, body)
+			continue
+		}
+		if h != nil {
+			go c.handle(ctx, h, id, body)
+		}
+	}
+}
+
+func (c *Caller) handle(ctx context.Context, h Handler, id uint64, msg []byte) {
+	res, err := h(ctx, msg)
+	if err != nil {
+		return
+	}
+	b, err := c.env.Reply(id, res)
+	if err != nil {
+		return
+	}
+	c.conn.SendMessage(c.OpCode, b)
+}
+
+func (c *Caller) deliver(id uint64, body []byte) {
+	c.mu.Lock()
+	ch, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if ok {
+		ch <- body
+	}
+}
+
+// fail fails all pending calls with err
+func (c *Caller) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
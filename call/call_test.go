@@ -0,0 +1,144 @@
+package call
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+// jsonEnvelope is an Envelope of text messages like {"id":1,"body":"..."}
+type jsonEnvelope struct{}
+
+type jsonMessage struct {
+	ID    uint64 `json:"id"`
+	Reply bool   `json:"reply,omitempty"`
+	Body  string `json:"body"`
+}
+
+func (jsonEnvelope) Request(id uint64, msg []byte) ([]byte, error) {
+	return json.Marshal(jsonMessage{ID: id, Body: string(msg)})
+}
+
+func (jsonEnvelope) Reply(id uint64, msg []byte) ([]byte, error) {
+	return json.Marshal(jsonMessage{ID: id, Reply: true, Body: string(msg)})
+}
+
+func (jsonEnvelope) Open(msg []byte) (uint64, []byte, bool, error) {
+	var m jsonMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return 0, nil, false, err
+	}
+	return m.ID, []byte(m.Body), m.Reply, nil
+}
+
+func newPair(t *testing.T, env Envelope) (*Caller, *Caller) {
+	t.Helper()
+	sc, cc := net.Pipe()
+	s := New(ws.NewConn(sc), env)
+	c := New(ws.NewClientConn(cc, bufio.NewReader(cc)), env)
+	t.Cleanup(func() {
+		sc.Close()
+		cc.Close()
+	})
+	return s, c
+}
+
+func upper(ctx context.Context, msg []byte) ([]byte, error) {
+	if string(msg) == "slow" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return []byte(strings.ToUpper(string(msg))), nil
+}
+
+func TestCaller_Call(t *testing.T) {
+	for name, env := range map[string]Envelope{"binary": nil, "json": jsonEnvelope{}} {
+		t.Run(name, func(t *testing.T) {
+			s, c := newPair(t, env)
+			if env != nil {
+				s.OpCode, c.OpCode = ws.OpCodeText, ws.OpCodeText
+			}
+			go s.Serve(upper)
+			go c.Serve(upper)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			done := make(chan struct{})
+			for _, w := range []string{"a", "b", "c", "d"} {
+				go func(w string) {
+					defer func() { done <- struct{}{} }()
+					res, err := c.Call(ctx, []byte(w))
+					if err != nil || string(res) != strings.ToUpper(w) {
+						t.Errorf("Call(%q) = %q, %v", w, res, err)
+					}
+				}(w)
+			}
+			for i := 0; i < 4; i++ {
+				<-done
+			}
+
+			// the server calls the client as well
+			if res, err := s.Call(ctx, []byte("e")); err != nil || string(res) != "E" {
+				t.Errorf("Call(e) = %q, %v", res, err)
+			}
+		})
+	}
+}
+
+func TestCaller_Timeout(t *testing.T) {
+	s, c := newPair(t, nil)
+	go s.Serve(upper)
+	go c.Serve(nil)
+
+	c.Timeout = 20 * time.Millisecond
+	if _, err := c.Call(context.Background(), []byte("slow")); err != context.DeadlineExceeded {
+		t.Errorf("Call() error = %v, want DeadlineExceeded", err)
+	}
+	if n := c.Pending(); n != 0 {
+		t.Errorf("Pending() = %d, want 0", n)
+	}
+	if res, err := c.Call(context.Background(), []byte("a")); err != nil || string(res) != "A" {
+		t.Errorf("Call(a) = %q, %v", res, err)
+	}
+}
+
+func TestCaller_FailOnClose(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	server := ws.NewConn(sc)
+	c := New(ws.NewClientConn(cc, bufio.NewReader(cc)), nil)
+	go c.Serve(nil)
+
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.Call(context.Background(), []byte("never answered"))
+			errc <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := server.NextMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go server.NextMessage() // receive the echoed close frame
+	server.SendCloseFrame(ws.StatusGoingAway)
+
+	for i := 0; i < 2; i++ {
+		var cerr *ws.CloseError
+		if err := <-errc; !errors.As(err, &cerr) || cerr.Code != ws.StatusGoingAway {
+			t.Errorf("Call() error = %v, want close %d", err, ws.StatusGoingAway)
+		}
+	}
+	var cerr *ws.CloseError
+	if _, err := c.Call(context.Background(), []byte("a")); !errors.As(err, &cerr) {
+		t.Errorf("Call() after close error = %v, want close error", err)
+	}
+}
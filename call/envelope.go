@@ -0,0 +1,58 @@
+package call
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Envelope tags messages with correlation ids, so that replies can be
+// matched with the requests
+type Envelope interface {
+	// Request wraps msg as a request with id
+	Request(id uint64, msg []byte) ([]byte, error)
+	// Reply wraps msg as the reply to the request with id
+	Reply(id uint64, msg []byte) ([]byte, error)
+	// Open returns the id and the body of a message, and reports whether
+	// it is a reply
+	Open(msg []byte) (id uint64, body []byte, reply bool, err error)
+}
+
+// BinaryEnvelope prefixes the body with a kind byte and the id encoded
+// as uvarint
+type BinaryEnvelope struct{}
+
+const (
+	kindRequest byte = 'q'
+	kindReply   byte = 'r'
+)
+
+var errInvalidEnvelope = errors.New("call: invalid envelope")
+
+// Request implements Envelope
+func (BinaryEnvelope) Request(id uint64, msg []byte) ([]byte, error) {
+	return wrap(kindRequest, id, msg), nil
+}
+
+// Reply implements Envelope
+func (BinaryEnvelope) Reply(id uint64, msg []byte) ([]byte, error) {
+	return wrap(kindReply, id, msg), nil
+}
+
+// Open implements Envelope
+func (BinaryEnvelope) Open(msg []byte) (uint64, []byte, bool, error) {
+	if len(msg) < 2 || (msg[0] != kindRequest && msg[0] != kindReply) {
+		return 0, nil, false, errInvalidEnvelope
+	}
+	id, n := binary.Uvarint(msg[1:])
+	if n <= 0 {
+		return 0, nil, false, errInvalidEnvelope
+	}
+	return id, msg[1+n:], msg[0] == kindReply, nil
+}
+
+func wrap(kind byte, id uint64, msg []byte) []byte {
+	b := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(msg))
+	b[0] = kind
+	n := binary.PutUvarint(b[1:], id)
+	return append(b[:1+n], msg...)
+}
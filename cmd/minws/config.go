@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+// Handler modes
+const (
+	modeEcho      = "echo"
+	modeBroadcast = "broadcast"
+	modeExec      = "exec"
+	modeProxy     = "proxy"
+	modeBridge    = "bridge"
+	modeStatic    = "static"
+)
+
+// Config is the configuration of the server. It is read from a JSON file
+// given by -config, and then overridden by the other flags.
+//
+//	{
+//	  "listen": [":5001"],
+//	  "tls": {"certs": [{"cert": "server.crt", "key": "server.key"}]},
+//	  "limits": {"max_conns": 1000, "max_message_size": 1048576},
+//	  "timeouts": {"handshake": "10s", "idle": "5m"},
+//	  "allowed_origins": ["https://example.com"],
+//	  "subprotocols": ["chat"],
+//	  "mode": "exec",
+//	  "exec": {"command": ["./chat.sh", "-v"]},
+//	  "static": {"root": "./public"},
+//	  "log_level": "info"
+//	}
+type Config struct {
+	Listen         []string       `json:"listen"`
+	TLS            TLSConfig      `json:"tls"`
+	Limits         LimitsConfig   `json:"limits"`
+	Timeouts       TimeoutsConfig `json:"timeouts"`
+	AllowedOrigins []string       `json:"allowed_origins"`
+	Subprotocols   []string       `json:"subprotocols"`
+	Mode           string         `json:"mode"`
+	Exec           ExecConfig     `json:"exec"`
+	Proxy          ProxyConfig    `json:"proxy"`
+	Bridge         BridgeConfig   `json:"bridge"`
+	Static         StaticConfig   `json:"static"`
+	LogLevel       string         `json:"log_level"`
+}
+
+// TLSConfig serves wss:// if Certs is not empty
+type TLSConfig struct {
+	Certs []CertConfig `json:"certs"`
+}
+
+// CertConfig is a pair of PEM encoded certificate and key files
+type CertConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// LimitsConfig limits resources
+type LimitsConfig struct {
+	// MaxConns is the max number of connections. 0 means no limit.
+	MaxConns int `json:"max_conns"`
+	// MaxMessageSize is the max size of a received message. 0 means
+	// ws.DefaultMaxMessageSize.
+	MaxMessageSize int `json:"max_message_size"`
+}
+
+// TimeoutsConfig bounds waits of connections. 0 means no timeout.
+type TimeoutsConfig struct {
+	// Handshake limits the time to complete the opening handshake
+	Handshake Duration `json:"handshake"`
+	// Idle closes connections which receive nothing for the duration
+	Idle Duration `json:"idle"`
+}
+
+// ExecConfig is the command run per connection in exec mode
+type ExecConfig struct {
+	Command     []string `json:"command"`
+	Dir         string   `json:"dir"`
+	Env         []string `json:"env"`
+	KillTimeout Duration `json:"kill_timeout"`
+}
+
+// ProxyConfig is the backend WebSocket servers in proxy mode
+type ProxyConfig struct {
+	Backends   []string `json:"backends"`
+	Policy     string   `json:"policy"`
+	HashHeader string   `json:"hash_header"`
+	HashCookie string   `json:"hash_cookie"`
+}
+
+// BridgeConfig is the backend TCP servers in bridge mode
+type BridgeConfig struct {
+	Backend  string            `json:"backend"`
+	Backends map[string]string `json:"backends"`
+}
+
+// StaticConfig serves files to requests other than WebSocket handshakes
+// in any mode. In static mode, only files are served.
+type StaticConfig struct {
+	Root string `json:"root"`
+}
+
+// Duration is time.Duration written like "10s" in the config file
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// defaultConfig returns the configuration without file and flags
+func defaultConfig() *Config {
+	return &Config{
+		Listen:   []string{":5001"},
+		Mode:     modeEcho,
+		Limits:   LimitsConfig{MaxMessageSize: ws.DefaultMaxMessageSize},
+		Proxy:    ProxyConfig{Policy: "round-robin"},
+		LogLevel: "info",
+	}
+}
+
+// loadConfig reads the file over the defaults. Unknown keys are errors
+// to catch typos.
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := defaultConfig()
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		if serr, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(b[:serr.Offset], []byte("\n"))
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// configError lists all problems of a config, so that they can be fixed
+// at once
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid config:\n\t" + strings.Join(e, "\n\t")
+}
+
+// validate checks the config before the server starts
+func (cfg *Config) validate() error {
+	var errs configError
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if len(cfg.Listen) == 0 {
+		add("listen: no address")
+	}
+	for _, addr := range cfg.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			add("listen: %v", err)
+		}
+	}
+	for i, c := range cfg.TLS.Certs {
+		if c.Cert == "" || c.Key == "" {
+			add("tls.certs[%d]: both cert and key are required", i)
+		}
+	}
+	if cfg.Limits.MaxConns < 0 {
+		add("limits.max_conns: must not be negative")
+	}
+	if cfg.Limits.MaxMessageSize < 0 {
+		add("limits.max_message_size: must not be negative")
+	}
+	if cfg.Timeouts.Handshake < 0 {
+		add("timeouts.handshake: must not be negative")
+	}
+	if cfg.Timeouts.Idle < 0 {
+		add("timeouts.idle: must not be negative")
+	}
+	for _, o := range cfg.AllowedOrigins {
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" {
+			add("allowed_origins: %q is not scheme://host[:port]", o)
+		}
+	}
+	for _, p := range cfg.Subprotocols {
+		if p == "" || strings.ContainsAny(p, " \t,;\"()<>@:/[]?={}") {
+			add("subprotocols: %q is not a token", p)
+		}
+	}
+	if cfg.Static.Root != "" {
+		if fi, err := os.Stat(cfg.Static.Root); err != nil {
+			add("static.root: %v", err)
+		} else if !fi.IsDir() {
+			add("static.root: %s is not a directory", cfg.Static.Root)
+		}
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		add("log_level: %v", err)
+	}
+
+	switch cfg.Mode {
+	case modeEcho, modeBroadcast:
+	case modeExec:
+		if len(cfg.Exec.Command) == 0 || cfg.Exec.Command[0] == "" {
+			add("exec.command: required in exec mode")
+		}
+		if cfg.Exec.KillTimeout < 0 {
+			add("exec.kill_timeout: must not be negative")
+		}
+	case modeProxy:
+		if len(cfg.Proxy.Backends) == 0 {
+			add("proxy.backends: required in proxy mode")
+		}
+		for _, b := range cfg.Proxy.Backends {
+			if u, err := url.Parse(b); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+				add("proxy.backends: %q is not a ws:// or wss:// URL", b)
+			}
+		}
+		if _, err := parsePolicy(cfg.Proxy.Policy); err != nil {
+			add("proxy.policy: %v", err)
+		}
+		if len(cfg.Subprotocols) > 0 {
+			add("subprotocols: negotiated by the backends in proxy mode")
+		}
+	case modeBridge:
+		if cfg.Bridge.Backend == "" && len(cfg.Bridge.Backends) == 0 {
+			add("bridge: backend or backends is required in bridge mode")
+		}
+		if cfg.Bridge.Backend != "" {
+			if _, _, err := net.SplitHostPort(cfg.Bridge.Backend); err != nil {
+				add("bridge.backend: %v", err)
+			}
+		}
+		for name, addr := range cfg.Bridge.Backends {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				add("bridge.backends[%q]: %v", name, err)
+			}
+		}
+		if len(cfg.Subprotocols) > 0 {
+			add("subprotocols: fixed to binary and base64 in bridge mode")
+		}
+	case modeStatic:
+		if cfg.Static.Root == "" {
+			add("static.root: required in static mode")
+		}
+	default:
+		add("mode: unknown mode %q, want echo, broadcast, exec, proxy, bridge or static", cfg.Mode)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "minws.json")
+	if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": [":8080", "127.0.0.1:8081"],
+		"limits": {"max_conns": 10},
+		"timeouts": {"handshake": "3s", "idle": "1m30s"},
+		"allowed_origins": ["https://example.com"],
+		"mode": "exec",
+		"exec": {"command": ["cat"]},
+		"log_level": "debug"
+	}`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	want := defaultConfig()
+	want.Listen = []string{":8080", "127.0.0.1:8081"}
+	want.Limits.MaxConns = 10
+	want.Timeouts = TimeoutsConfig{Handshake: Duration(3 * time.Second), Idle: Duration(90 * time.Second)}
+	want.AllowedOrigins = []string{"https://example.com"}
+	want.Mode = modeExec
+	want.Exec.Command = []string{"cat"}
+	want.LogLevel = "debug"
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loadConfig() = %+v, want %+v", cfg, want)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+}
+
+func TestLoadConfig_Error(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"{\n\"listen\": [\":80\"],\n}", ":3:"},
+		{`{"mdoe": "echo"}`, `unknown field "mdoe"`},
+		{`{"timeouts": {"idle": 10}}`, "duration must be a string"},
+		{`{"timeouts": {"idle": "10"}}`, "missing unit"},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(writeConfig(t, tt.config))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadConfig(%s) error = %v, want %q", tt.config, err, tt.want)
+		}
+	}
+}
+
+func TestConfig_validate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Listen = []string{"localhost"}
+	cfg.TLS.Certs = []CertConfig{{Cert: "a.crt"}}
+	cfg.Limits.MaxConns = -1
+	cfg.AllowedOrigins = []string{"example.com"}
+	cfg.Subprotocols = []string{"a b"}
+	cfg.LogLevel = "verbose"
+	cfg.Mode = modeProxy
+	cfg.Proxy = ProxyConfig{Backends: []string{"http://a"}, Policy: "random"}
+
+	err := cfg.validate()
+	errs, ok := err.(configError)
+	if !ok {
+		t.Fatalf("validate() error = %v, want configError", err)
+	}
+	for _, want := range []string{
+		"listen:", "tls.certs[0]", "limits.max_conns", "allowed_origins",
+		"subprotocols: \"a b\"", "log_level", "proxy.backends", "proxy.policy",
+		"subprotocols: negotiated",
+	} {
+		found := false
+		for _, e := range errs {
+			found = found || strings.HasPrefix(e, want)
+		}
+		if !found {
+			t.Errorf("validate() error = %v, want %q", err, want)
+		}
+	}
+
+	for _, mode := range []string{modeExec, modeBridge, modeStatic, "static-files"} {
+		cfg := defaultConfig()
+		cfg.Mode = mode
+		if err := cfg.validate(); err == nil {
+			t.Errorf("validate() in %s mode without options error = nil", mode)
+		}
+	}
+}
+
+func TestApplyFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want func(*Config)
+	}{
+		{
+			[]string{"-addr", ":80,:81", "-max-conns", "5", "-idle-timeout", "1m"},
+			func(c *Config) {
+				c.Listen = []string{":80", ":81"}
+				c.Limits.MaxConns = 5
+				c.Timeouts.Idle = Duration(time.Minute)
+			},
+		},
+		{
+			[]string{"-backends", "a=localhost:1,b=localhost:2"},
+			func(c *Config) {
+				c.Mode = modeBridge
+				c.Bridge.Backends = map[string]string{"a": "localhost:1", "b": "localhost:2"}
+			},
+		},
+		{
+			[]string{"-mode", "broadcast", "-proxy", "ws://a,ws://b", "-policy", "hash"},
+			func(c *Config) {
+				c.Mode = modeBroadcast
+				c.Proxy.Backends = []string{"ws://a", "ws://b"}
+				c.Proxy.Policy = "hash"
+			},
+		},
+		{
+			[]string{"-exec", "--", "sh", "-c", "cat"},
+			func(c *Config) {
+				c.Mode = modeExec
+				c.Exec.Command = []string{"sh", "-c", "cat"}
+			},
+		},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("minws", flag.ContinueOnError)
+		for _, name := range []string{"addr", "backends", "mode", "proxy", "policy"} {
+			fs.String(name, "", "")
+		}
+		fs.Int("max-conns", 0, "")
+		fs.Duration("idle-timeout", 0, "")
+		fs.Bool("exec", false, "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := defaultConfig()
+		if err := applyFlags(cfg, fs); err != nil {
+			t.Fatalf("applyFlags(%v) error = %v", tt.args, err)
+		}
+		want := defaultConfig()
+		tt.want(want)
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("applyFlags(%v) = %+v, want %+v", tt.args, cfg, want)
+		}
+	}
+}
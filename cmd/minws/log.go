@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+type logLevel int
+
+// Log levels in order of severity
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// minLevel is the least severe level to be logged
+var minLevel = levelInfo
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q, want debug, info, warn or error", s)
+}
+
+func logln(l logLevel, v ...interface{}) {
+	if l < minLevel {
+		return
+	}
+	log.Output(3, "["+levelNames[l]+"] "+fmt.Sprintln(v...))
+}
+
+func debugln(v ...interface{}) { logln(levelDebug, v...) }
+func infoln(v ...interface{})  { logln(levelInfo, v...) }
+func warnln(v ...interface{})  { logln(levelWarn, v...) }
+func errorln(v ...interface{}) { logln(levelError, v...) }
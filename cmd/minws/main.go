@@ -1,102 +1,230 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
-	"net"
+	"strings"
+	"time"
 
-	"github.com/cou929/minws"
+	"github.com/cou929/minws/proxy"
 	"github.com/cou929/minws/ws"
 )
 
 func main() {
-	l, err := net.Listen("tcp", ":5001")
+	configPath := flag.String("config", "", "JSON config file, overridden by the other flags")
+	flag.String("addr", ":5001", "comma separated addresses to listen")
+	flag.String("cert", "", "comma separated certificate files to serve wss://")
+	flag.String("key", "", "comma separated key files in the same order as -cert")
+	flag.String("mode", modeEcho, "handler of connections: echo, broadcast, exec, proxy, bridge or static")
+	flag.String("origins", "", "comma separated allowed origins, empty allows any")
+	flag.String("subprotocols", "", "comma separated supported subprotocols in order of preference")
+	flag.Int("max-conns", 0, "max number of connections, 0 means no limit")
+	flag.Int("max-message-size", ws.DefaultMaxMessageSize, "max size of a received message in bytes")
+	flag.Duration("handshake-timeout", 0, "time limit of the opening handshake, 0 means no limit")
+	flag.Duration("idle-timeout", 0, "close connections receiving nothing for the duration, 0 means never")
+	flag.String("static", "", "directory of files served to requests other than WebSocket handshakes")
+	flag.String("log-level", "info", "debug, info, warn or error")
+	flag.String("backend", "", "host:port of TCP backend to bridge connections to")
+	flag.String("backends", "", "comma separated name=host:port of TCP backends selected by path or ?target=name")
+	flag.String("proxy", "", "comma separated URLs of backend WebSocket servers to proxy connections to")
+	flag.String("policy", "round-robin", "backend selection of -proxy: round-robin, least-conn or hash")
+	flag.String("hash-header", "", "request header to hash with -policy hash")
+	flag.String("hash-cookie", "", "cookie to hash with -policy hash")
+	flag.Bool("exec", false, "run the command given by the arguments per connection, bridging messages to its stdin and stdout lines")
+	flag.Parse()
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := applyFlags(cfg, flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+	s, err := newServer(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer l.Close()
+	log.Fatal(s.run())
+}
+
+// applyFlags overrides the config with the flags set explicitly
+func applyFlags(cfg *Config, fs *flag.FlagSet) error {
+	var err error
+	var mode, implied string
+	fs.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch f.Name {
+		case "addr":
+			cfg.Listen = splitList(v)
+		case "cert", "key":
+			certs := splitList(fs.Lookup("cert").Value.String())
+			keys := splitList(fs.Lookup("key").Value.String())
+			if len(certs) != len(keys) {
+				err = fmt.Errorf("the number of -cert and -key files must be the same")
+				return
+			}
+			cfg.TLS.Certs = nil
+			for i := range certs {
+				cfg.TLS.Certs = append(cfg.TLS.Certs, CertConfig{Cert: certs[i], Key: keys[i]})
+			}
+		case "mode":
+			mode = v
+		case "origins":
+			cfg.AllowedOrigins = splitList(v)
+		case "subprotocols":
+			cfg.Subprotocols = splitList(v)
+		case "max-conns":
+			cfg.Limits.MaxConns = f.Value.(flag.Getter).Get().(int)
+		case "max-message-size":
+			cfg.Limits.MaxMessageSize = f.Value.(flag.Getter).Get().(int)
+		case "handshake-timeout":
+			cfg.Timeouts.Handshake = Duration(f.Value.(flag.Getter).Get().(time.Duration))
+		case "idle-timeout":
+			cfg.Timeouts.Idle = Duration(f.Value.(flag.Getter).Get().(time.Duration))
+		case "static":
+			cfg.Static.Root = v
+		case "log-level":
+			cfg.LogLevel = v
+		case "backend":
+			implied = modeBridge
+			cfg.Bridge.Backend = v
+		case "backends":
+			implied = modeBridge
+			cfg.Bridge.Backends = map[string]string{}
+			for _, kv := range splitList(v) {
+				i := strings.IndexByte(kv, '=')
+				if i < 0 {
+					err = fmt.Errorf("invalid -backends entry %q, want name=host:port", kv)
+					return
+				}
+				cfg.Bridge.Backends[kv[:i]] = kv[i+1:]
+			}
+		case "proxy":
+			implied = modeProxy
+			cfg.Proxy.Backends = splitList(v)
+		case "policy":
+			cfg.Proxy.Policy = v
+		case "hash-header":
+			cfg.Proxy.HashHeader = v
+		case "hash-cookie":
+			cfg.Proxy.HashCookie = v
+		case "exec":
+			if v == "true" {
+				implied = modeExec
+				cfg.Exec.Command = fs.Args()
+			}
+		}
+	})
+	// -mode wins over the mode implied by -backend, -proxy and -exec
+	if mode != "" {
+		cfg.Mode = mode
+	} else if implied != "" {
+		cfg.Mode = implied
+	}
+	return err
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func parsePolicy(s string) (proxy.Policy, error) {
+	switch s {
+	case "round-robin":
+		return proxy.RoundRobin, nil
+	case "least-conn":
+		return proxy.LeastConnections, nil
+	case "hash":
+		return proxy.ConsistentHash, nil
+	}
+	return 0, fmt.Errorf("unknown policy %q, want round-robin, least-conn or hash", s)
+}
+
+// serveEcho echoes text messages with a prefix and binary messages
+// prefixed by a byte
+func serveEcho(c *ws.Conn) {
+	defer c.Close()
 	for {
-		conn, err := l.Accept()
+		df, err := c.ReadMessage()
 		if err != nil {
-			log.Fatal(err)
+			debugln(err)
+			c.Close()
+			return
 		}
-		go func(tcpConn net.Conn) {
-			c, err := minws.HandShake(tcpConn)
+		switch df.OpCode {
+		case ws.OpCodeText:
+			msg := string(df.Message())
+			debugln("on text message", msg)
+			err = c.SendTextMessage("echoed: " + msg)
 			if err != nil {
-				log.Println(err)
+				debugln(err)
 				c.Close()
 				return
 			}
-			defer c.Close()
-			for {
-				df, err := c.ReadMessage()
+		case ws.OpCodeBinary:
+			msg := df.Message()
+			debugln("on binary message", msg)
+			msg = append([]byte{1}, msg...)
+			err = c.SendBinaryMessage(msg)
+			if err != nil {
+				debugln(err)
+				c.Close()
+				return
+			}
+			c.Close()
+		case ws.OpCodeClose:
+			status, err := (df.CloseStatusCode())
+			if err != nil {
+				debugln(err)
+				c.Close()
+				return
+			}
+			debugln("on close", status, ws.StatusText(status))
+			switch c.State {
+			case ws.Established:
+				err = c.SendCloseFrame(status)
 				if err != nil {
-					log.Println(err)
+					debugln(err)
 					c.Close()
 					return
 				}
-				switch df.OpCode {
-				case ws.OpCodeText:
-					msg := string(df.Message())
-					log.Println("on text message", msg)
-					err = c.SendTextMessage("echoed: " + msg)
-					if err != nil {
-						log.Println(err)
-						c.Close()
-						return
-					}
-				case ws.OpCodeBinary:
-					msg := df.Message()
-					log.Println("on binary message", msg)
-					msg = append([]byte{1}, msg...)
-					err = c.SendBinaryMessage(msg)
-					if err != nil {
-						log.Println(err)
-						c.Close()
-						return
-					}
-					c.Close()
-				case ws.OpCodeClose:
-					status, err := (df.CloseStatusCode())
-					if err != nil {
-						log.Println(err)
-						c.Close()
-						return
-					}
-					log.Println("on close", status, ws.StatusText(status))
-					switch c.State {
-					case ws.Established:
-						err = c.SendCloseFrame(status)
-						if err != nil {
-							log.Println(err)
-							c.Close()
-							return
-						}
-						c.Close()
-						return
-					case ws.Closing:
-						c.Close()
-						return
-					case ws.Closed:
-						log.Println("received close frame on closed state conn")
-						c.Close()
-						return
-					}
-				case ws.OpCodePing:
-					msg := df.Message()
-					log.Println("on ping", msg)
-					err := c.SendBinaryMessage(msg)
-					if err != nil {
-						log.Println(err)
-						c.Close()
-						return
-					}
-				case ws.OpCodePong:
-					msg := df.Message()
-					log.Println("on pong", string(msg))
-				default:
-					log.Println("not message", df.OpCode)
-				}
+				c.Close()
+				return
+			case ws.Closing:
+				c.Close()
+				return
+			case ws.Closed:
+				warnln("received close frame on closed state conn")
+				c.Close()
+				return
+			}
+		case ws.OpCodePing:
+			msg := df.Message()
+			debugln("on ping", msg)
+			err := c.Pong(msg)
+			if err != nil {
+				debugln(err)
+				c.Close()
+				return
 			}
-		}(conn)
+		case ws.OpCodePong:
+			msg := df.Message()
+			debugln("on pong", string(msg))
+		default:
+			debugln("not message", df.OpCode)
+		}
 	}
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cou929/minws"
+	"github.com/cou929/minws/bridge"
+	"github.com/cou929/minws/h2"
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/hub"
+	"github.com/cou929/minws/process"
+	"github.com/cou929/minws/proxy"
+	"github.com/cou929/minws/ws"
+)
+
+// closeTimeout bounds the wait for the close frame of the client when
+// the server rejects a connection
+const closeTimeout = 5 * time.Second
+
+// server accepts connections and serves them according to the config
+type server struct {
+	cfg      *Config
+	upgrader minws.Upgrader
+	tls      *tls.Config
+	conns    chan struct{} // semaphore of Limits.MaxConns
+	files    *minwshttp.FileServer
+
+	hub     *hub.Hub
+	process *process.Handler
+	proxy   *proxy.Proxy
+	bridge  *bridge.Bridge
+}
+
+// newServer prepares the handler of the mode. cfg must be validated.
+func newServer(cfg *Config) (*server, error) {
+	level, _ := parseLogLevel(cfg.LogLevel)
+	minLevel = level
+
+	s := &server{
+		cfg: cfg,
+		upgrader: minws.Upgrader{
+			Subprotocols: cfg.Subprotocols,
+			Origins:      cfg.AllowedOrigins,
+			Timeout:      time.Duration(cfg.Timeouts.Handshake),
+			IdleTimeout:  time.Duration(cfg.Timeouts.Idle),
+		},
+	}
+	if cfg.Static.Root != "" {
+		s.files = &minwshttp.FileServer{Root: cfg.Static.Root}
+		s.upgrader.Fallback = s.files
+	}
+	if cfg.Limits.MaxConns > 0 {
+		s.conns = make(chan struct{}, cfg.Limits.MaxConns)
+	}
+	if len(cfg.TLS.Certs) > 0 {
+		files := make([]minws.CertFile, len(cfg.TLS.Certs))
+		for i, c := range cfg.TLS.Certs {
+			files[i] = minws.CertFile{CertFile: c.Cert, KeyFile: c.Key}
+		}
+		store, err := minws.NewCertStore(files...)
+		if err != nil {
+			return nil, err
+		}
+		store.ReloadOnSignal(syscall.SIGHUP)
+		s.tls = store.TLSConfig()
+	}
+
+	switch cfg.Mode {
+	case modeBroadcast:
+		s.hub = hub.New()
+	case modeExec:
+		s.process = &process.Handler{
+			Command:     cfg.Exec.Command[0],
+			Args:        cfg.Exec.Command[1:],
+			Dir:         cfg.Exec.Dir,
+			Env:         cfg.Exec.Env,
+			KillTimeout: time.Duration(cfg.Exec.KillTimeout),
+		}
+	case modeProxy:
+		policy, _ := parsePolicy(cfg.Proxy.Policy)
+		s.proxy = &proxy.Proxy{
+			Backends:       cfg.Proxy.Backends,
+			Policy:         policy,
+			HashHeader:     cfg.Proxy.HashHeader,
+			HashCookie:     cfg.Proxy.HashCookie,
+			ForwardHeaders: []string{"Origin", "Cookie", "Authorization", "User-Agent"},
+			Upgrader:       s.upgrader,
+			MaxMessageSize: cfg.Limits.MaxMessageSize,
+		}
+	case modeBridge:
+		s.bridge = &bridge.Bridge{Backend: cfg.Bridge.Backend, Backends: cfg.Bridge.Backends}
+		s.upgrader.Subprotocols = s.bridge.Subprotocols()
+	}
+	return s, nil
+}
+
+// run listens on all addresses and returns the first error of them
+func (s *server) run() error {
+	errc := make(chan error, len(s.cfg.Listen))
+	for _, addr := range s.cfg.Listen {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		if s.tls != nil {
+			l = tls.NewListener(l, s.tls)
+		}
+		infoln("listening on", addr, "in", s.cfg.Mode, "mode")
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					errc <- err
+					return
+				}
+				go s.handle(conn)
+			}
+		}()
+	}
+	return <-errc
+}
+
+func (s *server) handle(conn net.Conn) {
+	if idle := time.Duration(s.cfg.Timeouts.Idle); idle > 0 {
+		conn = &idleConn{Conn: conn, idle: idle}
+	}
+	if s.conns != nil {
+		select {
+		case s.conns <- struct{}{}:
+			defer func() { <-s.conns }()
+		default:
+			warnln("too many connections, rejecting", conn.RemoteAddr())
+			s.reject(conn, ws.StatusTryAgainLater)
+			return
+		}
+	}
+
+	if s.cfg.Mode == modeStatic {
+		s.serveStatic(conn)
+		return
+	}
+	if s.proxy != nil {
+		if err := s.proxy.Serve(conn); err != nil && !errors.Is(err, minws.ErrNotWebSocket) {
+			warnln(err)
+		}
+		return
+	}
+
+	if s.upgrader.Timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.upgrader.Timeout))
+	}
+	conn, isH2, err := h2.Sniff(conn)
+	if err != nil {
+		debugln(err)
+		return
+	}
+	if isH2 {
+		conn.SetReadDeadline(time.Time{})
+		err := s.upgrader.ServeH2(conn, func(c *ws.Conn, req *minwshttp.Request) {
+			debugln("connected over HTTP/2", conn.RemoteAddr(), req.RequestURI, c.Subprotocol)
+			s.serve(c, req)
+		})
+		if err != nil {
+			debugln(err)
+		}
+		return
+	}
+
+	c, req, err := s.upgrader.Upgrade(conn)
+	if errors.Is(err, minws.ErrNotWebSocket) {
+		debugln(conn.RemoteAddr(), "served by file server")
+		return
+	}
+	if err != nil {
+		warnln(err)
+		return
+	}
+	debugln("connected", conn.RemoteAddr(), req.RequestURI, c.Subprotocol)
+	s.serve(c, req)
+}
+
+// serve runs the mode on an established connection
+func (s *server) serve(c *ws.Conn, req *minwshttp.Request) {
+	c.MaxMessageSize = s.cfg.Limits.MaxMessageSize
+	var err error
+	switch {
+	case s.hub != nil:
+		s.serveBroadcast(c)
+	case s.process != nil:
+		err = s.process.Serve(c, req)
+	case s.bridge != nil:
+		err = s.bridge.Serve(c, req.RequestURI)
+	default:
+		serveEcho(c)
+	}
+	if err != nil {
+		warnln(err)
+	}
+	debugln("disconnected", c.Rwc.RemoteAddr())
+}
+
+// reject completes the handshake only to close the connection with the
+// status
+func (s *server) reject(conn net.Conn, status int) {
+	c, _, err := s.upgrader.Upgrade(conn)
+	if err != nil {
+		return
+	}
+	c.CloseWithStatus(status)
+	c.Rwc.SetReadDeadline(time.Now().Add(closeTimeout))
+	for {
+		if _, _, err := c.NextMessage(); err != nil {
+			break
+		}
+	}
+	c.Rwc.Close()
+}
+
+// serveStatic serves files without WebSocket
+func (s *server) serveStatic(conn net.Conn) {
+	hc := minwshttp.NewConn(conn)
+	hc.ReadTimeout = s.upgrader.Timeout
+	hc.WriteTimeout = s.upgrader.Timeout
+	if s.upgrader.IdleTimeout > 0 {
+		hc.IdleTimeout = s.upgrader.IdleTimeout
+	}
+	if err := hc.Serve(s.files); err != nil {
+		debugln(err)
+	}
+}
+
+// serveBroadcast sends every message received to all connections. The
+// connection leaves the hub once reading fails, e.g. by the idle timeout.
+func (s *server) serveBroadcast(c *ws.Conn) {
+	s.hub.Register(c)
+	defer s.hub.Unregister(c)
+	for {
+		op, msg, err := c.NextMessage()
+		if err != nil {
+			debugln(err)
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				c.CloseWithStatus(ws.StatusGoingAway)
+			}
+			c.Rwc.Close()
+			return
+		}
+		if err := s.hub.Broadcast(op, msg); err != nil {
+			warnln(err)
+		}
+	}
+}
+
+// idleConn extends the read deadline on every read, so that a connection
+// receiving nothing for idle is timed out. An earlier deadline set
+// explicitly is respected.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	d := time.Now().Add(c.idle)
+	if !c.deadline.IsZero() && c.deadline.Before(d) {
+		d = c.deadline
+	}
+	c.mu.Unlock()
+	c.Conn.SetReadDeadline(d)
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *idleConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
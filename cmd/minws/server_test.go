@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws"
+	"github.com/cou929/minws/ws"
+)
+
+func TestServer_Broadcast_IdleTimeout(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Mode = modeBroadcast
+	cfg.Timeouts.Idle = Duration(50 * time.Millisecond)
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// handlers are done before the test returns, as they log
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handle(conn)
+			}()
+		}
+	}()
+
+	c, _, err := minws.Dial("ws://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Rwc.Close()
+	c.Rwc.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// the idle client is closed with 1001 and leaves the hub
+	_, _, err = c.NextMessage()
+	if cerr, ok := err.(*ws.CloseError); !ok || cerr.Code != ws.StatusGoingAway {
+		t.Errorf("NextMessage() error = %v, want close %d", err, ws.StatusGoingAway)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.hub.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Len() = %d, want 0", s.hub.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
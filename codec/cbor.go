@@ -0,0 +1,342 @@
+package codec
+
+import (
+	"math"
+	"reflect"
+)
+
+// cborCodec implements CBOR
+// See: https://tools.ietf.org/html/rfc8949
+type cborCodec struct{}
+
+func (cborCodec) Name() string { return "cbor" }
+func (cborCodec) Binary() bool { return true }
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	w := &cborWriter{}
+	if err := encode(w, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return w.b, nil
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	r := &reader{b: data}
+	item, err := r.readCBOR()
+	if err != nil {
+		return err
+	}
+	if len(r.b) > 0 {
+		return decodeError("%d bytes of trailing data", len(r.b))
+	}
+	return unmarshal(item, v)
+}
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// additional information for indefinite length and break
+const cborIndefinite = 31
+
+type cborWriter struct {
+	b []byte
+}
+
+// writeHead writes the initial byte and the argument in the shortest form
+func (w *cborWriter) writeHead(major byte, n uint64) {
+	m := major << 5
+	switch {
+	case n < 24:
+		w.b = append(w.b, m|byte(n))
+	case n <= math.MaxUint8:
+		w.b = append(w.b, m|24, byte(n))
+	case n <= math.MaxUint16:
+		w.b = append(w.b, m|25)
+		w.b = appendUint16(w.b, uint16(n))
+	case n <= math.MaxUint32:
+		w.b = append(w.b, m|26)
+		w.b = appendUint32(w.b, uint32(n))
+	default:
+		w.b = append(w.b, m|27)
+		w.b = appendUint64(w.b, n)
+	}
+}
+
+func (w *cborWriter) writeNil() { w.b = append(w.b, 0xf6) }
+
+func (w *cborWriter) writeBool(b bool) {
+	if b {
+		w.b = append(w.b, 0xf5)
+	} else {
+		w.b = append(w.b, 0xf4)
+	}
+}
+
+func (w *cborWriter) writeInt(n int64) {
+	if n >= 0 {
+		w.writeHead(cborUint, uint64(n))
+		return
+	}
+	w.writeHead(cborNegInt, uint64(-1-n))
+}
+
+func (w *cborWriter) writeUint(n uint64) { w.writeHead(cborUint, n) }
+
+func (w *cborWriter) writeFloat32(f float32) {
+	w.b = append(w.b, cborSimple<<5|26)
+	w.b = appendUint32(w.b, math.Float32bits(f))
+}
+
+func (w *cborWriter) writeFloat64(f float64) {
+	w.b = append(w.b, cborSimple<<5|27)
+	w.b = appendUint64(w.b, math.Float64bits(f))
+}
+
+func (w *cborWriter) writeString(s string) {
+	w.writeHead(cborText, uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *cborWriter) writeBytes(b []byte) {
+	w.writeHead(cborBytes, uint64(len(b)))
+	w.b = append(w.b, b...)
+}
+
+func (w *cborWriter) writeArrayHeader(n int) { w.writeHead(cborArray, uint64(n)) }
+func (w *cborWriter) writeMapHeader(n int)   { w.writeHead(cborMap, uint64(n)) }
+
+// errBreak is returned by readCBOR when it reads the break stop code
+var errBreak = decodeError("unexpected break")
+
+// cborArg reads the argument of the head. indefinite is true if the
+// additional information is 31.
+func (r *reader) cborArg(info byte) (n uint64, indefinite bool, err error) {
+	switch {
+	case info < 24:
+		return uint64(info), false, nil
+	case info <= 27:
+		n, err := r.uint(1 << (info - 24))
+		return n, false, err
+	case info == cborIndefinite:
+		return 0, true, nil
+	}
+	return 0, false, decodeError("invalid additional information %d", info)
+}
+
+func (r *reader) readCBOR() (interface{}, error) {
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := b>>5, b&0x1f
+	if major == cborSimple {
+		return r.cborSimple(info)
+	}
+	n, indefinite, err := r.cborArg(info)
+	if err != nil {
+		return nil, err
+	}
+	if indefinite && (major == cborUint || major == cborNegInt || major == cborTag) {
+		return nil, decodeError("invalid indefinite length of major type %d", major)
+	}
+
+	switch major {
+	case cborUint:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, decodeError("negative integer overflows int64")
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		var p []byte
+		if indefinite {
+			p, err = r.cborChunks(major)
+		} else if n > uint64(len(r.b)) {
+			err = decodeError("unexpected end of data")
+		} else {
+			q, _ := r.next(int(n))
+			p = append([]byte(nil), q...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(p), nil
+		}
+		return p, nil
+	case cborArray:
+		return r.cborArray(n, indefinite)
+	case cborMap:
+		return r.cborMap(n, indefinite)
+	}
+	// tags are not interpreted, the tagged item is returned as is
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+	return r.readCBOR()
+}
+
+func (r *reader) cborSimple(info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null, undefined
+		return nil, nil
+	case 25:
+		n, err := r.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		return halfToFloat64(uint16(n)), nil
+	case 26:
+		n, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 27:
+		n, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(n), nil
+	case cborIndefinite:
+		return nil, errBreak
+	}
+	return nil, decodeError("unsupported simple value %d", info)
+}
+
+// halfToFloat64 converts IEEE 754 half precision float
+func halfToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+// cborChunks reads an indefinite length string, which is a sequence of
+// definite length strings of the same major type terminated by break
+func (r *reader) cborChunks(major byte) ([]byte, error) {
+	var p []byte
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0xff {
+			return p, nil
+		}
+		if b>>5 != major {
+			return nil, decodeError("invalid chunk of major type %d", b>>5)
+		}
+		n, indefinite, err := r.cborArg(b & 0x1f)
+		if err != nil {
+			return nil, err
+		}
+		if indefinite || n > uint64(len(r.b)) {
+			return nil, decodeError("invalid chunk")
+		}
+		q, _ := r.next(int(n))
+		p = append(p, q...)
+	}
+}
+
+func (r *reader) cborArray(n uint64, indefinite bool) (interface{}, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+	if indefinite {
+		a := []interface{}{}
+		for {
+			item, err := r.readCBOR()
+			if err == errBreak {
+				return a, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, item)
+		}
+	}
+	l, err := r.length(n, 1)
+	if err != nil {
+		return nil, err
+	}
+	a := make([]interface{}, l)
+	for i := range a {
+		if a[i], err = r.readCBOR(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (r *reader) cborMap(n uint64, indefinite bool) (interface{}, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+	if indefinite {
+		m := mapItem{}
+		for {
+			k, err := r.readCBOR()
+			if err == errBreak {
+				return m, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.readCBOR()
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, mapEntry{k, v})
+		}
+	}
+	l, err := r.length(n, 2)
+	if err != nil {
+		return nil, err
+	}
+	m := make(mapItem, l)
+	for i := range m {
+		if m[i].key, err = r.readCBOR(); err != nil {
+			return nil, err
+		}
+		if m[i].value, err = r.readCBOR(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
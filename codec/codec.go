@@ -0,0 +1,182 @@
+// Package codec encodes values into WebSocket messages. Codecs are named
+// after the subprotocols which select them.
+//
+// MessagePack and CBOR codecs use the same struct field names as
+// encoding/json, including the "json" struct tags, so that a type can be
+// sent with any of the codecs.
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Codec encodes and decodes values
+type Codec interface {
+	// Name is the subprotocol name of the codec
+	Name() string
+	// Binary reports whether encoded values are sent as binary messages
+	Binary() bool
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Built-in codecs
+var (
+	JSON        Codec = jsonCodec{}
+	MessagePack Codec = msgpackCodec{}
+	CBOR        Codec = cborCodec{}
+)
+
+// Lookup returns the built-in codec of the subprotocol name
+func Lookup(name string) (Codec, bool) {
+	for _, c := range []Codec{JSON, MessagePack, CBOR} {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Binary() bool                               { return false }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// maxDepth limits nesting of decoded values to protect the stack
+const maxDepth = 1000
+
+// field is an exported struct field
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// structFields returns encoded fields of t in the same way as encoding/json,
+// including fields of embedded structs
+func structFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	type candidate struct {
+		field
+		tagged bool
+	}
+	var all []candidate
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts := tag, ""
+			if j := strings.IndexByte(tag, ','); j >= 0 {
+				name, opts = tag[:j], tag[j+1:]
+			}
+			idx := append(append([]int(nil), index...), i)
+			// embedded pointers to structs are not flattened
+			if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+				walk(sf.Type, idx)
+				continue
+			}
+			if sf.PkgPath != "" {
+				continue
+			}
+			tagged := name != ""
+			if name == "" {
+				name = sf.Name
+			}
+			all = append(all, candidate{field{
+				name:      name,
+				index:     idx,
+				omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+			}, tagged})
+		}
+	}
+	walk(t, nil)
+
+	// outer fields shadow embedded ones. Of the fields at the same depth,
+	// the tagged one wins, and the name is dropped if it is ambiguous.
+	byName := make(map[string][]int) // name -> positions in all
+	for i, c := range all {
+		byName[c.name] = append(byName[c.name], i)
+	}
+	var fields []field
+	for _, c := range all {
+		depth := len(c.index)
+		for _, j := range byName[c.name] {
+			if d := len(all[j].index); d < depth {
+				depth = d
+			}
+		}
+		if len(c.index) != depth {
+			continue
+		}
+		n, tagged := 0, 0
+		for _, j := range byName[c.name] {
+			if len(all[j].index) == depth {
+				n++
+				if all[j].tagged {
+					tagged++
+				}
+			}
+		}
+		if n == 1 || (tagged == 1 && c.tagged) {
+			fields = append(fields, c.field)
+		}
+	}
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// UnsupportedTypeError is returned when a value of the type can not be
+// encoded
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "codec: unsupported type " + e.Type.String()
+}
+
+// DecodeError is returned when data is malformed or does not fit into the
+// value
+type DecodeError struct {
+	Msg string
+}
+
+func (e *DecodeError) Error() string {
+	return "codec: " + e.Msg
+}
+
+func decodeError(format string, a ...interface{}) error {
+	return &DecodeError{Msg: fmt.Sprintf(format, a...)}
+}
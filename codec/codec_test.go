@@ -0,0 +1,341 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMessagePack_Marshal(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{false, "c2"},
+		{1, "01"},
+		{127, "7f"},
+		{128, "cc80"},
+		{256, "cd0100"},
+		{70000, "ce00011170"},
+		{uint64(1) << 40, "cf0000010000000000"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{-33, "d0df"},
+		{-200, "d1ff38"},
+		{-40000, "d2ffff63c0"},
+		{int64(-1) << 40, "d3ffffff0000000000"},
+		{1.5, "cb3ff8000000000000"},
+		{float32(1.5), "ca3fc00000"},
+		{"a", "a161"},
+		{string(make([]byte, 32)), "d920" + hex.EncodeToString(make([]byte, 32))},
+		{[]byte{1}, "c40101"},
+		{[]int{1, 2}, "920102"},
+		{map[string]int{"b": 2, "a": 1}, "82a16101a16202"},
+		{struct {
+			A int    `json:"a"`
+			B string `json:"b,omitempty"`
+			c int
+		}{A: 1}, "81a16101"},
+	}
+	for _, tt := range tests {
+		b, err := MessagePack.Marshal(tt.in)
+		if err != nil {
+			t.Fatalf("Marshal(%v) error = %v", tt.in, err)
+		}
+		if got := hex.EncodeToString(b); got != tt.want {
+			t.Errorf("Marshal(%#v) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// test vectors from https://tools.ietf.org/html/rfc8949#appendix-A
+func TestCBOR_Marshal(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{100, "1864"},
+		{1000, "1903e8"},
+		{1000000, "1a000f4240"},
+		{1000000000000, "1b000000e8d4a51000"},
+		{uint64(18446744073709551615), "1bffffffffffffffff"},
+		{-1, "20"},
+		{-10, "29"},
+		{-100, "3863"},
+		{-1000, "3903e7"},
+		{1.1, "fb3ff199999999999a"},
+		{false, "f4"},
+		{true, "f5"},
+		{nil, "f6"},
+		{"", "60"},
+		{"a", "6161"},
+		{"IETF", "6449455446"},
+		{"ü", "62c3bc"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{[]int{}, "80"},
+		{[]int{1, 2, 3}, "83010203"},
+		{[]interface{}{1, []int{2, 3}, []int{4, 5}}, "8301820203820405"},
+		{map[string]interface{}{"a": 1, "b": []int{2, 3}}, "a26161016162820203"},
+	}
+	for _, tt := range tests {
+		b, err := CBOR.Marshal(tt.in)
+		if err != nil {
+			t.Fatalf("Marshal(%v) error = %v", tt.in, err)
+		}
+		if got := hex.EncodeToString(b); got != tt.want {
+			t.Errorf("Marshal(%#v) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCBOR_Unmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"f93c00", 1.0},
+		{"f97bff", 65504.0},
+		{"f90001", 5.960464477539063e-8},
+		{"f9c400", -4.0},
+		{"fa47c35000", 100000.0},
+		{"3bffffffffffffffff", nil}, // overflows int64
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9fff", []interface{}{}},
+		{"9f018202039f0405ffff", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"bf61610161629f0203ffff", map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.in)
+		var got interface{}
+		err := CBOR.Unmarshal(b, &got)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("Unmarshal(%s) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", tt.in, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+type Embedded struct {
+	E string `json:"e"`
+}
+
+type testMessage struct {
+	Embedded
+	Type    string            `json:"type"`
+	ID      uint64            `json:"id"`
+	Score   float64           `json:"score"`
+	Ratio   float32           `json:"ratio"`
+	Delta   int8              `json:"delta"`
+	Tags    []string          `json:"tags"`
+	Counts  map[string]int    `json:"counts"`
+	Data    []byte            `json:"data"`
+	Key     [4]byte           `json:"key"`
+	Ptr     *int              `json:"ptr"`
+	Nil     *int              `json:"nil"`
+	Any     interface{}       `json:"any"`
+	Nested  []testNested      `json:"nested"`
+	Skip    string            `json:"-"`
+	Empty   string            `json:"empty,omitempty"`
+	ByIndex map[int]bool      `json:"by_index"`
+	Labels  map[string]string `json:"labels"`
+}
+
+type testNested struct {
+	Name string
+	OK   bool
+}
+
+func TestRoundTrip(t *testing.T) {
+	n := 42
+	in := testMessage{
+		Embedded: Embedded{E: "embedded"},
+		Type:     "chat",
+		ID:       1 << 63,
+		Score:    -1.25,
+		Ratio:    0.5,
+		Delta:    -7,
+		Tags:     []string{"a", "b"},
+		Counts:   map[string]int{"x": 1, "y": -300},
+		Data:     []byte{0, 1, 2, 255},
+		Key:      [4]byte{1, 2, 3, 4},
+		Ptr:      &n,
+		Any:      map[string]interface{}{"k": []interface{}{"v", true, nil}},
+		Nested:   []testNested{{Name: "n", OK: true}},
+		Skip:     "skipped",
+		ByIndex:  map[int]bool{1: true, -2: false},
+	}
+	want := in
+	want.Skip = ""
+
+	for _, c := range []Codec{MessagePack, CBOR} {
+		b, err := c.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: Marshal() error = %v", c.Name(), err)
+		}
+		var got testMessage
+		if err := c.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: Unmarshal() error = %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", c.Name(), got, want)
+		}
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	for _, c := range []Codec{MessagePack, CBOR} {
+		b, _ := c.Marshal(300)
+		var i8 int8
+		var derr *DecodeError
+		if err := c.Unmarshal(b, &i8); !errors.As(err, &derr) {
+			t.Errorf("%s: Unmarshal(300, int8) error = %v, want overflow", c.Name(), err)
+		}
+		var s string
+		if err := c.Unmarshal(b, &s); !errors.As(err, &derr) {
+			t.Errorf("%s: Unmarshal(300, string) error = %v, want mismatch", c.Name(), err)
+		}
+		if err := c.Unmarshal(append(b, 0), &i8); err == nil {
+			t.Errorf("%s: trailing data is accepted", c.Name())
+		}
+		if err := c.Unmarshal(b, i8); err == nil {
+			t.Errorf("%s: non-pointer is accepted", c.Name())
+		}
+		deep := bytes.Repeat([]byte{0x91}, 100000) // msgpack fixarray of 1
+		if c == CBOR {
+			deep = bytes.Repeat([]byte{0x81}, 100000)
+		}
+		var v interface{}
+		if err := c.Unmarshal(append(deep, 0), &v); err == nil {
+			t.Errorf("%s: too deep data is accepted", c.Name())
+		}
+		if _, err := c.Marshal(make(chan int)); err == nil {
+			t.Errorf("%s: Marshal(chan) error = nil", c.Name())
+		}
+	}
+}
+
+// TestUnmarshal_Corrupted checks decoders never panic or allocate
+// unboundedly on corrupted data
+func TestUnmarshal_Corrupted(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, c := range []Codec{MessagePack, CBOR} {
+		seed, _ := c.Marshal(testMessage{Tags: []string{"a"}, Counts: map[string]int{"a": 1}})
+		for i := 0; i < 5000; i++ {
+			b := append([]byte(nil), seed...)
+			switch rnd.Intn(3) {
+			case 0:
+				b = b[:rnd.Intn(len(b))]
+			default:
+				for n := rnd.Intn(4); n >= 0; n-- {
+					b[rnd.Intn(len(b))] = byte(rnd.Intn(256))
+				}
+			}
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%s: Unmarshal(%x) panicked: %v", c.Name(), b, r)
+					}
+				}()
+				var v interface{}
+				c.Unmarshal(b, &v)
+				var m testMessage
+				c.Unmarshal(b, &m)
+			}()
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, name := range []string{"json", "msgpack", "cbor"} {
+		if c, ok := Lookup(name); !ok || c.Name() != name {
+			t.Errorf("Lookup(%q) = %v, %v", name, c, ok)
+		}
+	}
+	if _, ok := Lookup("xml"); ok {
+		t.Error("Lookup(xml) = true")
+	}
+}
+
+func TestUnmarshal_UnhashableKey(t *testing.T) {
+	tests := []struct {
+		c  Codec
+		in string
+		v  interface{}
+	}{
+		// {[1]: 1}
+		{MessagePack, "81910101", &map[interface{}]int{}},
+		{CBOR, "81810101", &map[interface{}]int{}},
+		// {[[1]]: 1}
+		{MessagePack, "8191910101", &map[[1]interface{}]int{}},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.in)
+		var derr *DecodeError
+		if err := tt.c.Unmarshal(b, tt.v); !errors.As(err, &derr) {
+			t.Errorf("%s: Unmarshal(%s, %T) error = %v, want DecodeError", tt.c.Name(), tt.in, tt.v, err)
+		}
+	}
+}
+
+type shadowInner struct {
+	Name string
+	Tag  string
+	Dup  string
+}
+
+type shadowOther struct {
+	Tag string `json:"Tag"`
+	Dup string
+}
+
+type shadowOuter struct {
+	shadowInner
+	shadowOther
+	Name string
+}
+
+func TestMarshal_EmbeddedFields(t *testing.T) {
+	in := shadowOuter{
+		shadowInner: shadowInner{Name: "inner", Tag: "untagged", Dup: "a"},
+		shadowOther: shadowOther{Tag: "tagged", Dup: "b"},
+		Name:        "outer",
+	}
+	// the same fields as encoding/json: the outer Name shadows the
+	// embedded one, the tagged Tag wins, and ambiguous Dup is dropped
+	b, _ := json.Marshal(in)
+	var want map[string]interface{}
+	json.Unmarshal(b, &want)
+	for _, c := range []Codec{MessagePack, CBOR} {
+		b, err := c.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: Marshal() error = %v", c.Name(), err)
+		}
+		var got map[string]interface{}
+		if err := c.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: Unmarshal() error = %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", c.Name(), got, want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package codec
+
+import (
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Decoded items are represented as nil, bool, int64, uint64, float64,
+// string, []byte, []interface{} or mapItem before being assigned to the
+// destination.
+
+// mapItem is a decoded map. Keys may be of any decoded type, so it is a
+// list of entries rather than a Go map.
+type mapItem []mapEntry
+
+type mapEntry struct {
+	key, value interface{}
+}
+
+// unmarshal assigns the decoded item to v, which must be a non-nil pointer
+func unmarshal(item interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return decodeError("Unmarshal(non-pointer %T)", v)
+	}
+	return assign(rv.Elem(), item)
+}
+
+// assign sets decoded item src to dst
+func assign(dst reflect.Value, src interface{}) error {
+	if src == nil {
+		switch dst.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			dst.Set(reflect.Zero(dst.Type()))
+		}
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assign(dst.Elem(), src)
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return mismatch(dst, src)
+		}
+		dst.Set(reflect.ValueOf(natural(src)))
+		return nil
+	}
+
+	switch s := src.(type) {
+	case bool:
+		if dst.Kind() != reflect.Bool {
+			return mismatch(dst, src)
+		}
+		dst.SetBool(s)
+	case int64:
+		return assignInt(dst, s)
+	case uint64:
+		return assignUint(dst, s)
+	case float64:
+		switch dst.Kind() {
+		case reflect.Float32, reflect.Float64:
+			dst.SetFloat(s)
+		default:
+			return mismatch(dst, src)
+		}
+	case string:
+		switch {
+		case dst.Kind() == reflect.String:
+			dst.SetString(s)
+		case dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8:
+			dst.SetBytes([]byte(s))
+		default:
+			return mismatch(dst, src)
+		}
+	case []byte:
+		return assignBytes(dst, s)
+	case []interface{}:
+		return assignArray(dst, s)
+	case mapItem:
+		switch dst.Kind() {
+		case reflect.Map:
+			return assignMap(dst, s)
+		case reflect.Struct:
+			return assignStruct(dst, s)
+		}
+		return mismatch(dst, src)
+	default:
+		return mismatch(dst, src)
+	}
+	return nil
+}
+
+func assignInt(dst reflect.Value, n int64) error {
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if dst.OverflowInt(n) {
+			return decodeError("%d overflows %s", n, dst.Type())
+		}
+		dst.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 {
+			return decodeError("%d overflows %s", n, dst.Type())
+		}
+		return assignUint(dst, uint64(n))
+	case reflect.Float32, reflect.Float64:
+		dst.SetFloat(float64(n))
+	default:
+		return mismatch(dst, n)
+	}
+	return nil
+}
+
+func assignUint(dst reflect.Value, n uint64) error {
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n > math.MaxInt64 {
+			return decodeError("%d overflows %s", n, dst.Type())
+		}
+		return assignInt(dst, int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if dst.OverflowUint(n) {
+			return decodeError("%d overflows %s", n, dst.Type())
+		}
+		dst.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		dst.SetFloat(float64(n))
+	default:
+		return mismatch(dst, n)
+	}
+	return nil
+}
+
+func assignBytes(dst reflect.Value, b []byte) error {
+	switch {
+	case dst.Kind() == reflect.String:
+		dst.SetString(string(b))
+	case dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8:
+		dst.SetBytes(b)
+	case dst.Kind() == reflect.Array && dst.Type().Elem().Kind() == reflect.Uint8:
+		if len(b) != dst.Len() {
+			return decodeError("cannot decode %d bytes into %s", len(b), dst.Type())
+		}
+		reflect.Copy(dst, reflect.ValueOf(b))
+	default:
+		return mismatch(dst, b)
+	}
+	return nil
+}
+
+func assignArray(dst reflect.Value, a []interface{}) error {
+	switch dst.Kind() {
+	case reflect.Slice:
+		s := reflect.MakeSlice(dst.Type(), len(a), len(a))
+		for i, item := range a {
+			if err := assign(s.Index(i), item); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+	case reflect.Array:
+		if len(a) != dst.Len() {
+			return decodeError("cannot decode %d items into %s", len(a), dst.Type())
+		}
+		for i, item := range a {
+			if err := assign(dst.Index(i), item); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch(dst, a)
+	}
+	return nil
+}
+
+func assignMap(dst reflect.Value, m mapItem) error {
+	t := dst.Type()
+	if dst.IsNil() {
+		dst.Set(reflect.MakeMapWithSize(t, len(m)))
+	}
+	for _, e := range m {
+		k := reflect.New(t.Key()).Elem()
+		if err := assign(k, e.key); err != nil {
+			return err
+		}
+		if !hashable(k) {
+			return decodeError("unhashable map key %s", k.Type())
+		}
+		v := reflect.New(t.Elem()).Elem()
+		if err := assign(v, e.value); err != nil {
+			return err
+		}
+		dst.SetMapIndex(k, v)
+	}
+	return nil
+}
+
+// hashable reports whether v can be a map key. Interfaces are checked by
+// their dynamic values, e.g. a decoded array in interface{} is not.
+func hashable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface:
+		return v.IsNil() || hashable(v.Elem())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !hashable(v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !hashable(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.Type().Comparable()
+}
+
+// assignStruct sets fields by name, preferring an exact match and
+// falling back to a case-insensitive one as encoding/json does.
+// Unknown keys are ignored.
+func assignStruct(dst reflect.Value, m mapItem) error {
+	fields := structFields(dst.Type())
+	for _, e := range m {
+		name, ok := e.key.(string)
+		if !ok {
+			continue
+		}
+		f := findField(fields, name)
+		if f == nil {
+			continue
+		}
+		if err := assign(dst.FieldByIndex(f.index), e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func findField(fields []field, name string) *field {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, name) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// natural converts a decoded item into a value to be stored in an
+// interface{}. Maps with string keys become map[string]interface{}.
+func natural(src interface{}) interface{} {
+	switch s := src.(type) {
+	case []interface{}:
+		for i := range s {
+			s[i] = natural(s[i])
+		}
+		return s
+	case mapItem:
+		strKeys := true
+		for _, e := range s {
+			if _, ok := e.key.(string); !ok {
+				strKeys = false
+				break
+			}
+		}
+		if strKeys {
+			m := make(map[string]interface{}, len(s))
+			for _, e := range s {
+				m[e.key.(string)] = natural(e.value)
+			}
+			return m
+		}
+		m := make(map[interface{}]interface{}, len(s))
+		for _, e := range s {
+			k := natural(e.key)
+			if t := reflect.TypeOf(k); t != nil && !t.Comparable() {
+				continue
+			}
+			m[k] = natural(e.value)
+		}
+		return m
+	}
+	return src
+}
+
+func mismatch(dst reflect.Value, src interface{}) error {
+	return decodeError("cannot decode %T into %s", src, dst.Type())
+}
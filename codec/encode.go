@@ -0,0 +1,130 @@
+package codec
+
+import (
+	"reflect"
+	"sort"
+)
+
+// writer writes items of a binary format
+type writer interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(n int64)
+	writeUint(n uint64)
+	writeFloat32(f float32)
+	writeFloat64(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArrayHeader(n int)
+	writeMapHeader(n int)
+}
+
+// encode writes v walking it by reflection
+func encode(w writer, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	if !v.IsValid() {
+		w.writeNil()
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return encode(w, v.Elem(), depth+1)
+	case reflect.Bool:
+		w.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.writeUint(v.Uint())
+	case reflect.Float32:
+		w.writeFloat32(float32(v.Float()))
+	case reflect.Float64:
+		w.writeFloat64(v.Float())
+	case reflect.String:
+		w.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.writeBytes(v.Bytes())
+			return nil
+		}
+		return encodeArray(w, v, depth)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			w.writeBytes(b)
+			return nil
+		}
+		return encodeArray(w, v, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return encodeMap(w, v, depth)
+	case reflect.Struct:
+		return encodeStruct(w, v, depth)
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+func encodeArray(w writer, v reflect.Value, depth int) error {
+	w.writeArrayHeader(v.Len())
+	for i := 0; i < v.Len(); i++ {
+		if err := encode(w, v.Index(i), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeMap(w writer, v reflect.Value, depth int) error {
+	keys := v.MapKeys()
+	// sort string keys so that the output is deterministic
+	if v.Type().Key().Kind() == reflect.String {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	}
+	w.writeMapHeader(len(keys))
+	for _, k := range keys {
+		if err := encode(w, k, depth+1); err != nil {
+			return err
+		}
+		if err := encode(w, v.MapIndex(k), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeStruct(w writer, v reflect.Value, depth int) error {
+	fields := structFields(v.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		values = append(values, fv)
+		names = append(names, f.name)
+	}
+	w.writeMapHeader(len(values))
+	for i, fv := range values {
+		w.writeString(names[i])
+		if err := encode(w, fv, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
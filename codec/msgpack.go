@@ -0,0 +1,281 @@
+package codec
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+)
+
+// msgpackCodec implements MessagePack
+// See: https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	w := &msgpackWriter{}
+	if err := encode(w, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return w.b, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	r := &reader{b: data}
+	item, err := r.readMsgpack()
+	if err != nil {
+		return err
+	}
+	if len(r.b) > 0 {
+		return decodeError("%d bytes of trailing data", len(r.b))
+	}
+	return unmarshal(item, v)
+}
+
+type msgpackWriter struct {
+	b []byte
+}
+
+func (w *msgpackWriter) writeNil() { w.b = append(w.b, 0xc0) }
+
+func (w *msgpackWriter) writeBool(b bool) {
+	if b {
+		w.b = append(w.b, 0xc3)
+	} else {
+		w.b = append(w.b, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeInt(n int64) {
+	switch {
+	case n >= 0:
+		w.writeUint(uint64(n))
+	case n >= -32:
+		w.b = append(w.b, byte(n)) // negative fixint
+	case n >= math.MinInt8:
+		w.b = append(w.b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		w.b = append(w.b, 0xd1)
+		w.b = appendUint16(w.b, uint16(n))
+	case n >= math.MinInt32:
+		w.b = append(w.b, 0xd2)
+		w.b = appendUint32(w.b, uint32(n))
+	default:
+		w.b = append(w.b, 0xd3)
+		w.b = appendUint64(w.b, uint64(n))
+	}
+}
+
+func (w *msgpackWriter) writeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		w.b = append(w.b, byte(n)) // positive fixint
+	case n <= math.MaxUint8:
+		w.b = append(w.b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		w.b = append(w.b, 0xcd)
+		w.b = appendUint16(w.b, uint16(n))
+	case n <= math.MaxUint32:
+		w.b = append(w.b, 0xce)
+		w.b = appendUint32(w.b, uint32(n))
+	default:
+		w.b = append(w.b, 0xcf)
+		w.b = appendUint64(w.b, n)
+	}
+}
+
+func (w *msgpackWriter) writeFloat32(f float32) {
+	w.b = append(w.b, 0xca)
+	w.b = appendUint32(w.b, math.Float32bits(f))
+}
+
+func (w *msgpackWriter) writeFloat64(f float64) {
+	w.b = append(w.b, 0xcb)
+	w.b = appendUint64(w.b, math.Float64bits(f))
+}
+
+func (w *msgpackWriter) writeString(s string) {
+	w.writeHeader(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	w.b = append(w.b, s...)
+}
+
+func (w *msgpackWriter) writeBytes(b []byte) {
+	w.writeHeader(len(b), 0, -1, 0xc4, 0xc5, 0xc6)
+	w.b = append(w.b, b...)
+}
+
+func (w *msgpackWriter) writeArrayHeader(n int) {
+	w.writeHeader(n, 0x90, 15, 0, 0xdc, 0xdd)
+}
+
+func (w *msgpackWriter) writeMapHeader(n int) {
+	w.writeHeader(n, 0x80, 15, 0, 0xde, 0xdf)
+}
+
+// writeHeader writes the smallest header for length n. fixMax is the max
+// length of the fix format, or -1 if there is none, and t8 is the 8 bit
+// format, or 0 if there is none.
+func (w *msgpackWriter) writeHeader(n int, fix byte, fixMax int, t8, t16, t32 byte) {
+	switch {
+	case n <= fixMax:
+		w.b = append(w.b, fix|byte(n))
+	case t8 != 0 && n <= math.MaxUint8:
+		w.b = append(w.b, t8, byte(n))
+	case n <= math.MaxUint16:
+		w.b = append(w.b, t16)
+		w.b = appendUint16(w.b, uint16(n))
+	default:
+		w.b = append(w.b, t32)
+		w.b = appendUint32(w.b, uint32(n))
+	}
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], n)
+	return append(b, p[:]...)
+}
+
+func (r *reader) readMsgpack() (interface{}, error) {
+	t, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xe0 == 0xa0:
+		return r.msgpackString(int(t & 0x1f))
+	case t&0xf0 == 0x90:
+		return r.msgpackArray(uint64(t & 0x0f))
+	case t&0xf0 == 0x80:
+		return r.msgpackMap(uint64(t & 0x0f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := r.uint(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		n, err := r.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extend
+		shift := uint(64 - 8*size)
+		return int64(n<<shift) >> shift, nil
+	case 0xca:
+		n, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		n, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(n), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackString(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		p, err := r.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), p...), nil
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackArray(n)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackMap(n)
+	}
+	// ext types (0xc7-0xc9, 0xd4-0xd8) and the never used 0xc1
+	return nil, decodeError("unsupported msgpack type 0x%02x", t)
+}
+
+func (r *reader) msgpackString(n int) (interface{}, error) {
+	p, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(p), nil
+}
+
+func (r *reader) msgpackArray(n uint64) (interface{}, error) {
+	l, err := r.length(n, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+	a := make([]interface{}, l)
+	for i := range a {
+		if a[i], err = r.readMsgpack(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (r *reader) msgpackMap(n uint64) (interface{}, error) {
+	l, err := r.length(n, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+	m := make(mapItem, l)
+	for i := range m {
+		if m[i].key, err = r.readMsgpack(); err != nil {
+			return nil, err
+		}
+		if m[i].value, err = r.readMsgpack(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,64 @@
+package codec
+
+import "encoding/binary"
+
+// reader reads items of a binary format from a byte slice
+type reader struct {
+	b     []byte
+	depth int
+}
+
+func (r *reader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.b) {
+		return nil, decodeError("unexpected end of data")
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p, nil
+}
+
+func (r *reader) byte() (byte, error) {
+	p, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+// uint reads a big endian unsigned integer of n bytes
+func (r *reader) uint(n int) (uint64, error) {
+	p, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(p[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(p)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(p)), nil
+	}
+	return binary.BigEndian.Uint64(p), nil
+}
+
+// length validates the length of an array or a map, whose items take at
+// least one byte each, so that malformed data can not allocate too much
+func (r *reader) length(n uint64, itemsPerEntry int) (int, error) {
+	if n > uint64(len(r.b)/itemsPerEntry) {
+		return 0, decodeError("length %d exceeds data", n)
+	}
+	return int(n), nil
+}
+
+func (r *reader) enter() error {
+	r.depth++
+	if r.depth > maxDepth {
+		return decodeError("exceeded max depth")
+	}
+	return nil
+}
+
+func (r *reader) leave() {
+	r.depth--
+}
@@ -0,0 +1,160 @@
+package minws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// Dialer connects to WebSocket server as a client
+type Dialer struct {
+	// TLSConfig is used for wss:// connections. If nil, the default
+	// configuration is used.
+	TLSConfig *tls.Config
+	// RootCAs overrides TLSConfig.RootCAs to trust custom CAs
+	RootCAs *x509.CertPool
+	// Subprotocols are offered by Sec-WebSocket-Protocol header
+	Subprotocols []string
+	// Header is added to the opening handshake request
+	Header minwshttp.Header
+	// Timeout limits the time to connect and complete the handshake
+	Timeout time.Duration
+}
+
+// Dial connects to the ws:// or wss:// url with the default Dialer
+func Dial(rawurl string) (*ws.Conn, *minwshttp.ClientResponse, error) {
+	return (&Dialer{}).Dial(rawurl)
+}
+
+// Dial connects to the ws:// or wss:// url and performs the opening
+// handshake
+func (d *Dialer) Dial(rawurl string) (*ws.Conn, *minwshttp.ClientResponse, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	nd := &net.Dialer{Timeout: d.Timeout}
+	var conn net.Conn
+	if secure {
+		conn, err = tls.DialWithDialer(nd, "tcp", addr, d.tlsConfig(u.Hostname()))
+	} else {
+		conn, err = nd.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	c, res, err := d.handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, res, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, res, nil
+}
+
+func (d *Dialer) tlsConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{}
+	if d.TLSConfig != nil {
+		cfg = d.TLSConfig.Clone()
+	}
+	if d.RootCAs != nil {
+		cfg.RootCAs = d.RootCAs
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+	return cfg
+}
+
+// handshake sends the opening handshake and validates the response
+// https://tools.ietf.org/html/rfc6455#section-4.1
+func (d *Dialer) handshake(conn net.Conn, u *url.URL) (*ws.Conn, *minwshttp.ClientResponse, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	header := make(minwshttp.Header)
+	for k, v := range d.Header {
+		header[k] = v
+	}
+	header["Host"] = u.Host
+	header["Upgrade"] = "websocket"
+	header["Connection"] = "Upgrade"
+	header["Sec-WebSocket-Key"] = key
+	header["Sec-WebSocket-Version"] = "13"
+	if len(d.Subprotocols) > 0 {
+		header["Sec-WebSocket-Protocol"] = strings.Join(d.Subprotocols, ", ")
+	}
+	if err := minwshttp.WriteClientRequest(bufio.NewWriter(conn), "GET", u.RequestURI(), header); err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := minwshttp.ReadClientResponse(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read handshake response %w", err)
+	}
+	if res.StatusCode != minwshttp.StatusSwitchingProtocols {
+		return nil, res, fmt.Errorf("unexpected status %d %s", res.StatusCode, res.Status)
+	}
+	if !strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		return nil, res, fmt.Errorf("Must receive header Upgrade: websocket")
+	}
+	if !strings.EqualFold(res.Header.Get("Connection"), "Upgrade") {
+		return nil, res, fmt.Errorf("Must receive header Connection: Upgrade")
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != calcSecWebsocketAccept(key) {
+		return nil, res, fmt.Errorf("Invalid Sec-WebSocket-Accept")
+	}
+
+	proto := res.Header.Get("Sec-WebSocket-Protocol")
+	if proto != "" && !contains(d.Subprotocols, proto) {
+		return nil, res, fmt.Errorf("Unexpected subprotocol %s", proto)
+	}
+
+	c := ws.NewClientConn(conn, br)
+	c.Subprotocol = proto
+	return c, res, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
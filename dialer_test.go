@@ -0,0 +1,258 @@
+package minws
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// serveEcho runs an echo server on l until it is closed
+func serveEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			c, err := HandShake(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			echo(c)
+		}()
+	}
+}
+
+func echo(c *ws.Conn) {
+	for {
+		op, msg, err := c.NextMessage()
+		if err != nil {
+			return
+		}
+		if err := c.SendMessage(op, msg); err != nil {
+			return
+		}
+	}
+}
+
+func TestDialer_Dial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveEcho(l)
+
+	c, _, err := Dial("ws://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Rwc.Close()
+	msg := make([]byte, 70000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if err := c.SendBinaryMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.ReadBinaryMessage()
+	if err != nil {
+		t.Fatalf("ReadBinaryMessage() error = %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Error("echoed message differs")
+	}
+}
+
+func TestDialer_Dial_Subprotocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u := &Upgrader{Subprotocols: []string{"cbor", "msgpack", "json"}}
+	protos := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c, err := u.HandShake(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			protos <- c.Subprotocol
+			go echo(c)
+		}
+	}()
+
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{"json", "msgpack"}, "msgpack"},
+		{[]string{"json"}, "json"},
+		{[]string{"xml"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		d := &Dialer{Subprotocols: tt.offered}
+		c, _, err := d.Dial("ws://" + l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial(%v) error = %v", tt.offered, err)
+		}
+		if got := <-protos; got != tt.want {
+			t.Errorf("server Subprotocol = %q, want %q", got, tt.want)
+		}
+		if c.Subprotocol != tt.want {
+			t.Errorf("client Subprotocol = %q, want %q", c.Subprotocol, tt.want)
+		}
+
+		type point struct{ X, Y int }
+		if err := c.WriteValue(point{1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		var got point
+		if err := c.ReadValue(&got); err != nil || got != (point{1, 2}) {
+			t.Errorf("%q: ReadValue() = %v, %v", tt.want, got, err)
+		}
+		c.Rwc.Close()
+	}
+}
+
+func TestUpgrader_Origins(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u := &Upgrader{Origins: []string{"https://example.com"}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if c, err := u.HandShake(conn); err == nil {
+				go echo(c)
+			}
+		}
+	}()
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"", true},
+		{"https://evil.example", false},
+	}
+	for _, tt := range tests {
+		d := &Dialer{}
+		if tt.origin != "" {
+			d.Header = minwshttp.Header{"Origin": tt.origin}
+		}
+		c, _, err := d.Dial("ws://" + l.Addr().String())
+		if (err == nil) != tt.ok {
+			t.Errorf("Dial() with Origin %q error = %v, want ok %v", tt.origin, err, tt.ok)
+		}
+		if err == nil {
+			c.Rwc.Close()
+		}
+	}
+}
+
+func TestUpgrader_Fallback(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>chat</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u := &Upgrader{Fallback: &minwshttp.FileServer{Root: dir}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, _, err := u.Upgrade(conn)
+				if err != nil {
+					if !errors.Is(err, ErrNotWebSocket) {
+						t.Errorf("Upgrade() error = %v", err)
+					}
+					return
+				}
+				echo(c)
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// pipelined requests on a keep-alive connection, and then the handshake
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		res, err := minwshttp.ReadClientResponse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, len("<h1>chat</h1>"))
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != minwshttp.StatusOK || res.Header.Get("Connection") != "keep-alive" || string(body) != "<h1>chat</h1>" {
+			t.Errorf("response %d = %d %v %q", i, res.StatusCode, res.Header, body)
+		}
+	}
+	res, err := minwshttp.ReadClientResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != minwshttp.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != calcSecWebsocketAccept(key) {
+		t.Fatalf("handshake response = %d %v", res.StatusCode, res.Header)
+	}
+	c := ws.NewClientConn(conn, r)
+	c.SendTextMessage("hello")
+	if got, err := c.ReadTextMessage(); err != nil || got != "hello" {
+		t.Errorf("ReadTextMessage() = %q, %v", got, err)
+	}
+
+	// closed by the client after a request
+	conn2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	fmt.Fprintf(conn2, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	b, _ := ioutil.ReadAll(conn2)
+	if !strings.HasSuffix(string(b), "\r\n\r\n<h1>chat</h1>") || !strings.Contains(string(b), "Connection: close") {
+		t.Errorf("response = %q", b)
+	}
+}
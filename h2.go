@@ -0,0 +1,95 @@
+package minws
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/cou929/minws/h2"
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// ServeH2 serves WebSocket connections opened by the extended CONNECT
+// method on an HTTP/2 connection with prior knowledge, calling h in a new
+// goroutine for each of them. Origins, Subprotocols and Negotiate apply
+// as to HTTP/1.1 handshakes. Other requests are reset with
+// HTTP_1_1_REQUIRED, so that the client retries them over HTTP/1.1.
+// It returns when the connection is closed.
+// https://tools.ietf.org/html/rfc8441#section-5
+func (u *Upgrader) ServeH2(conn net.Conn, h func(c *ws.Conn, req *minwshttp.Request)) error {
+	return h2.ServeConn(conn, func(st *h2.Stream, req *minwshttp.Request) {
+		if req.Method != "CONNECT" {
+			st.Reset(h2.ErrCodeHTTP11Required)
+			return
+		}
+		proto, status, err := u.acceptH2(req)
+		if err != nil {
+			st.Respond(status, nil)
+			st.Close()
+			return
+		}
+		header := minwshttp.Header{}
+		if proto != "" {
+			header["Sec-WebSocket-Protocol"] = proto
+		}
+		if err := st.Respond(minwshttp.StatusOK, header); err != nil {
+			st.Reset(h2.ErrCodeCancel)
+			return
+		}
+		c := ws.NewServerConn(st, bufio.NewReader(st))
+		c.Subprotocol = proto
+		h(c, req)
+	})
+}
+
+// acceptH2 validates the extended CONNECT request, which replaces the
+// Upgrade headers and Sec-WebSocket-Key of HTTP/1.1
+// https://tools.ietf.org/html/rfc8441#section-5
+func (u *Upgrader) acceptH2(req *minwshttp.Request) (string, int, error) {
+	if req.Protocol != "websocket" {
+		return "", minwshttp.StatusBadRequest, fmt.Errorf("Must send :protocol websocket")
+	}
+	if !req.Header.Has("Sec-WebSocket-Version") {
+		return "", minwshttp.StatusBadRequest, fmt.Errorf("Must send header Sec-WebSocket-Version")
+	}
+	return u.accept(req)
+}
+
+// DialH2 opens a WebSocket connection with the extended CONNECT method on
+// the HTTP/2 connection, which many WebSocket connections may share. Only
+// ws:// urls are supported, as hc is cleartext.
+// https://tools.ietf.org/html/rfc8441#section-4
+func (d *Dialer) DialH2(hc *h2.Conn, rawurl string) (*ws.Conn, *minwshttp.ClientResponse, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	header := make(minwshttp.Header)
+	for k, v := range d.Header {
+		header[k] = v
+	}
+	header["Sec-WebSocket-Version"] = "13"
+	if len(d.Subprotocols) > 0 {
+		header["Sec-WebSocket-Protocol"] = strings.Join(d.Subprotocols, ", ")
+	}
+	st, res, err := hc.Connect("websocket", u.Host, u.RequestURI(), header)
+	if err != nil {
+		return nil, res, err
+	}
+
+	proto := res.Header.Get("Sec-WebSocket-Protocol")
+	if proto != "" && !contains(d.Subprotocols, proto) {
+		st.Reset(h2.ErrCodeCancel)
+		return nil, res, fmt.Errorf("Unexpected subprotocol %s", proto)
+	}
+	c := ws.NewClientConn(st, bufio.NewReader(st))
+	c.Subprotocol = proto
+	return c, res, nil
+}
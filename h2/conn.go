@@ -0,0 +1,791 @@
+// Package h2 implements the part of HTTP/2 needed to carry WebSocket
+// connections with the extended CONNECT method of RFC 8441, so that many
+// sockets share one TCP connection. Only cleartext connections with prior
+// knowledge are supported.
+//
+// Each stream is a net.Conn, on which the ws package runs its framing as
+// on a TCP connection. Server push and priorities are not supported, and
+// header blocks are sent without compression state.
+//
+// https://tools.ietf.org/html/rfc7540
+// https://tools.ietf.org/html/rfc8441
+package h2
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	minwshttp "github.com/cou929/minws/http"
+)
+
+// ClientPreface starts every HTTP/2 connection
+// https://tools.ietf.org/html/rfc7540#section-3.5
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Defaults of the settings sent to the peer
+const (
+	// DefaultMaxStreams is the number of concurrent streams a client may
+	// open
+	DefaultMaxStreams = 100
+	// DefaultWindowSize is the receive window of each stream and the
+	// connection
+	DefaultWindowSize = 1 << 20
+	// DefaultMaxHeaderBytes limits the decoded size of a header block
+	DefaultMaxHeaderBytes = minwshttp.DefaultMaxHeaderBytes
+)
+
+// Errors
+var (
+	ErrClosed             = errors.New("h2: connection closed")
+	ErrNoConnectProtocol  = errors.New("h2: server does not support extended CONNECT")
+	errHeaderTooLarge     = errors.New("h2: header block too large")
+	errStreamClosed       = errors.New("h2: use of closed stream")
+	errStreamLocallyEnded = errors.New("h2: write after end of stream")
+)
+
+// Handler serves a stream opened by the client with the request in its
+// HEADERS frame. It is called in a new goroutine, and must respond with
+// Stream.Respond or reset the stream.
+type Handler func(st *Stream, req *minwshttp.Request)
+
+// Conn is an HTTP/2 connection of either side
+type Conn struct {
+	rwc     net.Conn
+	br      *bufio.Reader
+	client  bool
+	handler Handler
+	dec     *decoder // used only by the read loop
+
+	wmu sync.Mutex // serializes frames
+	bw  *bufio.Writer
+
+	// connectMu orders new streams, whose ids must increase in the order
+	// of their HEADERS frames
+	connectMu sync.Mutex
+
+	mu             sync.Mutex
+	cond           *sync.Cond
+	streams        map[uint32]*Stream
+	lastID         uint32 // the latest stream id opened
+	sendWindow     int64
+	initialWindow  int64  // SETTINGS_INITIAL_WINDOW_SIZE of the peer
+	maxFrameSize   int    // SETTINGS_MAX_FRAME_SIZE of the peer
+	maxStreams     uint32 // SETTINGS_MAX_CONCURRENT_STREAMS of the peer
+	connectEnabled bool   // SETTINGS_ENABLE_CONNECT_PROTOCOL of the peer
+	gotSettings    bool
+	goAway         bool
+	err            error
+
+	// header block being continued by CONTINUATION frames
+	block          []byte
+	blockStream    uint32
+	blockEndStream bool
+}
+
+func newConn(rwc net.Conn, client bool) *Conn {
+	c := &Conn{
+		rwc:           rwc,
+		br:            bufio.NewReader(rwc),
+		bw:            bufio.NewWriter(rwc),
+		client:        client,
+		dec:           newDecoder(),
+		streams:       make(map[uint32]*Stream),
+		sendWindow:    defaultWindowSize,
+		initialWindow: defaultWindowSize,
+		maxFrameSize:  defaultMaxFrameSize,
+		maxStreams:    ^uint32(0),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// ServeConn serves the connection of a client with prior knowledge. The
+// client preface must not have been read. It returns when the connection
+// is closed.
+func ServeConn(conn net.Conn, h Handler) error {
+	c := newConn(conn, false)
+	c.handler = h
+	defer conn.Close()
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(c.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return errors.New("h2: invalid client preface")
+	}
+	if err := c.writeSettings(
+		setting{settingMaxConcurrentStreams, DefaultMaxStreams},
+		setting{settingEnableConnectProtocol, 1},
+	); err != nil {
+		return err
+	}
+	return c.readLoop()
+}
+
+// NewClientConn starts a connection to a server with prior knowledge
+func NewClientConn(conn net.Conn) (*Conn, error) {
+	c := newConn(conn, true)
+	if _, err := c.bw.WriteString(ClientPreface); err != nil {
+		return nil, err
+	}
+	if err := c.writeSettings(setting{settingEnablePush, 0}); err != nil {
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// Sniff tells whether the client of conn starts with the HTTP/2 preface,
+// so that one port serves both HTTP/1.1 and HTTP/2 with prior knowledge.
+// The returned conn must be used in place of conn, as it holds the peeked
+// bytes.
+func Sniff(conn net.Conn) (net.Conn, bool, error) {
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(len("PRI "))
+	if err != nil && len(b) == 0 {
+		return nil, false, err
+	}
+	return &sniffedConn{conn, br}, string(b) == "PRI ", nil
+}
+
+// sniffedConn reads the bytes peeked by Sniff before the rest of Conn
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// writeSettings sends the initial SETTINGS and raises the receive
+// window of the connection
+func (c *Conn) writeSettings(settings ...setting) error {
+	settings = append(settings,
+		setting{settingInitialWindowSize, DefaultWindowSize},
+		setting{settingMaxHeaderListSize, DefaultMaxHeaderBytes},
+	)
+	b := appendSettings(nil, settings...)
+	b = appendUint32Frame(b, frameWindowUpdate, 0, DefaultWindowSize-defaultWindowSize)
+	return c.write(b)
+}
+
+// write sends frames. It must not be called with c.mu held, as it may
+// block until the peer reads.
+func (c *Conn) write(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.bw.Write(b); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+func (c *Conn) writeFrame(typ, flags uint8, streamID uint32, payload []byte) error {
+	return c.write(appendFrame(nil, typ, flags, streamID, payload))
+}
+
+// writeHeaders sends the header block, split into CONTINUATION frames if
+// it exceeds the frame size of the peer
+func (c *Conn) writeHeaders(streamID uint32, block []byte, endStream bool) error {
+	c.mu.Lock()
+	max := c.maxFrameSize
+	c.mu.Unlock()
+
+	var flags uint8
+	if endStream {
+		flags |= flagEndStream
+	}
+	var b []byte
+	typ := uint8(frameHeaders)
+	for {
+		n := len(block)
+		if n > max {
+			n = max
+		} else {
+			flags |= flagEndHeaders
+		}
+		b = appendFrame(b, typ, flags, streamID, block[:n])
+		block = block[n:]
+		if len(block) == 0 {
+			return c.write(b)
+		}
+		typ, flags = frameContinuation, 0
+	}
+}
+
+// Close sends GOAWAY and closes the connection
+func (c *Conn) Close() error {
+	c.writeGoAway(ErrCodeNo)
+	c.shutdown(ErrClosed)
+	return c.rwc.Close()
+}
+
+// writeGoAway sends GOAWAY with the last stream opened by the peer
+func (c *Conn) writeGoAway(code ErrCode) error {
+	var lastID uint32
+	if !c.client {
+		c.mu.Lock()
+		lastID = c.lastID
+		c.mu.Unlock()
+	}
+	var payload [8]byte
+	payload[0], payload[1], payload[2], payload[3] = byte(lastID>>24), byte(lastID>>16), byte(lastID>>8), byte(lastID)
+	payload[4], payload[5], payload[6], payload[7] = byte(code>>24), byte(code>>16), byte(code>>8), byte(code)
+	return c.writeFrame(frameGoAway, 0, 0, payload[:])
+}
+
+// shutdown fails all streams with err
+func (c *Conn) shutdown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, st := range c.streams {
+		if st.err == nil {
+			st.err = err
+		}
+		delete(c.streams, id)
+	}
+	c.cond.Broadcast()
+}
+
+// readLoop handles frames until the connection fails
+func (c *Conn) readLoop() error {
+	buf := make([]byte, defaultMaxFrameSize)
+	for {
+		fh, payload, err := readFrame(c.br, buf)
+		if err == nil {
+			err = c.handleFrame(fh, payload)
+		}
+		var serr *StreamError
+		if errors.As(err, &serr) {
+			c.resetStream(serr.StreamID, serr.Code)
+			continue
+		}
+		if err != nil {
+			var cerr *ConnError
+			if errors.As(err, &cerr) {
+				c.writeGoAway(cerr.Code)
+			}
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			c.shutdown(err)
+			c.rwc.Close()
+			if err == ErrClosed {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (c *Conn) handleFrame(fh frameHeader, payload []byte) error {
+	if c.blockStream != 0 && (fh.typ != frameContinuation || fh.streamID != c.blockStream) {
+		return &ConnError{ErrCodeProtocol, "header block interrupted"}
+	}
+	switch fh.typ {
+	case frameData:
+		return c.handleData(fh, payload)
+	case frameHeaders:
+		if fh.streamID == 0 {
+			return &ConnError{ErrCodeProtocol, "HEADERS on stream 0"}
+		}
+		block, err := trimPadding(fh, payload)
+		if err != nil {
+			return err
+		}
+		if fh.has(flagPriority) {
+			if len(block) < 5 {
+				return &ConnError{ErrCodeFrameSize, "short HEADERS"}
+			}
+			block = block[5:]
+		}
+		c.block = append(c.block[:0], block...)
+		c.blockStream = fh.streamID
+		c.blockEndStream = fh.has(flagEndStream)
+		if fh.has(flagEndHeaders) {
+			return c.endHeaders()
+		}
+	case frameContinuation:
+		if c.blockStream == 0 {
+			return &ConnError{ErrCodeProtocol, "unexpected CONTINUATION"}
+		}
+		if len(c.block)+len(payload) > DefaultMaxHeaderBytes {
+			return &ConnError{ErrCodeEnhanceYourCalm, "header block too large"}
+		}
+		c.block = append(c.block, payload...)
+		if fh.has(flagEndHeaders) {
+			return c.endHeaders()
+		}
+	case framePriority:
+		if fh.streamID == 0 {
+			return &ConnError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+	case frameRSTStream:
+		if fh.streamID == 0 || len(payload) != 4 {
+			return &ConnError{ErrCodeProtocol, "invalid RST_STREAM"}
+		}
+		code := ErrCode(uint32(payload[0])<<24 | uint32(payload[1])<<16 | uint32(payload[2])<<8 | uint32(payload[3]))
+		c.mu.Lock()
+		if st, ok := c.streams[fh.streamID]; ok {
+			st.err = &StreamError{fh.streamID, code}
+			delete(c.streams, fh.streamID)
+			c.cond.Broadcast()
+		}
+		c.mu.Unlock()
+	case frameSettings:
+		return c.handleSettings(fh, payload)
+	case framePushPromise:
+		return &ConnError{ErrCodeProtocol, "push is disabled"}
+	case framePing:
+		if fh.streamID != 0 || len(payload) != 8 {
+			return &ConnError{ErrCodeProtocol, "invalid PING"}
+		}
+		if !fh.has(flagAck) {
+			return c.writeFrame(framePing, flagAck, 0, payload)
+		}
+	case frameGoAway:
+		if fh.streamID != 0 || len(payload) < 8 {
+			return &ConnError{ErrCodeProtocol, "invalid GOAWAY"}
+		}
+		c.mu.Lock()
+		c.goAway = true
+		c.mu.Unlock()
+	case frameWindowUpdate:
+		return c.handleWindowUpdate(fh, payload)
+	}
+	// unknown frames are ignored
+	return nil
+}
+
+func (c *Conn) handleData(fh frameHeader, payload []byte) error {
+	if fh.streamID == 0 {
+		return &ConnError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	data, err := trimPadding(fh, payload)
+	if err != nil {
+		return err
+	}
+	// the connection window is credited at once, while each stream is
+	// credited as the application reads
+	if fh.length > 0 {
+		if err := c.write(appendUint32Frame(nil, frameWindowUpdate, 0, fh.length)); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, ok := c.streams[fh.streamID]
+	if !ok {
+		if fh.streamID > c.lastID {
+			return &ConnError{ErrCodeProtocol, "DATA on idle stream"}
+		}
+		return &StreamError{fh.streamID, ErrCodeStreamClosed}
+	}
+	if st.remoteEnded {
+		return &StreamError{fh.streamID, ErrCodeStreamClosed}
+	}
+	if !st.closed {
+		if len(st.buf)+len(data) > DefaultWindowSize {
+			return &StreamError{fh.streamID, ErrCodeFlowControl}
+		}
+		st.buf = append(st.buf, data...)
+	}
+	// padding is credited as it is never read
+	st.unacked += int(fh.length) - len(data)
+	if fh.has(flagEndStream) {
+		st.remoteEnded = true
+		c.removeIfDone(st)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) handleSettings(fh frameHeader, payload []byte) error {
+	if fh.streamID != 0 {
+		return &ConnError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if fh.has(flagAck) {
+		if len(payload) != 0 {
+			return &ConnError{ErrCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	if len(payload)%6 != 0 {
+		return &ConnError{ErrCodeFrameSize, "invalid SETTINGS"}
+	}
+
+	c.mu.Lock()
+	for ; len(payload) > 0; payload = payload[6:] {
+		id := uint16(payload[0])<<8 | uint16(payload[1])
+		val := uint32(payload[2])<<24 | uint32(payload[3])<<16 | uint32(payload[4])<<8 | uint32(payload[5])
+		var err error
+		switch id {
+		case settingEnablePush, settingEnableConnectProtocol:
+			if val > 1 {
+				err = &ConnError{ErrCodeProtocol, "invalid boolean setting"}
+			}
+			if id == settingEnableConnectProtocol {
+				c.connectEnabled = val == 1
+			}
+		case settingMaxConcurrentStreams:
+			c.maxStreams = val
+		case settingInitialWindowSize:
+			if val > maxWindowSize {
+				err = &ConnError{ErrCodeFlowControl, "initial window too large"}
+				break
+			}
+			// the difference applies to all open streams
+			// https://tools.ietf.org/html/rfc7540#section-6.9.2
+			delta := int64(val) - c.initialWindow
+			c.initialWindow = int64(val)
+			for _, st := range c.streams {
+				st.sendWindow += delta
+			}
+		case settingMaxFrameSize:
+			if val < defaultMaxFrameSize || val > maxFrameSizeLimit {
+				err = &ConnError{ErrCodeProtocol, "invalid max frame size"}
+				break
+			}
+			c.maxFrameSize = int(val)
+		}
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	c.gotSettings = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	return c.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (c *Conn) handleWindowUpdate(fh frameHeader, payload []byte) error {
+	if len(payload) != 4 {
+		return &ConnError{ErrCodeFrameSize, "invalid WINDOW_UPDATE"}
+	}
+	inc := int64(uint32(payload[0])<<24|uint32(payload[1])<<16|uint32(payload[2])<<8|uint32(payload[3])) & maxWindowSize
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fh.streamID == 0 {
+		if inc == 0 {
+			return &ConnError{ErrCodeProtocol, "zero window increment"}
+		}
+		if c.sendWindow += inc; c.sendWindow > maxWindowSize {
+			return &ConnError{ErrCodeFlowControl, "window overflow"}
+		}
+	} else if st, ok := c.streams[fh.streamID]; ok {
+		if inc == 0 {
+			return &StreamError{fh.streamID, ErrCodeProtocol}
+		}
+		if st.sendWindow += inc; st.sendWindow > maxWindowSize {
+			return &StreamError{fh.streamID, ErrCodeFlowControl}
+		}
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// endHeaders handles the complete header block
+func (c *Conn) endHeaders() error {
+	id, endStream := c.blockStream, c.blockEndStream
+	c.blockStream = 0
+	fields, err := c.dec.decode(c.block, DefaultMaxHeaderBytes)
+	if err == errHeaderTooLarge {
+		return &ConnError{ErrCodeEnhanceYourCalm, "header list too large"}
+	}
+	if err != nil {
+		return &ConnError{ErrCodeCompression, err.Error()}
+	}
+	if c.client {
+		return c.handleResponse(id, fields, endStream)
+	}
+	return c.handleRequest(id, fields, endStream)
+}
+
+func (c *Conn) handleRequest(id uint32, fields []headerField, endStream bool) error {
+	c.mu.Lock()
+	if st, ok := c.streams[id]; ok {
+		// trailers
+		defer c.mu.Unlock()
+		if !endStream {
+			return &StreamError{id, ErrCodeProtocol}
+		}
+		st.remoteEnded = true
+		c.removeIfDone(st)
+		c.cond.Broadcast()
+		return nil
+	}
+	if id%2 == 0 || id <= c.lastID {
+		c.mu.Unlock()
+		return &ConnError{ErrCodeProtocol, "invalid stream id " + strconv.FormatUint(uint64(id), 10)}
+	}
+	c.lastID = id
+	if len(c.streams) >= DefaultMaxStreams {
+		c.mu.Unlock()
+		return &StreamError{id, ErrCodeRefusedStream}
+	}
+	st := c.newStream(id)
+	st.remoteEnded = endStream
+	c.mu.Unlock()
+
+	req, err := newRequest(fields, st)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.streams, id)
+		c.mu.Unlock()
+		return &StreamError{id, ErrCodeProtocol}
+	}
+	go c.handler(st, req)
+	return nil
+}
+
+func (c *Conn) handleResponse(id uint32, fields []headerField, endStream bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, ok := c.streams[id]
+	if !ok {
+		// reset by us
+		return nil
+	}
+	if st.response == nil {
+		res, err := newResponse(fields)
+		if err != nil {
+			return &StreamError{id, ErrCodeProtocol}
+		}
+		if res.StatusCode >= 100 && res.StatusCode < 200 {
+			// interim response
+			return nil
+		}
+		st.response = res
+	}
+	if endStream {
+		st.remoteEnded = true
+		c.removeIfDone(st)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// newRequest converts the request header fields. Pseudo-header fields
+// are kept out of Header, and :protocol of extended CONNECT is set to
+// Protocol.
+// https://tools.ietf.org/html/rfc7540#section-8.1.2
+// https://tools.ietf.org/html/rfc8441#section-4
+func newRequest(fields []headerField, st *Stream) (*minwshttp.Request, error) {
+	req := &minwshttp.Request{
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        make(minwshttp.Header),
+		ContentLength: -1,
+		Body:          st,
+	}
+	pseudo := make(map[string]string)
+	regular := false
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return nil, err
+		}
+		if f.name[0] != ':' {
+			regular = true
+			if v, ok := req.Header[f.name]; ok {
+				sep := ", "
+				if f.name == "cookie" {
+					sep = "; "
+				}
+				f.value = v + sep + f.value
+			}
+			req.Header[f.name] = f.value
+			continue
+		}
+		if regular {
+			return nil, errors.New("pseudo header after regular header")
+		}
+		switch f.name {
+		case ":method", ":scheme", ":authority", ":path", ":protocol":
+		default:
+			return nil, errors.New("unknown pseudo header " + f.name)
+		}
+		if _, ok := pseudo[f.name]; ok {
+			return nil, errors.New("duplicate pseudo header " + f.name)
+		}
+		pseudo[f.name] = f.value
+	}
+
+	req.Method = pseudo[":method"]
+	req.RequestURI = pseudo[":path"]
+	_, hasProtocol := pseudo[":protocol"]
+	switch {
+	case req.Method == "":
+		return nil, errors.New("missing :method")
+	case req.Method == "CONNECT" && !hasProtocol:
+		if pseudo[":authority"] == "" || pseudo[":scheme"] != "" || req.RequestURI != "" {
+			return nil, errors.New("malformed CONNECT")
+		}
+	case hasProtocol && req.Method != "CONNECT":
+		return nil, errors.New(":protocol without CONNECT")
+	default:
+		if pseudo[":scheme"] == "" || req.RequestURI == "" {
+			return nil, errors.New("missing :scheme or :path")
+		}
+	}
+	req.Protocol = pseudo[":protocol"]
+	// :authority stands for Host, which handlers of HTTP/1.1 look up
+	// https://tools.ietf.org/html/rfc7540#section-8.1.2.3
+	if a := pseudo[":authority"]; a != "" {
+		if host, ok := req.Header["host"]; !ok {
+			req.Header["host"] = a
+		} else if host != a {
+			return nil, errors.New(":authority differs from host")
+		}
+	}
+	return req, nil
+}
+
+func newResponse(fields []headerField) (*minwshttp.ClientResponse, error) {
+	res := &minwshttp.ClientResponse{Proto: "HTTP/2.0", ProtoMajor: 2, Header: make(minwshttp.Header)}
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return nil, err
+		}
+		if f.name == ":status" {
+			code, err := strconv.Atoi(f.value)
+			if err != nil || len(f.value) != 3 {
+				return nil, errors.New("invalid :status")
+			}
+			res.StatusCode = code
+			res.Status = minwshttp.StatusText(code)
+			continue
+		}
+		if f.name[0] == ':' {
+			return nil, errors.New("unknown pseudo header " + f.name)
+		}
+		res.Header[f.name] = f.value
+	}
+	if res.StatusCode == 0 {
+		return nil, errors.New("missing :status")
+	}
+	return res, nil
+}
+
+// checkField rejects malformed fields. Names must be lower-case tokens,
+// values must not contain NUL, CR or LF, and connection-specific fields
+// are not allowed.
+// https://tools.ietf.org/html/rfc7540#section-8.1.2
+func checkField(f headerField) error {
+	name := strings.TrimPrefix(f.name, ":")
+	if name == "" {
+		return errors.New("empty header name")
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !isTokenChar(c) || ('A' <= c && c <= 'Z') {
+			return errors.New("invalid header name " + strconv.Quote(f.name))
+		}
+	}
+	if strings.ContainsAny(f.value, "\x00\r\n") {
+		return errors.New("invalid value of header " + f.name)
+	}
+	if isConnectionHeader(f.name) || (f.name == "te" && f.value != "trailers") {
+		return errors.New("connection-specific header " + f.name)
+	}
+	return nil
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// Connect opens a stream with the extended CONNECT method for the
+// protocol, and waits for the response. The stream is returned only if
+// the status is 2xx.
+func (c *Conn) Connect(protocol, authority, path string, header minwshttp.Header) (*Stream, *minwshttp.ClientResponse, error) {
+	c.connectMu.Lock()
+	c.mu.Lock()
+	// the server tells if it supports extended CONNECT in its SETTINGS
+	for !c.gotSettings && c.err == nil {
+		c.cond.Wait()
+	}
+	switch {
+	case c.err != nil:
+		err := c.err
+		c.mu.Unlock()
+		c.connectMu.Unlock()
+		return nil, nil, err
+	case !c.connectEnabled:
+		c.mu.Unlock()
+		c.connectMu.Unlock()
+		return nil, nil, ErrNoConnectProtocol
+	case c.goAway:
+		c.mu.Unlock()
+		c.connectMu.Unlock()
+		return nil, nil, ErrClosed
+	}
+	for uint32(len(c.streams)) >= c.maxStreams && c.err == nil {
+		c.cond.Wait()
+	}
+	id := c.lastID + 2
+	if id == 2 {
+		id = 1
+	}
+	c.lastID = id
+	st := c.newStream(id)
+	c.mu.Unlock()
+
+	block := appendHeader(nil, ":method", "CONNECT")
+	block = appendHeader(block, ":protocol", protocol)
+	block = appendHeader(block, ":scheme", "http")
+	block = appendHeader(block, ":path", path)
+	block = appendHeader(block, ":authority", authority)
+	for k, v := range header {
+		if !isConnectionHeader(k) && !strings.EqualFold(k, "host") {
+			block = appendHeader(block, k, v)
+		}
+	}
+	err := c.writeHeaders(id, block, false)
+	c.connectMu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	for st.response == nil && st.err == nil {
+		c.cond.Wait()
+	}
+	res, err := st.response, st.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		st.Reset(ErrCodeCancel)
+		return nil, res, errors.New("h2: unexpected status " + strconv.Itoa(res.StatusCode))
+	}
+	return st, res, nil
+}
+
+// isConnectionHeader reports whether the header is connection-specific,
+// which is not allowed in HTTP/2
+// https://tools.ietf.org/html/rfc7540#section-8.1.2.2
+func isConnectionHeader(name string) bool {
+	switch strings.ToLower(name) {
+	case "connection", "upgrade", "keep-alive", "proxy-connection", "transfer-encoding":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package h2
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+)
+
+// serve runs ServeConn with h for each connection to the returned address
+func serve(t *testing.T, h Handler) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ServeConn(conn, h)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// echo accepts the tunnel and echoes its data until the client ends it
+func echo(st *Stream, req *minwshttp.Request) {
+	if req.Method != "CONNECT" {
+		st.Reset(ErrCodeHTTP11Required)
+		return
+	}
+	st.Respond(minwshttp.StatusOK, minwshttp.Header{"X-Path": req.RequestURI})
+	io.Copy(st, st)
+	st.Close()
+}
+
+func TestConn_Connect(t *testing.T) {
+	c := dial(t, serve(t, echo))
+
+	const n = 20
+	var wg sync.WaitGroup
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errc <- func() error {
+				st, res, err := c.Connect("websocket", "example.com", "/chat", nil)
+				if err != nil {
+					return err
+				}
+				if got := res.Header.Get("X-Path"); got != "/chat" {
+					return errors.New("unexpected x-path " + got)
+				}
+				defer st.Close()
+				msg := []byte{byte(i), 1, 2, 3}
+				if _, err := st.Write(msg); err != nil {
+					return err
+				}
+				got := make([]byte, len(msg))
+				if _, err := io.ReadFull(st, got); err != nil {
+					return err
+				}
+				if string(got) != string(msg) {
+					return errors.New("echoed data differs")
+				}
+				return nil
+			}()
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestConn_Connect_Echo(t *testing.T) {
+	c := dial(t, serve(t, echo))
+	st, _, err := c.Connect("websocket", "example.com", "/", nil)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	// larger than the initial windows, so that WINDOW_UPDATE is needed
+	msg := make([]byte, 3*DefaultWindowSize)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Write(msg)
+		done <- err
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(st, got); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Error("echoed data differs")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+}
+
+func TestConn_Connect_Rejected(t *testing.T) {
+	c := dial(t, serve(t, func(st *Stream, req *minwshttp.Request) {
+		if req.RequestURI == "/forbidden" {
+			st.Respond(minwshttp.StatusForbidden, nil)
+			st.Close()
+			return
+		}
+		echo(st, req)
+	}))
+	_, res, err := c.Connect("websocket", "example.com", "/forbidden", nil)
+	if err == nil {
+		t.Fatal("Connect() succeeded")
+	}
+	if res == nil || res.StatusCode != minwshttp.StatusForbidden {
+		t.Errorf("Connect() response = %+v", res)
+	}
+
+	// the connection is still usable
+	if _, _, err := c.Connect("websocket", "example.com", "/", nil); err != nil {
+		t.Errorf("Connect() error = %v", err)
+	}
+}
+
+func TestStream_Reset(t *testing.T) {
+	reset := make(chan *Stream, 1)
+	c := dial(t, serve(t, func(st *Stream, req *minwshttp.Request) {
+		st.Respond(minwshttp.StatusOK, nil)
+		reset <- st
+	}))
+	st, _, err := c.Connect("websocket", "example.com", "/", nil)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	(<-reset).Reset(ErrCodeCancel)
+
+	_, err = st.Read(make([]byte, 1))
+	var se *StreamError
+	if !errors.As(err, &se) || se.Code != ErrCodeCancel {
+		t.Errorf("Read() error = %v, want a stream error of CANCEL", err)
+	}
+}
+
+func TestStream_SetReadDeadline(t *testing.T) {
+	c := dial(t, serve(t, echo))
+	st, _, err := c.Connect("websocket", "example.com", "/", nil)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read() error = %v, want a timeout", err)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		in     string
+		wantH2 bool
+	}{
+		{ClientPreface, true},
+		{"GET / HTTP/1.1\r\n\r\n", false},
+		{"P", false},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tt.in))
+			client.Close()
+		}()
+		conn, isH2, err := Sniff(server)
+		if err != nil {
+			t.Fatalf("Sniff(%q) error = %v", tt.in, err)
+		}
+		if isH2 != tt.wantH2 {
+			t.Errorf("Sniff(%q) = %v, want %v", tt.in, isH2, tt.wantH2)
+		}
+		got, _ := ioutil.ReadAll(conn)
+		if string(got) != tt.in {
+			t.Errorf("read %q after Sniff, want %q", got, tt.in)
+		}
+	}
+}
+
+// rawRequest sends a HEADERS frame with the block on a new connection, and
+// returns the first RST_STREAM or GOAWAY frame of the server
+func rawRequest(t *testing.T, addr string, block []byte) (frameHeader, []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b := append([]byte(ClientPreface), appendSettings(nil)...)
+	b = appendFrame(b, frameHeaders, flagEndHeaders, 1, block)
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, defaultMaxFrameSize)
+	for {
+		fh, payload, err := readFrame(conn, buf)
+		if err != nil {
+			t.Fatalf("readFrame() error = %v", err)
+		}
+		if fh.typ == frameRSTStream || fh.typ == frameGoAway {
+			return fh, payload
+		}
+	}
+}
+
+func TestServeConn_MalformedHeaders(t *testing.T) {
+	addr := serve(t, echo)
+	connect := func(fields ...string) []byte {
+		b := appendHeader(nil, ":method", "CONNECT")
+		b = appendHeader(b, ":protocol", "websocket")
+		b = appendHeader(b, ":scheme", "http")
+		b = appendHeader(b, ":path", "/")
+		b = appendHeader(b, ":authority", "example.com")
+		for i := 0; i < len(fields); i += 2 {
+			b = append(b, 0)
+			b = appendString(b, fields[i])
+			b = appendString(b, fields[i+1])
+		}
+		return b
+	}
+	tests := []struct {
+		name  string
+		block []byte
+	}{
+		{"empty name", []byte{0, 0, 1, 'x'}},
+		{"empty name after pseudo headers", connect("", "x")},
+		{"uppercase name", connect("Origin", "x")},
+		{"missing method", appendHeader(nil, ":path", "/")},
+		{"unknown pseudo header", connect(":foo", "x")},
+		{"pseudo header after regular header", append(connect("origin", "x"), appendHeader(nil, ":path", "/")...)},
+		{"value with CR", connect("origin", "a\rb")},
+		{"value with LF", connect("origin", "a\nb")},
+		{"value with NUL", connect("origin", "a\x00b")},
+		{"invalid name", connect("a b", "x")},
+		{"connection", connect("connection", "keep-alive")},
+		{"transfer-encoding", connect("transfer-encoding", "chunked")},
+		{"upgrade", connect("upgrade", "websocket")},
+		{"te other than trailers", connect("te", "gzip")},
+		{"host differs from authority", connect("host", "evil.example")},
+		{"protocol without connect", append(appendHeader(appendHeader(appendHeader(nil, ":method", "GET"), ":scheme", "http"), ":path", "/"), appendHeader(nil, ":protocol", "websocket")...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fh, payload := rawRequest(t, addr, tt.block)
+			if fh.typ != frameRSTStream || fh.streamID != 1 {
+				t.Fatalf("got frame type %d on stream %d, want RST_STREAM on 1", fh.typ, fh.streamID)
+			}
+			if code := ErrCode(payload[0])<<24 | ErrCode(payload[1])<<16 | ErrCode(payload[2])<<8 | ErrCode(payload[3]); code != ErrCodeProtocol {
+				t.Errorf("RST_STREAM code = %v, want %v", code, ErrCodeProtocol)
+			}
+		})
+	}
+
+	// the server is still alive
+	if _, _, err := dial(t, addr).Connect("websocket", "example.com", "/", nil); err != nil {
+		t.Errorf("Connect() error = %v", err)
+	}
+}
+
+// Test_newRequest_random checks that random header blocks are rejected
+// without panics
+func Test_newRequest_random(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		block := make([]byte, rnd.Intn(16))
+		rnd.Read(block)
+		fields, err := newDecoder().decode(block, DefaultMaxHeaderBytes)
+		if err != nil {
+			continue
+		}
+		newRequest(fields, &Stream{})
+		newResponse(fields)
+	}
+}
+
+func Test_newRequest(t *testing.T) {
+	fields := []headerField{
+		{":method", "CONNECT"},
+		{":protocol", "websocket"},
+		{":scheme", "http"},
+		{":path", "/chat"},
+		{":authority", "example.com"},
+		{"origin", "https://example.com"},
+	}
+	req, err := newRequest(fields, &Stream{})
+	if err != nil {
+		t.Fatalf("newRequest() error = %v", err)
+	}
+	if req.Method != "CONNECT" || req.RequestURI != "/chat" || req.Protocol != "websocket" {
+		t.Errorf("newRequest() = %+v", req)
+	}
+	want := minwshttp.Header{"host": "example.com", "origin": "https://example.com"}
+	if !reflect.DeepEqual(req.Header, want) {
+		t.Errorf("Header = %v, want %v", req.Header, want)
+	}
+}
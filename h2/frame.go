@@ -0,0 +1,195 @@
+package h2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frame types
+// https://tools.ietf.org/html/rfc7540#section-6
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePriority     = 0x2
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+)
+
+// Frame flags
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+// Settings parameters
+// https://tools.ietf.org/html/rfc7540#section-6.5.2
+// https://tools.ietf.org/html/rfc8441#section-3
+const (
+	settingHeaderTableSize       = 0x1
+	settingEnablePush            = 0x2
+	settingMaxConcurrentStreams  = 0x3
+	settingInitialWindowSize     = 0x4
+	settingMaxFrameSize          = 0x5
+	settingMaxHeaderListSize     = 0x6
+	settingEnableConnectProtocol = 0x8
+)
+
+// ErrCode is an error code of RST_STREAM and GOAWAY frames
+// https://tools.ietf.org/html/rfc7540#section-7
+type ErrCode uint32
+
+// Error codes
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (e ErrCode) String() string {
+	if s, ok := errCodeNames[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(e))
+}
+
+// ConnError is a connection error, sent with GOAWAY
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("h2: connection error %v: %s", e.Code, e.Reason)
+}
+
+// StreamError is a stream error, sent with RST_STREAM
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("h2: stream %d reset with %v", e.StreamID, e.Code)
+}
+
+// Sizes of the protocol
+const (
+	frameHeaderLen      = 9
+	defaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+type frameHeader struct {
+	length   uint32
+	typ      uint8
+	flags    uint8
+	streamID uint32
+}
+
+func (h frameHeader) has(flag uint8) bool {
+	return h.flags&flag != 0
+}
+
+// readFrame reads a frame into buf, which must have maxSize bytes
+func readFrame(r io.Reader, buf []byte) (frameHeader, []byte, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frameHeader{}, nil, err
+	}
+	fh := frameHeader{
+		length:   uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2]),
+		typ:      hdr[3],
+		flags:    hdr[4],
+		streamID: binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1),
+	}
+	if fh.length > uint32(len(buf)) {
+		return fh, nil, &ConnError{ErrCodeFrameSize, "frame too large"}
+	}
+	payload := buf[:fh.length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fh, nil, err
+	}
+	return fh, payload, nil
+}
+
+// appendFrame appends a frame with the payload
+func appendFrame(b []byte, typ, flags uint8, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	b = append(b, byte(n>>16), byte(n>>8), byte(n), typ, flags)
+	b = append(b, byte(streamID>>24), byte(streamID>>16), byte(streamID>>8), byte(streamID))
+	return append(b, payload...)
+}
+
+// trimPadding removes the padding of DATA and HEADERS frames
+// https://tools.ietf.org/html/rfc7540#section-6.1
+func trimPadding(fh frameHeader, payload []byte) ([]byte, error) {
+	if !fh.has(flagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, &ConnError{ErrCodeProtocol, "invalid padding"}
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+type setting struct {
+	id  uint16
+	val uint32
+}
+
+func appendSettings(b []byte, settings ...setting) []byte {
+	var payload []byte
+	for _, s := range settings {
+		payload = append(payload, byte(s.id>>8), byte(s.id),
+			byte(s.val>>24), byte(s.val>>16), byte(s.val>>8), byte(s.val))
+	}
+	return appendFrame(b, frameSettings, 0, 0, payload)
+}
+
+func appendUint32Frame(b []byte, typ uint8, streamID uint32, v uint32) []byte {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], v)
+	return appendFrame(b, typ, 0, streamID, payload[:])
+}
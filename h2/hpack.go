@@ -0,0 +1,334 @@
+package h2
+
+import (
+	"errors"
+	"strings"
+)
+
+// HPACK header compression
+// https://tools.ietf.org/html/rfc7541
+
+// defaultHeaderTableSize is the initial size of the dynamic table
+const defaultHeaderTableSize = 4096
+
+var errCompression = errors.New("h2: header compression error")
+
+type headerField struct {
+	name, value string
+}
+
+// size is the size of the entry in the dynamic table
+func (hf headerField) size() int {
+	return len(hf.name) + len(hf.value) + 32
+}
+
+// https://tools.ietf.org/html/rfc7541#appendix-A
+var staticTable = [...]headerField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// decoder decodes header blocks of a connection. The dynamic table is
+// shared by all blocks, so that every block must be decoded in order.
+type decoder struct {
+	dynamic []headerField // newest first
+	size    int
+	maxSize int // set by the encoder, up to limit
+	limit   int // SETTINGS_HEADER_TABLE_SIZE sent to the peer
+}
+
+func newDecoder() *decoder {
+	return &decoder{maxSize: defaultHeaderTableSize, limit: defaultHeaderTableSize}
+}
+
+// decode decodes a header block. maxBytes limits the total size of the
+// fields, counted like entries of the dynamic table.
+func (d *decoder) decode(b []byte, maxBytes int) ([]headerField, error) {
+	var fields []headerField
+	total := 0
+	for len(b) > 0 {
+		var hf headerField
+		var err error
+		switch {
+		case b[0]&0x80 != 0: // indexed
+			var i uint64
+			if i, b, err = readInt(b, 7); err != nil {
+				return nil, err
+			}
+			if hf, err = d.at(i); err != nil {
+				return nil, err
+			}
+		case b[0]&0xc0 == 0x40: // literal with incremental indexing
+			if hf, b, err = d.readLiteral(b, 6); err != nil {
+				return nil, err
+			}
+			d.add(hf)
+		case b[0]&0xe0 == 0x20: // dynamic table size update
+			// allowed only at the start of a header block
+			// https://tools.ietf.org/html/rfc7541#section-4.2
+			if len(fields) > 0 {
+				return nil, errCompression
+			}
+			var n uint64
+			if n, b, err = readInt(b, 5); err != nil {
+				return nil, err
+			}
+			if n > uint64(d.limit) {
+				return nil, errCompression
+			}
+			d.maxSize = int(n)
+			d.evict()
+			continue
+		default: // literal without indexing or never indexed
+			if hf, b, err = d.readLiteral(b, 4); err != nil {
+				return nil, err
+			}
+		}
+		if total += hf.size(); total > maxBytes {
+			return nil, errHeaderTooLarge
+		}
+		fields = append(fields, hf)
+	}
+	return fields, nil
+}
+
+// at returns the entry of the index, which is 1-based over the static
+// table followed by the dynamic table
+func (d *decoder) at(i uint64) (headerField, error) {
+	switch {
+	case i == 0:
+		return headerField{}, errCompression
+	case i <= uint64(len(staticTable)):
+		return staticTable[i-1], nil
+	case i-uint64(len(staticTable)) <= uint64(len(d.dynamic)):
+		return d.dynamic[i-uint64(len(staticTable))-1], nil
+	}
+	return headerField{}, errCompression
+}
+
+func (d *decoder) readLiteral(b []byte, prefix uint) (headerField, []byte, error) {
+	var hf headerField
+	i, b, err := readInt(b, prefix)
+	if err != nil {
+		return hf, nil, err
+	}
+	if i > 0 {
+		ref, err := d.at(i)
+		if err != nil {
+			return hf, nil, err
+		}
+		hf.name = ref.name
+	} else if hf.name, b, err = readString(b); err != nil {
+		return hf, nil, err
+	}
+	if hf.value, b, err = readString(b); err != nil {
+		return hf, nil, err
+	}
+	return hf, b, nil
+}
+
+func (d *decoder) add(hf headerField) {
+	d.dynamic = append([]headerField{hf}, d.dynamic...)
+	d.size += hf.size()
+	d.evict()
+}
+
+func (d *decoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+// readInt decodes an integer of the prefix bits
+// https://tools.ietf.org/html/rfc7541#section-5.1
+func readInt(b []byte, prefix uint) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errCompression
+	}
+	max := uint64(1)<<prefix - 1
+	n := uint64(b[0]) & max
+	b = b[1:]
+	if n < max {
+		return n, b, nil
+	}
+	for shift := uint(0); len(b) > 0; shift += 7 {
+		if shift > 56 {
+			return 0, nil, errCompression
+		}
+		c := b[0]
+		b = b[1:]
+		n += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return n, b, nil
+		}
+	}
+	return 0, nil, errCompression
+}
+
+// readString decodes a string literal
+// https://tools.ietf.org/html/rfc7541#section-5.2
+func readString(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, errCompression
+	}
+	huffman := b[0]&0x80 != 0
+	n, b, err := readInt(b, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(b)) {
+		return "", nil, errCompression
+	}
+	s, rest := b[:n], b[n:]
+	if !huffman {
+		return string(s), rest, nil
+	}
+	decoded, err := huffmanDecode(s)
+	if err != nil {
+		return "", nil, err
+	}
+	return decoded, rest, nil
+}
+
+// appendHeader encodes a field as a literal without indexing, so that the
+// encoder keeps no state. The name is lower-cased as HTTP/2 requires.
+func appendHeader(b []byte, name, value string) []byte {
+	b = append(b, 0)
+	b = appendString(b, strings.ToLower(name))
+	return appendString(b, value)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendInt(b, 7, 0, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendInt encodes n with the prefix bits, setting the flags above them
+func appendInt(b []byte, prefix uint, flags byte, n uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if n < max {
+		return append(b, flags|byte(n))
+	}
+	b = append(b, flags|byte(max))
+	n -= max
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
+
+// huffmanNode is a node of the decoding tree. Leaves have sym >= 0.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{sym: -1}
+	for sym, code := range huffmanCodes {
+		n := root
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := code >> uint(i) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{sym: -1}
+			}
+			n = n.children[bit]
+		}
+		n.sym = sym
+	}
+	return root
+}
+
+// huffmanDecode decodes the Huffman coded string. The padding must be
+// the most significant bits of EOS, which are all ones, shorter than 8
+// bits.
+func huffmanDecode(b []byte) (string, error) {
+	var out []byte
+	n := huffmanRoot
+	depth, ones := 0, true
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			bit := c >> uint(i) & 1
+			n = n.children[bit]
+			if n == nil {
+				// EOS, whose code is 30 ones, is not in the tree
+				return "", errCompression
+			}
+			depth++
+			ones = ones && bit == 1
+			if n.sym >= 0 {
+				out = append(out, byte(n.sym))
+				n = huffmanRoot
+				depth, ones = 0, true
+			}
+		}
+	}
+	if depth >= 8 || !ones {
+		return "", errCompression
+	}
+	return string(out), nil
+}
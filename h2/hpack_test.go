@@ -0,0 +1,135 @@
+package h2
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// https://tools.ietf.org/html/rfc7541#appendix-C.4
+func Test_decoder_decode(t *testing.T) {
+	d := newDecoder()
+	blocks := []struct {
+		in   string
+		want []headerField
+	}{
+		{
+			"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+			[]headerField{
+				{":method", "GET"},
+				{":scheme", "http"},
+				{":path", "/"},
+				{":authority", "www.example.com"},
+			},
+		},
+		{
+			"828684be5886a8eb10649cbf",
+			[]headerField{
+				{":method", "GET"},
+				{":scheme", "http"},
+				{":path", "/"},
+				{":authority", "www.example.com"},
+				{"cache-control", "no-cache"},
+			},
+		},
+		{
+			"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+			[]headerField{
+				{":method", "GET"},
+				{":scheme", "https"},
+				{":path", "/index.html"},
+				{":authority", "www.example.com"},
+				{"custom-key", "custom-value"},
+			},
+		},
+	}
+	for i, b := range blocks {
+		got, err := d.decode(mustHex(t, b.in), DefaultMaxHeaderBytes)
+		if err != nil {
+			t.Fatalf("block %d: decode() error = %v", i, err)
+		}
+		if !reflect.DeepEqual(got, b.want) {
+			t.Errorf("block %d: decode() = %v, want %v", i, got, b.want)
+		}
+	}
+	if d.size != 164 {
+		t.Errorf("dynamic table size = %d, want 164", d.size)
+	}
+
+	// table size updates at the start of a block
+	got, err := d.decode(mustHex(t, "202082"), DefaultMaxHeaderBytes)
+	if err != nil {
+		t.Fatalf("decode() error = %v", err)
+	}
+	if want := []headerField{{":method", "GET"}}; !reflect.DeepEqual(got, want) || d.size != 0 {
+		t.Errorf("decode() = %v, table size %d, want %v, 0", got, d.size, want)
+	}
+}
+
+func Test_decoder_decode_errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		maxBytes int
+		wantErr  error
+	}{
+		{"index zero", "80", 100, errCompression},
+		{"index out of range", "be", 100, errCompression},
+		{"truncated string", "400a637573746f6d", 100, errCompression},
+		{"huffman padding of zeros", "0001618100", 100, errCompression},
+		{"table size over limit", "3fe21f", 100, errCompression},
+		{"table size update after a field", "8220", 100, errCompression},
+		{"too large", "82", 10, errHeaderTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newDecoder().decode(mustHex(t, tt.in), tt.maxBytes); err != tt.wantErr {
+				t.Errorf("decode() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_appendHeader(t *testing.T) {
+	b := appendHeader(nil, "Sec-WebSocket-Protocol", "chat")
+	got, err := newDecoder().decode(b, DefaultMaxHeaderBytes)
+	if err != nil {
+		t.Fatalf("decode() error = %v", err)
+	}
+	want := []headerField{{"sec-websocket-protocol", "chat"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode() = %v, want %v", got, want)
+	}
+}
+
+// https://tools.ietf.org/html/rfc7541#appendix-C.1
+func Test_appendInt(t *testing.T) {
+	tests := []struct {
+		n      uint64
+		prefix uint
+		want   string
+	}{
+		{10, 5, "0a"},
+		{1337, 5, "1f9a0a"},
+		{42, 8, "2a"},
+	}
+	for _, tt := range tests {
+		b := appendInt(nil, tt.prefix, 0, tt.n)
+		if got := hex.EncodeToString(b); got != tt.want {
+			t.Errorf("appendInt(%d, %d) = %s, want %s", tt.n, tt.prefix, got, tt.want)
+		}
+		n, rest, err := readInt(b, tt.prefix)
+		if err != nil || n != tt.n || len(rest) != 0 {
+			t.Errorf("readInt(%s) = %d, %x, %v", tt.want, n, rest, err)
+		}
+	}
+}
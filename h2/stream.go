@@ -0,0 +1,267 @@
+package h2
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+)
+
+// Stream is a stream of a connection. Read and Write carry the DATA
+// frames, so that a tunnel opened by CONNECT works as a net.Conn.
+type Stream struct {
+	ID uint32
+	c  *Conn
+
+	wmu sync.Mutex // serializes Write and Close
+
+	// guarded by c.mu
+	buf           []byte // received data not read yet
+	unacked       int    // bytes read but not credited to the peer
+	sendWindow    int64
+	remoteEnded   bool // END_STREAM received
+	localEnded    bool // END_STREAM sent
+	closed        bool // Close called
+	err           error
+	response      *minwshttp.ClientResponse
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+// newStream registers a stream. It must be called with c.mu held.
+func (c *Conn) newStream(id uint32) *Stream {
+	st := &Stream{ID: id, c: c, sendWindow: c.initialWindow}
+	c.streams[id] = st
+	return st
+}
+
+// removeIfDone forgets the stream once both sides have ended it. It must
+// be called with c.mu held.
+func (c *Conn) removeIfDone(st *Stream) {
+	if st.remoteEnded && st.localEnded {
+		delete(c.streams, st.ID)
+		c.cond.Broadcast()
+	}
+}
+
+// resetStream sends RST_STREAM and fails the stream
+func (c *Conn) resetStream(id uint32, code ErrCode) {
+	c.mu.Lock()
+	if st, ok := c.streams[id]; ok {
+		if st.err == nil {
+			st.err = &StreamError{id, code}
+		}
+		delete(c.streams, id)
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+	c.write(appendUint32Frame(nil, frameRSTStream, id, uint32(code)))
+}
+
+// Respond sends the response header. A tunnel is established by a 2xx
+// response to CONNECT.
+func (st *Stream) Respond(status int, header minwshttp.Header) error {
+	block := appendHeader(nil, ":status", strconv.Itoa(status))
+	for k, v := range header {
+		if !isConnectionHeader(k) && !strings.EqualFold(k, "host") {
+			block = appendHeader(block, k, v)
+		}
+	}
+	return st.c.writeHeaders(st.ID, block, false)
+}
+
+// Reset aborts the stream with the error code
+func (st *Stream) Reset(code ErrCode) {
+	st.c.resetStream(st.ID, code)
+}
+
+// Read reads DATA of the stream. io.EOF is returned once the peer has
+// ended the stream.
+func (st *Stream) Read(p []byte) (int, error) {
+	c := st.c
+	c.mu.Lock()
+	for len(st.buf) == 0 {
+		switch {
+		case st.closed:
+			c.mu.Unlock()
+			return 0, errStreamClosed
+		case st.remoteEnded:
+			c.mu.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			err := st.err
+			c.mu.Unlock()
+			return 0, err
+		case st.readDeadline.expired():
+			c.mu.Unlock()
+			return 0, timeoutError{}
+		}
+		c.cond.Wait()
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	st.unacked += n
+	// the window is credited in bulk rather than per read
+	var credit int
+	if st.unacked >= DefaultWindowSize/2 && !st.remoteEnded && st.err == nil {
+		credit, st.unacked = st.unacked, 0
+	}
+	c.mu.Unlock()
+
+	if credit > 0 {
+		c.write(appendUint32Frame(nil, frameWindowUpdate, st.ID, uint32(credit)))
+	}
+	return n, nil
+}
+
+// Write sends p in DATA frames as the flow control windows allow
+func (st *Stream) Write(p []byte) (int, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	c := st.c
+	written := 0
+	for len(p) > 0 {
+		c.mu.Lock()
+		for st.sendWindow <= 0 || c.sendWindow <= 0 {
+			if err := st.writeError(); err != nil {
+				c.mu.Unlock()
+				return written, err
+			}
+			c.cond.Wait()
+		}
+		if err := st.writeError(); err != nil {
+			c.mu.Unlock()
+			return written, err
+		}
+		n := int64(len(p))
+		for _, max := range []int64{st.sendWindow, c.sendWindow, int64(c.maxFrameSize)} {
+			if n > max {
+				n = max
+			}
+		}
+		st.sendWindow -= n
+		c.sendWindow -= n
+		c.mu.Unlock()
+
+		if err := c.writeFrame(frameData, 0, st.ID, p[:n]); err != nil {
+			return written, err
+		}
+		p = p[n:]
+		written += int(n)
+	}
+	return written, nil
+}
+
+// writeError returns the error which stops writing. It must be called
+// with c.mu held.
+func (st *Stream) writeError() error {
+	switch {
+	case st.closed:
+		return errStreamClosed
+	case st.localEnded:
+		return errStreamLocallyEnded
+	case st.err != nil:
+		return st.err
+	case st.writeDeadline.expired():
+		return timeoutError{}
+	}
+	return nil
+}
+
+// Close ends the stream with END_STREAM, like an orderly close of a TCP
+// connection. Data received later is discarded.
+// https://tools.ietf.org/html/rfc8441#section-5
+func (st *Stream) Close() error {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	c := st.c
+	c.mu.Lock()
+	if st.closed {
+		c.mu.Unlock()
+		return errStreamClosed
+	}
+	st.closed = true
+	st.buf = nil
+	end := !st.localEnded && st.err == nil
+	st.localEnded = true
+	c.removeIfDone(st)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if end {
+		return c.writeFrame(frameData, flagEndStream, st.ID, nil)
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (st *Stream) LocalAddr() net.Addr {
+	return st.c.rwc.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.c.rwc.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.c.mu.Lock()
+	defer st.c.mu.Unlock()
+	st.readDeadline.set(t, st.c)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. It bounds the wait for the flow
+// control window.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.c.mu.Lock()
+	defer st.c.mu.Unlock()
+	st.writeDeadline.set(t, st.c)
+	return nil
+}
+
+// deadline wakes up waiters of the connection when it passes
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+// set must be called with c.mu held
+func (d *deadline) set(t time.Time, c *Conn) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.t = t
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+}
+
+func (d *deadline) expired() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
+// timeoutError is returned when a deadline passes. It is a net.Error, so
+// that the ws package tells it from broken connections.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "h2: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
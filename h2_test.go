@@ -0,0 +1,124 @@
+package minws
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cou929/minws/h2"
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// serveH2 runs ServeH2 of u with an echo handler on a loopback listener
+func serveH2(t *testing.T, u *Upgrader) *h2.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go u.ServeH2(conn, func(c *ws.Conn, req *minwshttp.Request) {
+				echo(c)
+				c.Rwc.Close()
+			})
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc, err := h2.NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hc.Close() })
+	return hc
+}
+
+func TestDialer_DialH2(t *testing.T) {
+	hc := serveH2(t, &Upgrader{})
+
+	// the sockets share the connection
+	var conns []*ws.Conn
+	for i := 0; i < 3; i++ {
+		c, res, err := (&Dialer{}).DialH2(hc, "ws://example.com/chat")
+		if err != nil {
+			t.Fatalf("DialH2() error = %v", err)
+		}
+		if res.StatusCode != minwshttp.StatusOK {
+			t.Errorf("DialH2() status = %d", res.StatusCode)
+		}
+		defer c.Rwc.Close()
+		conns = append(conns, c)
+	}
+	msg := make([]byte, 70000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	for i, c := range conns {
+		if err := c.SendBinaryMessage(msg[i:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range conns {
+		got, err := c.ReadBinaryMessage()
+		if err != nil {
+			t.Fatalf("ReadBinaryMessage() error = %v", err)
+		}
+		if string(got) != string(msg[i:]) {
+			t.Errorf("socket %d: echoed message differs", i)
+		}
+	}
+}
+
+func TestDialer_DialH2_Subprotocol(t *testing.T) {
+	hc := serveH2(t, &Upgrader{Subprotocols: []string{"chat", "superchat"}})
+
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{"superchat", "chat"}, "chat"},
+		{[]string{"soap"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		c, _, err := (&Dialer{Subprotocols: tt.offered}).DialH2(hc, "ws://example.com/")
+		if err != nil {
+			t.Fatalf("DialH2() with %v error = %v", tt.offered, err)
+		}
+		if c.Subprotocol != tt.want {
+			t.Errorf("DialH2() with %v Subprotocol = %q, want %q", tt.offered, c.Subprotocol, tt.want)
+		}
+		c.Rwc.Close()
+	}
+}
+
+func TestUpgrader_ServeH2_Origins(t *testing.T) {
+	hc := serveH2(t, &Upgrader{Origins: []string{"https://example.com"}})
+
+	tests := []struct {
+		origin     string
+		wantStatus int
+	}{
+		{"https://example.com", minwshttp.StatusOK},
+		{"https://evil.example", minwshttp.StatusForbidden},
+	}
+	for _, tt := range tests {
+		d := &Dialer{Header: minwshttp.Header{"Origin": tt.origin}}
+		c, res, err := d.DialH2(hc, "ws://example.com/")
+		if res == nil || res.StatusCode != tt.wantStatus {
+			t.Errorf("DialH2() with Origin %q response = %+v, error = %v", tt.origin, res, err)
+		}
+		if err == nil {
+			c.Rwc.Close()
+		}
+	}
+}
@@ -3,10 +3,12 @@ package minws
 import (
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"strings"
+	"time"
 
 	minwshttp "github.com/cou929/minws/http"
 	"github.com/cou929/minws/ws"
@@ -14,31 +16,108 @@ import (
 
 const magicStr = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
+// ErrNotWebSocket is returned by Upgrade when the connection has been
+// used only for requests served by Fallback, and closed
+var ErrNotWebSocket = errors.New("not a websocket handshake request")
+
+// Upgrader holds options of the server side opening handshake
+type Upgrader struct {
+	// Subprotocols are supported by the server in order of preference.
+	// If empty, the first subprotocol offered by the client is accepted.
+	Subprotocols []string
+	// Negotiate, if set, is called after the request is validated and
+	// returns the subprotocol instead of Subprotocols, e.g. the one agreed
+	// with a backend. If it returns an error, the handshake fails with the
+	// status of *minwshttp.RequestError, or 502 for other errors.
+	Negotiate func(req *minwshttp.Request) (string, error)
+	// Origins, if not empty, are the allowed values of the Origin header
+	// compared case-insensitively. Requests from other origins are
+	// rejected with 403. Requests without Origin, which are not sent by
+	// browsers, are accepted.
+	Origins []string
+	// Timeout limits the time to read each request, and to send each
+	// response. Fallback can lift it for a streamed response with
+	// minwshttp.WriteDeadliner.
+	Timeout time.Duration
+	// Fallback, if set, serves requests without "Upgrade: websocket", e.g.
+	// static files of the page using the socket. Keep-alive connections
+	// are served until a handshake request arrives or they are closed.
+	Fallback minwshttp.Handler
+	// IdleTimeout limits the wait for the next request on keep-alive
+	// connections. The default is minwshttp.DefaultIdleTimeout.
+	IdleTimeout time.Duration
+}
+
 // HandShake establishes websocket connection
 func HandShake(tcpConn net.Conn) (*ws.Conn, error) {
+	return (&Upgrader{}).HandShake(tcpConn)
+}
+
+// HandShake establishes websocket connection. The agreed subprotocol is
+// set to Subprotocol of the returned Conn.
+func (u *Upgrader) HandShake(tcpConn net.Conn) (*ws.Conn, error) {
+	c, _, err := u.Upgrade(tcpConn)
+	return c, err
+}
+
+// Upgrade is like HandShake but also returns the opening handshake
+// request, so that the application can see its path and headers
+func (u *Upgrader) Upgrade(tcpConn net.Conn) (*ws.Conn, *minwshttp.Request, error) {
 	httpConn := minwshttp.NewConn(tcpConn)
+	httpConn.ReadTimeout = u.Timeout
+	httpConn.WriteTimeout = u.Timeout
+	if u.IdleTimeout > 0 {
+		httpConn.IdleTimeout = u.IdleTimeout
+	}
 
-	res, err := httpConn.ReadRequest()
-	if err != nil {
-		return nil, fmt.Errorf("failed to readRequest %w", err)
+	var res *minwshttp.Response
+	for {
+		var err error
+		if res, err = httpConn.ReadRequest(); err != nil {
+			tcpConn.Close()
+			if err == io.EOF && httpConn.Requests() > 0 {
+				// the keep-alive connection served by Fallback is over
+				return nil, nil, ErrNotWebSocket
+			}
+			return nil, nil, fmt.Errorf("failed to readRequest %w", err)
+		}
+		if u.Fallback == nil || isUpgradeRequest(res.Req) {
+			break
+		}
+		u.Fallback.ServeHTTP(res, res.Req)
+		res.FinishRequest()
 	}
-	err = handleHandShake(res, res.Req)
+
+	proto, err := u.handleHandShake(res, res.Req)
+	res.FinishRequest()
 	if err != nil {
-		log.Printf("Failed to complete handshake %v", err)
+		tcpConn.Close()
+		return nil, res.Req, fmt.Errorf("failed to complete handshake %w", err)
 	}
-	res.FinishRequest()
 
-	wsConn := ws.NewConn(tcpConn)
+	if u.Timeout > 0 {
+		tcpConn.SetDeadline(time.Time{})
+	}
+	rwc, r := httpConn.Hijack()
+	wsConn := ws.NewServerConn(rwc, r)
+	wsConn.Subprotocol = proto
 
-	return wsConn, nil
+	return wsConn, res.Req, nil
 }
 
-func handleHandShake(w minwshttp.ResponseWriter, req *minwshttp.Request) error {
+func (u *Upgrader) handleHandShake(w minwshttp.ResponseWriter, req *minwshttp.Request) (string, error) {
 	if err := validateRequest(req); err != nil {
 		w.SetStatus(minwshttp.StatusBadRequest)
 		w.SetHeader("Connection", "close")
 		fmt.Fprintf(w, "%s\n", err)
-		return err
+		return "", err
+	}
+	proto, status, err := u.accept(req)
+	if err != nil {
+		w.SetStatus(status)
+		w.SetHeader("Connection", "close")
+		fmt.Fprintf(w, "%s\n", err)
+		return "", err
 	}
 
 	w.SetStatus(minwshttp.StatusSwitchingProtocols)
@@ -46,15 +125,84 @@ func handleHandShake(w minwshttp.ResponseWriter, req *minwshttp.Request) error {
 	w.SetHeader("Connection", "Upgrade")
 	swa := calcSecWebsocketAccept(req.Header.Get("Sec-WebSocket-Key"))
 	w.SetHeader("Sec-WebSocket-Accept", swa)
-	if req.Header.Has("Sec-WebSocket-Protocol") {
-		// todo: check protocol to support
-		// todo: handle multiple proto case
-		w.SetHeader("Sec-WebSocket-Protocol", req.Header.Get("Sec-WebSocket-Protocol"))
+	if proto != "" {
+		w.SetHeader("Sec-WebSocket-Protocol", proto)
 	}
 	// todo: handle Sec-WebSocket-Extensions
 	// todo: handle Sec-WebSocket-Version
 
-	return nil
+	return proto, nil
+}
+
+// accept checks the origin of a handshake request and selects the
+// subprotocol. It applies to both HTTP/1.1 and HTTP/2. On error, status
+// is that of the response.
+func (u *Upgrader) accept(req *minwshttp.Request) (string, int, error) {
+	if !u.checkOrigin(req.Header.Get("Origin")) {
+		return "", minwshttp.StatusForbidden, fmt.Errorf("origin %q not allowed", req.Header.Get("Origin"))
+	}
+	if u.Negotiate == nil {
+		return u.selectSubprotocol(parseTokenList(req.Header.Get("Sec-WebSocket-Protocol"))), 0, nil
+	}
+	proto, err := u.Negotiate(req)
+	if err != nil {
+		status := minwshttp.StatusBadGateway
+		var rerr *minwshttp.RequestError
+		if errors.As(err, &rerr) {
+			status = rerr.Status
+		}
+		return "", status, err
+	}
+	return proto, 0, nil
+}
+
+// checkOrigin reports whether the origin is allowed
+// https://tools.ietf.org/html/rfc6455#section-10.2
+func (u *Upgrader) checkOrigin(origin string) bool {
+	if len(u.Origins) == 0 || origin == "" {
+		return true
+	}
+	for _, o := range u.Origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectSubprotocol returns the most preferred subprotocol offered by the
+// client, or "" if none is supported
+// https://tools.ietf.org/html/rfc6455#section-4.2.2
+func (u *Upgrader) selectSubprotocol(offered []string) string {
+	if len(u.Subprotocols) == 0 {
+		if len(offered) > 0 {
+			return offered[0]
+		}
+		return ""
+	}
+	for _, p := range u.Subprotocols {
+		for _, o := range offered {
+			if p == o {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// parseTokenList parses comma separated header value
+func parseTokenList(v string) []string {
+	var res []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func isUpgradeRequest(req *minwshttp.Request) bool {
+	return strings.Contains(strings.ToLower(req.Header.Get("Upgrade")), "websocket")
 }
 
 func validateRequest(req *minwshttp.Request) error {
@@ -0,0 +1,172 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxChunkLineBytes limits the length of a chunk size line with extensions
+const maxChunkLineBytes = 4 << 10
+
+// noBody is the body of requests without one
+var noBody io.Reader = eofReader{}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// setBody sets the body of the request according to its framing
+// https://tools.ietf.org/html/rfc7230#section-3.3.3
+func (c *Conn) setBody(req *Request) error {
+	te, hasTE := req.Header.lookup("Transfer-Encoding")
+	cl, hasCL := req.Header.lookup("Content-Length")
+
+	switch {
+	case hasTE && hasCL:
+		// a request with both may be used for request smuggling
+		return badRequest("both Transfer-Encoding and Content-Length")
+	case hasTE:
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return &RequestError{StatusNotImplemented, "unsupported Transfer-Encoding " + te}
+		}
+		req.ContentLength = -1
+		req.Body = &chunkedReader{c: c, req: req}
+	case hasCL:
+		n, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+		if err != nil || n < 0 || strings.HasPrefix(cl, "+") {
+			return badRequest("Invalid Content-Length %q", cl)
+		}
+		req.ContentLength = n
+		req.Body = &lengthReader{r: c.r, n: n}
+	default:
+		req.Body = noBody
+	}
+	if req.Body != noBody && req.ProtoMajor == 1 && req.ProtoMinor >= 1 &&
+		strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		req.Body = &continueReader{c: c, r: req.Body}
+	}
+	return nil
+}
+
+var continueLine = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// continueReader sends the interim response 100 Continue on the first
+// read, so that the client waiting for it sends the body
+// https://tools.ietf.org/html/rfc7231#section-5.1.1
+type continueReader struct {
+	c    *Conn
+	r    io.Reader
+	sent bool
+}
+
+func (cr *continueReader) Read(p []byte) (int, error) {
+	if !cr.sent && !cr.c.responded {
+		if _, err := cr.c.rwc.Write(continueLine); err != nil {
+			return 0, err
+		}
+		cr.sent = true
+	}
+	return cr.r.Read(p)
+}
+
+// lengthReader reads n bytes, and fails if the connection ends before
+type lengthReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *lengthReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if err == io.EOF && lr.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// chunkedReader decodes the chunked transfer coding
+// https://tools.ietf.org/html/rfc7230#section-4.1
+type chunkedReader struct {
+	c   *Conn
+	req *Request
+	n   int64 // bytes left in the current chunk
+	err error
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for cr.err == nil && cr.n == 0 {
+		cr.err = cr.beginChunk()
+	}
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if int64(len(p)) > cr.n {
+		p = p[:cr.n]
+	}
+	n, err := cr.c.r.Read(p)
+	cr.n -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && cr.n == 0 {
+		err = cr.endChunk()
+	}
+	cr.err = err
+	return n, err
+}
+
+// beginChunk reads the size line of the next chunk. The trailer is read
+// after the last chunk, and io.EOF is returned.
+func (cr *chunkedReader) beginChunk() error {
+	line, err := cr.c.readLineByteSlice(maxChunkLineBytes)
+	if err != nil {
+		return chunkError(err)
+	}
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i] // chunk extensions are ignored
+	}
+	size := string(bytes.TrimRight(line, " \t"))
+	if size == "" || len(size) > 16 {
+		return errors.New("invalid chunk size")
+	}
+	n, err := strconv.ParseUint(size, 16, 64)
+	if err != nil || n > 1<<62 {
+		return errors.New("invalid chunk size")
+	}
+	if n == 0 {
+		if cr.req.Trailer, err = cr.c.readHeader(); err != nil {
+			return chunkError(err)
+		}
+		return io.EOF
+	}
+	cr.n = int64(n)
+	return nil
+}
+
+// endChunk reads CRLF after the chunk data
+func (cr *chunkedReader) endChunk() error {
+	line, err := cr.c.readLineByteSlice(2)
+	if err != nil {
+		return chunkError(err)
+	}
+	if len(line) != 0 {
+		return errors.New("missing CRLF after chunk")
+	}
+	return nil
+}
+
+func chunkError(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
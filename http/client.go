@@ -0,0 +1,80 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ClientResponse represents HTTP response received by client
+type ClientResponse struct {
+	Proto      string
+	ProtoMajor int
+	ProtoMinor int
+	StatusCode int
+	Status     string // reason phrase
+	Header     Header
+}
+
+// WriteClientRequest writes request line and headers of a request without
+// body
+func WriteClientRequest(w *bufio.Writer, method, requestURI string, header Header) error {
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", method, requestURI)
+	for k, v := range header {
+		fmt.Fprintf(w, "%s: %s\r\n", k, v)
+	}
+	w.Write(crlf)
+	return w.Flush()
+}
+
+// ReadClientResponse reads status line and headers of response from r.
+// The same limits as requests are applied.
+func ReadClientResponse(r *bufio.Reader) (*ClientResponse, error) {
+	c := &Conn{
+		r:                   r,
+		MaxRequestLineBytes: DefaultMaxRequestLineBytes,
+		MaxHeaderBytes:      DefaultMaxHeaderBytes,
+		MaxHeaderCount:      DefaultMaxHeaderCount,
+	}
+
+	line, err := c.readLineByteSlice(c.MaxRequestLineBytes)
+	if err != nil {
+		return nil, err
+	}
+	res := &ClientResponse{}
+	var ok bool
+	res.Proto, res.StatusCode, res.Status, ok = parseStatusLine(string(line))
+	if !ok {
+		return nil, fmt.Errorf("Invalid status line %q", line)
+	}
+	if res.ProtoMajor, res.ProtoMinor, ok = parseHTTPVersion(res.Proto); !ok {
+		return nil, fmt.Errorf("Invalid proto version %q", res.Proto)
+	}
+
+	res.Header, err = c.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func parseStatusLine(line string) (proto string, code int, status string, ok bool) {
+	s1 := strings.Index(line, " ")
+	if s1 < 0 {
+		return
+	}
+	proto, rest := line[:s1], line[s1+1:]
+	codeStr := rest
+	if s2 := strings.Index(rest, " "); s2 >= 0 {
+		codeStr, status = rest[:s2], rest[s2+1:]
+	}
+	if len(codeStr) != 3 {
+		return
+	}
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || code < 100 {
+		return
+	}
+	return proto, code, status, true
+}
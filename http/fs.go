@@ -0,0 +1,135 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TimeFormat is the format of dates in headers like Last-Modified
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// sniffLen is the length of the content read to guess its media type
+const sniffLen = 512
+
+// FileServer serves files under Root to GET and HEAD requests. A request
+// for a directory is served with its index.html. Paths are cleaned before
+// joined to Root, so that no file outside of it is served.
+type FileServer struct {
+	Root string
+}
+
+// ServeHTTP implements Handler
+func (fs *FileServer) ServeHTTP(w ResponseWriter, req *Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.SetHeader("Allow", "GET, HEAD")
+		writeStatus(w, StatusMethodNotAllowed)
+		return
+	}
+	u, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil || !strings.HasPrefix(u.Path, "/") || strings.ContainsAny(u.Path, "\x00\\") {
+		writeStatus(w, StatusBadRequest)
+		return
+	}
+	// Clean removes ".." which climbs above the root
+	name := path.Clean("/" + u.Path)
+
+	file := filepath.Join(fs.Root, filepath.FromSlash(name))
+	fi, err := os.Stat(file)
+	if err == nil && fi.IsDir() {
+		// relative links in index.html need the trailing slash
+		if !strings.HasSuffix(u.Path, "/") {
+			target := path.Base(u.Path) + "/"
+			if u.RawQuery != "" {
+				target += "?" + u.RawQuery
+			}
+			w.SetHeader("Location", target)
+			writeStatus(w, StatusMovedPermanently)
+			return
+		}
+		file = filepath.Join(file, "index.html")
+		fi, err = os.Stat(file)
+	}
+	if err != nil || fi.IsDir() {
+		writeFileError(w, err)
+		return
+	}
+
+	modtime := fi.ModTime().UTC().Truncate(time.Second)
+	w.SetHeader("Last-Modified", modtime.Format(TimeFormat))
+	if ims, err := time.Parse(TimeFormat, req.Header.Get("If-Modified-Since")); err == nil && !modtime.After(ims) {
+		w.SetStatus(StatusNotModified)
+		w.Write(nil)
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		writeFileError(w, err)
+		return
+	}
+	w.SetHeader("Content-Type", contentType(file, head[:n]))
+	w.SetHeader("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	w.SetStatus(StatusOK)
+	if req.Method == "HEAD" {
+		return
+	}
+	// the body is streamed rather than buffered, as Content-Length is set
+	w.Write(head[:n])
+	io.Copy(w, f)
+}
+
+// contentType guesses the media type from the extension, or from the
+// content if the extension is unknown. body is the first sniffLen bytes
+// of the content at most.
+func contentType(name string, body []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	if len(body) == sniffLen {
+		// the last rune may continue after the sample
+		for i := 1; i < utf8.UTFMax; i++ {
+			if utf8.RuneStart(body[len(body)-i]) {
+				if !utf8.FullRune(body[len(body)-i:]) {
+					body = body[:len(body)-i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(body) && !strings.ContainsRune(string(body), 0) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+func writeFileError(w ResponseWriter, err error) {
+	switch {
+	case err == nil, os.IsNotExist(err):
+		writeStatus(w, StatusNotFound)
+	case os.IsPermission(err):
+		writeStatus(w, StatusForbidden)
+	default:
+		writeStatus(w, StatusInternalServerError)
+	}
+}
+
+func writeStatus(w ResponseWriter, code int) {
+	w.SetStatus(code)
+	fmt.Fprintf(w, "%d %s\n", code, StatusText(code))
+}
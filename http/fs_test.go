@@ -0,0 +1,203 @@
+package http
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRoot(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	files := map[string]string{
+		"secret.txt":          "secret",
+		"root/index.html":     "<h1>index</h1>",
+		"root/app.js":         "connect()",
+		"root/sub/index.html": "<h1>sub</h1>",
+		"root/empty/.keep":    "",
+		"root/data":           "\x00\x01\x02",
+		"root/note":           "plain text",
+	}
+	for name, body := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// serveFile sends a request to FileServer and returns the response
+func serveFile(t *testing.T, fs *FileServer, method, uri string, header Header) (*ClientResponse, string) {
+	t.Helper()
+	raw := method + " " + uri + " HTTP/1.1\r\nHost: localhost\r\n"
+	for k, v := range header {
+		raw += k + ": " + v + "\r\n"
+	}
+	tc := newTestConn(raw + "\r\n")
+	res, err := NewConn(tc).ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest() error = %v", err)
+	}
+	fs.ServeHTTP(res, res.Req)
+	res.FinishRequest()
+
+	r := bufio.NewReader(&tc.w)
+	cres, err := ReadClientResponse(r)
+	if err != nil {
+		t.Fatalf("ReadClientResponse() error = %v", err)
+	}
+	body, _ := ioutil.ReadAll(r)
+	return cres, string(body)
+}
+
+func TestFileServer(t *testing.T) {
+	fs := &FileServer{Root: newTestRoot(t)}
+	tests := []struct {
+		uri        string
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{"/", StatusOK, "text/html; charset=utf-8", "<h1>index</h1>"},
+		{"/index.html", StatusOK, "text/html; charset=utf-8", "<h1>index</h1>"},
+		{"/app.js?v=1", StatusOK, "text/javascript; charset=utf-8", "connect()"},
+		{"/sub/", StatusOK, "text/html; charset=utf-8", "<h1>sub</h1>"},
+		{"/%73ub/index.html", StatusOK, "text/html; charset=utf-8", "<h1>sub</h1>"},
+		{"/data", StatusOK, "application/octet-stream", "\x00\x01\x02"},
+		{"/note", StatusOK, "text/plain; charset=utf-8", "plain text"},
+		{"/empty/", StatusNotFound, "", ""},
+		{"/missing", StatusNotFound, "", ""},
+		{"/../secret.txt", StatusNotFound, "", ""},
+		{"/sub/../../secret.txt", StatusNotFound, "", ""},
+		{"/%2e%2e/secret.txt", StatusNotFound, "", ""},
+		{"/..%2fsecret.txt", StatusNotFound, "", ""},
+		{"/..\\secret.txt", StatusBadRequest, "", ""},
+		{"*", StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		res, body := serveFile(t, fs, "GET", tt.uri, nil)
+		if res.StatusCode != tt.wantStatus {
+			t.Errorf("GET %s status = %d, want %d", tt.uri, res.StatusCode, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != StatusOK {
+			continue
+		}
+		// .js is text/javascript or application/javascript by platform
+		if got := res.Header.Get("Content-Type"); got != tt.wantType && !strings.HasSuffix(tt.uri, ".js?v=1") {
+			t.Errorf("GET %s Content-Type = %q, want %q", tt.uri, got, tt.wantType)
+		}
+		if body != tt.wantBody {
+			t.Errorf("GET %s body = %q, want %q", tt.uri, body, tt.wantBody)
+		}
+	}
+}
+
+func TestFileServer_Redirect(t *testing.T) {
+	fs := &FileServer{Root: newTestRoot(t)}
+	res, _ := serveFile(t, fs, "GET", "/sub?a=1", nil)
+	if res.StatusCode != StatusMovedPermanently || res.Header.Get("Location") != "sub/?a=1" {
+		t.Errorf("GET /sub = %d Location %q, want 301 sub/?a=1", res.StatusCode, res.Header.Get("Location"))
+	}
+}
+
+func TestFileServer_Head(t *testing.T) {
+	fs := &FileServer{Root: newTestRoot(t)}
+	res, body := serveFile(t, fs, "HEAD", "/note", nil)
+	if res.StatusCode != StatusOK || res.Header.Get("Content-Length") != "10" || body != "" {
+		t.Errorf("HEAD = %d, Content-Length %q, body %q, want 200, 10, empty",
+			res.StatusCode, res.Header.Get("Content-Length"), body)
+	}
+
+	// the file is not read for HEAD
+	rec := &recorder{}
+	fs.ServeHTTP(rec, &Request{Method: "HEAD", RequestURI: "/note", Header: Header{}})
+	if rec.written != 0 {
+		t.Errorf("HEAD wrote %d bytes of body", rec.written)
+	}
+
+	res, _ = serveFile(t, fs, "POST", "/note", nil)
+	if res.StatusCode != StatusMethodNotAllowed || res.Header.Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST = %d, Allow %q, want 405", res.StatusCode, res.Header.Get("Allow"))
+	}
+}
+
+func TestFileServer_IfModifiedSince(t *testing.T) {
+	root := newTestRoot(t)
+	modtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "note"), modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileServer{Root: root}
+
+	res, _ := serveFile(t, fs, "GET", "/note", nil)
+	if got, want := res.Header.Get("Last-Modified"), "Thu, 02 Jan 2020 03:04:05 GMT"; got != want {
+		t.Errorf("Last-Modified = %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		since      string
+		wantStatus int
+	}{
+		{"Thu, 02 Jan 2020 03:04:05 GMT", StatusNotModified},
+		{"Fri, 03 Jan 2020 00:00:00 GMT", StatusNotModified},
+		{"Thu, 02 Jan 2020 03:04:04 GMT", StatusOK},
+		{"invalid", StatusOK},
+	}
+	for _, tt := range tests {
+		res, body := serveFile(t, fs, "GET", "/note", Header{"If-Modified-Since": tt.since})
+		if res.StatusCode != tt.wantStatus {
+			t.Errorf("If-Modified-Since %s: status = %d, want %d", tt.since, res.StatusCode, tt.wantStatus)
+		}
+		if tt.wantStatus == StatusNotModified && (body != "" || res.Header.Has("Content-Length")) {
+			t.Errorf("304 has body %q, Content-Length %q", body, res.Header.Get("Content-Length"))
+		}
+	}
+}
+
+// recorder is a ResponseWriter counting the body written
+type recorder struct {
+	status  int
+	written int
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.written += len(p)
+	return len(p), nil
+}
+
+func (r *recorder) SetStatus(code int)          { r.status = code }
+func (r *recorder) SetHeader(key, value string) {}
+
+func Test_contentType(t *testing.T) {
+	text := strings.Repeat("a", sniffLen-1)
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"note", "plain text", "text/plain; charset=utf-8"},
+		{"data", "\x00\x01", "application/octet-stream"},
+		{"data", "\xff", "application/octet-stream"},
+		// a rune cut at the end of the sample
+		{"note", text + "\xce", "text/plain; charset=utf-8"},
+		{"note", text[1:] + "\xe3\x81", "text/plain; charset=utf-8"},
+		{"note", text + "\xff", "application/octet-stream"},
+		// invalid at the end of a short file
+		{"note", "a\xce", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := contentType(tt.name, []byte(tt.body)); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("contentType(%q, %q) = %q, want %q", tt.name, tt.body, got, tt.want)
+		}
+	}
+}
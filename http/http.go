@@ -3,8 +3,12 @@ package http
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,59 +19,245 @@ var (
 	colonSpace = []byte(": ")
 )
 
+// Default limits applied to incoming requests
+const (
+	DefaultMaxRequestLineBytes = 8 << 10
+	DefaultMaxHeaderBytes      = 64 << 10
+	DefaultMaxHeaderCount      = 100
+	DefaultIdleTimeout         = 60 * time.Second
+)
+
+// maxDrainBytes is the largest unread request body discarded to read the
+// next request. The connection is closed if the rest is larger.
+const maxDrainBytes = 256 << 10
+
 // NewConn is a constructor of minws HTTP connection
 func NewConn(rwc net.Conn) *Conn {
 	return &Conn{
-		rwc: rwc,
-		r:   bufio.NewReader(rwc),
+		rwc:                 rwc,
+		r:                   bufio.NewReader(rwc),
+		MaxRequestLineBytes: DefaultMaxRequestLineBytes,
+		MaxHeaderBytes:      DefaultMaxHeaderBytes,
+		MaxHeaderCount:      DefaultMaxHeaderCount,
+		IdleTimeout:         DefaultIdleTimeout,
 	}
 }
 
-// Conn is server-side HTTP connection
+// Conn is server-side HTTP connection. ReadRequest can be called
+// repeatedly to read keep-alive and pipelined requests, after the
+// response to the previous one is finished.
 type Conn struct {
 	rwc net.Conn
 	r   *bufio.Reader
+
+	// MaxRequestLineBytes limits the length of the request line (414 if exceeded)
+	MaxRequestLineBytes int
+	// MaxHeaderBytes limits the total size of header lines (431 if exceeded)
+	MaxHeaderBytes int
+	// MaxHeaderCount limits the number of header lines (431 if exceeded)
+	MaxHeaderCount int
+	// IdleTimeout limits the wait for the next request on a keep-alive
+	// connection. 0 means no limit.
+	IdleTimeout time.Duration
+	// ReadTimeout limits the time to read a request including its body,
+	// from the first byte of it. 0 means no limit.
+	ReadTimeout time.Duration
+	// WriteTimeout limits the time to send a response, from the first
+	// byte of it. 0 means no limit. A handler streaming a long response
+	// can change the deadline with SetWriteDeadline.
+	WriteTimeout time.Duration
+
+	nreq    int       // number of requests read
+	body    io.Reader // body of the last request, drained before the next
+	closing bool      // the last response asked to close the connection
+	// the final response to the last request has started, so that 100
+	// Continue must not be sent
+	responded bool
+}
+
+// RequestError is an error caused by a malformed or oversized request.
+// Status is the HTTP status code sent back to the client.
+type RequestError struct {
+	Status int
+	Msg    string
 }
 
-// ReadRequest parses request
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, StatusText(e.Status), e.Msg)
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return &RequestError{StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// ReadRequest parses request.
+// If the request is malformed, an error response is sent to the client
+// and *RequestError is returned. io.EOF is returned when the connection
+// is not to be reused: the client closed it, the last response has
+// "Connection: close", or no request arrives within IdleTimeout.
 func (c *Conn) ReadRequest() (*Response, error) {
+	if c.closing {
+		return nil, io.EOF
+	}
+	if cr, ok := c.body.(*continueReader); ok && !cr.sent {
+		// the client may or may not send the body without 100 Continue
+		c.closing = true
+		return nil, io.EOF
+	}
+	if c.body != nil {
+		// the rest of the last body precedes the next request
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(c.body, maxDrainBytes+1))
+		c.body = nil
+		if err != nil || n > maxDrainBytes {
+			c.closing = true
+			return nil, io.EOF
+		}
+	}
+	if c.nreq > 0 {
+		if c.IdleTimeout > 0 {
+			c.rwc.SetReadDeadline(time.Now().Add(c.IdleTimeout))
+		}
+		if _, err := c.r.Peek(1); err != nil {
+			return nil, io.EOF
+		}
+		if c.ReadTimeout <= 0 {
+			c.rwc.SetReadDeadline(time.Time{})
+		}
+	}
+	if c.ReadTimeout > 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+	c.nreq++
+	c.responded = false
+
+	req, err := c.readRequest()
+	if err != nil {
+		var rerr *RequestError
+		if errors.As(err, &rerr) {
+			c.writeError(rerr)
+		}
+		return nil, err
+	}
+	c.body = req.Body
+
+	res := &Response{
+		Req:    req,
+		w:      bufio.NewWriter(c.rwc),
+		c:      c,
+		header: make(Header),
+	}
+
+	return res, nil
+}
+
+func (c *Conn) readRequest() (*Request, error) {
 	req := &Request{}
 
-	firstLine, err := c.readLineByteSlice()
+	firstLine, err := c.readLineByteSlice(c.MaxRequestLineBytes)
+	if err == errLineTooLong {
+		return nil, &RequestError{StatusRequestURITooLong, "request line too long"}
+	}
 	if err != nil {
 		return nil, err
 	}
 	var ok bool
 	req.Method, req.RequestURI, req.Proto, ok = parseRequestLine(string(firstLine))
 	if !ok {
-		return nil, fmt.Errorf("Invalid first line %s", string(firstLine))
+		return nil, badRequest("Invalid first line %q", firstLine)
+	}
+	if !validToken(req.Method) {
+		return nil, badRequest("Invalid method %q", req.Method)
+	}
+	if req.RequestURI == "" || strings.IndexFunc(req.RequestURI, isCTLOrSpace) >= 0 {
+		return nil, badRequest("Invalid request uri %q", req.RequestURI)
 	}
 	if req.ProtoMajor, req.ProtoMinor, ok = parseHTTPVersion(req.Proto); !ok {
-		return nil, fmt.Errorf("Invalid proto version %s", req.Proto)
+		return nil, badRequest("Invalid proto version %q", req.Proto)
 	}
 
 	req.Header, err = c.readHeader()
 	if err != nil {
 		return nil, err
 	}
+	if err := c.setBody(req); err != nil {
+		return nil, err
+	}
+	req.Close = shouldClose(req.ProtoMajor, req.ProtoMinor, req.Header)
+
+	return req, nil
+}
+
+// Requests returns the number of requests read
+func (c *Conn) Requests() int {
+	return c.nreq
+}
+
+// Serve reads requests and responds with h until the connection is not to
+// be reused, and then closes it. Requests after "Upgrade" ones are not
+// read, since the protocol has been switched.
+func (c *Conn) Serve(h Handler) error {
+	defer c.rwc.Close()
+	for {
+		res, err := c.ReadRequest()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		h.ServeHTTP(res, res.Req)
+		res.FinishRequest()
+		if res.status == StatusSwitchingProtocols {
+			return nil
+		}
+	}
+}
 
+// Hijack returns the underlying connection and the reader which may have
+// buffered bytes after the last request, e.g. WebSocket frames sent right
+// after the opening handshake. The Conn must not be used after that.
+func (c *Conn) Hijack() (net.Conn, *bufio.Reader) {
+	c.closing = true
+	return c.rwc, c.r
+}
+
+// shouldClose reports whether the client asks to close the connection
+// after the response
+// https://tools.ietf.org/html/rfc7230#section-6.3
+func shouldClose(major, minor int, h Header) bool {
+	if major < 1 || (major == 1 && minor == 0) {
+		return !headerValueContainsToken([]string{h.Get("Connection")}, "keep-alive")
+	}
+	return headerValueContainsToken([]string{h.Get("Connection")}, "close")
+}
+
+// writeError sends an error response and asks the client to close the connection
+func (c *Conn) writeError(e *RequestError) {
 	res := &Response{
-		Req:    req,
 		w:      bufio.NewWriter(c.rwc),
 		c:      c,
 		header: make(Header),
 	}
-
-	return res, nil
+	res.SetStatus(e.Status)
+	res.SetHeader("Connection", "close")
+	fmt.Fprintf(res, "%s\n", e.Msg)
+	res.FinishRequest()
 }
 
-func (c *Conn) readLineByteSlice() ([]byte, error) {
+// readLineByteSlice reads a line without CRLF.
+// It returns errLineTooLong if the line exceeds limit bytes (0 means no limit).
+func (c *Conn) readLineByteSlice(limit int) ([]byte, error) {
 	var line []byte
 	for {
 		l, more, err := c.r.ReadLine()
 		if err != nil {
 			return nil, err
 		}
+		if limit > 0 && len(line)+len(l) > limit {
+			return nil, errLineTooLong
+		}
 		line = append(line, l...)
 		if !more {
 			break
@@ -76,47 +266,125 @@ func (c *Conn) readLineByteSlice() ([]byte, error) {
 	return line, nil
 }
 
+// readHeader reads header fields. Keys are kept as received, and the
+// values of repeated fields are combined with ", ". Content-Length and
+// Transfer-Encoding must not be repeated, as a proxy in front may frame
+// the body by another of the values.
+// https://tools.ietf.org/html/rfc7230#section-3.2.2
 func (c *Conn) readHeader() (Header, error) {
 	res := make(Header)
+	keys := make(map[string]string) // lower-cased key to the key in res
+	total, count := 0, 0
 	for {
-		kv, err := c.readLineByteSlice()
-		if len(kv) == 0 {
+		remain := 0
+		if c.MaxHeaderBytes > 0 {
+			remain = c.MaxHeaderBytes - total
+			if remain <= 0 {
+				return res, &RequestError{StatusRequestHeaderFieldsTooLarge, "header too large"}
+			}
+		}
+		kv, err := c.readLineByteSlice(remain)
+		if err == errLineTooLong {
+			return res, &RequestError{StatusRequestHeaderFieldsTooLarge, "header too large"}
+		}
+		if err != nil {
 			return res, err
 		}
+		if len(kv) == 0 {
+			return res, nil
+		}
+		total += len(kv) + len(crlf)
+		count++
+		if c.MaxHeaderCount > 0 && count > c.MaxHeaderCount {
+			return res, &RequestError{StatusRequestHeaderFieldsTooLarge, "too many header fields"}
+		}
+
+		// obsolete line folding is rejected
+		// https://tools.ietf.org/html/rfc7230#section-3.2.4
+		if kv[0] == ' ' || kv[0] == '\t' {
+			return res, badRequest("obs-fold header line is not supported: %q", kv)
+		}
 
 		i := bytes.IndexByte(kv, ':')
 		if i < 0 {
-			return res, fmt.Errorf("Invalid header line: %s", kv)
+			return res, badRequest("Invalid header line: %q", kv)
 		}
-		// Todo: validation
 		key := string(kv[:i])
-		if key == "" {
-			return res, fmt.Errorf("Invalid header key: %s", kv)
+		if !validToken(key) {
+			return res, badRequest("Invalid header key: %q", kv)
 		}
 		// skip initial spaces in value
 		i++ // skip colon
 		for i < len(kv) && (kv[i] == ' ' || kv[i] == '\t') {
 			i++
 		}
-		value := string(kv[i:])
-		res[key] = value
-
-		if err != nil {
-			return res, err
+		value := strings.TrimRight(string(kv[i:]), " \t")
+		if !validHeaderValue(value) {
+			return res, badRequest("Invalid header value: %q", kv)
 		}
+		lower := strings.ToLower(key)
+		prev, ok := keys[lower]
+		if !ok {
+			keys[lower] = key
+			res[key] = value
+			continue
+		}
+		if lower == "content-length" || lower == "transfer-encoding" {
+			return res, badRequest("Repeated header %s", key)
+		}
+		res[prev] += ", " + value
 	}
 }
 
 func parseRequestLine(line string) (method, requestURI, proto string, ok bool) {
 	s1 := strings.Index(line, " ")
+	if s1 < 0 {
+		return
+	}
 	s2 := strings.Index(line[s1+1:], " ")
-	if s1 < 0 || s2 < 0 {
+	if s2 < 0 {
 		return
 	}
 	s2 += s1 + 1
 	return line[0:s1], line[s1+1 : s2], line[s2+1:], true
 }
 
+// validToken reports whether s is a token defined in RFC 7230 section 3.2.6
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTokenChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", b) >= 0
+}
+
+// validHeaderValue rejects control characters other than HTAB
+func validHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		b := v[i]
+		if (b < ' ' && b != '\t') || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func isCTLOrSpace(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
+
 func parseHTTPVersion(vers string) (major, minor int, ok bool) {
 	Big := 10000
 	if !strings.HasPrefix(vers, "HTTP/") {
@@ -137,11 +405,14 @@ func parseHTTPVersion(vers string) (major, minor int, ok bool) {
 	return major, minor, true
 }
 
+// headerValueContainsToken reports whether the comma separated values
+// contain the token, compared case-insensitively
 func headerValueContainsToken(values []string, token string) bool {
 	for _, v := range values {
-		// Todo: parse value
-		if strings.Index(v, token) != -1 {
-			return true
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
 		}
 	}
 	return false
@@ -155,29 +426,64 @@ type Request struct {
 	ProtoMajor int
 	ProtoMinor int
 	Header     Header
+	// ContentLength is the length of Body, or -1 if it is chunked
+	ContentLength int64
+	// Body is the request body, which is empty if the request has none.
+	// It is valid until the next request is read.
+	Body io.Reader
+	// Trailer is set when the chunked body has been read to the end
+	Trailer Header
+	// Close is true if the client asks to close the connection after the
+	// response
+	Close bool
+	// Protocol is the :protocol pseudo-header of an HTTP/2 extended
+	// CONNECT request, such as "websocket". It is empty for HTTP/1.x.
+	Protocol string
 }
 
-// Header represents HTTP header
+// Header represents HTTP header. The values of a field repeated in a
+// message are combined with ", ".
 type Header map[string]string
 
-// Get returns header value
+// Get returns header value. The key is compared case-insensitively if
+// it does not match exactly.
 func (h Header) Get(key string) string {
-	if v := h[key]; len(v) > 0 {
-		return v
-	}
-	return ""
+	v, _ := h.lookup(key)
+	return v
 }
 
 // Has checks header contains key
 func (h Header) Has(key string) bool {
-	_, ok := h[key]
+	_, ok := h.lookup(key)
 	return ok
 }
 
+func (h Header) lookup(key string) (string, bool) {
+	if v, ok := h[key]; ok {
+		return v, true
+	}
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
 func (h Header) set(key, value string) {
 	h[key] = value
 }
 
+// keys returns the keys in sorted order
+func (h Header) keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // ResponseWriter is writer for HTTP response
 type ResponseWriter interface {
 	Write(p []byte) (n int, err error)
@@ -185,42 +491,140 @@ type ResponseWriter interface {
 	SetHeader(key, value string)
 }
 
-// Response represents HTTP Response
+// Handler responds to an HTTP request
+type Handler interface {
+	ServeHTTP(w ResponseWriter, req *Request)
+}
+
+// HandlerFunc is a function used as Handler
+type HandlerFunc func(w ResponseWriter, req *Request)
+
+// ServeHTTP calls f(w, req)
+func (f HandlerFunc) ServeHTTP(w ResponseWriter, req *Request) {
+	f(w, req)
+}
+
+// maxBufferedBody is the size of the body buffered to be sent with
+// Content-Length. Larger bodies are streamed.
+const maxBufferedBody = 4 << 10
+
+// ErrResponseFinished is returned by writes after FinishRequest
+var ErrResponseFinished = errors.New("http: response is finished")
+
+// Flusher is implemented by ResponseWriters which can send the buffered
+// body to the client before the handler returns
+type Flusher interface {
+	Flush() error
+}
+
+// WriteDeadliner is implemented by ResponseWriters which can change the
+// write deadline of the connection, e.g. to lift WriteTimeout for an
+// event stream
+type WriteDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// Response represents HTTP Response.
+//
+// A small body is buffered and sent with Content-Length. Once the body
+// exceeds maxBufferedBody or Flush is called, the response is streamed:
+// with the Content-Length set by the handler if any, otherwise with the
+// chunked transfer coding, or for HTTP/1.0 clients by closing the
+// connection at the end.
 type Response struct {
-	Req           *Request
-	w             *bufio.Writer
-	c             *Conn
-	wroteHeader   bool
-	status        int
-	header        Header
-	contentLength int
+	Req         *Request
+	w           *bufio.Writer
+	c           *Conn
+	wroteHeader bool
+	status      int
+	header      Header
+	trailer     Header
+
+	buf      []byte // body not sent yet
+	chunked  bool
+	written  int64 // body bytes sent
+	finished bool
+	deadline bool // the handler set the write deadline
 }
 
+// Write buffers or sends the body. It is discarded for HEAD requests and
+// statuses which have no body.
 func (r *Response) Write(p []byte) (int, error) {
+	if r.finished {
+		return 0, ErrResponseFinished
+	}
+	if r.status == 0 {
+		r.SetStatus(StatusOK)
+	}
 	if !r.wroteHeader {
-		if r.status == 0 {
-			r.SetStatus(StatusOK)
+		r.buf = append(r.buf, p...)
+		if len(r.buf) <= maxBufferedBody {
+			return len(p), nil
 		}
-		r.writeHeader(p)
+		r.startStream()
+		return len(p), r.writeBody(nil)
 	}
-	i, err := r.w.Write(p)
-	if err != nil {
-		return i, err
+	return len(p), r.writeBody(p)
+}
+
+// Flush sends the header and the body written so far
+func (r *Response) Flush() error {
+	if r.finished {
+		return ErrResponseFinished
+	}
+	if r.status == 0 {
+		r.SetStatus(StatusOK)
+	}
+	if !r.wroteHeader {
+		r.startStream()
+	}
+	if err := r.writeBody(nil); err != nil {
+		return err
 	}
-	return i, nil
+	return r.w.Flush()
 }
 
 // FinishRequest finalizes request and send respnose to client
 func (r *Response) FinishRequest() {
+	if r.finished {
+		return
+	}
+	if r.status == 0 {
+		r.SetStatus(StatusOK)
+	}
 	if !r.wroteHeader {
-		if r.status == 0 {
-			r.SetStatus(StatusOK)
+		if len(r.trailer) > 0 && r.canChunk() {
+			// trailers need the chunked coding
+			r.startStream()
+		} else if cl, ok := r.declaredLength(); ok {
+			r.writeHeader(cl)
+		} else {
+			r.writeHeader(int64(len(r.buf)))
+		}
+	}
+	r.writeBody(nil)
+	if r.chunked && r.sendsBody() {
+		r.w.WriteString("0\r\n")
+		for _, k := range r.trailer.keys() {
+			fmt.Fprintf(r.w, "%s: %s\r\n", k, r.trailer[k])
 		}
-		r.writeHeader(nil)
+		r.w.Write(crlf)
 	}
+	if cl, ok := r.declaredLength(); ok && r.sendsBody() && r.written != cl {
+		// the client cannot find the end of the response
+		r.c.closing = true
+	}
+	r.finished = true
 	r.w.Flush()
 }
 
+// SetWriteDeadline sets the write deadline of the connection, which
+// replaces WriteTimeout for the response. The zero value means no limit.
+func (r *Response) SetWriteDeadline(t time.Time) error {
+	r.deadline = true
+	return r.c.rwc.SetWriteDeadline(t)
+}
+
 // SetStatus set response status code
 func (r *Response) SetStatus(code int) {
 	r.status = code
@@ -231,11 +635,95 @@ func (r *Response) SetHeader(key, value string) {
 	r.header.set(key, value)
 }
 
-func (r *Response) writeHeader(p []byte) {
+// SetTrailer sets a header sent after the chunked body. Trailers set
+// before the body is sent are announced with the Trailer header. They
+// are dropped if the response is not chunked, i.e. for HTTP/1.0 clients
+// or when Content-Length is set.
+func (r *Response) SetTrailer(key, value string) {
+	if r.trailer == nil {
+		r.trailer = make(Header)
+	}
+	r.trailer.set(key, value)
+}
+
+// bodyAllowed reports whether the status may have a body
+// https://tools.ietf.org/html/rfc7230#section-3.3
+func (r *Response) bodyAllowed() bool {
+	return r.status >= 200 && r.status != StatusNoContent && r.status != StatusNotModified
+}
+
+// sendsBody reports whether the body is sent, which is not for HEAD
+// requests even if their header describes the body
+func (r *Response) sendsBody() bool {
+	return r.bodyAllowed() && (r.Req == nil || r.Req.Method != "HEAD")
+}
+
+func (r *Response) declaredLength() (int64, bool) {
+	if !r.header.Has("Content-Length") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(r.header.Get("Content-Length"), 10, 64)
+	return n, err == nil && n >= 0
+}
+
+func (r *Response) canChunk() bool {
+	_, declared := r.declaredLength()
+	return r.bodyAllowed() && !declared && r.Req != nil &&
+		(r.Req.ProtoMajor > 1 || (r.Req.ProtoMajor == 1 && r.Req.ProtoMinor >= 1))
+}
+
+// startStream writes the header for a body whose length is unknown yet
+func (r *Response) startStream() {
+	if cl, ok := r.declaredLength(); ok {
+		r.writeHeader(cl)
+		return
+	}
+	if r.canChunk() {
+		r.chunked = true
+	} else if r.bodyAllowed() {
+		// the end of the body is told by closing the connection
+		r.header.set("Connection", "close")
+	}
+	r.writeHeader(-1)
+}
+
+// writeBody sends the buffered body and p
+func (r *Response) writeBody(p []byte) error {
+	if len(r.buf) > 0 {
+		b := r.buf
+		r.buf = nil
+		if err := r.writeBody(b); err != nil {
+			return err
+		}
+	}
+	if len(p) == 0 || !r.sendsBody() {
+		return nil
+	}
+	if r.chunked {
+		fmt.Fprintf(r.w, "%x\r\n", len(p))
+	}
+	n, err := r.w.Write(p)
+	r.written += int64(n)
+	if err != nil {
+		return err
+	}
+	if r.chunked {
+		_, err = r.w.Write(crlf)
+	}
+	return err
+}
+
+// writeHeader writes the status line and headers. contentLength is -1 if
+// the length is unknown.
+func (r *Response) writeHeader(contentLength int64) {
 	if r.wroteHeader {
 		return
 	}
 	r.wroteHeader = true
+	r.c.responded = true
+	if r.c.WriteTimeout > 0 && !r.deadline {
+		r.c.rwc.SetWriteDeadline(time.Now().Add(r.c.WriteTimeout))
+	}
 
 	// status line
 	ver := "1.1"
@@ -243,17 +731,36 @@ func (r *Response) writeHeader(p []byte) {
 
 	exh := extraHeader{}
 
-	// content-type
-	exh.contentType = "text/plain; charset=utf-8"
+	if r.bodyAllowed() {
+		// content-type
+		exh.contentType = "text/plain; charset=utf-8"
+		if r.header.Has("Content-Type") {
+			exh.contentType = r.header.Get("Content-Type")
+		}
 
-	// content-length
-	r.contentLength = len(p)
-	exh.contentLength = strconv.AppendInt(exh.contentLength, int64(len(p)), 10)
+		// content-length
+		if contentLength >= 0 {
+			exh.contentLength = strconv.AppendInt(exh.contentLength, contentLength, 10)
+		}
+	}
+
+	// transfer-encoding
+	if r.chunked {
+		exh.transferEncoding = "chunked"
+		if len(r.trailer) > 0 {
+			r.header.set("Trailer", strings.Join(r.trailer.keys(), ", "))
+		}
+	}
 
 	// connection
 	exh.connection = "keep-alive"
 	if r.header.Has("Connection") {
 		exh.connection = r.header.Get("Connection")
+	} else if r.Req == nil || r.Req.Close {
+		exh.connection = "close"
+	}
+	if headerValueContainsToken([]string{exh.connection}, "close") {
+		r.c.closing = true
 	}
 
 	// date
@@ -265,6 +772,9 @@ func (r *Response) writeHeader(p []byte) {
 
 	// other headers
 	for k, v := range r.header {
+		if isExtraHeader(k) {
+			continue
+		}
 		fmt.Fprintf(r.w, "%s: %s\r\n", k, v)
 	}
 
@@ -286,6 +796,15 @@ var extraHeaderKeys = [][]byte{
 	[]byte("Transfer-Encoding"),
 }
 
+// isExtraHeader reports whether the header is written by extraHeader
+func isExtraHeader(key string) bool {
+	switch key {
+	case "Content-Type", "Content-Length", "Connection", "Transfer-Encoding", "Date":
+		return true
+	}
+	return false
+}
+
 var (
 	headerContentLength = []byte("Content-Length: ")
 	headerDate          = []byte("Date: ")
@@ -0,0 +1,680 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConn is a net.Conn which reads from r and records written bytes
+type testConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *testConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *testConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *testConn) Close() error                { return nil }
+
+func (c *testConn) SetDeadline(time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(time.Time) error { return nil }
+
+func newTestConn(raw string) *testConn {
+	return &testConn{r: strings.NewReader(raw)}
+}
+
+func TestConn_ReadRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		wantStatus int // 0 means the request should be accepted
+		wantHeader Header
+	}{
+		{
+			name:       "normal",
+			raw:        "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n",
+			wantHeader: Header{"Host": "example.com", "Upgrade": "websocket"},
+		},
+		{
+			name:       "trailing whitespace in value",
+			raw:        "GET / HTTP/1.1\r\nHost: example.com \t\r\n\r\n",
+			wantHeader: Header{"Host": "example.com"},
+		},
+		{
+			name:       "repeated header",
+			raw:        "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: a\r\naccept: b\r\n\r\n",
+			wantHeader: Header{"Accept": "a, b"},
+		},
+		{
+			name:       "no space in request line",
+			raw:        "GET\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "only one space in request line",
+			raw:        "GET /\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "invalid method",
+			raw:        "G(T / HTTP/1.1\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "invalid proto",
+			raw:        "GET / HTTX/1.1\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "request line too long",
+			raw:        "GET /" + strings.Repeat("a", DefaultMaxRequestLineBytes) + " HTTP/1.1\r\n\r\n",
+			wantStatus: StatusRequestURITooLong,
+		},
+		{
+			name:       "obs-fold",
+			raw:        "GET / HTTP/1.1\r\nX-Foo: a\r\n  b\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "missing colon",
+			raw:        "GET / HTTP/1.1\r\nHost\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "invalid header name",
+			raw:        "GET / HTTP/1.1\r\nHo st: example.com\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "empty header name",
+			raw:        "GET / HTTP/1.1\r\n: example.com\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "control char in header value",
+			raw:        "GET / HTTP/1.1\r\nHost: exa\x00mple.com\r\n\r\n",
+			wantStatus: StatusBadRequest,
+		},
+		{
+			name:       "header too large",
+			raw:        "GET / HTTP/1.1\r\nX-Foo: " + strings.Repeat("a", DefaultMaxHeaderBytes) + "\r\n\r\n",
+			wantStatus: StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "too many headers",
+			raw:        "GET / HTTP/1.1\r\n" + strings.Repeat("X-Foo: a\r\n", DefaultMaxHeaderCount+1) + "\r\n",
+			wantStatus: StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := newTestConn(tt.raw)
+			res, err := NewConn(tc).ReadRequest()
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("ReadRequest() error = %v", err)
+				}
+				for k, v := range tt.wantHeader {
+					if got := res.Req.Header.Get(k); got != v {
+						t.Errorf("Header.Get(%q) = %q, want %q", k, got, v)
+					}
+				}
+				return
+			}
+			var rerr *RequestError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("ReadRequest() error = %v, want *RequestError", err)
+			}
+			if rerr.Status != tt.wantStatus {
+				t.Errorf("ReadRequest() status = %d, want %d", rerr.Status, tt.wantStatus)
+			}
+			wantLine := "HTTP/1.1 " + strconv.Itoa(tt.wantStatus) + " "
+			if !strings.HasPrefix(tc.w.String(), wantLine) {
+				t.Errorf("response = %q, want prefix %q", tc.w.String(), wantLine)
+			}
+		})
+	}
+}
+
+// TestConn_ReadRequest_Corpus mutates valid requests randomly and checks
+// the parser never panics and either accepts or rejects them cleanly.
+func TestConn_ReadRequest_Corpus(t *testing.T) {
+	corpus := []string{
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		"GET /chat HTTP/1.1\r\nHost: server.example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		" \r\n\r\n",
+		"GET  HTTP/1.1\r\n\r\n",
+		"\r\n",
+		"",
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, seed := range corpus {
+		for i := 0; i < 500; i++ {
+			b := []byte(seed)
+			for n := rnd.Intn(4); n >= 0 && len(b) > 0; n-- {
+				switch rnd.Intn(3) {
+				case 0:
+					b[rnd.Intn(len(b))] = byte(rnd.Intn(256))
+				case 1:
+					j := rnd.Intn(len(b))
+					b = append(b[:j], b[j+1:]...)
+				case 2:
+					j := rnd.Intn(len(b))
+					b = append(b[:j], append([]byte{" \r\n:\t"[rnd.Intn(5)]}, b[j:]...)...)
+				}
+			}
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("ReadRequest(%q) panicked: %v", b, r)
+					}
+				}()
+				NewConn(newTestConn(string(b))).ReadRequest()
+			}()
+		}
+	}
+}
+
+func TestConn_ReadRequest_Body(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		wantBody    string
+		wantTrailer Header
+		wantErr     bool
+	}{
+		{
+			name:     "content-length",
+			raw:      "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+			wantBody: "hello",
+		},
+		{
+			name:     "no body",
+			raw:      "GET / HTTP/1.1\r\n\r\n",
+			wantBody: "",
+		},
+		{
+			name:        "chunked",
+			raw:         "POST / HTTP/1.1\r\ntransfer-encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n7\r\n, world\r\n0\r\nX-Sum: 12\r\n\r\n",
+			wantBody:    "hello, world",
+			wantTrailer: Header{"X-Sum": "12"},
+		},
+		{
+			name:    "truncated",
+			raw:     "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello",
+			wantErr: true,
+		},
+		{
+			name:    "invalid chunk size",
+			raw:     "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing crlf after chunk",
+			raw:     "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhello\r\n0\r\n\r\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := NewConn(newTestConn(tt.raw)).ReadRequest()
+			if err != nil {
+				t.Fatalf("ReadRequest() error = %v", err)
+			}
+			body, err := ioutil.ReadAll(res.Req.Body)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ReadAll(Body) = %q, want error", body)
+				}
+				return
+			}
+			if err != nil || string(body) != tt.wantBody {
+				t.Errorf("ReadAll(Body) = %q, %v, want %q", body, err, tt.wantBody)
+			}
+			if !reflect.DeepEqual(res.Req.Trailer, tt.wantTrailer) {
+				t.Errorf("Trailer = %v, want %v", res.Req.Trailer, tt.wantTrailer)
+			}
+		})
+	}
+}
+
+func TestConn_ReadRequest_Framing(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		wantStatus int
+	}{
+		{"both te and cl", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n", StatusBadRequest},
+		{"unknown te", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", StatusNotImplemented},
+		{"negative cl", "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", StatusBadRequest},
+		{"invalid cl", "POST / HTTP/1.1\r\nContent-Length: 1x\r\n\r\n", StatusBadRequest},
+		{"repeated cl", "POST / HTTP/1.1\r\nContent-Length: 0\r\nContent-Length: 50\r\n\r\n", StatusBadRequest},
+		{"repeated cl in another case", "POST / HTTP/1.1\r\nContent-Length: 0\r\ncontent-length: 0\r\n\r\n", StatusBadRequest},
+		{"repeated te", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n", StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewConn(newTestConn(tt.raw)).ReadRequest()
+			var rerr *RequestError
+			if !errors.As(err, &rerr) || rerr.Status != tt.wantStatus {
+				t.Errorf("ReadRequest() error = %v, want status %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// echoHandler responds with the method, path and body of requests
+type echoHandler struct{}
+
+func (echoHandler) ServeHTTP(w ResponseWriter, req *Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	fmt.Fprintf(w, "%s %s %s", req.Method, req.RequestURI, body)
+}
+
+// readResponses reads responses with Content-Length until EOF
+func readResponses(t *testing.T, raw string) []string {
+	t.Helper()
+	var res []string
+	r := bufio.NewReader(strings.NewReader(raw))
+	for {
+		cres, err := ReadClientResponse(r)
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatalf("ReadClientResponse() error = %v", err)
+		}
+		n, _ := strconv.Atoi(cres.Header.Get("Content-Length"))
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, cres.Header.Get("Connection")+": "+string(body))
+	}
+}
+
+func TestConn_Serve(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{
+			name: "pipelined",
+			raw: "POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc" +
+				"GET /b HTTP/1.1\r\n\r\n" +
+				"POST /c HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nx\r\n0\r\n\r\n",
+			want: []string{"keep-alive: POST /a abc", "keep-alive: GET /b ", "keep-alive: POST /c x"},
+		},
+		{
+			name: "connection close",
+			raw:  "GET /a HTTP/1.1\r\nConnection: close\r\n\r\nGET /b HTTP/1.1\r\n\r\n",
+			want: []string{"close: GET /a "},
+		},
+		{
+			name: "http/1.0",
+			raw:  "GET /a HTTP/1.0\r\n\r\nGET /b HTTP/1.0\r\n\r\n",
+			want: []string{"close: GET /a "},
+		},
+		{
+			name: "http/1.0 keep-alive",
+			raw:  "GET /a HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\nGET /b HTTP/1.0\r\n\r\n",
+			want: []string{"keep-alive: GET /a ", "close: GET /b "},
+		},
+		{
+			name: "unread body is skipped",
+			raw: "POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc" +
+				"GET /b HTTP/1.1\r\n\r\n",
+			want: []string{"keep-alive: POST /a abc", "keep-alive: GET /b "},
+		},
+		{
+			name: "malformed request",
+			raw:  "GET /a HTTP/1.1\r\n\r\nBAD\r\n\r\nGET /b HTTP/1.1\r\n\r\n",
+			want: []string{"keep-alive: GET /a ", "close: Invalid first line \"BAD\"\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := newTestConn(tt.raw)
+			NewConn(tc).Serve(echoHandler{})
+			if got := readResponses(t, tc.w.String()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("responses = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// skipBodyHandler does not read the body
+type skipBodyHandler struct{}
+
+func (skipBodyHandler) ServeHTTP(w ResponseWriter, req *Request) {
+	fmt.Fprintf(w, "%s", req.RequestURI)
+}
+
+func TestConn_Serve_SkipBody(t *testing.T) {
+	small := "POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /b HTTP/1.1\r\n\r\n"
+	tc := newTestConn(small)
+	NewConn(tc).Serve(skipBodyHandler{})
+	if got, want := readResponses(t, tc.w.String()), []string{"keep-alive: /a", "keep-alive: /b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("responses = %q, want %q", got, want)
+	}
+
+	// too large to drain, so the connection is closed
+	large := fmt.Sprintf("POST /a HTTP/1.1\r\nContent-Length: %d\r\n\r\n%sGET /b HTTP/1.1\r\n\r\n",
+		maxDrainBytes+1, strings.Repeat("a", maxDrainBytes+1))
+	tc = newTestConn(large)
+	NewConn(tc).Serve(skipBodyHandler{})
+	if got, want := readResponses(t, tc.w.String()), []string{"keep-alive: /a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("responses = %q, want %q", got, want)
+	}
+}
+
+func TestConn_IdleTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewConn(server)
+	c.IdleTimeout = 50 * time.Millisecond
+	done := make(chan error, 1)
+	go func() { done <- c.Serve(echoHandler{}) }()
+
+	fmt.Fprintf(client, "GET /a HTTP/1.1\r\n\r\n")
+	r := bufio.NewReader(client)
+	if _, err := ReadClientResponse(r); err != nil {
+		t.Fatal(err)
+	}
+	go ioutil.ReadAll(r)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("idle connection is not closed")
+	}
+}
+
+func TestConn_WriteTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline bool // the handler lifts the write deadline
+	}{
+		{"timeout", false},
+		{"lifted by the handler", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			c := NewConn(server)
+			c.WriteTimeout = 50 * time.Millisecond
+			done := make(chan error, 1)
+			go c.Serve(HandlerFunc(func(w ResponseWriter, req *Request) {
+				if tt.deadline {
+					w.(WriteDeadliner).SetWriteDeadline(time.Time{})
+				}
+				w.Write([]byte("hello"))
+				done <- w.(Flusher).Flush()
+			}))
+
+			// the client does not read the response for a while
+			fmt.Fprintf(client, "GET /a HTTP/1.1\r\n\r\n")
+			time.Sleep(100 * time.Millisecond)
+			if tt.deadline {
+				if _, err := ReadClientResponse(bufio.NewReader(client)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case err := <-done:
+				ne, ok := err.(net.Error)
+				if timeout := ok && ne.Timeout(); timeout == tt.deadline {
+					t.Errorf("Flush() error = %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Error("Flush() does not return")
+			}
+		})
+	}
+}
+
+// response holds a response parsed by the test
+type response struct {
+	*ClientResponse
+	body    string
+	trailer Header
+}
+
+// serveRaw serves raw requests with h and parses the responses
+func serveRaw(t *testing.T, raw string, h HandlerFunc) []response {
+	t.Helper()
+	tc := newTestConn(raw)
+	NewConn(tc).Serve(h)
+
+	var res []response
+	r := bufio.NewReader(&tc.w)
+	methods := strings.Fields(raw) // the first is the method of the first request
+	for i := 0; ; i++ {
+		cres, err := ReadClientResponse(r)
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatalf("ReadClientResponse() error = %v", err)
+		}
+		got := response{ClientResponse: cres}
+		var body io.Reader
+		switch {
+		case cres.StatusCode < 200 || cres.StatusCode == StatusNoContent ||
+			cres.StatusCode == StatusNotModified || methods[0] == "HEAD":
+			body = noBody
+		case cres.Header.Get("Transfer-Encoding") == "chunked":
+			req := &Request{}
+			body = &chunkedReader{c: &Conn{r: r, MaxHeaderBytes: DefaultMaxHeaderBytes}, req: req}
+			defer func(i int) { res[i].trailer = req.Trailer }(i)
+		case cres.Header.Has("Content-Length"):
+			n, _ := strconv.ParseInt(cres.Header.Get("Content-Length"), 10, 64)
+			body = io.LimitReader(r, n)
+		default:
+			body = r
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+		got.body = string(b)
+		res = append(res, got)
+	}
+}
+
+func TestResponse(t *testing.T) {
+	large := strings.Repeat("x", maxBufferedBody+1)
+	tests := []struct {
+		name        string
+		raw         string
+		h           HandlerFunc
+		wantStatus  int
+		wantHeader  Header // "" means the header is absent
+		wantBody    string
+		wantTrailer Header
+	}{
+		{
+			name: "buffered",
+			raw:  "GET / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				fmt.Fprint(w, "hello, ")
+				fmt.Fprint(w, "world")
+			},
+			wantStatus: StatusOK,
+			wantHeader: Header{"Content-Length": "12", "Transfer-Encoding": ""},
+			wantBody:   "hello, world",
+		},
+		{
+			name: "large body is chunked",
+			raw:  "GET / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				fmt.Fprint(w, large)
+				fmt.Fprint(w, "end")
+			},
+			wantStatus: StatusOK,
+			wantHeader: Header{"Content-Length": "", "Transfer-Encoding": "chunked"},
+			wantBody:   large + "end",
+		},
+		{
+			name: "flush",
+			raw:  "GET / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				fmt.Fprint(w, "data: 1\n\n")
+				w.(Flusher).Flush()
+				fmt.Fprint(w, "data: 2\n\n")
+			},
+			wantStatus: StatusOK,
+			wantHeader: Header{"Transfer-Encoding": "chunked", "Connection": "keep-alive"},
+			wantBody:   "data: 1\n\ndata: 2\n\n",
+		},
+		{
+			name: "trailer",
+			raw:  "GET / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				r := w.(*Response)
+				r.SetTrailer("X-Checksum", "")
+				fmt.Fprint(w, "body")
+				r.SetTrailer("X-Checksum", "abc")
+			},
+			wantStatus:  StatusOK,
+			wantHeader:  Header{"Transfer-Encoding": "chunked", "Trailer": "X-Checksum"},
+			wantBody:    "body",
+			wantTrailer: Header{"X-Checksum": "abc"},
+		},
+		{
+			name: "http/1.0 stream",
+			raw:  "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				fmt.Fprint(w, "a")
+				w.(Flusher).Flush()
+				fmt.Fprint(w, "b")
+			},
+			wantStatus: StatusOK,
+			wantHeader: Header{"Transfer-Encoding": "", "Content-Length": "", "Connection": "close"},
+			wantBody:   "ab",
+		},
+		{
+			name: "content-length set by handler",
+			raw:  "GET / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				w.SetHeader("Content-Length", strconv.Itoa(len(large)))
+				fmt.Fprint(w, large)
+			},
+			wantStatus: StatusOK,
+			wantHeader: Header{"Transfer-Encoding": "", "Content-Length": strconv.Itoa(len(large))},
+			wantBody:   large,
+		},
+		{
+			name: "head",
+			raw:  "HEAD / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				fmt.Fprint(w, "hello")
+			},
+			wantStatus: StatusOK,
+			wantHeader: Header{"Content-Length": "5"},
+		},
+		{
+			name: "head of stream",
+			raw:  "HEAD / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				fmt.Fprint(w, large)
+			},
+			wantStatus: StatusOK,
+			wantHeader: Header{"Content-Length": "", "Transfer-Encoding": "chunked"},
+		},
+		{
+			name: "no content",
+			raw:  "GET / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				w.SetStatus(StatusNoContent)
+				fmt.Fprint(w, large)
+			},
+			wantStatus: StatusNoContent,
+			wantHeader: Header{"Content-Length": "", "Transfer-Encoding": "", "Content-Type": ""},
+		},
+		{
+			name: "not modified",
+			raw:  "GET / HTTP/1.1\r\n\r\n",
+			h: func(w ResponseWriter, req *Request) {
+				w.SetStatus(StatusNotModified)
+				w.(Flusher).Flush()
+			},
+			wantStatus: StatusNotModified,
+			wantHeader: Header{"Content-Length": "", "Transfer-Encoding": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serveRaw(t, tt.raw, tt.h)
+			if len(res) != 1 {
+				t.Fatalf("got %d responses, want 1", len(res))
+			}
+			got := res[0]
+			if got.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", got.StatusCode, tt.wantStatus)
+			}
+			for k, v := range tt.wantHeader {
+				if got.Header.Get(k) != v || (v == "" && got.Header.Has(k)) {
+					t.Errorf("header %s = %q, want %q", k, got.Header.Get(k), v)
+				}
+			}
+			if got.body != tt.wantBody {
+				t.Errorf("body = %q, want %q", got.body, tt.wantBody)
+			}
+			if len(got.trailer)+len(tt.wantTrailer) > 0 && !reflect.DeepEqual(got.trailer, tt.wantTrailer) {
+				t.Errorf("trailer = %v, want %v", got.trailer, tt.wantTrailer)
+			}
+		})
+	}
+}
+
+func TestResponse_Finished(t *testing.T) {
+	serveRaw(t, "GET / HTTP/1.1\r\n\r\n", func(w ResponseWriter, req *Request) {
+		r := w.(*Response)
+		r.FinishRequest()
+		if _, err := r.Write([]byte("late")); err != ErrResponseFinished {
+			t.Errorf("Write() after FinishRequest error = %v", err)
+		}
+	})
+}
+
+func TestResponse_Continue(t *testing.T) {
+	raw := "POST /a HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\nabc" +
+		"POST /b HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\nabc"
+	read := func(w ResponseWriter, req *Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "%s", body)
+	}
+	res := serveRaw(t, raw, read)
+	var got []string
+	for _, r := range res {
+		got = append(got, fmt.Sprintf("%d %s", r.StatusCode, r.body))
+	}
+	if want := []string{"100 ", "200 abc", "100 ", "200 abc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("responses = %q, want %q", got, want)
+	}
+
+	// rejected without reading the body, which may not be sent
+	res = serveRaw(t, raw, func(w ResponseWriter, req *Request) {
+		w.SetStatus(StatusForbidden)
+	})
+	if len(res) != 1 || res[0].StatusCode != StatusForbidden {
+		t.Errorf("responses = %v, want only 403", res)
+	}
+}
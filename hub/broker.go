@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"sync"
+
+	"github.com/cou929/minws/ws"
+)
+
+// Message is a broadcast message passed through Broker
+type Message struct {
+	Room    string // empty means all connections
+	OpCode  ws.OpCode
+	Payload []byte
+}
+
+// Broker delivers broadcast messages to hubs on all nodes
+type Broker interface {
+	// Publish sends the message to all subscribers, including the ones on
+	// the publishing node
+	Publish(m Message) error
+	// Subscribe registers f which is called for each published message
+	Subscribe(f func(Message))
+	// Close stops the broker
+	Close() error
+}
+
+// MemoryBroker is a Broker within a process. It is useful to share
+// broadcast messages between hubs, and for testing.
+type MemoryBroker struct {
+	mu   sync.RWMutex
+	subs []func(Message)
+}
+
+// NewMemoryBroker is a constructor of MemoryBroker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// Publish calls subscribers synchronously
+func (b *MemoryBroker) Publish(m Message) error {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, f := range subs {
+		f(m)
+	}
+	return nil
+}
+
+// Subscribe registers f
+func (b *MemoryBroker) Subscribe(f func(Message)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs[:len(b.subs):len(b.subs)], f)
+}
+
+// Close removes all subscribers
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = nil
+	return nil
+}
@@ -0,0 +1,185 @@
+package hub
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker()
+	h1, h2 := New(), New()
+	h1.SetBroker(b)
+	h2.SetBroker(b)
+
+	s1, c1 := newPair(t)
+	s2, c2 := newPair(t)
+	s3, c3 := newPair(t)
+	h1.Join(s1, "room")
+	h2.Join(s2, "room")
+	h2.Register(s3)
+
+	if err := h1.BroadcastTo("room", ws.OpCodeText, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*ws.Conn{c1, c2} {
+		if got, ok := receive(t, c); !ok || got != "hello" {
+			t.Errorf("received %q, %v, want %q", got, ok, "hello")
+		}
+	}
+	if got, ok := receive(t, c3); ok {
+		t.Errorf("non member received %q", got)
+	}
+}
+
+const testToken = "secret"
+
+func newMeshNode(t *testing.T, id string) (*MeshBroker, *Hub) {
+	t.Helper()
+	return newMeshNodeWithToken(t, id, testToken)
+}
+
+func newMeshNodeWithToken(t *testing.T, id, token string) (*MeshBroker, *Hub) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewMeshBroker(id, token, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	h := New()
+	h.SetBroker(b)
+	return b, h
+}
+
+func TestMeshBroker(t *testing.T) {
+	// a - b - c, so messages between a and c are forwarded by b
+	ba, ha := newMeshNode(t, "a")
+	bb, hb := newMeshNode(t, "b")
+	bc, hc := newMeshNode(t, "c")
+	ba.Connect(bb.Addr().String())
+	bc.Connect(bb.Addr().String())
+	waitFor(t, func() bool { return ba.Links() == 1 && bb.Links() == 2 && bc.Links() == 1 })
+
+	sa, ca := newPair(t)
+	sb, cb := newPair(t)
+	sc, cc := newPair(t)
+	sc2, cc2 := newPair(t)
+	ha.Join(sa, "room")
+	hb.Join(sb, "room")
+	hc.Join(sc, "room")
+	hc.Join(sc2, "other")
+
+	if err := ha.BroadcastTo("room", ws.OpCodeText, []byte("from a")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*ws.Conn{ca, cb, cc} {
+		if got, ok := receive(t, c); !ok || got != "from a" {
+			t.Errorf("received %q, %v, want %q", got, ok, "from a")
+		}
+		// exactly once
+		if got, ok := receive(t, c); ok {
+			t.Errorf("received duplicated %q", got)
+		}
+	}
+	if got, ok := receive(t, cc2); ok {
+		t.Errorf("member of other room received %q", got)
+	}
+
+	if err := hc.Broadcast(ws.OpCodeBinary, []byte("to all")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*ws.Conn{ca, cb, cc, cc2} {
+		if got, ok := receive(t, c); !ok || got != "to all" {
+			t.Errorf("received %q, %v, want %q", got, ok, "to all")
+		}
+	}
+
+	// a full mesh does not deliver duplicates either
+	ba.Connect(bc.Addr().String())
+	waitFor(t, func() bool { return ba.Links() == 2 && bc.Links() == 2 })
+	if err := hb.BroadcastTo("room", ws.OpCodeText, []byte("from b")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*ws.Conn{ca, cb, cc} {
+		if got, ok := receive(t, c); !ok || got != "from b" {
+			t.Errorf("received %q, %v, want %q", got, ok, "from b")
+		}
+		if got, ok := receive(t, c); ok {
+			t.Errorf("received duplicated %q", got)
+		}
+	}
+}
+
+func TestMeshBroker_Reconnect(t *testing.T) {
+	ba, ha := newMeshNode(t, "a")
+	bb, hb := newMeshNode(t, "b")
+	ba.RetryInterval = 10 * time.Millisecond
+	ba.Connect(bb.Addr().String())
+	waitFor(t, func() bool { return ba.Links() == 1 })
+
+	// drop the link from b side
+	bb.mu.Lock()
+	for c := range bb.links {
+		c.Rwc.Close()
+	}
+	bb.mu.Unlock()
+	waitFor(t, func() bool { return ba.Links() == 0 || bb.Links() == 0 })
+	waitFor(t, func() bool { return ba.Links() == 1 && bb.Links() == 1 })
+
+	sb, cb := newPair(t)
+	hb.Join(sb, "room")
+	if err := ha.BroadcastTo("room", ws.OpCodeText, []byte("after reconnect")); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := receive(t, cb); !ok || got != "after reconnect" {
+		t.Errorf("received %q, %v, want %q", got, ok, "after reconnect")
+	}
+}
+
+func TestMeshBroker_InvalidToken(t *testing.T) {
+	ba, _ := newMeshNodeWithToken(t, "a", "wrong")
+	bb, _ := newMeshNode(t, "b")
+	ba.RetryInterval = 10 * time.Millisecond
+	ba.Connect(bb.Addr().String())
+
+	time.Sleep(100 * time.Millisecond)
+	if ba.Links() != 0 || bb.Links() != 0 {
+		t.Errorf("Links() = %d, %d, want 0", ba.Links(), bb.Links())
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := NewMeshBroker("c", "", l); err != ErrEmptyToken {
+		t.Errorf("NewMeshBroker() error = %v, want %v", err, ErrEmptyToken)
+	}
+}
+
+func Test_decodeMeshMessage(t *testing.T) {
+	id := msgID{origin: "a/1", seq: 1}
+	tests := []struct {
+		op      ws.OpCode
+		wantErr bool
+	}{
+		{ws.OpCodeText, false},
+		{ws.OpCodeBinary, false},
+		{ws.OpCodeClose, true},
+		{ws.OpCodePing, true},
+		{ws.OpCodeContinuation, true},
+	}
+	for _, tt := range tests {
+		frame := encodeMeshMessage(id, Message{Room: "room", OpCode: tt.op, Payload: []byte("x")})
+		_, _, err := decodeMeshMessage(frame)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("decodeMeshMessage() opcode %v error = %v, wantErr %v", tt.op, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Package hub manages groups of WebSocket connections and broadcasts
+// messages to them.
+package hub
+
+import (
+	"sync"
+
+	"github.com/cou929/minws/ws"
+)
+
+// DefaultQueueSize is the number of messages queued per connection
+const DefaultQueueSize = 64
+
+// Hub registers connections and broadcasts messages to everyone or to the
+// members of a room. A message is encoded to a frame once and the same
+// bytes are written to every recipient.
+//
+// Each connection has a send queue and a writer goroutine, so that a slow
+// client does not block others. A connection whose queue is full is
+// closed and removed.
+type Hub struct {
+	// QueueSize is the capacity of the send queue of each connection.
+	// It must be set before registering connections.
+	QueueSize int
+
+	mu     sync.RWMutex
+	conns  map[*ws.Conn]*member
+	rooms  map[string]map[*ws.Conn]*member
+	broker Broker
+}
+
+type member struct {
+	conn  *ws.Conn
+	rooms map[string]struct{}
+	send  chan *ws.PreparedMessage
+}
+
+// New is a constructor of Hub
+func New() *Hub {
+	return &Hub{
+		QueueSize: DefaultQueueSize,
+		conns:     make(map[*ws.Conn]*member),
+		rooms:     make(map[string]map[*ws.Conn]*member),
+	}
+}
+
+// Register adds the connection to the hub. It is removed automatically
+// when the connection is closed.
+func (h *Hub) Register(c *ws.Conn) {
+	h.mu.Lock()
+	if _, ok := h.conns[c]; ok {
+		h.mu.Unlock()
+		return
+	}
+	m := &member{
+		conn:  c,
+		rooms: make(map[string]struct{}),
+		send:  make(chan *ws.PreparedMessage, h.QueueSize),
+	}
+	h.conns[c] = m
+	h.mu.Unlock()
+
+	go h.writeLoop(m)
+	c.OnClose(func() { h.Unregister(c) })
+}
+
+// Unregister removes the connection from the hub and all rooms
+func (h *Hub) Unregister(c *ws.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, ok := h.conns[c]
+	if !ok {
+		return
+	}
+	for room := range m.rooms {
+		h.leave(m, room)
+	}
+	delete(h.conns, c)
+	close(m.send)
+}
+
+func (h *Hub) writeLoop(m *member) {
+	for pm := range m.send {
+		if err := m.conn.WritePreparedMessage(pm); err != nil {
+			m.conn.Rwc.Close()
+			h.Unregister(m.conn)
+			// drain the queue until Unregister closes it
+			for range m.send {
+			}
+			return
+		}
+	}
+}
+
+// Join adds the connection to the room, registering it if needed
+func (h *Hub) Join(c *ws.Conn, room string) {
+	h.Register(c)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, ok := h.conns[c]
+	if !ok {
+		return
+	}
+	m.rooms[room] = struct{}{}
+	members, ok := h.rooms[room]
+	if !ok {
+		members = make(map[*ws.Conn]*member)
+		h.rooms[room] = members
+	}
+	members[c] = m
+}
+
+// Leave removes the connection from the room
+func (h *Hub) Leave(c *ws.Conn, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m, ok := h.conns[c]; ok {
+		h.leave(m, room)
+	}
+}
+
+func (h *Hub) leave(m *member, room string) {
+	delete(m.rooms, room)
+	members := h.rooms[room]
+	delete(members, m.conn)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// Len returns the number of registered connections
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns)
+}
+
+// Rooms returns names of the rooms the connection joins
+func (h *Hub) Rooms(c *ws.Conn) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	m, ok := h.conns[c]
+	if !ok {
+		return nil
+	}
+	res := make([]string, 0, len(m.rooms))
+	for room := range m.rooms {
+		res = append(res, room)
+	}
+	return res
+}
+
+// Members returns connections in the room
+func (h *Hub) Members(room string) []*ws.Conn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	res := make([]*ws.Conn, 0, len(h.rooms[room]))
+	for c := range h.rooms[room] {
+		res = append(res, c)
+	}
+	return res
+}
+
+// SetBroker makes the hub publish broadcast messages through the broker,
+// so that they reach connections registered to hubs on other nodes
+func (h *Hub) SetBroker(b Broker) {
+	h.mu.Lock()
+	h.broker = b
+	h.mu.Unlock()
+	b.Subscribe(h.deliver)
+}
+
+// Broadcast sends the message to all registered connections.
+// With a broker, connections on all nodes receive it.
+func (h *Hub) Broadcast(op ws.OpCode, msg []byte) error {
+	return h.publish(Message{OpCode: op, Payload: msg})
+}
+
+// BroadcastTo sends the message to the members of the room.
+// With a broker, members on all nodes receive it.
+func (h *Hub) BroadcastTo(room string, op ws.OpCode, msg []byte) error {
+	return h.publish(Message{Room: room, OpCode: op, Payload: msg})
+}
+
+func (h *Hub) publish(m Message) error {
+	h.mu.RLock()
+	b := h.broker
+	h.mu.RUnlock()
+	if b == nil {
+		h.deliver(m)
+		return nil
+	}
+	return b.Publish(m)
+}
+
+// deliver sends the message to local connections
+func (h *Hub) deliver(m Message) {
+	pm := ws.NewPreparedMessage(m.OpCode, m.Payload)
+	if m.Room == "" {
+		h.BroadcastPrepared(pm)
+		return
+	}
+	h.BroadcastPreparedTo(m.Room, pm)
+}
+
+// BroadcastPrepared sends the prepared message to all registered
+// connections on this node
+func (h *Hub) BroadcastPrepared(pm *ws.PreparedMessage) {
+	h.mu.RLock()
+	slow := h.enqueue(h.conns, pm)
+	h.mu.RUnlock()
+	h.dropSlow(slow)
+}
+
+// BroadcastPreparedTo sends the prepared message to the members of the room
+// on this node
+func (h *Hub) BroadcastPreparedTo(room string, pm *ws.PreparedMessage) {
+	h.mu.RLock()
+	slow := h.enqueue(h.rooms[room], pm)
+	h.mu.RUnlock()
+	h.dropSlow(slow)
+}
+
+// BroadcastPreparedFilter sends the prepared message to the members of the
+// room for which filter returns true
+func (h *Hub) BroadcastPreparedFilter(room string, pm *ws.PreparedMessage, filter func(*ws.Conn) bool) {
+	h.mu.RLock()
+	slow := h.enqueueFilter(h.rooms[room], pm, filter)
+	h.mu.RUnlock()
+	h.dropSlow(slow)
+}
+
+// enqueue must be called with h.mu held. It returns members whose queue is
+// full.
+func (h *Hub) enqueue(members map[*ws.Conn]*member, pm *ws.PreparedMessage) []*member {
+	return h.enqueueFilter(members, pm, nil)
+}
+
+func (h *Hub) enqueueFilter(members map[*ws.Conn]*member, pm *ws.PreparedMessage, filter func(*ws.Conn) bool) []*member {
+	var slow []*member
+	for c, m := range members {
+		if filter != nil && !filter(c) {
+			continue
+		}
+		select {
+		case m.send <- pm:
+		default:
+			slow = append(slow, m)
+		}
+	}
+	return slow
+}
+
+func (h *Hub) dropSlow(slow []*member) {
+	for _, m := range slow {
+		m.conn.Rwc.Close()
+		h.Unregister(m.conn)
+	}
+}
@@ -0,0 +1,133 @@
+package hub
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+// newPair returns server side conn, which keeps reading in background
+// like an application does, and client side conn
+func newPair(t *testing.T) (*ws.Conn, *ws.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	s := ws.NewConn(server)
+	c := ws.NewClientConn(client, bufio.NewReader(client))
+	go func() {
+		for {
+			if _, _, err := s.NextMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+	return s, c
+}
+
+// receive reads a message from the client side conn with timeout
+func receive(t *testing.T, c *ws.Conn) (string, bool) {
+	t.Helper()
+	c.Rwc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	defer c.Rwc.SetReadDeadline(time.Time{})
+	df, err := ws.NewDataFrameFromReader(c.Rwc)
+	if err != nil {
+		return "", false
+	}
+	return string(df.Message()), true
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHub_BroadcastTo(t *testing.T) {
+	h := New()
+	s1, c1 := newPair(t)
+	s2, c2 := newPair(t)
+	s3, c3 := newPair(t)
+	h.Join(s1, "a")
+	h.Join(s2, "a")
+	h.Join(s2, "b")
+	h.Register(s3)
+
+	h.BroadcastTo("a", ws.OpCodeText, []byte("to a"))
+	for _, c := range []*ws.Conn{c1, c2} {
+		if got, ok := receive(t, c); !ok || got != "to a" {
+			t.Errorf("received %q, %v, want %q", got, ok, "to a")
+		}
+	}
+	if got, ok := receive(t, c3); ok {
+		t.Errorf("non member received %q", got)
+	}
+
+	h.Broadcast(ws.OpCodeText, []byte("to all"))
+	for _, c := range []*ws.Conn{c1, c2, c3} {
+		if got, ok := receive(t, c); !ok || got != "to all" {
+			t.Errorf("received %q, %v, want %q", got, ok, "to all")
+		}
+	}
+
+	h.Leave(s2, "a")
+	h.BroadcastTo("a", ws.OpCodeText, []byte("after leave"))
+	if got, ok := receive(t, c1); !ok || got != "after leave" {
+		t.Errorf("received %q, %v, want %q", got, ok, "after leave")
+	}
+	if got, ok := receive(t, c2); ok {
+		t.Errorf("left member received %q", got)
+	}
+
+	rooms := h.Rooms(s2)
+	sort.Strings(rooms)
+	if len(rooms) != 1 || rooms[0] != "b" {
+		t.Errorf("Rooms() = %v, want [b]", rooms)
+	}
+}
+
+func TestHub_RemoveOnClose(t *testing.T) {
+	h := New()
+	s1, c1 := newPair(t)
+	s2, _ := newPair(t)
+	h.Join(s1, "a")
+	h.Join(s2, "a")
+
+	// closing handshake from client
+	if err := c1.SendCloseFrame(ws.StatusNormalClosure); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, c1)
+	waitFor(t, func() bool { return h.Len() == 1 })
+	if members := h.Members("a"); len(members) != 1 || members[0] != s2 {
+		t.Errorf("Members() = %v, want [s2]", members)
+	}
+
+	// TCP connection is dropped
+	s2.Rwc.Close()
+	waitFor(t, func() bool { return h.Len() == 0 })
+	if members := h.Members("a"); len(members) != 0 {
+		t.Errorf("Members() = %v, want empty", members)
+	}
+}
+
+func TestHub_SlowConsumer(t *testing.T) {
+	h := New()
+	h.QueueSize = 1
+	s1, _ := newPair(t)
+	h.Register(s1)
+
+	// the client never reads, so the writer blocks and the queue fills up
+	for i := 0; i < 3; i++ {
+		h.Broadcast(ws.OpCodeText, []byte("message"))
+	}
+	waitFor(t, func() bool { return h.Len() == 0 })
+}
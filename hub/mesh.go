@@ -0,0 +1,344 @@
+package hub
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cou929/minws"
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// DefaultRetryInterval is the interval to reconnect to a peer
+const DefaultRetryInterval = time.Second
+
+// seenCacheSize is the number of recent message ids kept to drop duplicates
+const seenCacheSize = 4096
+
+// ErrEmptyToken is returned by NewMeshBroker without a token
+var ErrEmptyToken = errors.New("mesh: empty token")
+
+// MeshBroker is a Broker connecting minws nodes with WebSocket links.
+// Each node listens for links from other nodes and connects to the peers
+// given by Connect. A published message is flooded over the links: every
+// node delivers it to local subscribers and forwards it to its other
+// links, dropping the ones already seen. So the nodes do not need to be
+// fully connected as long as the mesh is connected.
+//
+// Nodes share a token, which is sent in the Authorization header of the
+// opening handshake of links, so that only the nodes can publish. Each
+// link has a send queue like connections of Hub, and a link whose queue
+// is full is closed, so that a stalled peer does not block the others.
+type MeshBroker struct {
+	// RetryInterval is the interval to reconnect to a peer
+	RetryInterval time.Duration
+
+	origin string // unique id of this node and process
+	token  string
+	l      net.Listener
+	done   chan struct{}
+
+	mu     sync.Mutex
+	subs   []func(Message)
+	links  map[*ws.Conn]chan []byte // send queue of each link
+	seq    uint64
+	seen   map[msgID]struct{}
+	seenQ  [seenCacheSize]msgID
+	seenAt int
+	closed bool
+}
+
+type msgID struct {
+	origin string
+	seq    uint64
+}
+
+// NewMeshBroker starts a broker accepting links on l. id names this node,
+// and token is the secret shared by all nodes of the mesh.
+func NewMeshBroker(id, token string, l net.Listener) (*MeshBroker, error) {
+	if token == "" {
+		return nil, ErrEmptyToken
+	}
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	b := &MeshBroker{
+		RetryInterval: DefaultRetryInterval,
+		// a restarted node must not reuse ids of messages sent before
+		origin: id + "/" + hex.EncodeToString(nonce),
+		token:  token,
+		l:      l,
+		done:   make(chan struct{}),
+		links:  make(map[*ws.Conn]chan []byte),
+		seen:   make(map[msgID]struct{}),
+	}
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the address to accept links
+func (b *MeshBroker) Addr() net.Addr {
+	return b.l.Addr()
+}
+
+// Connect keeps a link to the peer at addr, reconnecting when it is lost
+func (b *MeshBroker) Connect(addr string) {
+	go func() {
+		for {
+			d := &minws.Dialer{Header: minwshttp.Header{"Authorization": "Bearer " + b.token}}
+			c, _, err := d.Dial("ws://" + addr + "/")
+			if err == nil {
+				b.serveLink(c)
+			}
+			select {
+			case <-b.done:
+				return
+			case <-time.After(b.RetryInterval):
+			}
+		}
+	}()
+}
+
+// Links returns the number of active links
+func (b *MeshBroker) Links() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.links)
+}
+
+func (b *MeshBroker) accept() {
+	u := &minws.Upgrader{Negotiate: b.authorize}
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			c, _, err := u.Upgrade(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			b.serveLink(c)
+		}()
+	}
+}
+
+// authorize checks the token of the peer opening a link
+func (b *MeshBroker) authorize(req *minwshttp.Request) (string, error) {
+	want := "Bearer " + b.token
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(want)) != 1 {
+		return "", &minwshttp.RequestError{Status: minwshttp.StatusUnauthorized, Msg: "mesh: invalid token"}
+	}
+	return "", nil
+}
+
+// serveLink receives messages from the link until it is broken
+func (b *MeshBroker) serveLink(c *ws.Conn) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		c.Rwc.Close()
+		return
+	}
+	send := make(chan []byte, DefaultQueueSize)
+	b.links[c] = send
+	b.mu.Unlock()
+	go writeLink(c, send)
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.links, c)
+		close(send)
+		b.mu.Unlock()
+		c.Rwc.Close()
+	}()
+
+	for {
+		op, frame, err := c.NextMessage()
+		if err != nil {
+			return
+		}
+		if op != ws.OpCodeBinary {
+			continue
+		}
+		id, m, err := decodeMeshMessage(frame)
+		if err != nil {
+			log.Println("mesh: invalid message", err)
+			return
+		}
+		b.receive(id, m, frame, c)
+	}
+}
+
+// Publish delivers the message to local subscribers and sends it to the
+// links
+func (b *MeshBroker) Publish(m Message) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return fmt.Errorf("mesh: broker is closed")
+	}
+	b.seq++
+	id := msgID{b.origin, b.seq}
+	b.markSeen(id)
+	b.mu.Unlock()
+
+	b.receive(id, m, encodeMeshMessage(id, m), nil)
+	return nil
+}
+
+// writeLink sends queued frames until the queue is closed
+func writeLink(c *ws.Conn, send chan []byte) {
+	for frame := range send {
+		if err := c.SendMessage(ws.OpCodeBinary, frame); err != nil {
+			c.Rwc.Close()
+			// drain the queue until serveLink closes it
+			for range send {
+			}
+			return
+		}
+	}
+}
+
+// receive delivers the message and forwards it to the links except from
+func (b *MeshBroker) receive(id msgID, m Message, frame []byte, from *ws.Conn) {
+	b.mu.Lock()
+	if from != nil && !b.markSeen(id) {
+		b.mu.Unlock()
+		return
+	}
+	subs := b.subs
+	var slow []*ws.Conn
+	for c, send := range b.links {
+		if c == from {
+			continue
+		}
+		select {
+		case send <- frame:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, f := range subs {
+		f(m)
+	}
+	// serveLink removes the link once its read fails
+	for _, c := range slow {
+		c.Rwc.Close()
+	}
+}
+
+// markSeen must be called with b.mu held. It returns false if the message
+// has been seen.
+func (b *MeshBroker) markSeen(id msgID) bool {
+	if _, ok := b.seen[id]; ok {
+		return false
+	}
+	if old := b.seenQ[b.seenAt]; old.origin != "" {
+		delete(b.seen, old)
+	}
+	b.seen[id] = struct{}{}
+	b.seenQ[b.seenAt] = id
+	b.seenAt = (b.seenAt + 1) % seenCacheSize
+	return true
+}
+
+// Subscribe registers f
+func (b *MeshBroker) Subscribe(f func(Message)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs[:len(b.subs):len(b.subs)], f)
+}
+
+// Close stops accepting and reconnecting, and closes all links
+func (b *MeshBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	for c := range b.links {
+		c.Rwc.Close()
+	}
+	b.mu.Unlock()
+	return b.l.Close()
+}
+
+/*
+Message on a link is sent as a binary WebSocket message:
+
+	origin length (uvarint) | origin | seq (uvarint) |
+	room length (uvarint) | room | opcode (1 byte) | payload
+*/
+
+func encodeMeshMessage(id msgID, m Message) []byte {
+	b := make([]byte, 0, 3*binary.MaxVarintLen64+len(id.origin)+len(m.Room)+1+len(m.Payload))
+	b = appendString(b, id.origin)
+	b = appendUvarint(b, id.seq)
+	b = appendString(b, m.Room)
+	b = append(b, byte(m.OpCode))
+	return append(b, m.Payload...)
+}
+
+func decodeMeshMessage(b []byte) (msgID, Message, error) {
+	var id msgID
+	var m Message
+	var ok bool
+	if id.origin, b, ok = readString(b); !ok {
+		return id, m, fmt.Errorf("invalid origin")
+	}
+	if id.seq, b, ok = readUvarint(b); !ok {
+		return id, m, fmt.Errorf("invalid seq")
+	}
+	if m.Room, b, ok = readString(b); !ok {
+		return id, m, fmt.Errorf("invalid room")
+	}
+	if len(b) < 1 {
+		return id, m, fmt.Errorf("missing opcode")
+	}
+	m.OpCode = ws.OpCode(b[0])
+	if m.OpCode != ws.OpCodeText && m.OpCode != ws.OpCodeBinary {
+		return id, m, fmt.Errorf("invalid opcode %v", m.OpCode)
+	}
+	m.Payload = b[1:]
+	return id, m, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readUvarint(b []byte) (uint64, []byte, bool) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, b, false
+	}
+	return v, b[n:], true
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	l, b, ok := readUvarint(b)
+	if !ok || uint64(len(b)) < l {
+		return "", b, false
+	}
+	return string(b[:l]), b[l:], true
+}
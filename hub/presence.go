@@ -0,0 +1,199 @@
+package hub
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/cou929/minws/ws"
+)
+
+// Principal is the authenticated user of a connection
+type Principal struct {
+	ID   string            `json:"id"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// Presence events
+const (
+	EventJoin  = "join"
+	EventLeave = "leave"
+)
+
+// PresenceEvent is pushed to the other members of the room when a user
+// comes online or goes offline
+type PresenceEvent struct {
+	Type  string    `json:"type"` // always "presence"
+	Event string    `json:"event"`
+	Room  string    `json:"room"`
+	User  Principal `json:"user"`
+}
+
+// Presence tracks who is online in each room on top of Hub.
+// A user may have multiple connections (e.g. browser tabs); the user is
+// online while at least one of them is in the room, so join and leave
+// events are sent only for the first and the last connection.
+type Presence struct {
+	hub *Hub
+	// Encode builds a message of the event. JSON text message by default.
+	Encode func(ev PresenceEvent) (ws.OpCode, []byte)
+
+	mu    sync.Mutex
+	rooms map[string]map[string]*presence // room -> user id -> presence
+	users map[*ws.Conn]Principal
+}
+
+type presence struct {
+	user  Principal
+	conns map[*ws.Conn]struct{}
+}
+
+// NewPresence is a constructor of Presence
+func NewPresence(h *Hub) *Presence {
+	return &Presence{
+		hub:    h,
+		Encode: encodeJSON,
+		rooms:  make(map[string]map[string]*presence),
+		users:  make(map[*ws.Conn]Principal),
+	}
+}
+
+func encodeJSON(ev PresenceEvent) (ws.OpCode, []byte) {
+	b, _ := json.Marshal(ev)
+	return ws.OpCodeText, b
+}
+
+// Join adds the connection of the user to the room. If the connection
+// has joined rooms as another user, it moves to the user in those rooms
+// as well, leaving them as the previous user.
+func (p *Presence) Join(c *ws.Conn, room string, user Principal) {
+	p.hub.Join(c, room)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prev, ok := p.users[c]
+	if !ok {
+		c.OnClose(func() { p.LeaveAll(c) })
+	}
+	var rooms []string
+	if ok && prev.ID != user.ID {
+		for r, users := range p.rooms {
+			if pr, ok := users[prev.ID]; ok {
+				if _, ok := pr.conns[c]; ok {
+					rooms = append(rooms, r)
+				}
+			}
+		}
+		sort.Strings(rooms)
+		for _, r := range rooms {
+			p.leave(c, r)
+		}
+	}
+	p.users[c] = user
+	for _, r := range rooms {
+		p.join(c, r, user)
+	}
+	p.join(c, room, user)
+}
+
+// join must be called with p.mu held
+func (p *Presence) join(c *ws.Conn, room string, user Principal) {
+	users, ok := p.rooms[room]
+	if !ok {
+		users = make(map[string]*presence)
+		p.rooms[room] = users
+	}
+	pr, ok := users[user.ID]
+	if !ok {
+		pr = &presence{user: user, conns: make(map[*ws.Conn]struct{})}
+		users[user.ID] = pr
+	}
+	pr.conns[c] = struct{}{}
+	if !ok {
+		p.notify(EventJoin, room, user)
+	}
+}
+
+// Leave removes the connection from the room
+func (p *Presence) Leave(c *ws.Conn, room string) {
+	p.hub.Leave(c, room)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.leave(c, room)
+}
+
+// LeaveAll removes the connection from all rooms. It is called
+// automatically when the connection is closed.
+func (p *Presence) LeaveAll(c *ws.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for room := range p.rooms {
+		p.leave(c, room)
+	}
+	delete(p.users, c)
+}
+
+func (p *Presence) leave(c *ws.Conn, room string) {
+	user, ok := p.users[c]
+	if !ok {
+		return
+	}
+	pr, ok := p.rooms[room][user.ID]
+	if !ok {
+		return
+	}
+	if _, ok := pr.conns[c]; !ok {
+		return
+	}
+	delete(pr.conns, c)
+	if len(pr.conns) > 0 {
+		return
+	}
+	delete(p.rooms[room], user.ID)
+	if len(p.rooms[room]) == 0 {
+		delete(p.rooms, room)
+	}
+	p.notify(EventLeave, room, pr.user)
+}
+
+// notify must be called with p.mu held, so that events are sent in the
+// same order as the state changes
+func (p *Presence) notify(event, room string, user Principal) {
+	op, msg := p.Encode(PresenceEvent{Type: "presence", Event: event, Room: room, User: user})
+	pm := ws.NewPreparedMessage(op, msg)
+	p.hub.BroadcastPreparedFilter(room, pm, func(c *ws.Conn) bool {
+		u, ok := p.users[c]
+		return ok && u.ID != user.ID
+	})
+}
+
+// Online returns users online in the room, sorted by id
+func (p *Presence) Online(room string) []Principal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]Principal, 0, len(p.rooms[room]))
+	for _, pr := range p.rooms[room] {
+		res = append(res, pr.user)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// IsOnline reports whether the user is online in the room
+func (p *Presence) IsOnline(room, userID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.rooms[room][userID]
+	return ok
+}
+
+// Connections returns the number of connections of the user in the room
+func (p *Presence) Connections(room, userID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pr, ok := p.rooms[room][userID]; ok {
+		return len(pr.conns)
+	}
+	return 0
+}
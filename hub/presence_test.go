@@ -0,0 +1,124 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cou929/minws/ws"
+)
+
+func receiveEvent(t *testing.T, c *ws.Conn) (PresenceEvent, bool) {
+	t.Helper()
+	var ev PresenceEvent
+	msg, ok := receive(t, c)
+	if !ok {
+		return ev, false
+	}
+	if err := json.Unmarshal([]byte(msg), &ev); err != nil {
+		t.Fatalf("invalid event %q: %v", msg, err)
+	}
+	return ev, true
+}
+
+func TestPresence(t *testing.T) {
+	p := NewPresence(New())
+	alice := Principal{ID: "alice", Meta: map[string]string{"name": "Alice"}}
+	bob := Principal{ID: "bob"}
+
+	sBob, cBob := newPair(t)
+	p.Join(sBob, "room", bob)
+
+	// first tab of alice
+	sAlice1, cAlice1 := newPair(t)
+	p.Join(sAlice1, "room", alice)
+	ev, ok := receiveEvent(t, cBob)
+	if !ok || ev.Event != EventJoin || ev.Room != "room" || ev.User.ID != "alice" || ev.User.Meta["name"] != "Alice" {
+		t.Errorf("bob received %+v, %v, want join of alice", ev, ok)
+	}
+	if ev, ok := receiveEvent(t, cAlice1); ok {
+		t.Errorf("alice received own event %+v", ev)
+	}
+
+	// second tab of alice does not notify
+	sAlice2, cAlice2 := newPair(t)
+	p.Join(sAlice2, "room", alice)
+	if ev, ok := receiveEvent(t, cBob); ok {
+		t.Errorf("bob received %+v for second tab", ev)
+	}
+	if got := p.Connections("room", "alice"); got != 2 {
+		t.Errorf("Connections() = %d, want 2", got)
+	}
+	online := p.Online("room")
+	if len(online) != 2 || online[0].ID != "alice" || online[1].ID != "bob" {
+		t.Errorf("Online() = %+v, want alice and bob", online)
+	}
+
+	// closing one tab keeps alice online
+	cAlice1.SendCloseFrame(ws.StatusNormalClosure)
+	receive(t, cAlice1)
+	waitFor(t, func() bool { return p.Connections("room", "alice") == 1 })
+	if ev, ok := receiveEvent(t, cBob); ok {
+		t.Errorf("bob received %+v while alice has another tab", ev)
+	}
+
+	// leaving with the last tab notifies
+	p.Leave(sAlice2, "room")
+	ev, ok = receiveEvent(t, cBob)
+	if !ok || ev.Event != EventLeave || ev.User.ID != "alice" {
+		t.Errorf("bob received %+v, %v, want leave of alice", ev, ok)
+	}
+	if p.IsOnline("room", "alice") {
+		t.Error("alice is online after leaving")
+	}
+	if ev, ok := receiveEvent(t, cAlice2); ok {
+		t.Errorf("alice received own event %+v", ev)
+	}
+
+	// bob goes offline by disconnecting
+	p.Join(sAlice2, "room", alice)
+	receiveEvent(t, cBob)
+	sBob.Rwc.Close()
+	ev, ok = receiveEvent(t, cAlice2)
+	if !ok || ev.Event != EventLeave || ev.User.ID != "bob" {
+		t.Errorf("alice received %+v, %v, want leave of bob", ev, ok)
+	}
+	if online := p.Online("room"); len(online) != 1 || online[0].ID != "alice" {
+		t.Errorf("Online() = %+v, want alice", online)
+	}
+}
+
+func TestPresence_ChangeUser(t *testing.T) {
+	p := NewPresence(New())
+	sBob, cBob := newPair(t)
+	p.Join(sBob, "room", Principal{ID: "bob"})
+
+	s, c := newPair(t)
+	p.Join(s, "room", Principal{ID: "alice"})
+	receiveEvent(t, cBob)
+
+	// the connection moves to carol in the room it has joined
+	p.Join(s, "other", Principal{ID: "carol"})
+	for _, want := range []PresenceEvent{
+		{Type: "presence", Event: EventLeave, Room: "room", User: Principal{ID: "alice"}},
+		{Type: "presence", Event: EventJoin, Room: "room", User: Principal{ID: "carol"}},
+	} {
+		if ev, ok := receiveEvent(t, cBob); !ok || ev.Event != want.Event || ev.User.ID != want.User.ID {
+			t.Errorf("bob received %+v, %v, want %+v", ev, ok, want)
+		}
+	}
+	if ev, ok := receiveEvent(t, c); ok {
+		t.Errorf("carol received own event %+v", ev)
+	}
+	if p.IsOnline("room", "alice") {
+		t.Error("alice is online after the change")
+	}
+	if !p.IsOnline("room", "carol") || !p.IsOnline("other", "carol") {
+		t.Error("carol is not online")
+	}
+
+	// leaving removes carol rather than a stale entry
+	p.LeaveAll(s)
+	if online := p.Online("room"); len(online) != 1 || online[0].ID != "bob" {
+		t.Errorf("Online() = %+v, want bob", online)
+	}
+}
@@ -0,0 +1,294 @@
+// Package jsonrpc implements JSON-RPC 2.0 over WebSocket connections.
+// See: https://www.jsonrpc.org/specification
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/cou929/minws/ws"
+)
+
+// ErrClosed is returned by calls which are pending or made after the
+// connection is closed
+var ErrClosed = errors.New("jsonrpc: connection closed")
+
+type connKey struct{}
+
+// ConnFromContext returns the connection which the request being handled
+// came from, so that methods can call back the peer
+func ConnFromContext(ctx context.Context) (*Conn, bool) {
+	c, ok := ctx.Value(connKey{}).(*Conn)
+	return c, ok
+}
+
+// Conn is a JSON-RPC peer on a WebSocket connection.
+// Both ends can serve methods and call methods of the other end.
+type Conn struct {
+	ws       *ws.Conn
+	registry *Registry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan *message
+	err     error // set when closed
+}
+
+// NewConn is a constructor of Conn. r may be nil if the peer calls no
+// methods. Call Serve to start processing incoming messages.
+func NewConn(c *ws.Conn, r *Registry) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &Conn{
+		ws:       c,
+		registry: r,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(map[string]chan *message),
+	}
+	ctx = context.WithValue(ctx, connKey{}, conn)
+	conn.ctx = ctx
+	return conn
+}
+
+// Serve reads messages until the connection is closed. Requests are
+// handled concurrently and responses are delivered to pending calls.
+// When it returns, contexts of running methods are canceled and pending
+// calls fail with ErrClosed.
+func (c *Conn) Serve() error {
+	defer c.shutdown()
+	for {
+		op, msg, err := c.ws.NextMessage()
+		if err != nil {
+			return err
+		}
+		if op != ws.OpCodeText && op != ws.OpCodeBinary {
+			continue
+		}
+		c.handleMessage(msg)
+	}
+}
+
+func (c *Conn) shutdown() {
+	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = ErrClosed
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *Conn) handleMessage(b []byte) {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		go c.handleBatch(b)
+		return
+	}
+	if !json.Valid(b) {
+		c.send(errorResponse(nil, CodeParseError, "Parse error"))
+		return
+	}
+	var m message
+	if err := json.Unmarshal(b, &m); err != nil {
+		// valid JSON which is not a request object, e.g. 1
+		c.send(errorResponse(nil, CodeInvalidRequest, "Invalid Request"))
+		return
+	}
+	if !m.isRequest() && (m.Result != nil || m.Error != nil) {
+		c.deliver(&m)
+		return
+	}
+	go func() {
+		if res := c.handleRequest(&m); res != nil {
+			c.send(res)
+		}
+	}()
+}
+
+// handleBatch handles requests in a batch concurrently and sends the
+// responses at once
+func (c *Conn) handleBatch(b []byte) {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(b, &batch); err != nil {
+		c.send(errorResponse(nil, CodeParseError, "Parse error"))
+		return
+	}
+	if len(batch) == 0 {
+		c.send(errorResponse(nil, CodeInvalidRequest, "Invalid Request"))
+		return
+	}
+
+	res := make([]*response, len(batch))
+	var wg sync.WaitGroup
+	for i, raw := range batch {
+		var m message
+		if err := json.Unmarshal(raw, &m); err != nil {
+			res[i] = errorResponse(nil, CodeInvalidRequest, "Invalid Request")
+			continue
+		}
+		wg.Add(1)
+		go func(i int, m *message) {
+			defer wg.Done()
+			res[i] = c.handleRequest(m)
+		}(i, &m)
+	}
+	wg.Wait()
+
+	out := res[:0]
+	for _, r := range res {
+		if r != nil {
+			out = append(out, r)
+		}
+	}
+	// nothing is returned for a batch of notifications
+	if len(out) > 0 {
+		c.send(out)
+	}
+}
+
+// handleRequest calls the method and returns the response, or nil for
+// a notification
+func (c *Conn) handleRequest(m *message) *response {
+	if m.Version != version || !m.isRequest() || !validID(m.ID) {
+		return errorResponse(m.ID, CodeInvalidRequest, "Invalid Request")
+	}
+	method, ok := c.registry.lookup(m.Method)
+	if !ok {
+		if m.isNotification() {
+			return nil
+		}
+		return errorResponse(m.ID, CodeMethodNotFound, "Method not found")
+	}
+
+	result, err := method.call(c.ctx, m.Params)
+	if m.isNotification() {
+		return nil
+	}
+	if err != nil {
+		var rerr *Error
+		if !errors.As(err, &rerr) {
+			rerr = &Error{Code: CodeServerError, Message: err.Error()}
+		}
+		return &response{Version: version, Error: rerr, ID: m.ID}
+	}
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	return &response{Version: version, Result: result, ID: m.ID}
+}
+
+// validID reports whether id is absent, a string, a number or null
+func validID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+func (c *Conn) send(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(errorResponse(nil, CodeInternalError, err.Error()))
+	}
+	return c.ws.SendTextMessage(string(b))
+}
+
+// deliver passes the response to the pending call
+func (c *Conn) deliver(m *message) {
+	c.mu.Lock()
+	ch, ok := c.pending[string(m.ID)]
+	delete(c.pending, string(m.ID))
+	c.mu.Unlock()
+	if ok {
+		ch <- m
+	}
+}
+
+// Call calls the method of the peer and waits for the response.
+// The result is decoded into result unless it is nil. An error object
+// returned by the peer is returned as *Error.
+func (c *Conn) Call(ctx context.Context, method string, params, result interface{}) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	ch := make(chan *message, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	if err := c.request(method, params, json.RawMessage(id)); err != nil {
+		c.forget(id)
+		return err
+	}
+
+	select {
+	case m, ok := <-ch:
+		if !ok {
+			return ErrClosed
+		}
+		if m.Error != nil {
+			return m.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(m.Result, result)
+	case <-ctx.Done():
+		c.forget(id)
+		return ctx.Err()
+	}
+}
+
+func (c *Conn) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// Notify sends a notification, which has no response
+func (c *Conn) Notify(method string, params interface{}) error {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.request(method, params, nil)
+}
+
+func (c *Conn) request(method string, params interface{}, id json.RawMessage) error {
+	m := message{Version: version, Method: method, ID: id}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("jsonrpc: failed to encode params %w", err)
+		}
+		m.Params = b
+	}
+	return c.ws.SendTextMessage(mustMarshal(m))
+}
+
+func mustMarshal(m message) string {
+	b, err := json.Marshal(m)
+	if err != nil {
+		// message consists of raw json and strings only
+		panic(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,264 @@
+package jsonrpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+type addParams struct {
+	A, B int
+}
+
+// newPair returns server and client side conns serving in background
+func newPair(t *testing.T, server, client *Registry) (*Conn, *Conn) {
+	t.Helper()
+	sc, cc := net.Pipe()
+	s := NewConn(ws.NewConn(sc), server)
+	c := NewConn(ws.NewClientConn(cc, bufio.NewReader(cc)), client)
+	go s.Serve()
+	go c.Serve()
+	t.Cleanup(func() {
+		sc.Close()
+		cc.Close()
+	})
+	return s, c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestConn_Call(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register("add", func(p addParams) (int, error) { return p.A + p.B, nil }); err != nil {
+		t.Fatal(err)
+	}
+	r.Register("sum", func(p []int) (int, error) {
+		s := 0
+		for _, n := range p {
+			s += n
+		}
+		return s, nil
+	})
+	r.Register("fail", func() error { return errors.New("boom") })
+	r.Register("teapot", func() error { return &Error{Code: 418, Message: "teapot", Data: "short"} })
+	r.Register("nothing", func(context.Context) error { return nil })
+	_, c := newPair(t, r, nil)
+	ctx := testContext(t)
+
+	var sum int
+	if err := c.Call(ctx, "add", addParams{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Errorf("add = %d, %v, want 3", sum, err)
+	}
+	if err := c.Call(ctx, "sum", []int{1, 2, 3}, &sum); err != nil || sum != 6 {
+		t.Errorf("sum = %d, %v, want 6", sum, err)
+	}
+	if err := c.Call(ctx, "nothing", nil, nil); err != nil {
+		t.Errorf("nothing error = %v", err)
+	}
+
+	errTests := []struct {
+		method string
+		params interface{}
+		code   int
+	}{
+		{"missing", nil, CodeMethodNotFound},
+		{"add", "not an object", CodeInvalidParams},
+		{"fail", nil, CodeServerError},
+		{"teapot", nil, 418},
+	}
+	for _, tt := range errTests {
+		err := c.Call(ctx, tt.method, tt.params, nil)
+		var rerr *Error
+		if !errors.As(err, &rerr) || rerr.Code != tt.code {
+			t.Errorf("Call(%q) error = %v, want code %d", tt.method, err, tt.code)
+		}
+	}
+}
+
+func TestRegistry_Register_Invalid(t *testing.T) {
+	r := NewRegistry()
+	for name, fn := range map[string]interface{}{
+		"not func":        1,
+		"no error":        func() int { return 0 },
+		"too many args":   func(a, b int) error { return nil },
+		"too many return": func() (int, int, error) { return 0, 0, nil },
+	} {
+		if err := r.Register(name, fn); err == nil {
+			t.Errorf("Register(%s) error = nil", name)
+		}
+	}
+}
+
+func TestConn_ServerToClient(t *testing.T) {
+	client := NewRegistry()
+	client.Register("greet", func(name string) (string, error) { return "hello " + name, nil })
+	notified := make(chan string, 1)
+	client.Register("notice", func(msg string) error {
+		notified <- msg
+		return nil
+	})
+
+	server := NewRegistry()
+	server.Register("login", func(ctx context.Context, name string) (string, error) {
+		c, _ := ConnFromContext(ctx)
+		var res string
+		err := c.Call(ctx, "greet", name, &res)
+		return res, err
+	})
+	s, c := newPair(t, server, client)
+	ctx := testContext(t)
+
+	var got string
+	if err := c.Call(ctx, "login", "alice", &got); err != nil || got != "hello alice" {
+		t.Errorf("login = %q, %v", got, err)
+	}
+
+	if err := s.Notify("notice", "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-notified:
+		if msg != "maintenance" {
+			t.Errorf("notice = %q", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("notification not received")
+	}
+}
+
+func TestConn_Batch(t *testing.T) {
+	r := NewRegistry()
+	r.Register("add", func(p addParams) (int, error) { return p.A + p.B, nil })
+	r.Register("log", func(string) error { return nil })
+
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	go NewConn(ws.NewConn(sc), r).Serve()
+	c := ws.NewClientConn(cc, bufio.NewReader(cc))
+
+	tests := []struct {
+		name string
+		req  string
+		want string // empty if no response is expected
+	}{
+		{
+			name: "batch",
+			req: `[
+				{"jsonrpc":"2.0","method":"add","params":{"A":1,"B":2},"id":1},
+				{"jsonrpc":"2.0","method":"log","params":"x"},
+				{"jsonrpc":"2.0","method":"missing","id":"b"},
+				1
+			]`,
+			want: `[{"jsonrpc":"2.0","result":3,"id":1},` +
+				`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":"b"},` +
+				`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}]`,
+		},
+		{
+			name: "empty batch",
+			req:  `[]`,
+			want: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`,
+		},
+		{
+			name: "parse error",
+			req:  `{"jsonrpc":"2.0","method":"add"`,
+			want: `{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`,
+		},
+		{
+			name: "invalid version",
+			req:  `{"jsonrpc":"1.0","method":"add","id":1}`,
+			want: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":1}`,
+		},
+		{
+			name: "not an object",
+			req:  `1`,
+			want: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`,
+		},
+		{
+			name: "string",
+			req:  `"x"`,
+			want: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`,
+		},
+		{
+			name: "invalid method type",
+			req:  `{"jsonrpc":"2.0","method":1,"params":"bar"}`,
+			want: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`,
+		},
+		{
+			name: "notifications only",
+			req:  `[{"jsonrpc":"2.0","method":"log","params":"x"}]`,
+		},
+	}
+	for _, tt := range tests {
+		if err := c.SendTextMessage(tt.req); err != nil {
+			t.Fatal(err)
+		}
+		cc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		got, err := c.ReadTextMessage()
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want no response", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: ReadTextMessage() error = %v", tt.name, err)
+		}
+		if !jsonEqual(got, tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func jsonEqual(a, b string) bool {
+	var va, vb interface{}
+	if json.Unmarshal([]byte(a), &va) != nil || json.Unmarshal([]byte(b), &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return string(ja) == string(jb)
+}
+
+func TestConn_CancelOnClose(t *testing.T) {
+	canceled := make(chan struct{})
+	r := NewRegistry()
+	r.Register("wait", func(ctx context.Context) error {
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	})
+	_, c := newPair(t, r, nil)
+	ctx := testContext(t)
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.Call(ctx, "wait", nil, nil) }()
+	time.Sleep(10 * time.Millisecond)
+	c.ws.Rwc.Close()
+
+	select {
+	case <-canceled:
+	case <-ctx.Done():
+		t.Fatal("method context was not canceled")
+	}
+	select {
+	case err := <-errc:
+		if err != ErrClosed {
+			t.Errorf("Call() error = %v, want ErrClosed", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("pending call did not fail")
+	}
+	if err := c.Call(ctx, "wait", nil, nil); err != ErrClosed {
+		t.Errorf("Call() after close error = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,66 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const version = "2.0"
+
+// Error codes
+// See: https://www.jsonrpc.org/specification#error_object
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeServerError is used for errors returned by methods
+	CodeServerError = -32000
+)
+
+// Error is a JSON-RPC error object
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc: %d %s", e.Code, e.Message)
+}
+
+// message is either request, notification or response
+type message struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+func (m *message) isRequest() bool {
+	return m.Method != ""
+}
+
+// isNotification reports whether the request expects no response
+func (m *message) isNotification() bool {
+	return m.ID == nil
+}
+
+type response struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var nullID = json.RawMessage("null")
+
+func errorResponse(id json.RawMessage, code int, msg string) *response {
+	if id == nil {
+		id = nullID
+	}
+	return &response{Version: version, Error: &Error{Code: code, Message: msg}, ID: id}
+}
@@ -0,0 +1,117 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Registry holds methods callable by the peer
+type Registry struct {
+	mu      sync.RWMutex
+	methods map[string]*method
+}
+
+type method struct {
+	fn        reflect.Value
+	hasCtx    bool
+	params    reflect.Type // nil if the method takes no params
+	hasResult bool
+}
+
+// NewRegistry is a constructor of Registry
+func NewRegistry() *Registry {
+	return &Registry{methods: make(map[string]*method)}
+}
+
+// Register adds a method. fn must be a function of the form
+//
+//	func([ctx context.Context,] [params T]) ([result R,] error)
+//
+// Params of the request are decoded into T with encoding/json, and result
+// is encoded likewise. ctx is canceled when the connection is closed.
+func (r *Registry) Register(name string, fn interface{}) error {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		return fmt.Errorf("jsonrpc: %s is not a function", name)
+	}
+	m := &method{fn: v}
+
+	in := 0
+	if in < t.NumIn() && t.In(in) == contextType {
+		m.hasCtx = true
+		in++
+	}
+	if in < t.NumIn() {
+		m.params = t.In(in)
+		in++
+	}
+	if in != t.NumIn() {
+		return fmt.Errorf("jsonrpc: %s has too many arguments", name)
+	}
+
+	switch t.NumOut() {
+	case 1:
+	case 2:
+		m.hasResult = true
+	default:
+		return fmt.Errorf("jsonrpc: %s must return ([result,] error)", name)
+	}
+	if t.Out(t.NumOut()-1) != errorType {
+		return fmt.Errorf("jsonrpc: last return value of %s must be error", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.methods[name] = m
+	return nil
+}
+
+func (r *Registry) lookup(name string) (*method, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.methods[name]
+	return m, ok
+}
+
+// call decodes params, calls the method and returns the result
+func (m *method) call(ctx context.Context, params json.RawMessage) (result interface{}, err error) {
+	var args []reflect.Value
+	if m.hasCtx {
+		args = append(args, reflect.ValueOf(ctx))
+	}
+	if m.params != nil {
+		p := reflect.New(m.params)
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, p.Interface()); err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+		}
+		args = append(args, p.Elem())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = &Error{Code: CodeInternalError, Message: fmt.Sprint(p)}
+		}
+	}()
+	out := m.fn.Call(args)
+	if e := out[len(out)-1]; !e.IsNil() {
+		return nil, e.Interface().(error)
+	}
+	if m.hasResult {
+		return out[0].Interface(), nil
+	}
+	return nil, nil
+}
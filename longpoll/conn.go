@@ -0,0 +1,371 @@
+package longpoll
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// ErrClosed is returned when sending on a closed session
+var ErrClosed = errors.New("longpoll: session is closed")
+
+// Errors of batchAfter
+var (
+	errReplaced = errors.New("longpoll: replaced by a newer poll")
+	errBehind   = errors.New("longpoll: missed messages no longer kept")
+)
+
+// incomingQueueSize is the number of received messages queued before
+// POST requests block
+const incomingQueueSize = 16
+
+// Conn is a session of the long polling transport. It implements
+// ws.MessageConn, and sends and receives on the WebSocket connection
+// after upgraded.
+type Conn struct {
+	// ID names the session
+	ID string
+	// Request is the request which opened the session
+	Request *minwshttp.Request
+
+	s    *Server
+	in   chan incoming
+	done chan struct{}
+
+	mu          sync.Mutex
+	buf         []entry // unacknowledged messages in order of seq
+	seq         uint64  // sequence number of the last sent message
+	changed     chan struct{}
+	gen         int // generation of the latest poll
+	polls       int
+	expiry      *time.Timer
+	ws          *ws.Conn // set once upgraded
+	upgrading   bool     // messages are being sent again on a WebSocket connection
+	closed      bool
+	closeStatus int
+	closeErr    error
+	onClose     []func()
+}
+
+type incoming struct {
+	op   ws.OpCode
+	data []byte
+}
+
+type entry struct {
+	seq  uint64
+	op   ws.OpCode
+	data []byte
+}
+
+func newConn(s *Server, id string, req *minwshttp.Request) *Conn {
+	c := &Conn{
+		ID:      id,
+		Request: req,
+		s:       s,
+		in:      make(chan incoming, incomingQueueSize),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	// a session whose client never polls expires as well
+	c.expiry = time.AfterFunc(s.TTL, c.expire)
+	return c
+}
+
+// NextMessage returns the next message from the client
+func (c *Conn) NextMessage() (ws.OpCode, []byte, error) {
+	select {
+	case m := <-c.in:
+		return m.op, m.data, nil
+	default:
+	}
+	select {
+	case m := <-c.in:
+		return m.op, m.data, nil
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return 0, nil, c.closeErr
+	}
+}
+
+// SendMessage queues the message for the next poll, or sends it on the
+// WebSocket connection if upgraded
+func (c *Conn) SendMessage(op ws.OpCode, msg []byte) error {
+	if op != ws.OpCodeText && op != ws.OpCodeBinary {
+		return errors.New("longpoll: unsupported opcode " + strconv.Itoa(int(op)))
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if wc := c.ws; wc != nil {
+		c.mu.Unlock()
+		return wc.SendMessage(op, msg)
+	}
+	defer c.mu.Unlock()
+	c.seq++
+	c.buf = append(c.buf, entry{seq: c.seq, op: op, data: append([]byte(nil), msg...)})
+	if n := len(c.buf) - c.s.BufferSize; n > 0 {
+		c.buf = append(c.buf[:0], c.buf[n:]...)
+	}
+	c.notify()
+	return nil
+}
+
+// SendTextMessage sends a text message
+func (c *Conn) SendTextMessage(msg string) error {
+	return c.SendMessage(ws.OpCodeText, []byte(msg))
+}
+
+// SendBinaryMessage sends a binary message
+func (c *Conn) SendBinaryMessage(msg []byte) error {
+	return c.SendMessage(ws.OpCodeBinary, msg)
+}
+
+// notify wakes up the waiting poll. It must be called with c.mu held.
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Close closes the session with 1000
+func (c *Conn) Close() {
+	c.CloseWithStatus(ws.StatusNormalClosure)
+}
+
+// CloseWithStatus closes the session. The status is sent to the client
+// after the queued messages, and the session is kept until then or TTL
+// passes.
+func (c *Conn) CloseWithStatus(status int) {
+	if !c.shutdown(status, &ws.CloseError{Code: status, Text: "closed by server"}) {
+		return
+	}
+	// ws is no longer set once closed
+	c.mu.Lock()
+	wc := c.ws
+	c.mu.Unlock()
+	if wc != nil {
+		wc.CloseWithStatus(status)
+		c.s.remove(c)
+	}
+}
+
+// closeByPeer closes the session at the request of the client
+func (c *Conn) closeByPeer(status int) {
+	c.shutdown(status, &ws.CloseError{Code: status, Text: "closed by client"})
+	c.s.remove(c)
+}
+
+// expire closes the session left without poll for TTL
+func (c *Conn) expire() {
+	c.shutdown(ws.StatusGoingAway, &ws.CloseError{Code: ws.StatusGoingAway, Text: "session expired"})
+	c.s.remove(c)
+}
+
+// shutdown marks the session closed and reports whether it was open
+func (c *Conn) shutdown(status int, err error) bool {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	c.closed = true
+	c.closeStatus = status
+	c.closeErr = err
+	close(c.done)
+	c.notify()
+	hooks := c.onClose
+	c.onClose = nil
+	c.mu.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+	return true
+}
+
+// OnClose registers f to be called when the session is closed.
+// If it is already closed, f is called immediately in a new goroutine.
+func (c *Conn) OnClose(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		go f()
+		return
+	}
+	c.onClose = append(c.onClose, f)
+}
+
+// receive queues a message from the client
+func (c *Conn) receive(m incoming) error {
+	select {
+	case c.in <- m:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// attach registers a poll, which replaces the previous one
+func (c *Conn) attach() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.polls++
+	c.expiry.Stop()
+	c.notify()
+	return c.gen
+}
+
+// detach unregisters the poll. The session expires after TTL without
+// poll unless upgraded.
+func (c *Conn) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.polls--
+	if c.polls > 0 || c.ws != nil {
+		return
+	}
+	c.expiry.Reset(c.s.TTL)
+}
+
+// trim drops messages up to seq. It must be called with c.mu held.
+func (c *Conn) trim(seq uint64) error {
+	if seq > c.seq || (len(c.buf) > 0 && c.buf[0].seq > seq+1) {
+		return errBehind
+	}
+	i := 0
+	for i < len(c.buf) && c.buf[i].seq <= seq {
+		i++
+	}
+	c.buf = append(c.buf[:0], c.buf[i:]...)
+	return nil
+}
+
+// batchAfter acknowledges messages up to seq, and returns the batch of
+// the following ones and the channel closed on the next change
+func (c *Conn) batchAfter(seq uint64, gen int) (*batch, <-chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return nil, nil, errReplaced
+	}
+	b := &batch{Messages: []message{}}
+	if c.ws != nil {
+		b.Upgraded = true
+		return b, c.changed, nil
+	}
+	if err := c.trim(seq); err != nil {
+		return nil, nil, err
+	}
+	for _, e := range c.buf {
+		if len(b.Messages) == c.s.MaxBatch {
+			break
+		}
+		m := message{Seq: e.seq, Type: "text", Data: string(e.data)}
+		if e.op == ws.OpCodeBinary {
+			m.Type, m.Data = "binary", base64.StdEncoding.EncodeToString(e.data)
+		}
+		b.Messages = append(b.Messages, m)
+	}
+	if c.closed && len(b.Messages) == len(c.buf) {
+		b.Close = c.closeStatus
+	}
+	return b, c.changed, nil
+}
+
+// upgrade moves the session to wc, sending again the messages after
+// lastSeq. The messages are sent without c.mu held, and those queued
+// meanwhile are sent after them, until none is left. If sending fails, wc
+// is closed and the session stays on polls with the messages kept.
+func (c *Conn) upgrade(wc *ws.Conn, lastSeq uint64) bool {
+	c.mu.Lock()
+	if c.closed || c.ws != nil || c.upgrading {
+		c.mu.Unlock()
+		return false
+	}
+	if err := c.trim(lastSeq); err != nil {
+		c.mu.Unlock()
+		c.CloseWithStatus(ws.StatusPolicyViolation)
+		return false
+	}
+	c.upgrading = true
+	sent := lastSeq
+	for {
+		if len(c.buf) > 0 && c.buf[0].seq > sent+1 {
+			// dropped for BufferSize while sending
+			c.upgrading = false
+			c.mu.Unlock()
+			wc.Rwc.Close()
+			c.CloseWithStatus(ws.StatusPolicyViolation)
+			return true
+		}
+		var pending []entry
+		for _, e := range c.buf {
+			if e.seq > sent {
+				pending = append(pending, e)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		c.mu.Unlock()
+		for _, e := range pending {
+			if err := wc.SendMessage(e.op, e.data); err != nil {
+				c.mu.Lock()
+				c.upgrading = false
+				c.mu.Unlock()
+				wc.Rwc.Close()
+				return true
+			}
+			sent = e.seq
+		}
+		c.mu.Lock()
+	}
+	c.upgrading = false
+	if c.closed {
+		// closed while sending, so that the close status is not sent yet
+		status := c.closeStatus
+		c.mu.Unlock()
+		wc.CloseWithStatus(status)
+		c.s.remove(c)
+		return true
+	}
+	c.buf = nil
+	c.ws = wc
+	c.expiry.Stop()
+	c.notify()
+	c.mu.Unlock()
+
+	go c.read(wc)
+	return true
+}
+
+// read passes messages on the WebSocket connection to the session until
+// it is closed
+func (c *Conn) read(wc *ws.Conn) {
+	defer wc.Rwc.Close()
+	for {
+		op, msg, err := wc.NextMessage()
+		if err != nil {
+			status := ws.StatusAbnormalClosure
+			var cerr *ws.CloseError
+			if errors.As(err, &cerr) {
+				status = cerr.Code
+			}
+			c.shutdown(status, err)
+			c.s.remove(c)
+			return
+		}
+		if err := c.receive(incoming{op, msg}); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Package longpoll implements a fallback transport with HTTP long polling
+// for clients which can use neither WebSocket nor Server-Sent Events.
+// A session is exposed to the application as ws.MessageConn, and moves to
+// a WebSocket connection once the client manages to open one.
+//
+// GET without session opens a session, and is answered at once:
+//
+//	{"session": "<id>", "messages": []}
+//
+// GET ?session=<id>&last_seq=<n> acknowledges the messages up to n, and
+// waits until messages after n are available or Timeout passes. The
+// messages are sent in a batch, the binary ones base64 encoded:
+//
+//	{"messages": [{"seq": 1, "type": "text", "data": "hello"},
+//	              {"seq": 2, "type": "binary", "data": "AAE="}],
+//	 "close": 1000}
+//
+// close is set when the session is closed after the messages. A poll
+// replaced by a newer one of the same session is answered with no
+// messages.
+//
+// POST ?session=<id> sends a batch of messages, whose body is a JSON
+// array like [{"type": "text", "data": "hi"}]. DELETE ?session=<id>
+// closes the session.
+//
+// To upgrade, the client opens a WebSocket connection with
+// ?session=<id>&last_seq=<n>, which the application passes to
+// Server.Upgrade. The messages after n are sent again on it in order, so
+// that the client numbers them from n+1 and skips those it has received
+// by a poll in flight. Polls are then answered with {"upgraded": true}.
+package longpoll
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// Defaults of Server
+const (
+	DefaultTimeout     = 25 * time.Second
+	DefaultTTL         = time.Minute
+	DefaultBufferSize  = 256
+	DefaultMaxBatch    = 64
+	DefaultMaxPostSize = 1 << 20
+)
+
+// Server serves sessions over long polling
+type Server struct {
+	// Handler is called in a new goroutine for each session with the
+	// request which opened it
+	Handler func(c ws.MessageConn, req *minwshttp.Request)
+	// Timeout is how long a poll waits for messages. It should be shorter
+	// than timeouts of proxies between the client.
+	Timeout time.Duration
+	// TTL is how long a session is kept without poll
+	TTL time.Duration
+	// BufferSize is the max number of unacknowledged messages kept per
+	// session. A client which has missed dropped messages is closed with
+	// 1008 on the next poll.
+	BufferSize int
+	// MaxBatch limits the number of messages in a poll response
+	MaxBatch int
+	// MaxPostSize limits the size of a POST body
+	MaxPostSize int64
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+// NewServer is a constructor of Server
+func NewServer(h func(c ws.MessageConn, req *minwshttp.Request)) *Server {
+	return &Server{
+		Handler:     h,
+		Timeout:     DefaultTimeout,
+		TTL:         DefaultTTL,
+		BufferSize:  DefaultBufferSize,
+		MaxBatch:    DefaultMaxBatch,
+		MaxPostSize: DefaultMaxPostSize,
+		conns:       make(map[string]*Conn),
+	}
+}
+
+// message is the JSON form of a message
+type message struct {
+	Seq  uint64 `json:"seq,omitempty"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// batch is the JSON form of a poll response
+type batch struct {
+	Session  string    `json:"session,omitempty"`
+	Messages []message `json:"messages"`
+	Close    int       `json:"close,omitempty"`
+	Upgraded bool      `json:"upgraded,omitempty"`
+}
+
+// Len returns the number of live sessions
+func (s *Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Get returns the session of the id
+func (s *Server) Get(id string) (*Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conns[id]
+	return c, ok
+}
+
+// ServeHTTP implements minwshttp.Handler
+func (s *Server) ServeHTTP(w minwshttp.ResponseWriter, req *minwshttp.Request) {
+	u, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		writeStatus(w, minwshttp.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	id := q.Get("session")
+	if req.Method == "GET" && id == "" {
+		c := s.open(req)
+		writeJSON(w, &batch{Session: c.ID, Messages: []message{}})
+		return
+	}
+
+	c, ok := s.Get(id)
+	switch {
+	case req.Method != "GET" && req.Method != "POST" && req.Method != "DELETE":
+		w.SetHeader("Allow", "GET, POST, DELETE")
+		writeStatus(w, minwshttp.StatusMethodNotAllowed)
+	case !ok:
+		writeStatus(w, minwshttp.StatusNotFound)
+	case req.Method == "GET":
+		lastSeq, err := strconv.ParseUint(q.Get("last_seq"), 10, 64)
+		if err != nil {
+			writeStatus(w, minwshttp.StatusBadRequest)
+			return
+		}
+		s.poll(w, c, lastSeq)
+	case req.Method == "POST":
+		s.receive(w, req, c)
+	default:
+		c.closeByPeer(ws.StatusNormalClosure)
+		w.SetStatus(minwshttp.StatusNoContent)
+	}
+}
+
+// poll answers the messages after lastSeq once available
+func (s *Server) poll(w minwshttp.ResponseWriter, c *Conn, lastSeq uint64) {
+	gen := c.attach()
+	defer c.detach()
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	for {
+		b, changed, err := c.batchAfter(lastSeq, gen)
+		if err == errBehind {
+			c.CloseWithStatus(ws.StatusPolicyViolation)
+			writeJSON(w, &batch{Messages: []message{}, Close: ws.StatusPolicyViolation})
+			s.remove(c)
+			return
+		}
+		if err != nil {
+			// replaced by a newer poll
+			writeJSON(w, &batch{Messages: []message{}})
+			return
+		}
+		if len(b.Messages) > 0 || b.Close != 0 || b.Upgraded {
+			writeJSON(w, b)
+			if b.Close != 0 {
+				s.remove(c)
+			}
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			writeJSON(w, b)
+			return
+		}
+	}
+}
+
+// receive passes the batch of the POST request to the session
+func (s *Server) receive(w minwshttp.ResponseWriter, req *minwshttp.Request, c *Conn) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, s.MaxPostSize+1))
+	if err != nil {
+		writeStatus(w, minwshttp.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > s.MaxPostSize {
+		writeStatus(w, minwshttp.StatusRequestEntityTooLarge)
+		return
+	}
+	var msgs []message
+	if err := json.Unmarshal(body, &msgs); err != nil {
+		writeStatus(w, minwshttp.StatusBadRequest)
+		return
+	}
+	in := make([]incoming, len(msgs))
+	for i, m := range msgs {
+		switch m.Type {
+		case "text":
+			in[i] = incoming{ws.OpCodeText, []byte(m.Data)}
+		case "binary":
+			b, err := base64.StdEncoding.DecodeString(m.Data)
+			if err != nil {
+				writeStatus(w, minwshttp.StatusBadRequest)
+				return
+			}
+			in[i] = incoming{ws.OpCodeBinary, b}
+		default:
+			writeStatus(w, minwshttp.StatusBadRequest)
+			return
+		}
+	}
+	for _, m := range in {
+		if err := c.receive(m); err != nil {
+			writeStatus(w, minwshttp.StatusGone)
+			return
+		}
+	}
+	w.SetStatus(minwshttp.StatusNoContent)
+}
+
+// Upgrade moves the session named by the query of the handshake request
+// to c, and reports whether it took c. If false, the request does not name
+// a live session, and the caller serves c as a new connection. If the
+// messages cannot be sent again on c, c is closed and the session is kept
+// for polls.
+func (s *Server) Upgrade(c *ws.Conn, req *minwshttp.Request) bool {
+	u, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		return false
+	}
+	q := u.Query()
+	lastSeq, err := strconv.ParseUint(q.Get("last_seq"), 10, 64)
+	if err != nil {
+		return false
+	}
+	sc, ok := s.Get(q.Get("session"))
+	if !ok {
+		return false
+	}
+	return sc.upgrade(c, lastSeq)
+}
+
+// open starts a new session and its handler
+func (s *Server) open(req *minwshttp.Request) *Conn {
+	c := newConn(s, newID(), req)
+	s.mu.Lock()
+	s.conns[c.ID] = c
+	s.mu.Unlock()
+	go s.Handler(c, req)
+	return c
+}
+
+func (s *Server) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[c.ID] == c {
+		delete(s.conns, c.ID)
+	}
+}
+
+func writeJSON(w minwshttp.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeStatus(w, minwshttp.StatusInternalServerError)
+		return
+	}
+	w.SetHeader("Content-Type", "application/json")
+	w.SetHeader("Cache-Control", "no-cache")
+	w.SetStatus(minwshttp.StatusOK)
+	w.Write(b)
+}
+
+func writeStatus(w minwshttp.ResponseWriter, code int) {
+	w.SetStatus(code)
+	w.Write([]byte(minwshttp.StatusText(code) + "\n"))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,347 @@
+package longpoll
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws"
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// echo sends back messages, and closes with 4000 on "close"
+func echo(errc chan<- error) func(c ws.MessageConn, req *minwshttp.Request) {
+	return func(c ws.MessageConn, req *minwshttp.Request) {
+		for {
+			op, msg, err := c.NextMessage()
+			if err != nil {
+				errc <- err
+				return
+			}
+			if string(msg) == "close" {
+				c.CloseWithStatus(4000)
+				continue
+			}
+			c.SendMessage(op, msg)
+		}
+	}
+}
+
+// serve serves s as the fallback of WebSocket connections, which upgrade
+// sessions or are served by the same handler
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, req, err := (&minws.Upgrader{Fallback: s}).Upgrade(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				if !s.Upgrade(c, req) {
+					s.Handler(c, req)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String() + "/poll"
+}
+
+func do(t *testing.T, method, url, body string) (int, *batch) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != minwshttp.StatusOK {
+		return res.StatusCode, nil
+	}
+	var b batch
+	if err := json.NewDecoder(res.Body).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, &b
+}
+
+func open(t *testing.T, addr string) string {
+	t.Helper()
+	_, b := do(t, "GET", "http://"+addr, "")
+	if b == nil || b.Session == "" {
+		t.Fatalf("open: %+v, want session", b)
+	}
+	return "http://" + addr + "?session=" + b.Session
+}
+
+func poll(t *testing.T, session, lastSeq string) *batch {
+	t.Helper()
+	code, b := do(t, "GET", session+"&last_seq="+lastSeq, "")
+	if code != minwshttp.StatusOK {
+		t.Fatalf("poll status = %d", code)
+	}
+	return b
+}
+
+func closeError(t *testing.T, errc <-chan error) int {
+	t.Helper()
+	select {
+	case err := <-errc:
+		var cerr *ws.CloseError
+		if !errors.As(err, &cerr) {
+			t.Fatalf("NextMessage() error = %v, want *ws.CloseError", err)
+		}
+		return cerr.Code
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return")
+	}
+	return 0
+}
+
+func TestServer(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	s.Timeout = 200 * time.Millisecond
+	addr := serve(t, s)
+	session := open(t, addr)
+
+	if code, _ := do(t, "POST", session, `[{"type":"text","data":"a"},{"type":"binary","data":"AP8="}]`); code != minwshttp.StatusNoContent {
+		t.Fatalf("POST status = %d, want %d", code, minwshttp.StatusNoContent)
+	}
+	var got []message
+	for len(got) < 2 {
+		b := poll(t, session, "0")
+		got = b.Messages
+	}
+	want := []message{{1, "text", "a"}, {2, "binary", "AP8="}}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("messages = %+v, want %+v", got, want)
+	}
+
+	// nothing after 2 until timeout
+	start := time.Now()
+	if b := poll(t, session, "2"); len(b.Messages) != 0 || b.Close != 0 {
+		t.Errorf("poll = %+v, want empty", b)
+	}
+	if d := time.Since(start); d < s.Timeout {
+		t.Errorf("poll returned after %v, want >= %v", d, s.Timeout)
+	}
+
+	// a poll is answered as soon as a message is sent
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		http.Post(session, "application/json", strings.NewReader(`[{"type":"text","data":"b"}]`))
+	}()
+	if b := poll(t, session, "2"); len(b.Messages) != 1 || b.Messages[0] != (message{3, "text", "b"}) {
+		t.Errorf("poll = %+v, want b", b)
+	}
+
+	tests := []struct {
+		method, body string
+		want         int
+	}{
+		{"POST", `[{"type":"text"`, minwshttp.StatusBadRequest},
+		{"POST", `[{"type":"close","data":""}]`, minwshttp.StatusBadRequest},
+		{"POST", `[{"type":"binary","data":"!"}]`, minwshttp.StatusBadRequest},
+		{"PUT", "", minwshttp.StatusMethodNotAllowed},
+		{"DELETE", "", minwshttp.StatusNoContent},
+		{"POST", `[]`, minwshttp.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code, _ := do(t, tt.method, session, tt.body); code != tt.want {
+			t.Errorf("%s %s status = %d, want %d", tt.method, tt.body, code, tt.want)
+		}
+	}
+	if got := closeError(t, errc); got != ws.StatusNormalClosure {
+		t.Errorf("close code = %d, want %d", got, ws.StatusNormalClosure)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", s.Len())
+	}
+}
+
+func TestServer_Replaced(t *testing.T) {
+	s := NewServer(echo(make(chan error, 1)))
+	s.Timeout = 2 * time.Second
+	addr := serve(t, s)
+	session := open(t, addr)
+
+	done := make(chan *batch, 1)
+	go func() {
+		var b batch
+		if res, err := http.Get(session + "&last_seq=0"); err == nil {
+			json.NewDecoder(res.Body).Decode(&b)
+			res.Body.Close()
+		}
+		done <- &b
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go http.Get(session + "&last_seq=0")
+	select {
+	case b := <-done:
+		if b.Messages == nil || len(b.Messages) != 0 {
+			t.Errorf("replaced poll = %+v, want empty", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replaced poll did not return")
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	addr := serve(t, s)
+	session := open(t, addr)
+
+	do(t, "POST", session, `[{"type":"text","data":"a"},{"type":"text","data":"close"}]`)
+	if got := closeError(t, errc); got != 4000 {
+		t.Errorf("close code = %d, want 4000", got)
+	}
+	b := poll(t, session, "0")
+	if len(b.Messages) != 1 || b.Messages[0].Data != "a" || b.Close != 4000 {
+		t.Errorf("poll = %+v, want a and close 4000", b)
+	}
+	if code, _ := do(t, "GET", session+"&last_seq=1", ""); code != minwshttp.StatusNotFound {
+		t.Errorf("poll after close status = %d, want %d", code, minwshttp.StatusNotFound)
+	}
+}
+
+func TestServer_Behind(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	s.BufferSize = 1
+	addr := serve(t, s)
+	session := open(t, addr)
+
+	do(t, "POST", session, `[{"type":"text","data":"a"},{"type":"text","data":"b"}]`)
+	for {
+		if b := poll(t, session, "1"); len(b.Messages) > 0 {
+			break
+		}
+	}
+	// a is dropped while unacknowledged
+	if b := poll(t, session, "0"); b.Close != ws.StatusPolicyViolation {
+		t.Errorf("poll = %+v, want close %d", b, ws.StatusPolicyViolation)
+	}
+	if got := closeError(t, errc); got != ws.StatusPolicyViolation {
+		t.Errorf("close code = %d, want %d", got, ws.StatusPolicyViolation)
+	}
+}
+
+func TestServer_Expire(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	s.TTL = 50 * time.Millisecond
+	addr := serve(t, s)
+	open(t, addr)
+
+	if got := closeError(t, errc); got != ws.StatusGoingAway {
+		t.Errorf("close code = %d, want %d", got, ws.StatusGoingAway)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", s.Len())
+	}
+}
+
+func TestServer_Upgrade(t *testing.T) {
+	errc := make(chan error, 2)
+	s := NewServer(echo(errc))
+	addr := serve(t, s)
+	session := open(t, addr)
+
+	do(t, "POST", session, `[{"type":"text","data":"a"},{"type":"text","data":"b"}]`)
+	for {
+		if b := poll(t, session, "0"); len(b.Messages) == 2 {
+			break
+		}
+	}
+
+	// b is sent again, as the client has acknowledged only a
+	c, _, err := (&minws.Dialer{}).Dial("ws://" + strings.TrimPrefix(session, "http://") + "&last_seq=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Rwc.Close()
+	c.Rwc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	read := func() string {
+		t.Helper()
+		msg, err := c.ReadTextMessage()
+		if err != nil {
+			t.Fatalf("ReadTextMessage() error = %v", err)
+		}
+		return msg
+	}
+	if got := read(); got != "b" {
+		t.Errorf("replayed = %q, want b", got)
+	}
+	if b := poll(t, session, "2"); !b.Upgraded {
+		t.Errorf("poll = %+v, want upgraded", b)
+	}
+
+	// the handler serves the session over the WebSocket connection,
+	// which still accepts POST
+	c.SendTextMessage("c")
+	if got := read(); got != "c" {
+		t.Errorf("echo = %q, want c", got)
+	}
+	do(t, "POST", session, `[{"type":"text","data":"d"}]`)
+	if got := read(); got != "d" {
+		t.Errorf("echo = %q, want d", got)
+	}
+
+	c.CloseWithStatus(ws.StatusGoingAway)
+	if got := closeError(t, errc); got != ws.StatusGoingAway {
+		t.Errorf("close code = %d, want %d", got, ws.StatusGoingAway)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", s.Len())
+	}
+
+	// a WebSocket connection without session is a new connection
+	c, _, err = (&minws.Dialer{}).Dial("ws://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Rwc.Close()
+	c.SendTextMessage("e")
+	if got := read(); got != "e" {
+		t.Errorf("echo = %q, want e", got)
+	}
+}
+
+func TestConn_upgrade_SendError(t *testing.T) {
+	c := newConn(NewServer(nil), "s", nil)
+	defer c.expiry.Stop()
+	c.SendTextMessage("a")
+
+	server, client := net.Pipe()
+	client.Close()
+	if !c.upgrade(ws.NewServerConn(server, bufio.NewReader(server)), 0) {
+		t.Fatal("upgrade() = false")
+	}
+
+	// the session stays on polls with the message
+	b, _, err := c.batchAfter(0, c.attach())
+	if err != nil {
+		t.Fatalf("batchAfter() error = %v", err)
+	}
+	if b.Upgraded || len(b.Messages) != 1 || b.Messages[0].Data != "a" {
+		t.Errorf("batchAfter() = %+v, want message a", b)
+	}
+}
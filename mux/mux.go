@@ -0,0 +1,236 @@
+// Package mux multiplexes independent bidirectional streams over a
+// WebSocket connection.
+//
+// Each frame is sent in a binary message of a header and a payload:
+//
+//	+--------+--------------------+-----------+
+//	| type 8 | stream id 32 (BE)  | payload   |
+//	+--------+--------------------+-----------+
+//
+// Streams opened by the client have odd ids and those opened by the server
+// have even ids. The receiver grants the sender a window of bytes it may
+// send, and extends it by window updates as the data is read.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/cou929/minws/ws"
+)
+
+// Frame types
+const (
+	typeOpen   = 0
+	typeData   = 1
+	typeClose  = 2 // the sender sends no more data
+	typeWindow = 3 // payload is the window increment (32 bit BE)
+	typeReset  = 4 // the stream is aborted
+)
+
+const headerLen = 5
+
+// Defaults of Session
+const (
+	DefaultWindow      = 256 << 10
+	DefaultMaxFrame    = 32 << 10
+	DefaultAcceptQueue = 64
+)
+
+// Errors
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+	ErrStreamReset   = errors.New("mux: stream reset by peer")
+)
+
+// Session carries streams on a connection
+type Session struct {
+	conn *ws.Conn
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error // set when closed
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// Client starts a session on the client side of the connection
+func Client(c *ws.Conn) *Session {
+	return newSession(c, 1)
+}
+
+// Server starts a session on the server side of the connection
+func Server(c *ws.Conn) *Session {
+	return newSession(c, 2)
+}
+
+func newSession(c *ws.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:    c,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		accept:  make(chan *Stream, DefaultAcceptQueue),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open opens a new stream
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(typeOpen, id, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for a stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+// NumStreams returns the number of open streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Close closes the session and all streams, and the connection
+func (s *Session) Close() error {
+	s.conn.Close()
+	s.shutdown(ErrSessionClosed)
+	return nil
+}
+
+// Done is closed when the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+
+	close(s.done)
+	for _, st := range streams {
+		st.abort(err)
+	}
+}
+
+func (s *Session) readLoop() {
+	for {
+		op, msg, err := s.conn.NextMessage()
+		if err != nil {
+			s.shutdown(ErrSessionClosed)
+			return
+		}
+		if op != ws.OpCodeBinary || len(msg) < headerLen {
+			continue
+		}
+		s.handleFrame(msg[0], binary.BigEndian.Uint32(msg[1:]), msg[headerLen:])
+	}
+}
+
+func (s *Session) handleFrame(typ byte, id uint32, payload []byte) {
+	if typ == typeOpen {
+		s.handleOpen(id)
+		return
+	}
+	s.mu.Lock()
+	st, ok := s.streams[id]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	switch typ {
+	case typeData:
+		if !st.receive(payload) {
+			// the peer overran the window
+			s.writeFrame(typeReset, id, nil)
+			s.remove(id)
+			st.abort(ErrStreamReset)
+		}
+	case typeClose:
+		st.receiveClose()
+	case typeWindow:
+		if len(payload) == 4 {
+			st.grant(int(binary.BigEndian.Uint32(payload)))
+		}
+	case typeReset:
+		s.remove(id)
+		st.abort(ErrStreamReset)
+	}
+}
+
+func (s *Session) handleOpen(id uint32) {
+	s.mu.Lock()
+	// the id must be of the peer and not in use
+	if s.err != nil || id%2 == s.nextID%2 || s.streams[id] != nil {
+		s.mu.Unlock()
+		s.writeFrame(typeReset, id, nil)
+		return
+	}
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		// nobody accepts streams
+		s.remove(id)
+		s.writeFrame(typeReset, id, nil)
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	b := make([]byte, headerLen+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], id)
+	copy(b[headerLen:], payload)
+	if err := s.conn.SendBinaryMessage(b); err != nil {
+		s.shutdown(ErrSessionClosed)
+		return ErrSessionClosed
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+func newPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+	sc, cc := net.Pipe()
+	server := Server(ws.NewConn(sc))
+	client := Client(ws.NewClientConn(cc, bufio.NewReader(cc)))
+	t.Cleanup(func() {
+		sc.Close()
+		cc.Close()
+	})
+	return server, client
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSession_Streams(t *testing.T) {
+	server, client := newPair(t)
+
+	// the server echoes streams opened by the client
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if st.ID()%2 != 1 {
+				t.Errorf("client stream id = %d, want odd", st.ID())
+			}
+			// larger than the window to exercise flow control
+			data := make([]byte, 3*DefaultWindow+i)
+			rand.New(rand.NewSource(int64(i))).Read(data)
+			go func() {
+				st.Write(data)
+				st.Close()
+			}()
+			got, err := ioutil.ReadAll(st)
+			if err != nil {
+				t.Errorf("stream %d: ReadAll() error = %v", st.ID(), err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("stream %d: echoed %d bytes, want %d", st.ID(), len(got), len(data))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	waitFor(t, func() bool { return client.NumStreams() == 0 && server.NumStreams() == 0 })
+}
+
+func TestSession_ServerOpen(t *testing.T) {
+	server, client := newPair(t)
+	st, err := server.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID()%2 != 0 {
+		t.Errorf("server stream id = %d, want even", st.ID())
+	}
+	go st.Write([]byte("hello"))
+	cst, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cst.ID() != st.ID() {
+		t.Errorf("accepted id = %d, want %d", cst.ID(), st.ID())
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(cst, b); err != nil || string(b) != "hello" {
+		t.Errorf("Read() = %q, %v", b, err)
+	}
+
+	// writes fail after close, reads continue until EOF
+	st.Close()
+	if _, err := st.Write([]byte("x")); err != ErrStreamClosed {
+		t.Errorf("Write() after Close error = %v, want ErrStreamClosed", err)
+	}
+	if _, err := cst.Read(b); err != io.EOF {
+		t.Errorf("Read() error = %v, want EOF", err)
+	}
+	if _, err := cst.Write([]byte("bye")); err != nil {
+		t.Errorf("Write() on half closed stream error = %v", err)
+	}
+	if _, err := io.ReadFull(st, b[:3]); err != nil || string(b[:3]) != "bye" {
+		t.Errorf("Read() = %q, %v", b[:3], err)
+	}
+}
+
+func TestStream_FlowControl(t *testing.T) {
+	server, client := newPair(t)
+	st, _ := client.Open()
+	sst, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan int, 1)
+	go func() {
+		n, _ := st.Write(make([]byte, DefaultWindow+1))
+		written <- n
+	}()
+	select {
+	case n := <-written:
+		t.Fatalf("Write() of %d bytes returned beyond the window", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := io.ReadFull(sst, make([]byte, DefaultWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-written:
+		if n != DefaultWindow+1 {
+			t.Errorf("Write() = %d, want %d", n, DefaultWindow+1)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write() is not unblocked by window update")
+	}
+}
+
+func TestStream_Reset(t *testing.T) {
+	server, client := newPair(t)
+	st, _ := client.Open()
+	sst, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Reset()
+	if _, err := sst.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("Read() error = %v, want ErrStreamReset", err)
+	}
+	waitFor(t, func() bool { return client.NumStreams() == 0 && server.NumStreams() == 0 })
+}
+
+func TestSession_Close(t *testing.T) {
+	server, client := newPair(t)
+	st, _ := client.Open()
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		errc <- err
+	}()
+	server.Close()
+
+	select {
+	case err := <-errc:
+		if err != ErrSessionClosed {
+			t.Errorf("Read() error = %v, want ErrSessionClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read() is not unblocked by session close")
+	}
+	<-client.Done()
+	if _, err := client.Open(); err != ErrSessionClosed {
+		t.Errorf("Open() error = %v, want ErrSessionClosed", err)
+	}
+	if _, err := server.Accept(); err != ErrSessionClosed {
+		t.Errorf("Accept() error = %v, want ErrSessionClosed", err)
+	}
+}
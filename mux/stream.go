@@ -0,0 +1,186 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+var _ io.ReadWriteCloser = (*Stream)(nil)
+
+// Stream is a bidirectional stream in a session
+type Stream struct {
+	id uint32
+	s  *Session
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// receiving side
+	buf        []byte
+	recvWindow int // bytes the peer may send
+	consumed   int // bytes read but not granted to the peer yet
+	remoteEOF  bool
+
+	// sending side
+	sendWindow int
+	localEOF   bool
+
+	err error // set when aborted
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		id:         id,
+		s:          s,
+		recvWindow: DefaultWindow,
+		sendWindow: DefaultWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID returns the stream id
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads data sent by the peer. It returns io.EOF after the peer
+// closed the stream.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 && !st.remoteEOF && st.err == nil {
+		st.cond.Wait()
+	}
+	if len(st.buf) == 0 {
+		defer st.mu.Unlock()
+		if st.err != nil {
+			return 0, st.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	st.consumed += n
+	// grant the window back in batches
+	var grant int
+	if st.consumed >= DefaultWindow/2 {
+		grant = st.consumed
+		st.recvWindow += grant
+		st.consumed = 0
+	}
+	st.mu.Unlock()
+
+	if grant > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(grant))
+		st.s.writeFrame(typeWindow, st.id, b[:])
+	}
+	return n, nil
+}
+
+// Write sends p to the peer, blocking while the window is exhausted
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.localEOF {
+			st.cond.Wait()
+		}
+		if st.err != nil || st.localEOF {
+			err := st.err
+			if err == nil {
+				err = ErrStreamClosed
+			}
+			st.mu.Unlock()
+			return written, err
+		}
+		n := len(p)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > DefaultMaxFrame {
+			n = DefaultMaxFrame
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.s.writeFrame(typeData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close tells the peer that no more data is sent. The stream is removed
+// from the session when both sides have closed it.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localEOF || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localEOF = true
+	done := st.remoteEOF
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	err := st.s.writeFrame(typeClose, st.id, nil)
+	if done {
+		st.s.remove(st.id)
+	}
+	return err
+}
+
+// Reset aborts the stream in both directions
+func (st *Stream) Reset() error {
+	st.s.remove(st.id)
+	st.abort(ErrStreamClosed)
+	return st.s.writeFrame(typeReset, st.id, nil)
+}
+
+// receive appends data from the peer. It returns false if the data
+// exceeds the window.
+func (st *Stream) receive(p []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err != nil || st.remoteEOF {
+		return true
+	}
+	if len(p) > st.recvWindow {
+		return false
+	}
+	st.recvWindow -= len(p)
+	st.buf = append(st.buf, p...)
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *Stream) receiveClose() {
+	st.mu.Lock()
+	st.remoteEOF = true
+	done := st.localEOF
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if done {
+		st.s.remove(st.id)
+	}
+}
+
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+func (st *Stream) abort(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+}
@@ -0,0 +1,181 @@
+// Package process serves WebSocket connections with a process per
+// connection like websocketd. Text messages are written to the stdin of
+// the process as lines, and lines of its stdout are sent back as text
+// messages.
+package process
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// Defaults of Handler
+const (
+	DefaultKillTimeout = time.Second
+	maxLineBytes       = 1 << 20
+	closeTimeout       = 5 * time.Second
+)
+
+// ServerSoftware is set to SERVER_SOFTWARE of processes
+const ServerSoftware = "minws"
+
+// Handler runs Command for each connection
+type Handler struct {
+	Command string
+	Args    []string
+	Dir     string
+	// Env is added to the environment of the process, in the form of
+	// "key=value"
+	Env []string
+	// KillTimeout is the wait between SIGINT and SIGKILL when the client
+	// disconnects
+	KillTimeout time.Duration
+}
+
+// Serve runs the process and relays messages until either the process
+// exits or the client disconnects. The exit of the process closes the
+// connection with 1000 if the exit status is 0, and 1011 otherwise.
+// The disconnect of the client kills the process.
+func (h *Handler) Serve(c *ws.Conn, req *minwshttp.Request) error {
+	cmd := exec.Command(h.Command, h.Args...)
+	cmd.Dir = h.Dir
+	cmd.Env = append(h.environ(c, req), h.Env...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		c.CloseWithStatus(ws.StatusInternalError)
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		c.CloseWithStatus(ws.StatusInternalError)
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		c.CloseWithStatus(ws.StatusInternalError)
+		return err
+	}
+
+	exited := make(chan struct{})
+	disconnected := make(chan struct{})
+	go func() {
+		defer close(disconnected)
+		for {
+			op, msg, err := c.NextMessage()
+			if err != nil {
+				break
+			}
+			if op != ws.OpCodeText {
+				continue
+			}
+			if _, err := stdin.Write(append(msg, '\n')); err != nil {
+				break
+			}
+		}
+		stdin.Close()
+		h.stop(cmd, exited)
+	}()
+
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 4096), maxLineBytes)
+	for sc.Scan() {
+		if err := c.SendTextMessage(sc.Text()); err != nil {
+			break
+		}
+	}
+	// the client has gone if sending failed, and the process is being
+	// stopped. Drain the rest so that it does not block on stdout.
+	io.Copy(ioutil.Discard, stdout)
+	err = cmd.Wait()
+	close(exited)
+
+	status := ws.StatusNormalClosure
+	if err != nil {
+		status = ws.StatusInternalError
+	}
+	c.CloseWithStatus(status)
+	c.Rwc.SetReadDeadline(time.Now().Add(closeTimeout))
+	<-disconnected
+
+	var eerr *exec.ExitError
+	if errors.As(err, &eerr) {
+		// exit status is reported to the client
+		return nil
+	}
+	return err
+}
+
+// stop interrupts the process and kills it unless it exits in time
+func (h *Handler) stop(cmd *exec.Cmd, exited <-chan struct{}) {
+	timeout := h.KillTimeout
+	if timeout == 0 {
+		timeout = DefaultKillTimeout
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+		return
+	}
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+	}
+}
+
+// environ returns CGI style environment variables of the request
+// See: https://tools.ietf.org/html/rfc3875#section-4.1
+func (h *Handler) environ(c *ws.Conn, req *minwshttp.Request) []string {
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=" + ServerSoftware,
+		"SERVER_PROTOCOL=" + req.Proto,
+		"REQUEST_METHOD=" + req.Method,
+		"REQUEST_URI=" + req.RequestURI,
+		"SCRIPT_NAME=" + h.Command,
+	}
+	if path := os.Getenv("PATH"); path != "" {
+		env = append(env, "PATH="+path)
+	}
+	if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		env = append(env, "PATH_INFO="+u.Path, "QUERY_STRING="+u.RawQuery)
+	}
+	if host, port, err := net.SplitHostPort(c.Rwc.RemoteAddr().String()); err == nil {
+		env = append(env, "REMOTE_ADDR="+host, "REMOTE_PORT="+port)
+	}
+	if host, port, err := net.SplitHostPort(c.Rwc.LocalAddr().String()); err == nil {
+		env = append(env, "SERVER_NAME="+host, "SERVER_PORT="+port)
+	}
+	for k, v := range req.Header {
+		// Proxy would set HTTP_PROXY, which many programs take as their
+		// proxy (httpoxy), so it is dropped as CGI servers do
+		// https://httpoxy.org/
+		if strings.EqualFold(k, "Proxy") || !validEnvName(k) {
+			continue
+		}
+		env = append(env, "HTTP_"+strings.ToUpper(strings.ReplaceAll(k, "-", "_"))+"="+v)
+	}
+	return env
+}
+
+// validEnvName reports whether the header name maps to a portable
+// environment variable name, that is, it consists of [A-Za-z0-9-]
+func validEnvName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return name != ""
+}
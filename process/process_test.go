@@ -0,0 +1,165 @@
+package process
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws"
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+const script = `
+echo "hello $QUERY_STRING $PATH_INFO $HTTP_X_USER $REQUEST_METHOD $EXTRA"
+while read line; do
+	case "$line" in
+	exit*) exit ${line#exit } ;;
+	*) echo "got $line" ;;
+	esac
+done
+`
+
+func serve(t *testing.T, h *Handler) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	errc := make(chan error, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, req, err := (&minws.Upgrader{}).Upgrade(conn)
+				if err != nil {
+					return
+				}
+				errc <- h.Serve(c, req)
+			}()
+		}
+	}()
+	return "ws://" + l.Addr().String(), errc
+}
+
+func read(t *testing.T, c *ws.Conn) string {
+	t.Helper()
+	c.Rwc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := c.ReadTextMessage()
+	if err != nil {
+		t.Fatalf("ReadTextMessage() error = %v", err)
+	}
+	return msg
+}
+
+func TestHandler_Serve(t *testing.T) {
+	h := &Handler{Command: "sh", Args: []string{"-c", script}, Env: []string{"EXTRA=extra"}}
+	url, errc := serve(t, h)
+
+	tests := []struct {
+		exit     string
+		wantCode int
+	}{
+		{"exit 0", ws.StatusNormalClosure},
+		{"exit 3", ws.StatusInternalError},
+	}
+	for _, tt := range tests {
+		d := &minws.Dialer{Header: minwshttp.Header{"X-User": "alice"}}
+		c, _, err := d.Dial(url + "/path?a=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := read(t, c), "hello a=1 /path alice GET extra"; got != want {
+			t.Errorf("greeting = %q, want %q", got, want)
+		}
+		c.SendTextMessage("one")
+		c.SendTextMessage("two")
+		for _, want := range []string{"got one", "got two"} {
+			if got := read(t, c); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}
+
+		c.SendTextMessage(tt.exit)
+		c.Rwc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err = c.NextMessage()
+		var cerr *ws.CloseError
+		if !errors.As(err, &cerr) || cerr.Code != tt.wantCode {
+			t.Errorf("%s: NextMessage() error = %v, want close %d", tt.exit, err, tt.wantCode)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	}
+}
+
+func TestHandler_Serve_Disconnect(t *testing.T) {
+	// sleep ignores stdin, so that it must be killed
+	h := &Handler{Command: "sh", Args: []string{"-c", "echo started; exec sleep 30"}, KillTimeout: 10 * time.Millisecond}
+	url, errc := serve(t, h)
+
+	c, _, err := minws.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(t, c)
+	c.Rwc.Close()
+
+	select {
+	case <-errc:
+	case <-time.After(2 * time.Second):
+		t.Fatal("process is not killed on disconnect")
+	}
+}
+
+func TestHandler_Serve_NotFound(t *testing.T) {
+	url, errc := serve(t, &Handler{Command: "./no-such-command"})
+	c, _, err := minws.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Rwc.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.NextMessage()
+	var cerr *ws.CloseError
+	if !errors.As(err, &cerr) || cerr.Code != ws.StatusInternalError {
+		t.Errorf("NextMessage() error = %v, want close %d", err, ws.StatusInternalError)
+	}
+	if err := <-errc; err == nil {
+		t.Error("Serve() error = nil")
+	}
+}
+
+func TestHandler_environ(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	req := &minwshttp.Request{
+		Method:     "GET",
+		RequestURI: "/",
+		Proto:      "HTTP/1.1",
+		Header: minwshttp.Header{
+			"X-User": "alice",
+			"Proxy":  "http://attacker.example",
+			"X.Evil": "1",
+		},
+	}
+	env := (&Handler{Command: "sh"}).environ(ws.NewConn(server), req)
+
+	has := make(map[string]bool)
+	for _, kv := range env {
+		has[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	if !has["HTTP_X_USER"] {
+		t.Errorf("HTTP_X_USER is missing in %v", env)
+	}
+	for _, name := range []string{"HTTP_PROXY", "HTTP_X.EVIL"} {
+		if has[name] {
+			t.Errorf("%s is set in %v", name, env)
+		}
+	}
+}
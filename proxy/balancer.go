@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+
+	minwshttp "github.com/cou929/minws/http"
+)
+
+// Policy is a strategy to pick a backend
+type Policy int
+
+// Policies
+const (
+	RoundRobin Policy = iota
+	LeastConnections
+	// ConsistentHash picks the backend by the hash of HashHeader or
+	// HashCookie of the request, so that a client sticks to a backend.
+	// Requests without the key are distributed by round robin.
+	ConsistentHash
+)
+
+// replicas is the number of points of a backend on the hash ring
+const replicas = 100
+
+type ringPoint struct {
+	hash    uint32
+	backend int
+}
+
+// buildRing places replicas of backends on the hash ring
+func buildRing(backends []string) []ringPoint {
+	ring := make([]ringPoint, 0, len(backends)*replicas)
+	for i, b := range backends {
+		for r := 0; r < replicas; r++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(r) + "-" + b))
+			ring = append(ring, ringPoint{hash: h, backend: i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// lookupRing returns the backend of the first point at or after the hash
+// of key
+func lookupRing(ring []ringPoint, key string) int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].backend
+}
+
+// cookie returns the value of the cookie in the Cookie header
+func cookie(h minwshttp.Header, name string) string {
+	for _, c := range strings.Split(h.Get("Cookie"), ";") {
+		c = strings.TrimSpace(c)
+		if i := strings.IndexByte(c, '='); i > 0 && c[:i] == name {
+			return strings.Trim(c[i+1:], `"`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,230 @@
+// Package proxy implements a reverse proxy to backend WebSocket servers.
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cou929/minws"
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// closeTimeout bounds the wait for the closing handshake of the other side
+const closeTimeout = 5 * time.Second
+
+// ErrNoBackend is returned when no backend is configured
+var ErrNoBackend = errors.New("proxy: no backend")
+
+// Proxy accepts WebSocket connections and relays them to backends
+type Proxy struct {
+	// Backends are URLs of backend servers like ws://10.0.0.1:8080.
+	// The request URI of the client is appended to the path.
+	Backends []string
+	Policy   Policy
+	// HashHeader and HashCookie name the key of ConsistentHash
+	HashHeader string
+	HashCookie string
+	// ForwardHeaders are request headers sent to the backend as well.
+	// X-Forwarded-For is always added.
+	ForwardHeaders []string
+	// Upgrader is used for the handshake with clients. Negotiate is set
+	// per request.
+	Upgrader minws.Upgrader
+	// Dialer is used to connect to backends. TLSConfig and Timeout are
+	// respected, and the other fields are set per request.
+	Dialer minws.Dialer
+	// MaxMessageSize limits the size of a message from either side. 0
+	// means ws.DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	mu    sync.Mutex
+	next  int
+	conns map[string]int
+	ring  []ringPoint
+	// ringOf is the copy of Backends the ring was built from
+	ringOf []string
+}
+
+// Pick returns the backend for the request according to the policy, and
+// counts a connection to it at once, so that concurrent handshakes see
+// each other for LeastConnections. Done must be called when the
+// connection ends or fails.
+func (p *Proxy) Pick(req *minwshttp.Request) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.Backends) == 0 {
+		return "", ErrNoBackend
+	}
+	b := p.pick(req)
+	if p.conns == nil {
+		p.conns = make(map[string]int)
+	}
+	p.conns[b]++
+	return b, nil
+}
+
+// Done releases the connection counted by Pick
+func (p *Proxy) Done(backend string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[backend]--; p.conns[backend] <= 0 {
+		delete(p.conns, backend)
+	}
+}
+
+// pick must be called with p.mu held
+func (p *Proxy) pick(req *minwshttp.Request) string {
+	switch p.Policy {
+	case LeastConnections:
+		best := 0
+		for i, b := range p.Backends {
+			if p.conns[b] < p.conns[p.Backends[best]] {
+				best = i
+			}
+		}
+		return p.Backends[best]
+	case ConsistentHash:
+		if key := p.hashKey(req); key != "" {
+			if !equal(p.ringOf, p.Backends) {
+				p.ring = buildRing(p.Backends)
+				p.ringOf = append([]string(nil), p.Backends...)
+			}
+			return p.Backends[lookupRing(p.ring, key)]
+		}
+	}
+	b := p.Backends[p.next%len(p.Backends)]
+	p.next++
+	return b
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Proxy) hashKey(req *minwshttp.Request) string {
+	if p.HashHeader != "" {
+		if v := req.Header.Get(p.HashHeader); v != "" {
+			return v
+		}
+	}
+	if p.HashCookie != "" {
+		return cookie(req.Header, p.HashCookie)
+	}
+	return ""
+}
+
+// Conns returns the number of connections of the backend, including
+// those in the opening handshake
+func (p *Proxy) Conns(backend string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns[backend]
+}
+
+// Serve performs the opening handshake with the client, connecting to a
+// backend in the middle of it so that the subprotocol agreed with the
+// backend is returned to the client. Then it relays messages until
+// either side closes.
+func (p *Proxy) Serve(tcpConn net.Conn) error {
+	var backend string
+	var bc *ws.Conn
+	u := p.Upgrader
+	u.Negotiate = func(req *minwshttp.Request) (string, error) {
+		var err error
+		if backend, err = p.Pick(req); err != nil {
+			return "", err
+		}
+		bc, err = p.dial(backend, req, tcpConn.RemoteAddr())
+		if err != nil {
+			p.Done(backend)
+			return "", err
+		}
+		return bc.Subprotocol, nil
+	}
+	c, _, err := u.Upgrade(tcpConn)
+	if err != nil {
+		if bc != nil {
+			bc.Rwc.Close()
+			p.Done(backend)
+		}
+		return err
+	}
+	defer p.Done(backend)
+
+	c.MaxMessageSize = p.MaxMessageSize
+	bc.MaxMessageSize = p.MaxMessageSize
+	relay(c, bc)
+	return nil
+}
+
+// dial performs the opening handshake with the backend on behalf of the
+// client
+func (p *Proxy) dial(backend string, req *minwshttp.Request, remote net.Addr) (*ws.Conn, error) {
+	d := p.Dialer
+	d.Header = make(minwshttp.Header)
+	for _, k := range p.ForwardHeaders {
+		if req.Header.Has(k) {
+			d.Header[k] = req.Header.Get(k)
+		}
+	}
+	if host, _, err := net.SplitHostPort(remote.String()); err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		d.Header["X-Forwarded-For"] = host
+	}
+	d.Subprotocols = nil
+	for _, s := range strings.Split(req.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			d.Subprotocols = append(d.Subprotocols, s)
+		}
+	}
+	c, _, err := d.Dial(strings.TrimSuffix(backend, "/") + req.RequestURI)
+	return c, err
+}
+
+// relay copies messages in both directions and propagates the close
+func relay(client, backend *ws.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		copyMessages(backend, client)
+	}()
+	copyMessages(client, backend)
+	<-done
+}
+
+// copyMessages sends messages from src to dst keeping their opcodes.
+// When src is closed with a close frame, the code is sent to dst and its
+// reply is waited for. Otherwise dst is closed abruptly as well.
+func copyMessages(dst, src *ws.Conn) {
+	for {
+		op, msg, err := src.NextMessage()
+		if err != nil {
+			var cerr *ws.CloseError
+			if errors.As(err, &cerr) {
+				dst.CloseWithStatus(cerr.Code)
+				dst.Rwc.SetReadDeadline(time.Now().Add(closeTimeout))
+			} else {
+				dst.Rwc.Close()
+			}
+			return
+		}
+		if err := dst.SendMessage(op, msg); err != nil {
+			src.Rwc.Close()
+			return
+		}
+	}
+}
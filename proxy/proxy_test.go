@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws"
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// backend runs a WebSocket server which greets with its name and the
+// request, echoes messages, closes with the code of "close <code>" and
+// reports close codes from the client to closed
+type backend struct {
+	name   string
+	url    string
+	closed chan int
+}
+
+func newBackend(t *testing.T, name string) *backend {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b := &backend{name: name, url: "ws://" + l.Addr().String(), closed: make(chan int, 10)}
+	u := &minws.Upgrader{Subprotocols: []string{"chat.v2", "chat.v1"}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, req, err := u.Upgrade(conn)
+				if err != nil {
+					return
+				}
+				c.SendTextMessage(fmt.Sprintf("%s %s proto=%s xff=%s user=%s",
+					name, req.RequestURI, c.Subprotocol,
+					req.Header.Get("X-Forwarded-For"), req.Header.Get("X-User")))
+				for {
+					op, msg, err := c.NextMessage()
+					var cerr *ws.CloseError
+					if errors.As(err, &cerr) {
+						b.closed <- cerr.Code
+					}
+					if err != nil {
+						return
+					}
+					if s := string(msg); strings.HasPrefix(s, "close ") {
+						code, _ := strconv.Atoi(s[6:])
+						c.CloseWithStatus(code)
+						continue
+					}
+					c.SendMessage(op, msg)
+				}
+			}()
+		}
+	}()
+	return b
+}
+
+func serve(t *testing.T, p *Proxy) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.Serve(conn)
+		}
+	}()
+	return "ws://" + l.Addr().String()
+}
+
+// greeting connects to the proxy and returns the greeting of the backend
+func greeting(t *testing.T, d *minws.Dialer, url string) (*ws.Conn, string) {
+	t.Helper()
+	c, _, err := d.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Rwc.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := c.ReadTextMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Rwc.SetReadDeadline(time.Time{})
+	return c, msg
+}
+
+func TestProxy_Relay(t *testing.T) {
+	b := newBackend(t, "a")
+	p := &Proxy{Backends: []string{b.url}, ForwardHeaders: []string{"X-User"}}
+	url := serve(t, p)
+
+	d := &minws.Dialer{Subprotocols: []string{"chat.v1", "chat.v2"}, Header: minwshttp.Header{"X-User": "alice"}}
+	c, msg := greeting(t, d, url+"/room/1?x=y")
+	want := "a /room/1?x=y proto=chat.v2 xff=127.0.0.1 user=alice"
+	if msg != want {
+		t.Errorf("greeting = %q, want %q", msg, want)
+	}
+	if c.Subprotocol != "chat.v2" {
+		t.Errorf("Subprotocol = %q, want chat.v2", c.Subprotocol)
+	}
+
+	// message boundaries and opcodes are preserved
+	msgs := []struct {
+		op  ws.OpCode
+		msg string
+	}{
+		{ws.OpCodeText, "hello"},
+		{ws.OpCodeBinary, "\x00\x01"},
+		{ws.OpCodeText, ""},
+		{ws.OpCodeBinary, strings.Repeat("x", 70000)},
+	}
+	for _, m := range msgs {
+		c.SendMessage(m.op, []byte(m.msg))
+	}
+	for _, m := range msgs {
+		op, got, err := c.NextMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != m.op || string(got) != m.msg {
+			t.Errorf("got %v %d bytes, want %v %d bytes", op, len(got), m.op, len(m.msg))
+		}
+	}
+
+	// close code of the client is relayed to the backend
+	c.CloseWithStatus(4001)
+	if _, _, err := c.NextMessage(); err == nil {
+		t.Error("NextMessage() after close succeeded")
+	}
+	select {
+	case code := <-b.closed:
+		if code != 4001 {
+			t.Errorf("backend received close %d, want 4001", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("backend did not receive close")
+	}
+
+	// close code of the backend is relayed to the client
+	c, _ = greeting(t, d, url)
+	c.SendTextMessage("close 4002")
+	_, _, err := c.NextMessage()
+	var cerr *ws.CloseError
+	if !errors.As(err, &cerr) || cerr.Code != 4002 {
+		t.Errorf("NextMessage() error = %v, want close 4002", err)
+	}
+	waitFor(t, func() bool { return p.Conns(b.url) == 0 })
+}
+
+func TestProxy_Policy(t *testing.T) {
+	var backends []*backend
+	var urls []string
+	for _, name := range []string{"a", "b", "c"} {
+		b := newBackend(t, name)
+		backends = append(backends, b)
+		urls = append(urls, b.url)
+	}
+	name := func(greeting string) string { return strings.Fields(greeting)[0] }
+
+	t.Run("round robin", func(t *testing.T) {
+		url := serve(t, &Proxy{Backends: urls})
+		var got []string
+		for i := 0; i < 6; i++ {
+			c, msg := greeting(t, &minws.Dialer{}, url)
+			got = append(got, name(msg))
+			c.Rwc.Close()
+		}
+		if s := strings.Join(got, ""); s != "abcabc" {
+			t.Errorf("backends = %s, want abcabc", s)
+		}
+	})
+
+	t.Run("least connections", func(t *testing.T) {
+		p := &Proxy{Backends: urls, Policy: LeastConnections}
+		url := serve(t, p)
+		var got []string
+		for i := 0; i < 3; i++ {
+			_, msg := greeting(t, &minws.Dialer{}, url)
+			got = append(got, name(msg))
+		}
+		if s := strings.Join(got, ""); s != "abc" {
+			t.Errorf("backends = %s, want abc", s)
+		}
+		// b has the least connections after a connection to it is closed
+		c, msg := greeting(t, &minws.Dialer{}, url)
+		c.Rwc.Close()
+		waitFor(t, func() bool { return p.Conns(urls[0]) == 1 })
+		if name(msg) != "a" {
+			t.Fatalf("backend = %s, want a", name(msg))
+		}
+		hold, _ := greeting(t, &minws.Dialer{}, url)
+		defer hold.Rwc.Close()
+		if _, msg := greeting(t, &minws.Dialer{}, url); name(msg) != "b" {
+			t.Errorf("backend = %s, want b", name(msg))
+		}
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		url := serve(t, &Proxy{Backends: urls, Policy: ConsistentHash, HashHeader: "X-User", HashCookie: "sid"})
+		seen := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			d := &minws.Dialer{Header: minwshttp.Header{"Cookie": fmt.Sprintf("theme=dark; sid=%d", i)}}
+			c, first := greeting(t, d, url)
+			c.Rwc.Close()
+			for j := 0; j < 3; j++ {
+				c, msg := greeting(t, d, url)
+				c.Rwc.Close()
+				if name(msg) != name(first) {
+					t.Fatalf("sid=%d: backend = %s, want sticky %s", i, name(msg), name(first))
+				}
+			}
+			seen[name(first)] = true
+		}
+		if len(seen) != 3 {
+			t.Errorf("keys are mapped to %d backends, want 3", len(seen))
+		}
+
+		d := &minws.Dialer{Header: minwshttp.Header{"X-User": "alice", "Cookie": "sid=1"}}
+		c, first := greeting(t, d, url)
+		c.Rwc.Close()
+		d.Header["Cookie"] = "sid=2"
+		if c, msg := greeting(t, d, url); name(msg) != name(first) {
+			t.Errorf("header is not preferred to cookie")
+		} else {
+			c.Rwc.Close()
+		}
+	})
+}
+
+func TestProxy_Pick(t *testing.T) {
+	t.Run("least connections counts picks at once", func(t *testing.T) {
+		p := &Proxy{Backends: []string{"a", "b"}, Policy: LeastConnections}
+		req := &minwshttp.Request{Header: minwshttp.Header{}}
+		var got []string
+		for i := 0; i < 4; i++ {
+			b, err := p.Pick(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, b)
+		}
+		if s := strings.Join(got, ""); s != "abab" {
+			t.Errorf("backends = %s, want abab", s)
+		}
+		p.Done("a")
+		if b, _ := p.Pick(req); b != "a" {
+			t.Errorf("backend after Done = %s, want a", b)
+		}
+	})
+
+	t.Run("ring is rebuilt when a backend is replaced", func(t *testing.T) {
+		p := &Proxy{Backends: []string{"a", "b"}, Policy: ConsistentHash, HashHeader: "X-User"}
+		for i := 0; i < 20; i++ {
+			p.Pick(&minwshttp.Request{Header: minwshttp.Header{"X-User": strconv.Itoa(i)}})
+		}
+		p.Backends = []string{"a", "c"}
+		fresh := &Proxy{Backends: []string{"a", "c"}, Policy: ConsistentHash, HashHeader: "X-User"}
+		for i := 0; i < 20; i++ {
+			req := &minwshttp.Request{Header: minwshttp.Header{"X-User": strconv.Itoa(i)}}
+			got, _ := p.Pick(req)
+			want, _ := fresh.Pick(req)
+			if got != want {
+				t.Errorf("key %d is mapped to %s, want %s", i, got, want)
+			}
+		}
+	})
+}
+
+func TestProxy_MaxMessageSize(t *testing.T) {
+	b := newBackend(t, "a")
+	url := serve(t, &Proxy{Backends: []string{b.url}, MaxMessageSize: 100})
+
+	c, _ := greeting(t, &minws.Dialer{}, url)
+	c.SendTextMessage(strings.Repeat("x", 101))
+	c.Rwc.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := c.NextMessage()
+	var cerr *ws.CloseError
+	if !errors.As(err, &cerr) || cerr.Code != ws.StatusMessageTooBig {
+		t.Errorf("NextMessage() error = %v, want close %d", err, ws.StatusMessageTooBig)
+	}
+}
+
+func TestProxy_BadGateway(t *testing.T) {
+	url := serve(t, &Proxy{Backends: []string{"ws://127.0.0.1:1"}})
+	_, res, err := minws.Dial(url)
+	if err == nil {
+		t.Fatal("Dial() succeeded")
+	}
+	if res == nil || res.StatusCode != minwshttp.StatusBadGateway {
+		t.Errorf("response = %+v, want 502", res)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
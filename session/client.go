@@ -0,0 +1,104 @@
+package session
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cou929/minws"
+	"github.com/cou929/minws/ws"
+)
+
+// Client is the client side of a session, which resumes it on reconnect
+// and acknowledges received messages
+type Client struct {
+	Dialer *minws.Dialer
+
+	// ID is the current session id, empty until connected
+	ID string
+	// LastSeq is the sequence number of the last received message
+	LastSeq uint64
+	// Resumed reports whether the last Connect resumed the session.
+	// If false after reconnect, messages may have been lost.
+	Resumed bool
+
+	conn *ws.Conn
+}
+
+// Connect dials rawurl, resuming the session if there is one
+func (c *Client) Connect(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if c.ID != "" {
+		q := u.Query()
+		q.Set("session", c.ID)
+		q.Set("last_seq", strconv.FormatUint(c.LastSeq, 10))
+		u.RawQuery = q.Encode()
+	}
+	d := c.Dialer
+	if d == nil {
+		d = &minws.Dialer{}
+	}
+	conn, _, err := d.Dial(u.String())
+	if err != nil {
+		return err
+	}
+
+	msg, err := conn.ReadTextMessage()
+	if err != nil {
+		conn.Rwc.Close()
+		return err
+	}
+	f := strings.Fields(msg)
+	if len(f) != 3 || f[0] != "session" {
+		conn.Rwc.Close()
+		return fmt.Errorf("session: unexpected message %q", msg)
+	}
+	c.Resumed = f[1] == c.ID
+	if !c.Resumed {
+		c.ID = f[1]
+		// sequence numbers start over in the new session
+		c.LastSeq, _ = strconv.ParseUint(f[2], 10, 64)
+	}
+	c.conn = conn
+	return nil
+}
+
+// Conn returns the current connection
+func (c *Client) Conn() *ws.Conn {
+	return c.conn
+}
+
+// Receive returns the next message from the server and acknowledges it.
+// Messages already received are skipped.
+func (c *Client) Receive() (ws.OpCode, []byte, error) {
+	for {
+		op, msg, err := c.conn.NextMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		kind, arg, payload := parseFrame(msg)
+		if kind != "msg" {
+			continue
+		}
+		seq, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil || seq <= c.LastSeq {
+			continue
+		}
+		c.LastSeq = seq
+		if err := c.conn.SendTextMessage("ack " + arg + "\n"); err != nil {
+			return 0, nil, err
+		}
+		return op, payload, nil
+	}
+}
+
+// Send sends a message to the server
+func (c *Client) Send(op ws.OpCode, msg []byte) error {
+	b := make([]byte, 0, 4+len(msg))
+	b = append(append(b, "msg\n"...), msg...)
+	return c.conn.SendMessage(op, b)
+}
@@ -0,0 +1,403 @@
+// Package session implements resumable sessions on WebSocket connections.
+//
+// The server numbers the messages it sends and keeps them until the client
+// acknowledges them, so that a client reconnecting with
+// ?session=<id>&last_seq=<n> receives the messages it missed.
+// Messages are framed with a header line:
+//
+//	server to client
+//	  "session <id> <seq>\n"  sent on attach, seq is the last sequence number
+//	  "msg <seq>\n<payload>"  data message, with the opcode of the payload
+//	client to server
+//	  "ack <seq>\n"           acknowledges messages up to seq
+//	  "msg\n<payload>"        data message
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+// Defaults of Manager
+const (
+	DefaultBufferSize = 256
+	DefaultTTL        = time.Minute
+)
+
+// ErrDetached is returned by Receive when the session has no connection
+var ErrDetached = errors.New("session: no connection attached")
+
+// errExpired is returned by attach when the session has been removed
+var errExpired = errors.New("session: expired")
+
+// Manager keeps sessions while their clients are disconnected
+type Manager struct {
+	// BufferSize is the max number of unacknowledged messages kept per
+	// session. Older messages are dropped when exceeded.
+	BufferSize int
+	// TTL is how long a session is kept after its connection is closed
+	TTL time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewManager is a constructor of Manager
+func NewManager() *Manager {
+	return &Manager{
+		BufferSize: DefaultBufferSize,
+		TTL:        DefaultTTL,
+		sessions:   make(map[string]*Session),
+	}
+}
+
+// Attach binds c to a session. If the query of requestURI names a live
+// session and last_seq is within its buffer, the session is resumed and
+// messages after last_seq are sent again. Otherwise a new session is
+// created, and the client tells it from the session id.
+func (m *Manager) Attach(c *ws.Conn, requestURI string) (*Session, error) {
+	s, lastSeq := m.lookup(requestURI)
+	if s != nil {
+		err := s.attach(c, lastSeq)
+		if err != errExpired {
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+		// expired after lookup
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	s = &Session{ID: id, m: m}
+	m.mu.Lock()
+	m.sessions[id] = s
+	m.mu.Unlock()
+	if err := s.attach(c, 0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// lookup returns the session to resume and the last received sequence
+// number, or nil if the request does not resume a session
+func (m *Manager) lookup(requestURI string) (*Session, uint64) {
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return nil, 0
+	}
+	q := u.Query()
+	id := q.Get("session")
+	if id == "" {
+		return nil, 0
+	}
+	lastSeq, err := strconv.ParseUint(q.Get("last_seq"), 10, 64)
+	if err != nil {
+		return nil, 0
+	}
+
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	m.mu.Unlock()
+	if !ok || !s.canResume(lastSeq) {
+		return nil, 0
+	}
+	return s, lastSeq
+}
+
+// Get returns the session of id
+func (m *Manager) Get(id string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// Len returns the number of sessions
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+func (m *Manager) remove(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[s.ID] == s {
+		delete(m.sessions, s.ID)
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Session is a sequence of messages to a client which outlives its
+// connections
+type Session struct {
+	ID string
+	m  *Manager
+
+	// wmu serializes writes on the connection, which are done without mu
+	// held, so that a slow client blocks neither Ack nor Receive
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	conn    *ws.Conn
+	seq     uint64  // sequence number of the last sent message
+	sent    uint64  // sequence number of the last message written on conn
+	acked   uint64  // sequence number acknowledged by the client
+	buf     []entry // unacknowledged messages in order of seq
+	expiry  *time.Timer
+	timers  int  // number of expiry timers started, naming the latest
+	expired bool // removed from the manager
+}
+
+type entry struct {
+	seq     uint64
+	op      ws.OpCode
+	payload []byte
+}
+
+// canResume reports whether all messages after lastSeq are in the buffer
+func (s *Session) canResume(lastSeq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lastSeq > s.seq {
+		return false
+	}
+	first := s.seq + 1
+	if len(s.buf) > 0 {
+		first = s.buf[0].seq
+	}
+	return lastSeq+1 >= first
+}
+
+// attach replaces the connection and replays messages after lastSeq. If
+// sending fails, the session is detached from c and starts expiry.
+func (s *Session) attach(c *ws.Conn, lastSeq uint64) error {
+	s.mu.Lock()
+	if s.conn != nil {
+		// the previous connection is stale, and a write blocked on it
+		// releases wmu
+		s.conn.Rwc.Close()
+	}
+	s.mu.Unlock()
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	if s.expired {
+		s.mu.Unlock()
+		return errExpired
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.conn != nil {
+		s.conn.Rwc.Close()
+	}
+	s.conn = c
+	c.OnClose(func() { s.detach(c) })
+	s.trim(lastSeq)
+	s.sent = lastSeq
+	hdr := fmt.Sprintf("session %s %d\n", s.ID, s.seq)
+	s.mu.Unlock()
+
+	err := c.SendTextMessage(hdr)
+	if err == nil {
+		err = s.flush(c)
+	}
+	if err != nil {
+		c.Rwc.Close()
+		s.mu.Lock()
+		s.release(c)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// flush writes the messages not yet written on c in order. It must be
+// called with s.wmu held, and returns once c is no longer the connection.
+func (s *Session) flush(c *ws.Conn) error {
+	for {
+		s.mu.Lock()
+		if s.conn != c {
+			s.mu.Unlock()
+			return nil
+		}
+		next := s.sent + 1
+		if s.acked >= next {
+			// acknowledged before the write returned
+			next = s.acked + 1
+		}
+		if len(s.buf) > 0 && s.buf[0].seq > next {
+			// dropped for BufferSize before written, so that the client
+			// has to start a new session
+			s.mu.Unlock()
+			c.Rwc.Close()
+			return errors.New("session: messages dropped before sent")
+		}
+		var pending []entry
+		for _, e := range s.buf {
+			if e.seq > s.sent {
+				pending = append(pending, e)
+			}
+		}
+		s.mu.Unlock()
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, e := range pending {
+			if err := s.write(c, e); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			if s.conn == c && e.seq > s.sent {
+				s.sent = e.seq
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// detach is called when c is closed and starts expiry of the session
+func (s *Session) detach(c *ws.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(c)
+}
+
+// release unbinds c and starts expiry. It must be called with s.mu held.
+func (s *Session) release(c *ws.Conn) {
+	if s.conn != c {
+		return
+	}
+	s.conn = nil
+	s.timers++
+	n := s.timers
+	s.expiry = time.AfterFunc(s.m.TTL, func() { s.expire(n) })
+}
+
+// expire removes the session unless a connection has been attached or
+// another timer has started since the timer n started
+func (s *Session) expire(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil || s.timers != n || s.expired {
+		return
+	}
+	s.expired = true
+	s.m.remove(s)
+}
+
+// Send sends a message with the next sequence number. The message is
+// kept until acknowledged, so it is sent on the next attach if the
+// session has no connection now or sending fails.
+func (s *Session) Send(op ws.OpCode, msg []byte) {
+	s.mu.Lock()
+	s.seq++
+	s.buf = append(s.buf, entry{seq: s.seq, op: op, payload: append([]byte(nil), msg...)})
+	if n := len(s.buf) - s.m.BufferSize; n > 0 {
+		s.buf = append(s.buf[:0], s.buf[n:]...)
+	}
+	c := s.conn
+	s.mu.Unlock()
+	if c == nil {
+		return
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.flush(c)
+}
+
+func (s *Session) write(c *ws.Conn, e entry) error {
+	hdr := "msg " + strconv.FormatUint(e.seq, 10) + "\n"
+	b := make([]byte, 0, len(hdr)+len(e.payload))
+	b = append(append(b, hdr...), e.payload...)
+	return c.SendMessage(e.op, b)
+}
+
+// Ack drops messages up to seq from the buffer
+func (s *Session) Ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trim(seq)
+}
+
+func (s *Session) trim(seq uint64) {
+	if seq > s.acked {
+		s.acked = seq
+	}
+	i := 0
+	for i < len(s.buf) && s.buf[i].seq <= seq {
+		i++
+	}
+	s.buf = append(s.buf[:0], s.buf[i:]...)
+}
+
+// Buffered returns the number of unacknowledged messages
+func (s *Session) Buffered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buf)
+}
+
+// Receive reads the next data message from the client on the current
+// connection, handling acknowledgements. When the connection is closed
+// it returns the error, while the session is kept for TTL.
+func (s *Session) Receive() (ws.OpCode, []byte, error) {
+	s.mu.Lock()
+	c := s.conn
+	s.mu.Unlock()
+	if c == nil {
+		return 0, nil, ErrDetached
+	}
+	for {
+		op, msg, err := c.NextMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		kind, arg, payload := parseFrame(msg)
+		switch kind {
+		case "ack":
+			if seq, err := strconv.ParseUint(arg, 10, 64); err == nil {
+				s.Ack(seq)
+			}
+		case "msg":
+			return op, payload, nil
+		}
+	}
+}
+
+// parseFrame splits a message into the kind and the argument of the
+// header line and the payload
+func parseFrame(msg []byte) (kind, arg string, payload []byte) {
+	i := bytes.IndexByte(msg, '\n')
+	if i < 0 {
+		return "", "", nil
+	}
+	hdr := string(msg[:i])
+	kind = hdr
+	if j := bytes.IndexByte(msg[:i], ' '); j >= 0 {
+		kind, arg = hdr[:j], hdr[j+1:]
+	}
+	return kind, arg, msg[i+1:]
+}
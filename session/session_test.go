@@ -0,0 +1,259 @@
+package session
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws"
+	"github.com/cou929/minws/ws"
+)
+
+// serve attaches accepted connections to sessions of m and passes them
+// to sessions, echoing received messages
+func serve(t *testing.T, m *Manager) (string, <-chan *Session) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	sessions := make(chan *Session, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, req, err := (&minws.Upgrader{}).Upgrade(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				s, err := m.Attach(c, req.RequestURI)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				sessions <- s
+				for {
+					op, msg, err := s.Receive()
+					if err != nil {
+						return
+					}
+					s.Send(op, msg)
+				}
+			}()
+		}
+	}()
+	return "ws://" + l.Addr().String() + "/chat", sessions
+}
+
+func receive(t *testing.T, c *Client, want string) {
+	t.Helper()
+	c.Conn().Rwc.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := c.Receive()
+	if err != nil {
+		t.Fatalf("Receive() error = %v, want %q", err, want)
+	}
+	if string(msg) != want {
+		t.Fatalf("Receive() = %q, want %q", msg, want)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSession_Resume(t *testing.T) {
+	m := NewManager()
+	url, sessions := serve(t, m)
+
+	c := &Client{}
+	if err := c.Connect(url); err != nil {
+		t.Fatal(err)
+	}
+	s := <-sessions
+	if c.ID != s.ID || c.Resumed {
+		t.Fatalf("ID = %q, Resumed = %v, want new session %q", c.ID, c.Resumed, s.ID)
+	}
+	if err := c.Send(ws.OpCodeText, []byte("echo")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, c, "echo")
+	s.Send(ws.OpCodeText, []byte("1"))
+	receive(t, c, "1")
+	waitFor(t, func() bool { return s.Buffered() == 0 })
+
+	// messages sent while disconnected are replayed
+	c.Conn().Rwc.Close()
+	waitFor(t, func() bool { return !attached(s) })
+	s.Send(ws.OpCodeText, []byte("2"))
+	s.Send(ws.OpCodeBinary, []byte{3})
+
+	if err := c.Connect(url); err != nil {
+		t.Fatal(err)
+	}
+	if s2 := <-sessions; s2 != s || !c.Resumed {
+		t.Fatalf("Resumed = %v, want resumed session", c.Resumed)
+	}
+	receive(t, c, "2")
+	receive(t, c, "\x03")
+	s.Send(ws.OpCodeText, []byte("4"))
+	receive(t, c, "4")
+	waitFor(t, func() bool { return s.Buffered() == 0 })
+	if c.LastSeq != 5 {
+		t.Errorf("LastSeq = %d, want 5", c.LastSeq)
+	}
+}
+
+func attached(s *Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
+func TestSession_NewSession(t *testing.T) {
+	m := NewManager()
+	m.BufferSize = 2
+	url, sessions := serve(t, m)
+
+	c := &Client{}
+	if err := c.Connect(url); err != nil {
+		t.Fatal(err)
+	}
+	s := <-sessions
+	c.Conn().Rwc.Close()
+	waitFor(t, func() bool { return !attached(s) })
+	// overflows the buffer, so that messages are lost
+	for _, msg := range []string{"1", "2", "3"} {
+		s.Send(ws.OpCodeText, []byte(msg))
+	}
+	if n := s.Buffered(); n != 2 {
+		t.Errorf("Buffered() = %d, want 2", n)
+	}
+
+	if err := c.Connect(url); err != nil {
+		t.Fatal(err)
+	}
+	if s2 := <-sessions; s2 == s || c.Resumed || c.ID != s2.ID || c.LastSeq != 0 {
+		t.Errorf("Resumed = %v, ID = %q, LastSeq = %d, want new session", c.Resumed, c.ID, c.LastSeq)
+	}
+
+	// unknown session
+	c.Conn().Rwc.Close()
+	c.ID = "unknown"
+	if err := c.Connect(url); err != nil {
+		t.Fatal(err)
+	}
+	<-sessions
+	if c.Resumed || c.ID == "unknown" {
+		t.Errorf("Resumed = %v, ID = %q, want new session", c.Resumed, c.ID)
+	}
+}
+
+func TestSession_Expire(t *testing.T) {
+	m := NewManager()
+	m.TTL = 10 * time.Millisecond
+	url, sessions := serve(t, m)
+
+	c := &Client{}
+	if err := c.Connect(url); err != nil {
+		t.Fatal(err)
+	}
+	s := <-sessions
+	if _, ok := m.Get(s.ID); !ok {
+		t.Fatal("session is not registered")
+	}
+	c.Conn().Rwc.Close()
+	waitFor(t, func() bool { return m.Len() == 0 })
+}
+
+func TestSession_attach_SendError(t *testing.T) {
+	m := NewManager()
+	m.TTL = 10 * time.Millisecond
+	server, client := net.Pipe()
+	client.Close()
+	c := ws.NewServerConn(server, bufio.NewReader(server))
+	s, err := m.Attach(c, "/chat")
+	if err == nil {
+		t.Fatal("Attach() succeeded on a closed connection")
+	}
+	if s != nil {
+		t.Errorf("Attach() = %v, want nil", s)
+	}
+	// the session is detached and expires
+	waitFor(t, func() bool { return m.Len() == 0 })
+}
+
+func TestSession_expire_Attached(t *testing.T) {
+	m := NewManager()
+	s := &Session{ID: "s", m: m}
+	m.sessions[s.ID] = s
+
+	// the timer fires while a connection is attached
+	s.mu.Lock()
+	s.release(nil)
+	s.conn = &ws.Conn{}
+	s.expiry.Stop()
+	n := s.timers
+	s.mu.Unlock()
+	s.expire(n)
+	if m.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", m.Len())
+	}
+
+	// a timer replaced by a later one does nothing
+	s.mu.Lock()
+	s.conn = nil
+	s.timers++
+	s.mu.Unlock()
+	s.expire(n)
+	if m.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", m.Len())
+	}
+	s.expire(n + 1)
+	if m.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", m.Len())
+	}
+}
+
+func TestSession_SlowClient(t *testing.T) {
+	m := NewManager()
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		// reads the session header and nothing else
+		ws.NewClientConn(client, bufio.NewReader(client)).NextMessage()
+	}()
+	s, err := m.Attach(ws.NewServerConn(server, bufio.NewReader(server)), "/chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the write blocks on the client, but the buffer is still usable
+	go s.Send(ws.OpCodeText, []byte("blocked"))
+	waitFor(t, func() bool { return s.Buffered() == 1 })
+	done := make(chan struct{})
+	go func() {
+		s.Ack(1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Ack() blocks on a slow client")
+	}
+	if got := s.Buffered(); got != 0 {
+		t.Errorf("Buffered() = %d, want 0", got)
+	}
+}
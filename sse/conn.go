@@ -0,0 +1,296 @@
+package sse
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// ErrClosed is returned when sending on a closed session
+var ErrClosed = errors.New("sse: session is closed")
+
+// ErrInvalidEventName is returned by SendEvent for a name with line ends,
+// which would end the event field early
+var ErrInvalidEventName = errors.New("sse: event name contains CR or LF")
+
+// incomingQueueSize is the number of received messages queued before
+// POST requests block
+const incomingQueueSize = 16
+
+// Conn is a session of the SSE transport. It implements ws.MessageConn.
+type Conn struct {
+	// ID names the session
+	ID string
+	// Request is the request which opened the session
+	Request *minwshttp.Request
+
+	s    *Server
+	in   chan message
+	done chan struct{}
+
+	mu       sync.Mutex
+	events   []event // recent events in seq order
+	seq      uint64
+	changed  chan struct{} // closed when an event is added
+	gen      int           // generation of the attached stream
+	streams  int
+	expiry   *time.Timer
+	closed   bool
+	closeErr error
+	onClose  []func()
+}
+
+type message struct {
+	op   ws.OpCode
+	data []byte
+}
+
+type event struct {
+	seq   uint64
+	name  string // "" for message event
+	data  string
+	close bool
+}
+
+func newConn(s *Server, id string, req *minwshttp.Request) *Conn {
+	c := &Conn{
+		ID:      id,
+		Request: req,
+		s:       s,
+		in:      make(chan message, incomingQueueSize),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	// a session whose client never connects the stream expires as well
+	c.expiry = time.AfterFunc(s.TTL, c.expire)
+	return c
+}
+
+// appendTo formats the event. Lines of data are split on CR, LF and
+// CRLF, which are all line ends of the event stream.
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+func (ev *event) appendTo(b []byte, id string) []byte {
+	b = append(b, "id: "...)
+	b = append(b, id...)
+	b = append(b, '.')
+	b = strconv.AppendUint(b, ev.seq, 10)
+	b = append(b, '\n')
+	if ev.name != "" {
+		b = append(b, "event: "...)
+		b = append(b, ev.name...)
+		b = append(b, '\n')
+	}
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(ev.data)
+	for _, line := range strings.Split(data, "\n") {
+		b = append(b, "data: "...)
+		b = append(b, line...)
+		b = append(b, '\n')
+	}
+	return append(b, '\n')
+}
+
+// NextMessage returns the next message posted by the client
+func (c *Conn) NextMessage() (ws.OpCode, []byte, error) {
+	select {
+	case m := <-c.in:
+		return m.op, m.data, nil
+	default:
+	}
+	select {
+	case m := <-c.in:
+		return m.op, m.data, nil
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return 0, nil, c.closeErr
+	}
+}
+
+// SendMessage sends the message as an event
+func (c *Conn) SendMessage(op ws.OpCode, msg []byte) error {
+	switch op {
+	case ws.OpCodeText:
+		return c.SendEvent("", string(msg))
+	case ws.OpCodeBinary:
+		return c.SendEvent("binary", base64.StdEncoding.EncodeToString(msg))
+	}
+	return errors.New("sse: unsupported opcode " + strconv.Itoa(int(op)))
+}
+
+// SendTextMessage sends a text message
+func (c *Conn) SendTextMessage(msg string) error {
+	return c.SendEvent("", msg)
+}
+
+// SendBinaryMessage sends a binary message
+func (c *Conn) SendBinaryMessage(msg []byte) error {
+	return c.SendMessage(ws.OpCodeBinary, msg)
+}
+
+// SendEvent sends an event of the name. The name must not contain line
+// ends, and "" means "message".
+func (c *Conn) SendEvent(name, data string) error {
+	if strings.ContainsAny(name, "\r\n") {
+		return ErrInvalidEventName
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.push(event{name: name, data: data})
+	return nil
+}
+
+// push must be called with c.mu held
+func (c *Conn) push(ev event) {
+	c.seq++
+	ev.seq = c.seq
+	c.events = append(c.events, ev)
+	if n := len(c.events) - c.s.BufferSize; n > 0 {
+		c.events = append(c.events[:0], c.events[n:]...)
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Close closes the session with 1000
+func (c *Conn) Close() {
+	c.CloseWithStatus(ws.StatusNormalClosure)
+}
+
+// CloseWithStatus sends the close event and closes the session. The
+// session is kept until the event is delivered or TTL passes.
+func (c *Conn) CloseWithStatus(status int) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.push(event{name: "close", data: strconv.Itoa(status), close: true})
+	c.mu.Unlock()
+	c.shutdown(&ws.CloseError{Code: status, Text: "closed by server"})
+}
+
+// closeByPeer closes the session at the request of the client
+func (c *Conn) closeByPeer(status int) {
+	c.shutdown(&ws.CloseError{Code: status, Text: "closed by client"})
+	c.s.remove(c)
+}
+
+// expire closes the session left without stream for TTL
+func (c *Conn) expire() {
+	c.shutdown(&ws.CloseError{Code: ws.StatusGoingAway, Text: "session expired"})
+	c.s.remove(c)
+}
+
+func (c *Conn) shutdown(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.closeErr = err
+	close(c.done)
+	hooks := c.onClose
+	c.onClose = nil
+	c.mu.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// OnClose registers f to be called when the session is closed.
+// If it is already closed, f is called immediately in a new goroutine.
+func (c *Conn) OnClose(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		go f()
+		return
+	}
+	c.onClose = append(c.onClose, f)
+}
+
+// receive queues a message from the client
+func (c *Conn) receive(op ws.OpCode, msg []byte) error {
+	select {
+	case c.in <- message{op, msg}:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// canResume reports whether the events after seq are kept
+func (c *Conn) canResume(seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq > c.seq {
+		return false
+	}
+	return len(c.events) == 0 || c.events[0].seq <= seq+1
+}
+
+// attach registers a stream, which replaces the previous one
+func (c *Conn) attach() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.streams++
+	c.expiry.Stop()
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return c.gen
+}
+
+// detach unregisters the stream. The session expires after TTL without
+// stream, and is removed at once if it has been closed.
+func (c *Conn) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streams--
+	if c.streams > 0 {
+		return
+	}
+	if c.closed {
+		go c.s.remove(c)
+		return
+	}
+	c.expiry.Reset(c.s.TTL)
+}
+
+// Errors of eventsAfter
+var (
+	errReplaced = errors.New("sse: replaced by a newer stream")
+	errBehind   = errors.New("sse: missed events no longer kept")
+)
+
+// eventsAfter returns the events after seq, and the channel closed on
+// the next change
+func (c *Conn) eventsAfter(seq uint64, gen int) ([]event, <-chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return nil, nil, errReplaced
+	}
+	if len(c.events) > 0 && c.events[0].seq > seq+1 {
+		return nil, nil, errBehind
+	}
+	var events []event
+	for i, ev := range c.events {
+		if ev.seq > seq {
+			events = append(events, c.events[i:]...)
+			break
+		}
+	}
+	return events, c.changed, nil
+}
@@ -0,0 +1,269 @@
+// Package sse implements a fallback transport with Server-Sent Events for
+// clients which cannot use WebSocket, e.g. behind proxies stripping the
+// Upgrade header. A session is exposed to the application as
+// ws.MessageConn, so that the handler of WebSocket connections serves it
+// as well.
+//
+// GET opens the event stream of a new session. The first event names it:
+//
+//	event: session
+//	data: <id>
+//
+// Messages to the client are events with id "<session>.<seq>":
+//
+//	text    "message" event, whose data lines are the lines of the message
+//	binary  "binary" event, whose data is base64 encoded
+//	close   "close" event, whose data is the status code
+//
+// EventSource reconnects with the Last-Event-ID header, or the client may
+// pass it as ?last_event_id=, and the events after it are sent again.
+//
+// The client sends a message with POST ?session=<id> whose body is the
+// message. It is binary if Content-Type is application/octet-stream, and
+// text otherwise. DELETE ?session=<id> closes the session.
+package sse
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// Defaults of Server
+const (
+	DefaultBufferSize     = 256
+	DefaultTTL            = time.Minute
+	DefaultRetry          = 3 * time.Second
+	DefaultKeepAlive      = 15 * time.Second
+	DefaultMaxMessageSize = 1 << 20
+)
+
+// Server serves sessions over Server-Sent Events
+type Server struct {
+	// Handler is called in a new goroutine for each session with the
+	// request which opened it
+	Handler func(c ws.MessageConn, req *minwshttp.Request)
+	// BufferSize is the number of recent events kept to be sent again on
+	// reconnect
+	BufferSize int
+	// TTL is how long a session is kept without event stream
+	TTL time.Duration
+	// Retry is the reconnection time advised to the client
+	Retry time.Duration
+	// KeepAlive is the interval of comments sent on an idle stream, so that
+	// proxies do not time out it and a disconnect is detected
+	KeepAlive time.Duration
+	// MaxMessageSize limits the size of a message from the client
+	MaxMessageSize int
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+// NewServer is a constructor of Server
+func NewServer(h func(c ws.MessageConn, req *minwshttp.Request)) *Server {
+	return &Server{
+		Handler:        h,
+		BufferSize:     DefaultBufferSize,
+		TTL:            DefaultTTL,
+		Retry:          DefaultRetry,
+		KeepAlive:      DefaultKeepAlive,
+		MaxMessageSize: DefaultMaxMessageSize,
+		conns:          make(map[string]*Conn),
+	}
+}
+
+// Len returns the number of live sessions
+func (s *Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Get returns the session of the id
+func (s *Server) Get(id string) (*Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conns[id]
+	return c, ok
+}
+
+// ServeHTTP implements minwshttp.Handler
+func (s *Server) ServeHTTP(w minwshttp.ResponseWriter, req *minwshttp.Request) {
+	u, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		writeStatus(w, minwshttp.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	switch req.Method {
+	case "GET":
+		lastID := req.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = q.Get("last_event_id")
+		}
+		s.stream(w, req, lastID)
+	case "POST":
+		c, ok := s.Get(q.Get("session"))
+		if !ok {
+			writeStatus(w, minwshttp.StatusNotFound)
+			return
+		}
+		s.receive(w, req, c)
+	case "DELETE":
+		c, ok := s.Get(q.Get("session"))
+		if !ok {
+			writeStatus(w, minwshttp.StatusNotFound)
+			return
+		}
+		c.closeByPeer(ws.StatusNormalClosure)
+		w.SetStatus(minwshttp.StatusNoContent)
+	default:
+		w.SetHeader("Allow", "GET, POST, DELETE")
+		writeStatus(w, minwshttp.StatusMethodNotAllowed)
+	}
+}
+
+// stream sends events of the session named by lastID, or of a new one
+func (s *Server) stream(w minwshttp.ResponseWriter, req *minwshttp.Request, lastID string) {
+	f, ok := w.(minwshttp.Flusher)
+	if !ok {
+		writeStatus(w, minwshttp.StatusInternalServerError)
+		return
+	}
+	if d, ok := w.(minwshttp.WriteDeadliner); ok {
+		// the stream lasts as long as the session
+		d.SetWriteDeadline(time.Time{})
+	}
+	c, after := s.resume(lastID)
+	if c == nil {
+		c = s.open(req)
+		after = 0
+	}
+
+	w.SetHeader("Content-Type", "text/event-stream")
+	w.SetHeader("Cache-Control", "no-cache")
+	w.SetStatus(minwshttp.StatusOK)
+	gen := c.attach()
+	defer c.detach()
+
+	var b []byte
+	b = append(b, "retry: "...)
+	b = strconv.AppendInt(b, int64(s.Retry/time.Millisecond), 10)
+	b = append(b, "\nevent: session\ndata: "...)
+	b = append(b, c.ID...)
+	b = append(b, "\n\n"...)
+	for {
+		events, changed, err := c.eventsAfter(after, gen)
+		if err == errBehind {
+			c.CloseWithStatus(ws.StatusPolicyViolation)
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events {
+			b = ev.appendTo(b, c.ID)
+			after = ev.seq
+		}
+		if len(b) > 0 {
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+			if err := f.Flush(); err != nil {
+				return
+			}
+			b = b[:0]
+		}
+		if len(events) > 0 && events[len(events)-1].close {
+			return
+		}
+		select {
+		case <-changed:
+		case <-time.After(s.KeepAlive):
+			b = append(b, ":\n\n"...)
+		}
+	}
+}
+
+// resume returns the session and the seq of the last event received by
+// the client. A session which cannot be resumed because the client has
+// missed events no longer kept is closed.
+func (s *Server) resume(lastID string) (*Conn, uint64) {
+	i := strings.LastIndexByte(lastID, '.')
+	if i < 0 {
+		return nil, 0
+	}
+	seq, err := strconv.ParseUint(lastID[i+1:], 10, 64)
+	if err != nil {
+		return nil, 0
+	}
+	c, ok := s.Get(lastID[:i])
+	if !ok {
+		return nil, 0
+	}
+	if !c.canResume(seq) {
+		c.CloseWithStatus(ws.StatusPolicyViolation)
+		return nil, 0
+	}
+	return c, seq
+}
+
+// open starts a new session and its handler
+func (s *Server) open(req *minwshttp.Request) *Conn {
+	c := newConn(s, newID(), req)
+	s.mu.Lock()
+	s.conns[c.ID] = c
+	s.mu.Unlock()
+	go s.Handler(c, req)
+	return c
+}
+
+func (s *Server) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[c.ID] == c {
+		delete(s.conns, c.ID)
+	}
+}
+
+// receive passes the body of the POST request to the session
+func (s *Server) receive(w minwshttp.ResponseWriter, req *minwshttp.Request, c *Conn) {
+	msg, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(s.MaxMessageSize)+1))
+	if err != nil {
+		writeStatus(w, minwshttp.StatusBadRequest)
+		return
+	}
+	if len(msg) > s.MaxMessageSize {
+		writeStatus(w, minwshttp.StatusRequestEntityTooLarge)
+		return
+	}
+	var op ws.OpCode = ws.OpCodeText
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/octet-stream") {
+		op = ws.OpCodeBinary
+	}
+	if err := c.receive(op, msg); err != nil {
+		writeStatus(w, minwshttp.StatusGone)
+		return
+	}
+	w.SetStatus(minwshttp.StatusNoContent)
+}
+
+func writeStatus(w minwshttp.ResponseWriter, code int) {
+	w.SetStatus(code)
+	w.Write([]byte(minwshttp.StatusText(code) + "\n"))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
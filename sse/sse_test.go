@@ -0,0 +1,332 @@
+package sse
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	minwshttp "github.com/cou929/minws/http"
+	"github.com/cou929/minws/ws"
+)
+
+// echo sends back messages, and closes with 4000 on "close"
+func echo(errc chan<- error) func(c ws.MessageConn, req *minwshttp.Request) {
+	return func(c ws.MessageConn, req *minwshttp.Request) {
+		for {
+			op, msg, err := c.NextMessage()
+			if err != nil {
+				errc <- err
+				return
+			}
+			if string(msg) == "close" {
+				c.CloseWithStatus(4000)
+				continue
+			}
+			c.SendMessage(op, msg)
+		}
+	}
+}
+
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	return serveTimeout(t, s, 0)
+}
+
+// serveTimeout serves s on connections with the write timeout
+func serveTimeout(t *testing.T, s *Server, writeTimeout time.Duration) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hc := minwshttp.NewConn(conn)
+				hc.WriteTimeout = writeTimeout
+				hc.Serve(s)
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String() + "/events"
+}
+
+type clientEvent struct {
+	id, name, data string
+}
+
+type stream struct {
+	t    *testing.T
+	body io.ReadCloser
+	r    *bufio.Reader
+}
+
+func open(t *testing.T, url, lastID string) *stream {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Fatalf("Content-Type = %q, want %q", got, want)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return &stream{t: t, body: res.Body, r: bufio.NewReader(res.Body)}
+}
+
+// next reads the next event, skipping comments and retry
+func (s *stream) next() clientEvent {
+	s.t.Helper()
+	var ev clientEvent
+	var data []string
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			s.body.Close()
+		}
+	}()
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			s.t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if data == nil {
+				continue
+			}
+			ev.data = strings.Join(data, "\n")
+			return ev
+		}
+		i := strings.IndexByte(line, ':')
+		if i == 0 {
+			continue
+		}
+		field, value := line[:i], strings.TrimPrefix(line[i+1:], " ")
+		switch field {
+		case "id":
+			ev.id = value
+		case "event":
+			ev.name = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+func post(t *testing.T, url, contentType, body string) int {
+	t.Helper()
+	res, err := http.Post(url, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func closeError(t *testing.T, errc <-chan error) int {
+	t.Helper()
+	select {
+	case err := <-errc:
+		var cerr *ws.CloseError
+		if !errors.As(err, &cerr) {
+			t.Fatalf("NextMessage() error = %v, want *ws.CloseError", err)
+		}
+		return cerr.Code
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return")
+	}
+	return 0
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met")
+}
+
+func TestServer(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	url := serve(t, s)
+
+	st := open(t, url, "")
+	ev := st.next()
+	if ev.name != "session" || ev.data == "" {
+		t.Fatalf("first event = %+v, want session", ev)
+	}
+	session := url + "?session=" + ev.data
+
+	if got := post(t, session, "text/plain", "hello\r\nworld"); got != minwshttp.StatusNoContent {
+		t.Errorf("POST status = %d, want %d", got, minwshttp.StatusNoContent)
+	}
+	if got, want := st.next(), (clientEvent{ev.data + ".1", "", "hello\nworld"}); got != want {
+		t.Errorf("text event = %+v, want %+v", got, want)
+	}
+	post(t, session, "application/octet-stream", "\x00\xff")
+	if got, want := st.next(), (clientEvent{ev.data + ".2", "binary", base64.StdEncoding.EncodeToString([]byte("\x00\xff"))}); got != want {
+		t.Errorf("binary event = %+v, want %+v", got, want)
+	}
+
+	req, _ := http.NewRequest("DELETE", session, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := closeError(t, errc); got != ws.StatusNormalClosure {
+		t.Errorf("close code = %d, want %d", got, ws.StatusNormalClosure)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", s.Len())
+	}
+	if got := post(t, session, "text/plain", "x"); got != minwshttp.StatusNotFound {
+		t.Errorf("POST after DELETE status = %d, want %d", got, minwshttp.StatusNotFound)
+	}
+}
+
+func TestServer_WriteTimeout(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	url := serveTimeout(t, s, 50*time.Millisecond)
+
+	// the stream outlives the write timeout of the connection
+	st := open(t, url, "")
+	ev := st.next()
+	time.Sleep(100 * time.Millisecond)
+	post(t, url+"?session="+ev.data, "text/plain", "hello")
+	if got, want := st.next(), (clientEvent{ev.data + ".1", "", "hello"}); got != want {
+		t.Errorf("event = %+v, want %+v", got, want)
+	}
+}
+
+func TestServer_CloseByServer(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	url := serve(t, s)
+
+	st := open(t, url, "")
+	id := st.next().data
+	post(t, url+"?session="+id, "text/plain", "close")
+	if got, want := st.next(), (clientEvent{id + ".1", "close", "4000"}); got != want {
+		t.Errorf("close event = %+v, want %+v", got, want)
+	}
+	if got := closeError(t, errc); got != 4000 {
+		t.Errorf("close code = %d, want 4000", got)
+	}
+	waitFor(t, func() bool { return s.Len() == 0 })
+}
+
+func TestServer_Resume(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	s.BufferSize = 2
+	url := serve(t, s)
+
+	st := open(t, url, "")
+	id := st.next().data
+	session := url + "?session=" + id
+	post(t, session, "text/plain", "a")
+	post(t, session, "text/plain", "b")
+	first := st.next()
+	st.next()
+
+	// the events after Last-Event-ID are sent again on the new stream
+	st = open(t, url, first.id)
+	if ev := st.next(); ev.name != "session" || ev.data != id {
+		t.Fatalf("session event = %+v, want %s", ev, id)
+	}
+	if got, want := st.next(), (clientEvent{id + ".2", "", "b"}); got != want {
+		t.Errorf("replayed event = %+v, want %+v", got, want)
+	}
+	post(t, session, "text/plain", "c")
+	if got, want := st.next(), (clientEvent{id + ".3", "", "c"}); got != want {
+		t.Errorf("event = %+v, want %+v", got, want)
+	}
+
+	// a is no longer kept, so the session is closed and a new one opens
+	st = open(t, url+"?last_event_id="+id+".0", "")
+	if ev := st.next(); ev.name != "session" || ev.data == id {
+		t.Errorf("session event = %+v, want a new session", ev)
+	}
+	if got := closeError(t, errc); got != ws.StatusPolicyViolation {
+		t.Errorf("close code = %d, want %d", got, ws.StatusPolicyViolation)
+	}
+}
+
+func TestServer_Expire(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(echo(errc))
+	s.TTL = 50 * time.Millisecond
+	s.KeepAlive = 10 * time.Millisecond
+	url := serve(t, s)
+
+	st := open(t, url, "")
+	st.next()
+	st.body.Close()
+	if got := closeError(t, errc); got != ws.StatusGoingAway {
+		t.Errorf("close code = %d, want %d", got, ws.StatusGoingAway)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", s.Len())
+	}
+}
+
+func TestServer_Post(t *testing.T) {
+	s := NewServer(echo(make(chan error, 1)))
+	s.MaxMessageSize = 4
+	url := serve(t, s)
+
+	st := open(t, url, "")
+	session := url + "?session=" + st.next().data
+	tests := []struct {
+		url, body string
+		want      int
+	}{
+		{session, "1234", minwshttp.StatusNoContent},
+		{session, "12345", minwshttp.StatusRequestEntityTooLarge},
+		{url + "?session=unknown", "1", minwshttp.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := post(t, tt.url, "text/plain", tt.body); got != tt.want {
+			t.Errorf("POST %q status = %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestConn_SendEvent(t *testing.T) {
+	c := newConn(NewServer(nil), "s", nil)
+	defer c.expiry.Stop()
+	for _, name := range []string{"a\nb", "a\rb", "\r\n"} {
+		if err := c.SendEvent(name, "x"); err != ErrInvalidEventName {
+			t.Errorf("SendEvent(%q) error = %v, want %v", name, err, ErrInvalidEventName)
+		}
+	}
+	if err := c.SendEvent("update", "x"); err != nil {
+		t.Errorf("SendEvent() error = %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package minws
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// CertFile is a pair of PEM encoded certificate and key files
+type CertFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore holds certificates for wss:// server. It selects a certificate
+// by SNI and can reload the files without restarting the server.
+type CertStore struct {
+	files []CertFile
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+}
+
+// NewCertStore loads certificates. The first one is used when no
+// certificate matches the server name sent by the client.
+func NewCertStore(files ...CertFile) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	s := &CertStore{files: files}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads certificate files again. On error, certificates loaded
+// before are kept.
+func (s *CertStore) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", f.CertFile, err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", f.CertFile, err)
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate selects a certificate by SNI. It is set to
+// tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range s.certs {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// TLSConfig returns a server config using the certificates
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// ReloadOnSignal reloads certificates whenever one of sig (usually
+// SIGHUP) is received. Calling the returned function stops it.
+func (s *CertStore) ReloadOnSignal(sig ...os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if err := s.Reload(); err != nil {
+					log.Println("failed to reload certificates", err)
+					continue
+				}
+				log.Println("reloaded certificates")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
@@ -0,0 +1,152 @@
+package minws
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for the names and
+// returns CertFile and the certificate
+func writeSelfSignedCert(t *testing.T, dir, name string, serial int64, dnsNames ...string) (CertFile, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := CertFile{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	if err := ioutil.WriteFile(f.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return f, cert
+}
+
+func peerCertificate(t *testing.T, c *ws.Conn) *x509.Certificate {
+	t.Helper()
+	tc, ok := c.Rwc.(*tls.Conn)
+	if !ok {
+		t.Fatalf("Rwc is %T, want *tls.Conn", c.Rwc)
+	}
+	return tc.ConnectionState().PeerCertificates[0]
+}
+
+func TestDialer_Dial_TLS(t *testing.T) {
+	dir := t.TempDir()
+	fileA, certA := writeSelfSignedCert(t, dir, "a", 1, "localhost", "a.example")
+	fileB, certB := writeSelfSignedCert(t, dir, "b", 2, "b.example")
+
+	store, err := NewCertStore(fileA, fileB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", store.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveEcho(l)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certA)
+	roots.AddCert(certB)
+
+	t.Run("echo over wss", func(t *testing.T) {
+		c, res, err := (&Dialer{RootCAs: roots, Timeout: 5 * time.Second}).Dial("wss://localhost:" + port + "/chat")
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer c.Rwc.Close()
+		if res.StatusCode != 101 {
+			t.Errorf("StatusCode = %d, want 101", res.StatusCode)
+		}
+		if err := c.SendTextMessage("hello"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.ReadTextMessage(); err != nil || got != "hello" {
+			t.Errorf("ReadTextMessage() = %q, %v, want %q", got, err, "hello")
+		}
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		if _, _, err := (&Dialer{Timeout: 5 * time.Second}).Dial("wss://localhost:" + port); err == nil {
+			t.Error("Dial() succeeded with self-signed certificate not in RootCAs")
+		}
+	})
+
+	t.Run("select certificate by SNI", func(t *testing.T) {
+		for _, tt := range []struct {
+			serverName string
+			want       *x509.Certificate
+		}{
+			{"a.example", certA},
+			{"b.example", certB},
+			{"localhost", certA},
+		} {
+			d := &Dialer{RootCAs: roots, TLSConfig: &tls.Config{ServerName: tt.serverName}, Timeout: 5 * time.Second}
+			c, _, err := d.Dial("wss://127.0.0.1:" + port)
+			if err != nil {
+				t.Fatalf("%s: Dial() error = %v", tt.serverName, err)
+			}
+			if got := peerCertificate(t, c); got.SerialNumber.Cmp(tt.want.SerialNumber) != 0 {
+				t.Errorf("%s: serial = %v, want %v", tt.serverName, got.SerialNumber, tt.want.SerialNumber)
+			}
+			c.Rwc.Close()
+		}
+	})
+
+	t.Run("reload certificates", func(t *testing.T) {
+		_, certA2 := writeSelfSignedCert(t, dir, "a", 3, "localhost", "a.example")
+		if err := store.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		roots.AddCert(certA2)
+		c, _, err := (&Dialer{RootCAs: roots, Timeout: 5 * time.Second}).Dial("wss://localhost:" + port)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer c.Rwc.Close()
+		if got := peerCertificate(t, c); got.SerialNumber.Cmp(certA2.SerialNumber) != 0 {
+			t.Errorf("serial = %v, want %v", got.SerialNumber, certA2.SerialNumber)
+		}
+	})
+}
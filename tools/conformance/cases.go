@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/cou929/minws/ws"
+)
+
+// Case is a test case following the categories of the Autobahn Testsuite
+type Case struct {
+	ID          string
+	Category    string
+	Description string
+	// RequestHeader is added to the opening handshake.
+	// Cases with RequestHeader run only over tcp transport.
+	RequestHeader map[string]string
+	Run           func(p *Peer) error
+}
+
+// maxMessageSize is MaxMessageSize of the server under test
+const maxMessageSize = 4 << 20
+
+const (
+	opText  = byte(ws.OpCodeText)
+	opBin   = byte(ws.OpCodeBinary)
+	opCont  = byte(ws.OpCodeContinuation)
+	opClose = byte(ws.OpCodeClose)
+	opPing  = byte(ws.OpCodePing)
+	opPong  = byte(ws.OpCodePong)
+)
+
+// Cases returns all test cases
+func Cases() []*Case {
+	var cs []*Case
+	for _, f := range []func() []*Case{
+		framingCases,
+		pingCases,
+		reservedBitsCases,
+		opcodeCases,
+		fragmentationCases,
+		utf8Cases,
+		closeCases,
+		limitCases,
+		compressionCases,
+	} {
+		cs = append(cs, f()...)
+	}
+	return cs
+}
+
+// then runs checks in order and returns the first error
+func then(checks ...func() error) error {
+	for _, c := range checks {
+		if err := c(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func payloadOf(n int) []byte {
+	return bytes.Repeat([]byte("*"), n)
+}
+
+func framingCases() []*Case {
+	var cs []*Case
+	lens := []int{0, 125, 126, 127, 128, 65535, 65536}
+	for i, op := range []ws.OpCode{ws.OpCodeText, ws.OpCodeBinary} {
+		for j, l := range lens {
+			op, l := op, l
+			cs = append(cs, &Case{
+				ID:          fmt.Sprintf("1.%d.%d", i+1, j+1),
+				Category:    "framing",
+				Description: fmt.Sprintf("Send %s message with payload length %d", opName(op), l),
+				Run: func(p *Peer) error {
+					p.Send(fin|byte(op), payloadOf(l))
+					return p.Expect(op, payloadOf(l))
+				},
+			})
+		}
+		op := op
+		cs = append(cs, &Case{
+			ID:          fmt.Sprintf("1.%d.%d", i+1, len(lens)+1),
+			Category:    "framing",
+			Description: fmt.Sprintf("Send %s message with payload length 65536, chopped into chunks of 997 octets", opName(op)),
+			Run: func(p *Peer) error {
+				p.SendChopped(fin|byte(op), payloadOf(65536), 997)
+				return p.Expect(op, payloadOf(65536))
+			},
+		})
+	}
+	return cs
+}
+
+func pingCases() []*Case {
+	return []*Case{
+		{
+			ID: "2.1", Category: "pings", Description: "Send opPing without payload",
+			Run: func(p *Peer) error {
+				p.Send(fin|opPing, nil)
+				return p.Expect(ws.OpCodePong, nil)
+			},
+		},
+		{
+			ID: "2.2", Category: "pings", Description: "Send opPing with small opText payload",
+			Run: func(p *Peer) error {
+				p.Send(fin|opPing, []byte("Hello, world!"))
+				return p.Expect(ws.OpCodePong, []byte("Hello, world!"))
+			},
+		},
+		{
+			ID: "2.3", Category: "pings", Description: "Send opPing with small binary payload",
+			Run: func(p *Peer) error {
+				p.Send(fin|opPing, []byte{0x00, 0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0x00, 0xff})
+				return p.Expect(ws.OpCodePong, []byte{0x00, 0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0x00, 0xff})
+			},
+		},
+		{
+			ID: "2.4", Category: "pings", Description: "Send opPing with payload of 125 octets",
+			Run: func(p *Peer) error {
+				p.Send(fin|opPing, payloadOf(125))
+				return p.Expect(ws.OpCodePong, payloadOf(125))
+			},
+		},
+		{
+			ID: "2.5", Category: "pings", Description: "Send opPing with payload of 126 octets",
+			Run: func(p *Peer) error {
+				p.Send(fin|opPing, payloadOf(126))
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+		{
+			ID: "2.6", Category: "pings", Description: "Send opPing with payload of 125 octets, byte-wise chopped",
+			Run: func(p *Peer) error {
+				p.SendChopped(fin|opPing, payloadOf(125), 1)
+				return p.Expect(ws.OpCodePong, payloadOf(125))
+			},
+		},
+		{
+			ID: "2.7", Category: "pings", Description: "Send unsolicited opPong without payload, then text",
+			Run: func(p *Peer) error {
+				p.Send(fin|opPong, nil)
+				p.SendText("after pong")
+				return p.ExpectText("after pong")
+			},
+		},
+		{
+			ID: "2.8", Category: "pings", Description: "Send unsolicited opPong with payload, then text",
+			Run: func(p *Peer) error {
+				p.Send(fin|opPong, []byte("unsolicited pong payload"))
+				p.SendText("after pong")
+				return p.ExpectText("after pong")
+			},
+		},
+		{
+			ID: "2.9", Category: "pings", Description: "Send unsolicited opPong, then ping",
+			Run: func(p *Peer) error {
+				p.Send(fin|opPong, []byte("unsolicited pong payload"))
+				p.Send(fin|opPing, []byte("ping payload"))
+				return p.Expect(ws.OpCodePong, []byte("ping payload"))
+			},
+		},
+		{
+			ID: "2.10", Category: "pings", Description: "Send 10 pings",
+			Run: func(p *Peer) error {
+				for i := 0; i < 10; i++ {
+					p.Send(fin|opPing, []byte(fmt.Sprintf("payload-%d", i)))
+				}
+				for i := 0; i < 10; i++ {
+					if err := p.Expect(ws.OpCodePong, []byte(fmt.Sprintf("payload-%d", i))); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func reservedBitsCases() []*Case {
+	var cs []*Case
+	for rsv := 1; rsv <= 7; rsv++ {
+		b := byte(rsv) << 4
+		for i, op := range []byte{opText, opBin, opPing} {
+			op := op
+			cs = append(cs, &Case{
+				ID:          fmt.Sprintf("3.%d.%d", rsv, i+1),
+				Category:    "reserved bits",
+				Description: fmt.Sprintf("Send %s frame with RSV = %d", opName(ws.OpCode(op)), rsv),
+				Run: func(p *Peer) error {
+					p.Send(fin|b|op, []byte("Hello, world!"))
+					return p.ExpectClose(ws.StatusProtocolError)
+				},
+			})
+		}
+		cs = append(cs, &Case{
+			ID:          fmt.Sprintf("3.%d.4", rsv),
+			Category:    "reserved bits",
+			Description: fmt.Sprintf("Send opText, then opText with RSV = %d, then ping", rsv),
+			Run: func(p *Peer) error {
+				p.SendText("Hello, world!")
+				p.Send(fin|b|opText, []byte("Hello, world!"))
+				p.Send(fin|opPing, nil)
+				return then(
+					func() error { return p.ExpectText("Hello, world!") },
+					func() error { return p.ExpectClose(ws.StatusProtocolError) },
+				)
+			},
+		})
+	}
+	return cs
+}
+
+func opcodeCases() []*Case {
+	var cs []*Case
+	for i, op := range []byte{0x3, 0x4, 0x5, 0x6, 0x7, 0xB, 0xC, 0xD, 0xE, 0xF} {
+		op := op
+		group := 1
+		if op >= 0x8 {
+			group = 2
+		}
+		cs = append(cs, &Case{
+			ID:          fmt.Sprintf("4.%d.%d", group, i%5+1),
+			Category:    "opcodes",
+			Description: fmt.Sprintf("Send frame with reserved opcode %#x", op),
+			Run: func(p *Peer) error {
+				p.Send(fin|op, []byte("reserved opcode payload"))
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		})
+		cs = append(cs, &Case{
+			ID:          fmt.Sprintf("4.%d.%d", group, i%5+6),
+			Category:    "opcodes",
+			Description: fmt.Sprintf("Send opText, then frame with reserved opcode %#x, then ping", op),
+			Run: func(p *Peer) error {
+				p.SendText("Hello, world!")
+				p.Send(fin|op, nil)
+				p.Send(fin|opPing, nil)
+				return then(
+					func() error { return p.ExpectText("Hello, world!") },
+					func() error { return p.ExpectClose(ws.StatusProtocolError) },
+				)
+			},
+		})
+	}
+	return cs
+}
+
+func fragmentationCases() []*Case {
+	return []*Case{
+		{
+			ID: "5.1", Category: "fragmentation", Description: "Send opPing fragmented into 2 fragments",
+			Run: func(p *Peer) error {
+				p.Send(opPing, []byte("fragment1"))
+				p.Send(fin|opCont, []byte("fragment2"))
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+		{
+			ID: "5.2", Category: "fragmentation", Description: "Send opPong fragmented into 2 fragments",
+			Run: func(p *Peer) error {
+				p.Send(opPong, []byte("fragment1"))
+				p.Send(fin|opCont, []byte("fragment2"))
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+		{
+			ID: "5.3", Category: "fragmentation", Description: "Send opText message fragmented into 2 fragments",
+			Run: func(p *Peer) error {
+				p.Send(opText, []byte("fragment1"))
+				p.Send(fin|opCont, []byte("fragment2"))
+				return p.ExpectText("fragment1fragment2")
+			},
+		},
+		{
+			ID: "5.4", Category: "fragmentation", Description: "Send binary message fragmented into 2 fragments, chopped",
+			Run: func(p *Peer) error {
+				p.SendChopped(opBin, []byte("fragment1"), 1)
+				p.SendChopped(fin|opCont, []byte("fragment2"), 1)
+				return p.Expect(ws.OpCodeBinary, []byte("fragment1fragment2"))
+			},
+		},
+		{
+			ID: "5.6", Category: "fragmentation", Description: "Send opText message fragmented into 2 fragments, opPing in-between",
+			Run: func(p *Peer) error {
+				p.Send(opText, []byte("fragment1"))
+				p.Send(fin|opPing, []byte("ping payload"))
+				p.Send(fin|opCont, []byte("fragment2"))
+				return then(
+					func() error { return p.Expect(ws.OpCodePong, []byte("ping payload")) },
+					func() error { return p.ExpectText("fragment1fragment2") },
+				)
+			},
+		},
+		{
+			ID: "5.7", Category: "fragmentation", Description: "Send opText message fragmented into 3 fragments, pings in-between",
+			Run: func(p *Peer) error {
+				p.Send(opText, []byte("fragment1"))
+				p.Send(fin|opPing, []byte("ping 1"))
+				p.Send(opCont, []byte("fragment2"))
+				p.Send(fin|opPing, []byte("ping 2"))
+				p.Send(fin|opCont, []byte("fragment3"))
+				return then(
+					func() error { return p.Expect(ws.OpCodePong, []byte("ping 1")) },
+					func() error { return p.Expect(ws.OpCodePong, []byte("ping 2")) },
+					func() error { return p.ExpectText("fragment1fragment2fragment3") },
+				)
+			},
+		},
+		{
+			ID: "5.9", Category: "fragmentation", Description: "Send unfragmented opText message after continuation frame with FIN = true",
+			Run: func(p *Peer) error {
+				p.Send(fin|opCont, []byte("non-continuation payload"))
+				p.SendText("Hello, world!")
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+		{
+			ID: "5.10", Category: "fragmentation", Description: "Send unfragmented opText message after continuation frame with FIN = false",
+			Run: func(p *Peer) error {
+				p.Send(opCont, []byte("non-continuation payload"))
+				p.SendText("Hello, world!")
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+		{
+			ID: "5.15", Category: "fragmentation", Description: "Send opText message in 2 fragments, then continuation frame with FIN = false where there is nothing to continue",
+			Run: func(p *Peer) error {
+				p.Send(opText, []byte("fragment1"))
+				p.Send(fin|opCont, []byte("fragment2"))
+				p.Send(opCont, []byte("fragment3"))
+				p.Send(fin|opText, []byte("fragment4"))
+				return then(
+					func() error { return p.ExpectText("fragment1fragment2") },
+					func() error { return p.ExpectClose(ws.StatusProtocolError) },
+				)
+			},
+		},
+		{
+			ID: "5.18", Category: "fragmentation", Description: "Send opText message in 2 fragments, with both frame opcodes set to text",
+			Run: func(p *Peer) error {
+				p.Send(opText, []byte("fragment1"))
+				p.Send(fin|opText, []byte("fragment2"))
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+		{
+			ID: "5.19", Category: "fragmentation", Description: "Send opText message in 5 fragments with pings in-between",
+			Run: func(p *Peer) error {
+				p.Send(opText, []byte("fragment1"))
+				p.Send(opCont, []byte("fragment2"))
+				p.Send(fin|opPing, []byte("pongme 1!"))
+				p.Send(opCont, []byte("fragment3"))
+				p.Send(opCont, []byte("fragment4"))
+				p.Send(fin|opPing, []byte("pongme 2!"))
+				p.Send(fin|opCont, []byte("fragment5"))
+				return then(
+					func() error { return p.Expect(ws.OpCodePong, []byte("pongme 1!")) },
+					func() error { return p.Expect(ws.OpCodePong, []byte("pongme 2!")) },
+					func() error { return p.ExpectText("fragment1fragment2fragment3fragment4fragment5") },
+				)
+			},
+		},
+	}
+}
+
+var validUTF8 = []string{
+	"Hello-µ@ßöäüàá-UTF-8!!",
+	"κόσμε",
+	"\x00",
+	"\u0080",
+	"ࠀ",
+	"\U00010000",
+	"\u007f",
+	"߿",
+	"￿",
+	"\U0010ffff",
+	"퟿",
+	"",
+	"�",
+}
+
+var invalidUTF8 = []string{
+	"κόσμε-\xed\xa0\x80-edited",
+	"\xf4\x90\x80\x80",
+	"\xf8\x88\x80\x80\x80",
+	"\x80",
+	"\xbf",
+	"\xc0 ",
+	"\xce",
+	"\xc0\xaf",
+	"\xe0\x80\xaf",
+	"\xf0\x80\x80\xaf",
+	"\xed\xa0\x80",
+	"\xed\xbf\xbf",
+	"\xfe",
+	"\xff",
+}
+
+func utf8Cases() []*Case {
+	cs := []*Case{
+		{
+			ID: "6.1.1", Category: "utf-8", Description: "Send opText message of length 0",
+			Run: func(p *Peer) error {
+				p.SendText("")
+				return p.ExpectText("")
+			},
+		},
+		{
+			ID: "6.1.2", Category: "utf-8", Description: "Send fragmented opText message, 3 fragments each of length 0",
+			Run: func(p *Peer) error {
+				p.Send(opText, nil)
+				p.Send(opCont, nil)
+				p.Send(fin|opCont, nil)
+				return p.ExpectText("")
+			},
+		},
+	}
+	for i, s := range validUTF8 {
+		s := s
+		cs = append(cs,
+			&Case{
+				ID:          fmt.Sprintf("6.2.%d", i+1),
+				Category:    "utf-8",
+				Description: fmt.Sprintf("Send valid UTF-8 opText message %q", s),
+				Run: func(p *Peer) error {
+					p.SendText(s)
+					return p.ExpectText(s)
+				},
+			},
+			&Case{
+				ID:          fmt.Sprintf("6.3.%d", i+1),
+				Category:    "utf-8",
+				Description: fmt.Sprintf("Send valid UTF-8 opText message %q in fragments of 1 octet", s),
+				Run: func(p *Peer) error {
+					sendBytewiseFragments(p, s)
+					return p.ExpectText(s)
+				},
+			},
+		)
+	}
+	for i, s := range invalidUTF8 {
+		s := s
+		cs = append(cs,
+			&Case{
+				ID:          fmt.Sprintf("6.4.%d", i+1),
+				Category:    "utf-8",
+				Description: fmt.Sprintf("Send invalid UTF-8 opText message %q", s),
+				Run: func(p *Peer) error {
+					p.SendText(s)
+					return p.ExpectClose(ws.StatusInvalidFramePayloadData)
+				},
+			},
+			&Case{
+				ID:          fmt.Sprintf("6.5.%d", i+1),
+				Category:    "utf-8",
+				Description: fmt.Sprintf("Send invalid UTF-8 opText message %q in fragments of 1 octet", s),
+				Run: func(p *Peer) error {
+					sendBytewiseFragments(p, s)
+					return p.ExpectClose(ws.StatusInvalidFramePayloadData)
+				},
+			},
+		)
+	}
+	cs = append(cs, &Case{
+		ID: "6.6.1", Category: "utf-8", Description: "Send invalid UTF-8 in the first fragment and expect fail fast before the message completes",
+		Run: func(p *Peer) error {
+			p.Send(opText, []byte("κόσμε\xf4\x90\x80\x80"))
+			if err := p.ExpectClose(ws.StatusInvalidFramePayloadData); err != nil {
+				return err
+			}
+			p.Send(fin|opCont, []byte("edited"))
+			return nil
+		},
+	})
+	return cs
+}
+
+func sendBytewiseFragments(p *Peer, s string) {
+	for i := 0; i < len(s); i++ {
+		op := opCont
+		if i == 0 {
+			op = opText
+		}
+		if i == len(s)-1 {
+			op |= fin
+		}
+		p.Send(op, []byte{s[i]})
+	}
+}
+
+func closeCases() []*Case {
+	cs := []*Case{
+		{
+			ID: "7.1.1", Category: "close", Description: "Send a message followed by a opClose frame",
+			Run: func(p *Peer) error {
+				p.SendText("Hello, world!")
+				p.SendClose(ws.StatusNormalClosure, "")
+				return then(
+					func() error { return p.ExpectText("Hello, world!") },
+					func() error { return p.ExpectClose(ws.StatusNormalClosure) },
+				)
+			},
+		},
+		{
+			ID: "7.1.2", Category: "close", Description: "Send two opClose frames",
+			Run: func(p *Peer) error {
+				p.SendClose(ws.StatusNormalClosure, "")
+				p.SendClose(ws.StatusNormalClosure, "")
+				return p.ExpectClose(ws.StatusNormalClosure)
+			},
+		},
+		{
+			ID: "7.1.3", Category: "close", Description: "Send a opPing after opClose frame",
+			Run: func(p *Peer) error {
+				p.SendClose(ws.StatusNormalClosure, "")
+				p.Send(fin|opPing, []byte("ping after close"))
+				return p.ExpectClose(ws.StatusNormalClosure)
+			},
+		},
+		{
+			ID: "7.1.4", Category: "close", Description: "Send opText message after opClose frame",
+			Run: func(p *Peer) error {
+				p.SendClose(ws.StatusNormalClosure, "")
+				p.SendText("text after close")
+				return p.ExpectClose(ws.StatusNormalClosure)
+			},
+		},
+		{
+			ID: "7.1.5", Category: "close", Description: "Send message fragment, then opClose frame, then continuation",
+			Run: func(p *Peer) error {
+				p.Send(opText, []byte("fragment1"))
+				p.SendClose(ws.StatusNormalClosure, "")
+				p.Send(fin|opCont, []byte("fragment2"))
+				return p.ExpectClose(ws.StatusNormalClosure)
+			},
+		},
+		{
+			ID: "7.3.1", Category: "close", Description: "Send opClose frame with payload length 0",
+			Run: func(p *Peer) error {
+				p.Send(fin|opClose, nil)
+				return p.ExpectClose(ws.StatusNoStatusReceived)
+			},
+		},
+		{
+			ID: "7.3.2", Category: "close", Description: "Send opClose frame with payload length 1",
+			Run: func(p *Peer) error {
+				p.Send(fin|opClose, []byte{0x03})
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+		{
+			ID: "7.3.3", Category: "close", Description: "Send opClose frame with status code and no reason",
+			Run: func(p *Peer) error {
+				p.SendClose(ws.StatusNormalClosure, "")
+				return p.ExpectClose(ws.StatusNormalClosure)
+			},
+		},
+		{
+			ID: "7.3.4", Category: "close", Description: "Send opClose frame with status code and reason",
+			Run: func(p *Peer) error {
+				p.SendClose(ws.StatusNormalClosure, "Hello World!")
+				return p.ExpectClose(ws.StatusNormalClosure)
+			},
+		},
+		{
+			ID: "7.3.5", Category: "close", Description: "Send opClose frame with reason of 123 octets",
+			Run: func(p *Peer) error {
+				p.SendClose(ws.StatusNormalClosure, strings.Repeat("*", 123))
+				return p.ExpectClose(ws.StatusNormalClosure)
+			},
+		},
+		{
+			ID: "7.3.6", Category: "close", Description: "Send opClose frame with reason of 124 octets (payload too long)",
+			Run: func(p *Peer) error {
+				p.SendClose(ws.StatusNormalClosure, strings.Repeat("*", 124))
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+		{
+			ID: "7.5.1", Category: "close", Description: "Send opClose frame with invalid UTF-8 reason",
+			Run: func(p *Peer) error {
+				p.SendClose(ws.StatusNormalClosure, "κόσμε-\xed\xa0\x80-edited")
+				return p.ExpectClose(ws.StatusInvalidFramePayloadData)
+			},
+		},
+	}
+	valid := []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999}
+	for i, code := range valid {
+		code := code
+		cs = append(cs, &Case{
+			ID:          fmt.Sprintf("7.7.%d", i+1),
+			Category:    "close",
+			Description: fmt.Sprintf("Send opClose frame with valid opClose code %d", code),
+			Run: func(p *Peer) error {
+				p.SendClose(code, "")
+				return p.ExpectClose(code)
+			},
+		})
+	}
+	invalid := []int{0, 999, 1004, 1005, 1006, 1015, 1016, 1100, 2000, 2999, 5000, 65535}
+	for i, code := range invalid {
+		code := code
+		cs = append(cs, &Case{
+			ID:          fmt.Sprintf("7.9.%d", i+1),
+			Category:    "close",
+			Description: fmt.Sprintf("Send opClose frame with invalid opClose code %d", code),
+			Run: func(p *Peer) error {
+				p.SendClose(code, "")
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		})
+	}
+	return cs
+}
+
+func limitCases() []*Case {
+	var cs []*Case
+	sizes := []int{64 << 10, 256 << 10, 1 << 20, maxMessageSize}
+	for i, op := range []ws.OpCode{ws.OpCodeText, ws.OpCodeBinary} {
+		for j, l := range sizes {
+			op, l := op, l
+			cs = append(cs, &Case{
+				ID:          fmt.Sprintf("9.%d.%d", i+1, j+1),
+				Category:    "limits",
+				Description: fmt.Sprintf("Send %s message of %d octets", opName(op), l),
+				Run: func(p *Peer) error {
+					p.Send(fin|byte(op), payloadOf(l))
+					return p.Expect(op, payloadOf(l))
+				},
+			})
+		}
+	}
+	cs = append(cs,
+		&Case{
+			ID: "9.3.1", Category: "limits", Description: "Send opText message of 1 MiB in 64 fragments",
+			Run: func(p *Peer) error {
+				const n = 64
+				for i := 0; i < n; i++ {
+					op := opCont
+					if i == 0 {
+						op = opText
+					}
+					if i == n-1 {
+						op |= fin
+					}
+					p.Send(op, payloadOf((1<<20)/n))
+				}
+				return p.ExpectText(string(payloadOf(1 << 20)))
+			},
+		},
+		&Case{
+			ID: "9.4.1", Category: "limits", Description: "Send binary message over the size limit",
+			Run: func(p *Peer) error {
+				p.Send(fin|opBin, payloadOf(maxMessageSize+1))
+				return p.ExpectClose(ws.StatusMessageTooBig)
+			},
+		},
+		&Case{
+			ID: "9.4.2", Category: "limits", Description: "Send fragmented opText message over the size limit",
+			Run: func(p *Peer) error {
+				p.Send(opText, payloadOf(maxMessageSize/2))
+				p.Send(fin|opCont, payloadOf(maxMessageSize/2+1))
+				return p.ExpectClose(ws.StatusMessageTooBig)
+			},
+		},
+	)
+	return cs
+}
+
+// minws does not implement permessage-deflate, so these cases check the
+// extension is declined and compressed frames are rejected.
+func compressionCases() []*Case {
+	return []*Case{
+		{
+			ID: "12.1.1", Category: "compression", Description: "Offer permessage-deflate and expect it is declined",
+			RequestHeader: map[string]string{"Sec-WebSocket-Extensions": "permessage-deflate; client_max_window_bits"},
+			Run: func(p *Peer) error {
+				if ext, ok := p.ResponseHeader["Sec-WebSocket-Extensions"]; ok {
+					return fmt.Errorf("server accepted extension %q", ext)
+				}
+				p.SendText("Hello, world!")
+				return p.ExpectText("Hello, world!")
+			},
+		},
+		{
+			ID: "12.1.2", Category: "compression", Description: "Send compressed frame (RSV1) without negotiating permessage-deflate",
+			Run: func(p *Peer) error {
+				// "Hello" compressed by raw deflate
+				p.Send(fin|0x40|opText, []byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00})
+				return p.ExpectClose(ws.StatusProtocolError)
+			},
+		},
+	}
+}
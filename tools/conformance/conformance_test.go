@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	results, err := Run(Cases(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			t.Errorf("%s [%s] %s: %v", r.Case.ID, r.Transport, r.Case.Description, r.Err)
+		}
+	}
+	if testing.Verbose() {
+		var buf bytes.Buffer
+		Report(&buf, results)
+		t.Log("\n" + buf.String())
+	}
+}
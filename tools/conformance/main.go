@@ -0,0 +1,34 @@
+// Command conformance runs Autobahn Testsuite style test cases against the
+// minws echo server and prints a per-case report.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+)
+
+func main() {
+	addr := flag.String("addr", "", "address of a running echo server to test instead of the in-process one")
+	prefix := flag.String("case", "", "run only cases whose id has this prefix")
+	flag.Parse()
+
+	var cases []*Case
+	for _, c := range Cases() {
+		if strings.HasPrefix(c.ID, *prefix) {
+			cases = append(cases, c)
+		}
+	}
+
+	results, err := Run(cases, *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Report(os.Stdout, results)
+	for _, r := range results {
+		if !r.Passed() {
+			os.Exit(1)
+		}
+	}
+}
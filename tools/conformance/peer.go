@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cou929/minws/ws"
+)
+
+const (
+	testKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	testAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+var maskingKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// timeout for waiting a frame from the server
+var timeout = 5 * time.Second
+
+// Peer is the client side of a test case.
+// It sends raw frames and checks frames sent back from the server.
+type Peer struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	frames chan *ws.DataFrame // closed when the server closes connection
+	done   chan struct{}
+
+	// ResponseHeader is the handshake response header (tcp transport only)
+	ResponseHeader map[string]string
+}
+
+func newPeer(conn net.Conn) *Peer {
+	return &Peer{
+		conn:   conn,
+		br:     bufio.NewReader(conn),
+		frames: make(chan *ws.DataFrame, 64),
+		done:   make(chan struct{}),
+	}
+}
+
+func (p *Peer) start() {
+	go func() {
+		defer close(p.frames)
+		for {
+			df, err := ws.NewDataFrameFromReader(p.br)
+			if err != nil {
+				return
+			}
+			select {
+			case p.frames <- df:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Peer) close() {
+	close(p.done)
+	p.conn.Close()
+}
+
+// handshake sends an opening handshake with extra headers and reads the
+// response
+func (p *Peer) handshake(header map[string]string) error {
+	var b strings.Builder
+	b.WriteString("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	b.WriteString("Sec-WebSocket-Key: " + testKey + "\r\nSec-WebSocket-Version: 13\r\n")
+	for k, v := range header {
+		b.WriteString(k + ": " + v + "\r\n")
+	}
+	b.WriteString("\r\n")
+	if _, err := p.conn.Write([]byte(b.String())); err != nil {
+		return err
+	}
+
+	status, err := p.br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(status, "HTTP/1.1 101 ") {
+		return fmt.Errorf("unexpected status line %q", status)
+	}
+	p.ResponseHeader = make(map[string]string)
+	for {
+		line, err := p.br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return fmt.Errorf("invalid header line %q", line)
+		}
+		p.ResponseHeader[line[:i]] = strings.TrimSpace(line[i+1:])
+	}
+	if got := p.ResponseHeader["Sec-WebSocket-Accept"]; got != testAccept {
+		return fmt.Errorf("Sec-WebSocket-Accept = %q, want %q", got, testAccept)
+	}
+	return nil
+}
+
+// frame builds a masked frame. b0 is the first byte (FIN, RSV and opcode).
+func frame(b0 byte, payload []byte) []byte {
+	res := []byte{b0, 0x80}
+	switch l := len(payload); {
+	case l < 126:
+		res[1] |= byte(l)
+	case l <= 0xffff:
+		res[1] |= 126
+		res = append(res, 0, 0)
+		binary.BigEndian.PutUint16(res[2:], uint16(l))
+	default:
+		res[1] |= 127
+		res = append(res, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(res[2:], uint64(l))
+	}
+	res = append(res, maskingKey[:]...)
+	for i, b := range payload {
+		res = append(res, b^maskingKey[i%4])
+	}
+	return res
+}
+
+const fin = 0x80
+
+// Send sends a frame. Write errors are ignored because the server may have
+// already failed the connection, which is checked by Expect methods.
+func (p *Peer) Send(b0 byte, payload []byte) {
+	p.conn.Write(frame(b0, payload))
+}
+
+// SendText sends a text message in a single frame
+func (p *Peer) SendText(s string) {
+	p.Send(fin|byte(ws.OpCodeText), []byte(s))
+}
+
+// SendChopped sends a frame by writes of chunk bytes
+func (p *Peer) SendChopped(b0 byte, payload []byte, chunk int) {
+	b := frame(b0, payload)
+	for len(b) > 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := p.conn.Write(b[:n]); err != nil {
+			return
+		}
+		b = b[n:]
+	}
+}
+
+// SendClose sends a close frame with the status code and reason
+func (p *Peer) SendClose(code int, reason string) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(code))
+	p.Send(fin|byte(ws.OpCodeClose), append(b, reason...))
+}
+
+func (p *Peer) next() (*ws.DataFrame, error) {
+	select {
+	case df, ok := <-p.frames:
+		if !ok {
+			return nil, fmt.Errorf("connection closed")
+		}
+		return df, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timeout")
+	}
+}
+
+// Expect checks the next frame has the opcode and payload
+func (p *Peer) Expect(op ws.OpCode, payload []byte) error {
+	df, err := p.next()
+	if err != nil {
+		return fmt.Errorf("want %s frame: %w", opName(op), err)
+	}
+	if df.OpCode != op {
+		return fmt.Errorf("got %s frame, want %s frame", opName(df.OpCode), opName(op))
+	}
+	if !df.Fin() {
+		return fmt.Errorf("got fragmented %s frame", opName(op))
+	}
+	if !bytes.Equal(df.Message(), payload) {
+		return fmt.Errorf("got %s payload %s, want %s", opName(op), abbrev(df.Message()), abbrev(payload))
+	}
+	return nil
+}
+
+// ExpectText checks the next frame is the text message
+func (p *Peer) ExpectText(s string) error {
+	return p.Expect(ws.OpCodeText, []byte(s))
+}
+
+// ExpectClose checks the next frame is a close frame with the code and the
+// server closes TCP connection after that. ws.StatusNoStatusReceived means
+// the close frame has no body.
+func (p *Peer) ExpectClose(code int) error {
+	df, err := p.next()
+	if err != nil {
+		return fmt.Errorf("want close frame: %w", err)
+	}
+	if df.OpCode != ws.OpCodeClose {
+		return fmt.Errorf("got %s frame, want close %d", opName(df.OpCode), code)
+	}
+	if got, err := df.CloseStatusCode(); err != nil || got != code {
+		return fmt.Errorf("got close %d (%v), want close %d", got, err, code)
+	}
+	select {
+	case df, ok := <-p.frames:
+		if ok {
+			return fmt.Errorf("got %s frame after close", opName(df.OpCode))
+		}
+	case <-time.After(timeout):
+		return fmt.Errorf("server did not close TCP connection")
+	}
+	return nil
+}
+
+func opName(op ws.OpCode) string {
+	switch op {
+	case ws.OpCodeContinuation:
+		return "continuation"
+	case ws.OpCodeText:
+		return "text"
+	case ws.OpCodeBinary:
+		return "binary"
+	case ws.OpCodeClose:
+		return "close"
+	case ws.OpCodePing:
+		return "ping"
+	case ws.OpCodePong:
+		return "pong"
+	}
+	return fmt.Sprintf("opcode %#x", int(op))
+}
+
+func abbrev(b []byte) string {
+	if len(b) > 32 {
+		return fmt.Sprintf("%q...(%d bytes)", b[:32], len(b))
+	}
+	return fmt.Sprintf("%q", b)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/cou929/minws"
+	"github.com/cou929/minws/ws"
+)
+
+// Transports over which cases run
+const (
+	TransportPipe = "pipe" // net.Pipe without opening handshake
+	TransportTCP  = "tcp"  // loopback socket with opening handshake
+)
+
+// Result is the outcome of a case over a transport
+type Result struct {
+	Case      *Case
+	Transport string
+	Err       error
+}
+
+// Passed reports whether the case passed
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+// echo is the server under test. It sends back every received message.
+func echo(c *ws.Conn) {
+	c.MaxMessageSize = maxMessageSize
+	defer c.Rwc.Close()
+	for {
+		op, msg, err := c.NextMessage()
+		if err != nil {
+			return
+		}
+		if op == ws.OpCodeText {
+			err = c.SendTextMessage(string(msg))
+		} else {
+			err = c.SendBinaryMessage(msg)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serve accepts connections, completes the opening handshake and runs echo
+func serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			c, err := minws.HandShake(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			echo(c)
+		}(conn)
+	}
+}
+
+// Run runs cases over each transport. If addr is not empty, cases run
+// against the server listening on addr over tcp instead of the in-process
+// echo server.
+func Run(cases []*Case, addr string) ([]Result, error) {
+	transports := []string{TransportPipe, TransportTCP}
+	if addr == "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		go serve(l)
+		addr = l.Addr().String()
+	} else {
+		transports = []string{TransportTCP}
+	}
+
+	results := make([]Result, 0, len(cases)*len(transports))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range cases {
+		for _, tr := range transports {
+			if tr == TransportPipe && c.RequestHeader != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(c *Case, tr string) {
+				defer wg.Done()
+				err := runCase(c, tr, addr)
+				mu.Lock()
+				results = append(results, Result{c, tr, err})
+				mu.Unlock()
+			}(c, tr)
+		}
+	}
+	wg.Wait()
+
+	order := make(map[*Case]int, len(cases))
+	for i, c := range cases {
+		order[c] = i
+	}
+	sortResults(results, order)
+	return results, nil
+}
+
+func runCase(c *Case, transport, addr string) error {
+	var p *Peer
+	switch transport {
+	case TransportPipe:
+		server, client := net.Pipe()
+		go echo(ws.NewConn(server))
+		p = newPeer(client)
+	case TransportTCP:
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		p = newPeer(conn)
+		if err := p.handshake(c.RequestHeader); err != nil {
+			p.conn.Close()
+			return fmt.Errorf("handshake: %w", err)
+		}
+	}
+	p.start()
+	defer p.close()
+	return c.Run(p)
+}
+
+func sortResults(results []Result, order map[*Case]int) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if order[a.Case] != order[b.Case] {
+			return order[a.Case] < order[b.Case]
+		}
+		return a.Transport < b.Transport
+	})
+}
+
+// Report writes per-case results and a summary per category
+func Report(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CASE\tCATEGORY\tTRANSPORT\tRESULT\tDESCRIPTION")
+	type count struct{ pass, fail int }
+	var categories []string
+	summary := make(map[string]*count)
+	for _, r := range results {
+		res := "PASS"
+		if !r.Passed() {
+			res = "FAIL: " + r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Case.ID, r.Case.Category, r.Transport, res, r.Case.Description)
+
+		c, ok := summary[r.Case.Category]
+		if !ok {
+			c = &count{}
+			summary[r.Case.Category] = c
+			categories = append(categories, r.Case.Category)
+		}
+		if r.Passed() {
+			c.pass++
+		} else {
+			c.fail++
+		}
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	total := count{}
+	for _, cat := range categories {
+		c := summary[cat]
+		fmt.Fprintf(w, "%-14s %4d passed, %4d failed\n", cat, c.pass, c.fail)
+		total.pass += c.pass
+		total.fail += c.fail
+	}
+	fmt.Fprintf(w, "%s\n%-14s %4d passed, %4d failed\n", strings.Repeat("-", 44), "total", total.pass, total.fail)
+}
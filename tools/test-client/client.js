@@ -1,8 +1,9 @@
 var connection = null;
 
 function connect() {
-    const port = 5001;
-    const serverUrl = 'ws://' + document.location.hostname + ':' + port;
+    // the page is served by minws itself, so the socket is on the same host
+    const scheme = document.location.protocol === 'https:' ? 'wss://' : 'ws://';
+    const serverUrl = scheme + document.location.host;
     connection = new WebSocket(serverUrl, "json");
     console.log("***CREATED WEBSOCKET");
 
@@ -0,0 +1,143 @@
+package ws
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// loopConn is a net.Conn which reads the same bytes repeatedly and discards
+// written bytes
+type loopConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data[c.off:])
+	c.off = (c.off + n) % len(c.data)
+	return n, nil
+}
+
+func (c *loopConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *loopConn) Close() error                { return nil }
+
+var benchSizes = []int{16, 1024, 64 << 10}
+
+func BenchmarkConn_ReadMessage(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			c := NewConn(&loopConn{data: clientFrame(0x80|byte(OpCodeBinary), make([]byte, size), true)})
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				df, err := c.ReadMessage()
+				if err != nil {
+					b.Fatal(err)
+				}
+				df.Message()
+			}
+		})
+	}
+}
+
+func BenchmarkConn_SendBinaryMessage(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			c := NewConn(&loopConn{})
+			msg := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := c.SendBinaryMessage(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConn_NextMessage(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			c := NewConn(&loopConn{data: clientFrame(0x80|byte(OpCodeBinary), make([]byte, size), true)})
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := c.NextMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConn_NextMessageInto(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			c := NewConn(&loopConn{data: clientFrame(0x80|byte(OpCodeBinary), make([]byte, size), true)})
+			var buf []byte
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if _, buf, err = c.NextMessageInto(buf[:0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConn_NextMessageInto_Fragmented(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			frag := make([]byte, size/4)
+			var data []byte
+			data = append(data, clientFrame(byte(OpCodeBinary), frag, true)...)
+			data = append(data, clientFrame(byte(OpCodeContinuation), frag, true)...)
+			data = append(data, clientFrame(0x80|byte(OpCodePong), nil, true)...)
+			data = append(data, clientFrame(byte(OpCodeContinuation), frag, true)...)
+			data = append(data, clientFrame(0x80|byte(OpCodeContinuation), frag, true)...)
+			c := NewConn(&loopConn{data: data})
+			var buf []byte
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if _, buf, err = c.NextMessageInto(buf[:0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConn_SendMessage(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			c := NewConn(&loopConn{})
+			msg := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := c.SendMessage(OpCodeBinary, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Benchmark_maskBytes(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			p := make([]byte, size)
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				maskBytes(testMaskingKey, 0, p)
+			}
+		})
+	}
+}
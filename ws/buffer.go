@@ -0,0 +1,40 @@
+package ws
+
+import "sync"
+
+// maxPooledBufferSize is the max capacity of buffers put back to the pool,
+// so that a few huge messages do not keep memory
+const maxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBufferSize {
+		return
+	}
+	*b = (*b)[:0]
+	bufferPool.Put(b)
+}
+
+// grow makes room for n more bytes in b
+func grow(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	c := len(b) + n
+	if len(b) > 0 && c < 2*cap(b) {
+		c = 2 * cap(b)
+	}
+	nb := make([]byte, len(b), c)
+	copy(nb, b)
+	return nb
+}
@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"encoding/json"
+
+	"github.com/cou929/minws/codec"
+)
+
+// ReadJSON reads the next data message and decodes it as JSON into v
+func (c *Conn) ReadJSON(v interface{}) error {
+	return c.readValue(codec.JSON, v)
+}
+
+// WriteJSON sends v encoded as JSON in a text message
+func (c *Conn) WriteJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(OpCodeText, b)
+}
+
+// Codec returns the codec selected by the negotiated subprotocol, or JSON
+// if there is no such codec
+func (c *Conn) Codec() codec.Codec {
+	if cd, ok := codec.Lookup(c.Subprotocol); ok {
+		return cd
+	}
+	return codec.JSON
+}
+
+// ReadValue reads the next data message and decodes it into v with the
+// codec of the connection
+func (c *Conn) ReadValue(v interface{}) error {
+	return c.readValue(c.Codec(), v)
+}
+
+// WriteValue sends v encoded with the codec of the connection, in a
+// binary message if the codec is binary and a text message otherwise
+func (c *Conn) WriteValue(v interface{}) error {
+	cd := c.Codec()
+	b, err := cd.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if cd.Binary() {
+		return c.writeFrame(OpCodeBinary, b)
+	}
+	return c.writeFrame(OpCodeText, b)
+}
+
+func (c *Conn) readValue(cd codec.Codec, v interface{}) error {
+	bp := getBuffer()
+	defer putBuffer(bp)
+	_, b, err := c.NextMessageInto(*bp)
+	*bp = b
+	if err != nil {
+		return err
+	}
+	return cd.Unmarshal(b, v)
+}
@@ -0,0 +1,55 @@
+package ws
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestConn_JSON(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	s := NewConn(server)
+	c := NewClientConn(client, bufio.NewReader(client))
+
+	type message struct {
+		Type string `json:"type"`
+		N    int    `json:"n"`
+	}
+	go c.WriteJSON(message{Type: "hello", N: 1})
+	var got message
+	if err := s.ReadJSON(&got); err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	if got != (message{Type: "hello", N: 1}) {
+		t.Errorf("ReadJSON() = %+v", got)
+	}
+
+	for _, tt := range []struct {
+		proto  string
+		wantOp OpCode
+	}{
+		{"", OpCodeText},
+		{"json", OpCodeText},
+		{"msgpack", OpCodeBinary},
+		{"cbor", OpCodeBinary},
+	} {
+		s.Subprotocol, c.Subprotocol = tt.proto, tt.proto
+		go c.WriteValue(message{Type: tt.proto, N: 2})
+		df, err := s.nextFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if df.OpCode != tt.wantOp {
+			t.Errorf("%q: opcode = %v, want %v", tt.proto, df.OpCode, tt.wantOp)
+		}
+		b, err := s.readPayload(df, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got message
+		if err := s.Codec().Unmarshal(b, &got); err != nil || got.Type != tt.proto {
+			t.Errorf("%q: decoded %+v, %v", tt.proto, got, err)
+		}
+	}
+}
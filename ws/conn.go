@@ -2,9 +2,13 @@ package ws
 
 import (
 	"bufio"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -15,118 +19,493 @@ const (
 	Closed      = 3
 )
 
+// DefaultMaxMessageSize is the limit of a received message when
+// Conn.MaxMessageSize is not set. The payload length of a frame is checked
+// against it before the payload is allocated.
+const DefaultMaxMessageSize = 16 << 20
+
+// MessageConn is the message level interface of Conn. Fallback transports
+// for clients which cannot use WebSocket implement it as well, so that an
+// application serves both with the same handler.
+type MessageConn interface {
+	// NextMessage returns the next data message. *CloseError is returned
+	// once the connection is closed by the peer.
+	NextMessage() (OpCode, []byte, error)
+	SendMessage(op OpCode, msg []byte) error
+	SendTextMessage(msg string) error
+	SendBinaryMessage(msg []byte) error
+	Close()
+	CloseWithStatus(status int)
+	OnClose(f func())
+}
+
+var _ MessageConn = (*Conn)(nil)
+
 // Conn represents a WebSocket connection
 type Conn struct {
 	Rwc   net.Conn
 	r     *bufio.Reader
 	State int
+
+	// client is true if this is the client side of the connection, which
+	// masks sent frames and expects unmasked frames
+	client bool
+
+	// opcode of the fragmented message being received, or
+	// OpCodeContinuation if there is none
+	fragmented OpCode
+	// validates text message across fragments
+	utf8     utf8Validator
+	readText bool
+	// total payload length of the message being received
+	readLen int
+
+	// Subprotocol is the subprotocol agreed in the opening handshake,
+	// which selects the codec of ReadValue and WriteValue
+	Subprotocol string
+
+	// MaxMessageSize limits the size of a received message in bytes.
+	// The connection is failed with 1009 if exceeded. 0 means
+	// DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	// buffers reused across frames to avoid allocations
+	cur   DataFrame // frame being read
+	rhdr  [maxFrameHeaderLen]byte
+	ctrl  [maxControlPayloadLen]byte
+	whdr  [maxFrameHeaderLen]byte
+	wiov  [2][]byte
+	wbufs net.Buffers
+	// serializes writes, so that messages can be sent from other goroutines
+	wmu sync.Mutex
+
+	// guards State changed by the reader and by Close from other goroutines
+	stateMu sync.Mutex
+
+	closeOnce sync.Once
+	hookMu    sync.Mutex
+	onClose   []func()
+	hooksRun  bool
 }
 
 // NewConn is a constructor of Conn
 func NewConn(tcpConn net.Conn) *Conn {
-	return &Conn{tcpConn, bufio.NewReader(tcpConn), Established}
+	return &Conn{Rwc: tcpConn, r: bufio.NewReader(tcpConn), State: Established}
+}
+
+// NewServerConn is like NewConn but reads with r, which may have buffered
+// frames sent by the client right after the opening handshake
+func NewServerConn(rwc net.Conn, r *bufio.Reader) *Conn {
+	return &Conn{Rwc: rwc, r: r, State: Established}
+}
+
+// NewClientConn is a constructor of client side Conn.
+// r is the reader used for the opening handshake, which may have buffered
+// frames sent by the server.
+func NewClientConn(rwc net.Conn, r *bufio.Reader) *Conn {
+	return &Conn{Rwc: rwc, r: r, State: Established, client: true}
 }
 
-// ReadMessage read received frames and return DataFrame object
+// ReadMessage read received frames and return DataFrame object.
+// If the frame violates the protocol, the connection is failed and
+// *CloseError is returned.
 func (c *Conn) ReadMessage() (*DataFrame, error) {
-	df, err := NewDataFrameFromReader(c.r)
+	df, err := c.nextFrame()
+	if err == nil {
+		_, err = c.readPayload(df, nil)
+	}
 	if err != nil {
+		return nil, c.failOnError(err)
+	}
+	res := *df
+	return &res, nil
+}
+
+// nextFrame reads and validates the header of the next frame.
+// The returned frame is reused by the next call.
+func (c *Conn) nextFrame() (*DataFrame, error) {
+	df := &c.cur
+	*df = DataFrame{}
+	if err := df.readHeader(c.r, c.rhdr[:]); err != nil {
+		return nil, err
+	}
+	if err := c.validateFrame(df); err != nil {
 		return nil, err
 	}
 	return df, nil
 }
 
+// readPayload appends the payload of df to dst and unmasks it in place
+func (c *Conn) readPayload(df *DataFrame, dst []byte) ([]byte, error) {
+	n := len(dst)
+	dst = grow(dst, df.payloadLen)[:n+df.payloadLen]
+	p := dst[n:]
+	if _, err := io.ReadFull(c.r, p); err != nil {
+		return dst[:n], fmt.Errorf("Failed to read payload %w", err)
+	}
+	if df.mask {
+		maskBytes(df.maskingKey, 0, p)
+	}
+	df.rawPayload, df.payload = p, p
+	if err := c.validatePayload(df); err != nil {
+		return dst[:n], err
+	}
+	return dst, nil
+}
+
+// failOnError fails the connection if err is a protocol violation.
+// Otherwise the stream can not be read any more, so the connection is
+// closed.
+func (c *Conn) failOnError(err error) error {
+	var cerr *CloseError
+	if errors.As(err, &cerr) {
+		c.fail(cerr)
+	} else {
+		c.setClosed()
+	}
+	return err
+}
+
+// validatePayload checks text messages are valid UTF-8 and close frames
+// have a valid status code and reason
+func (c *Conn) validatePayload(df *DataFrame) error {
+	switch df.OpCode {
+	case OpCodeText:
+		c.readText = true
+		c.utf8.Reset()
+	case OpCodeContinuation:
+	case OpCodeClose:
+		return validateClosePayload(df.Message())
+	default:
+		return nil
+	}
+	if !c.readText {
+		return nil
+	}
+	if !c.utf8.Write(df.Message()) {
+		return invalidPayloadError("invalid UTF-8 in text message")
+	}
+	if df.fin {
+		c.readText = false
+		if !c.utf8.Complete() {
+			return invalidPayloadError("incomplete UTF-8 in text message")
+		}
+	}
+	return nil
+}
+
+func validateClosePayload(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if len(p) == 1 {
+		return protocolError("close frame payload too short")
+	}
+	if code := int(binary.BigEndian.Uint16(p)); !validCloseCode(code) {
+		return protocolError("invalid close code %d", code)
+	}
+	var v utf8Validator
+	if !v.Write(p[2:]) || !v.Complete() {
+		return invalidPayloadError("invalid UTF-8 in close reason")
+	}
+	return nil
+}
+
+// validateFrame checks frame header according to
+// https://tools.ietf.org/html/rfc6455#section-5
+func (c *Conn) validateFrame(df *DataFrame) error {
+	// no extension is negotiated, so RSV bits must be 0
+	if df.rsv != 0 {
+		return protocolError("reserved bits must be 0")
+	}
+	if df.OpCode.IsReserved() {
+		return protocolError("reserved opcode %#x", int(df.OpCode))
+	}
+	// frames from client must be masked, and frames from server must not
+	if df.mask == c.client {
+		if c.client {
+			return protocolError("frame from server is masked")
+		}
+		return protocolError("frame is not masked")
+	}
+
+	if df.OpCode.IsControl() {
+		if !df.fin {
+			return protocolError("control frame must not be fragmented")
+		}
+		if df.payloadLen > maxControlPayloadLen {
+			return protocolError("control frame payload too long")
+		}
+		return nil
+	}
+
+	switch df.OpCode {
+	case OpCodeContinuation:
+		if c.fragmented == OpCodeContinuation {
+			return protocolError("unexpected continuation frame")
+		}
+		if df.fin {
+			c.fragmented = OpCodeContinuation
+		}
+	default:
+		if c.fragmented != OpCodeContinuation {
+			return protocolError("expected continuation frame")
+		}
+		if !df.fin {
+			c.fragmented = df.OpCode
+		}
+		c.readLen = 0
+	}
+
+	// compared without adding, which may overflow for huge lengths
+	if df.payloadLen > c.maxMessageSize()-c.readLen {
+		return &CloseError{Code: StatusMessageTooBig, Text: "message too big"}
+	}
+	c.readLen += df.payloadLen
+	return nil
+}
+
+func (c *Conn) maxMessageSize() int {
+	if c.MaxMessageSize > 0 {
+		return c.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// fail sends a close frame with the error code and closes the connection
+// https://tools.ietf.org/html/rfc6455#section-7.1.7
+func (c *Conn) fail(cerr *CloseError) {
+	if c.transition(Established, Closing) {
+		c.SendCloseFrame(cerr.Code)
+	}
+	c.setClosed()
+}
+
+// transition changes State from one to another, and reports whether it
+// was in the from state
+func (c *Conn) transition(from, to int) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.State != from {
+		return false
+	}
+	c.State = to
+	return true
+}
+
+// setClosed closes the underlying connection and calls OnClose hooks once
+func (c *Conn) setClosed() {
+	c.stateMu.Lock()
+	c.State = Closed
+	c.stateMu.Unlock()
+	c.closeOnce.Do(func() {
+		c.Rwc.Close()
+		c.hookMu.Lock()
+		hooks := c.onClose
+		c.onClose = nil
+		c.hooksRun = true
+		c.hookMu.Unlock()
+		for _, f := range hooks {
+			f()
+		}
+	})
+}
+
+// OnClose registers f to be called when the connection is closed.
+// If it is already closed, f is called immediately in a new goroutine.
+func (c *Conn) OnClose(f func()) {
+	c.hookMu.Lock()
+	defer c.hookMu.Unlock()
+	if c.hooksRun {
+		go f()
+		return
+	}
+	c.onClose = append(c.onClose, f)
+}
+
+// NextMessage reads a complete data message, reassembling fragmented
+// frames. Control frames received meanwhile are handled here: pings are
+// answered with pongs, and a close frame completes the closing handshake
+// and returns *CloseError.
+func (c *Conn) NextMessage() (OpCode, []byte, error) {
+	bp := getBuffer()
+	defer putBuffer(bp)
+	op, b, err := c.NextMessageInto(*bp)
+	*bp = b
+	if err != nil {
+		return 0, nil, err
+	}
+	msg := make([]byte, len(b))
+	copy(msg, b)
+	return op, msg, nil
+}
+
+// NextMessageInto is like NextMessage but appends the message to dst and
+// returns the extended buffer. It does not allocate if dst has enough
+// capacity for the message.
+func (c *Conn) NextMessageInto(dst []byte) (OpCode, []byte, error) {
+	// A timeout before the message starts leaves the connection usable,
+	// as no byte has been consumed. Timeouts in the middle of a message
+	// fail the connection.
+	if _, err := c.r.Peek(1); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return 0, dst, err
+		}
+		return 0, dst, c.failOnError(err)
+	}
+	var op OpCode
+	for {
+		df, err := c.nextFrame()
+		if err != nil {
+			return 0, dst, c.failOnError(err)
+		}
+		if df.OpCode.IsControl() {
+			if _, err := c.readPayload(df, c.ctrl[:0]); err != nil {
+				return 0, dst, c.failOnError(err)
+			}
+			if err := c.handleControl(df); err != nil {
+				return 0, dst, err
+			}
+			continue
+		}
+		if df.OpCode != OpCodeContinuation {
+			op = df.OpCode
+		}
+		if dst, err = c.readPayload(df, dst); err != nil {
+			return 0, dst, c.failOnError(err)
+		}
+		if df.fin {
+			return op, dst, nil
+		}
+	}
+}
+
+func (c *Conn) handleControl(df *DataFrame) error {
+	switch df.OpCode {
+	case OpCodePing:
+		return c.Pong(df.payload)
+	case OpCodeClose:
+		return c.handleClose(df)
+	}
+	return nil
+}
+
+// handleClose replies to the close frame from client and closes the
+// underlying connection, as the server closes TCP connection first.
+// https://tools.ietf.org/html/rfc6455#section-5.5.1
+func (c *Conn) handleClose(df *DataFrame) error {
+	code, err := df.CloseStatusCode()
+	if err != nil {
+		return err
+	}
+	if c.transition(Established, Closing) {
+		c.SendCloseFrame(code)
+	}
+	c.setClosed()
+	return &CloseError{Code: code, Text: df.CloseReason()}
+}
+
 // ReadTextMessage handles text message from client
 func (c *Conn) ReadTextMessage() (string, error) {
-	df, err := c.ReadMessage()
+	op, msg, err := c.NextMessage()
 	if err != nil {
 		return "", err
 	}
-	if df.OpCode != OpCodeText {
+	if op != OpCodeText {
 		return "", fmt.Errorf("Invalid format")
 	}
-	return string(df.Message()), nil
+	return string(msg), nil
 }
 
 // ReadBinaryMessage handles binary message from client
 func (c *Conn) ReadBinaryMessage() ([]byte, error) {
-	df, err := c.ReadMessage()
+	op, msg, err := c.NextMessage()
 	if err != nil {
 		return nil, err
 	}
-	if df.OpCode != OpCodeBinary {
+	if op != OpCodeBinary {
 		return nil, fmt.Errorf("Invalid format")
 	}
-	return df.Message(), nil
+	return msg, nil
 }
 
 // SendTextMessage pushes text message to client
 func (c *Conn) SendTextMessage(msg string) error {
-	df, err := NewDataFrameFromTextMessage(msg, false)
-	if err != nil {
-		return err
-	}
-	_, err = c.Rwc.Write(df.Frame())
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.writeFrame(OpCodeText, []byte(msg))
 }
 
 // SendBinaryMessage pushes binary message to client
 func (c *Conn) SendBinaryMessage(msg []byte) error {
-	df, err := NewDataFrameFromBinaryMessage(msg, false)
-	if err != nil {
-		return err
-	}
-	_, err = c.Rwc.Write(df.Frame())
-	if err != nil {
-		return err
+	return c.writeFrame(OpCodeBinary, msg)
+}
+
+// SendMessage pushes a text or binary message to client without copying msg
+func (c *Conn) SendMessage(op OpCode, msg []byte) error {
+	return c.writeFrame(op, msg)
+}
+
+// writeFrame writes an unfragmented frame. The header and the payload are
+// written with a single writev(2) if the connection supports it.
+func (c *Conn) writeFrame(op OpCode, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	hdr := appendFrameHeader(c.whdr[:0], true, op, c.client, len(payload))
+	if c.client {
+		// mask a copy, as payload is owned by the caller
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		hdr = append(hdr, key[:]...)
+		bp := getBuffer()
+		defer putBuffer(bp)
+		*bp = append(*bp, payload...)
+		maskBytes(key, 0, *bp)
+		payload = *bp
 	}
-	return nil
+	// WriteTo consumes wbufs, so point it to the fixed array every time
+	c.wiov = [2][]byte{hdr, payload}
+	c.wbufs = c.wiov[:]
+	_, err := c.wbufs.WriteTo(c.Rwc)
+	c.wiov[1] = nil
+	return err
 }
 
 // SendCloseFrame send an close frame
 func (c *Conn) SendCloseFrame(status int) error {
 	// status code must be network byte order
 	// https://tools.ietf.org/html/rfc6455#section-5.5.1
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, uint16(status))
-	df, err := NewDataFrameFromBinaryMessage(buf, false)
-	if err != nil {
-		return err
+	var buf []byte
+	// 1005 means no status code, so send empty body
+	if status != StatusNoStatusReceived {
+		buf = make([]byte, 2)
+		binary.BigEndian.PutUint16(buf, uint16(status))
 	}
-	df.OpCode = OpCodeClose
-	_, err = c.Rwc.Write(df.Frame())
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.writeFrame(OpCodeClose, buf)
 }
 
 // Close closes connection
 func (c *Conn) Close() {
-	if c.State == Established {
-		c.SendCloseFrame(StatusNormalClosure)
-		c.State = Closing
+	c.CloseWithStatus(StatusNormalClosure)
+}
+
+// CloseWithStatus starts the closing handshake with the status code.
+// If the connection is not established, it is closed immediately.
+func (c *Conn) CloseWithStatus(status int) {
+	if c.transition(Established, Closing) {
+		c.SendCloseFrame(status)
 		return
 	}
-	c.Rwc.Close()
-	c.State = Closed
-	return
+	c.setClosed()
 }
 
 // Ping sends a ping to client
 func (c *Conn) Ping() error {
 	msg := fmt.Sprintf("ping %d", time.Now().Unix())
-	df, err := NewDataFrameFromTextMessage(msg, false)
-	if err != nil {
-		return err
-	}
-	df.OpCode = OpCodePing
-	_, err = c.Rwc.Write(df.Frame())
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.writeFrame(OpCodePing, []byte(msg))
+}
+
+// Pong sends a pong to client with the payload of the ping
+func (c *Conn) Pong(msg []byte) error {
+	return c.writeFrame(OpCodePong, msg)
 }
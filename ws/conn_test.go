@@ -0,0 +1,343 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+var testMaskingKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// clientFrame builds a raw frame as a client sends it.
+// b0 is the first byte (FIN, RSV and opcode).
+func clientFrame(b0 byte, payload []byte, mask bool) []byte {
+	res := []byte{b0, 0}
+	switch l := len(payload); {
+	case l < 126:
+		res[1] = byte(l)
+	case l <= 0xffff:
+		res[1] = 126
+		res = append(res, 0, 0)
+		binary.BigEndian.PutUint16(res[2:], uint16(l))
+	default:
+		res[1] = 127
+		res = append(res, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(res[2:], uint64(l))
+	}
+	if !mask {
+		return append(res, payload...)
+	}
+	res[1] |= 0x80
+	res = append(res, testMaskingKey[:]...)
+	for i, b := range payload {
+		res = append(res, b^testMaskingKey[i%4])
+	}
+	return res
+}
+
+func TestConn_ReadMessage_ProtocolViolation(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{
+			name:   "rsv1",
+			frames: [][]byte{clientFrame(0x80|0x40|byte(OpCodeText), []byte("a"), true)},
+		},
+		{
+			name:   "rsv2",
+			frames: [][]byte{clientFrame(0x80|0x20|byte(OpCodeText), []byte("a"), true)},
+		},
+		{
+			name:   "rsv3",
+			frames: [][]byte{clientFrame(0x80|0x10|byte(OpCodeBinary), []byte("a"), true)},
+		},
+		{
+			name:   "reserved non-control opcode",
+			frames: [][]byte{clientFrame(0x80|0x3, nil, true)},
+		},
+		{
+			name:   "reserved control opcode",
+			frames: [][]byte{clientFrame(0x80|0xB, nil, true)},
+		},
+		{
+			name:   "unmasked frame",
+			frames: [][]byte{clientFrame(0x80|byte(OpCodeText), []byte("a"), false)},
+		},
+		{
+			name:   "fragmented ping",
+			frames: [][]byte{clientFrame(byte(OpCodePing), []byte("a"), true)},
+		},
+		{
+			name:   "control frame too long",
+			frames: [][]byte{clientFrame(0x80|byte(OpCodePing), make([]byte, 126), true)},
+		},
+		{
+			name:   "continuation without start",
+			frames: [][]byte{clientFrame(0x80|byte(OpCodeContinuation), []byte("a"), true)},
+		},
+		{
+			name: "new message during fragmented message",
+			frames: [][]byte{
+				clientFrame(byte(OpCodeText), []byte("a"), true),
+				clientFrame(0x80|byte(OpCodeText), []byte("b"), true),
+			},
+		},
+		{
+			name:   "payload length msb set",
+			frames: [][]byte{{0x80 | byte(OpCodeBinary), 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			c := NewConn(server)
+
+			closeFrame := make(chan *DataFrame, 1)
+			go func() {
+				for _, f := range tt.frames {
+					if _, err := client.Write(f); err != nil {
+						break
+					}
+				}
+				df, _ := NewDataFrameFromReader(client)
+				closeFrame <- df
+			}()
+
+			var err error
+			for i := 0; i < len(tt.frames) && err == nil; i++ {
+				_, err = c.ReadMessage()
+			}
+			var cerr *CloseError
+			if !errors.As(err, &cerr) || cerr.Code != StatusProtocolError {
+				t.Fatalf("ReadMessage() error = %v, want close %d", err, StatusProtocolError)
+			}
+			if c.State != Closed {
+				t.Errorf("State = %d, want Closed", c.State)
+			}
+			df := <-closeFrame
+			if df == nil || df.OpCode != OpCodeClose {
+				t.Fatalf("server sent %+v, want close frame", df)
+			}
+			if code, _ := df.CloseStatusCode(); code != StatusProtocolError {
+				t.Errorf("close code = %d, want %d", code, StatusProtocolError)
+			}
+		})
+	}
+}
+
+func TestConn_ReadMessage_Fragmented(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewConn(server)
+
+	go func() {
+		client.Write(clientFrame(byte(OpCodeText), []byte("he"), true))
+		client.Write(clientFrame(0x80|byte(OpCodePing), []byte("p"), true))
+		client.Write(clientFrame(byte(OpCodeContinuation), []byte("ll"), true))
+		client.Write(clientFrame(0x80|byte(OpCodeContinuation), []byte("o"), true))
+	}()
+
+	var got []byte
+	wantOps := []OpCode{OpCodeText, OpCodePing, OpCodeContinuation, OpCodeContinuation}
+	for i, want := range wantOps {
+		df, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		if df.OpCode != want {
+			t.Fatalf("frame %d opcode = %v, want %v", i, df.OpCode, want)
+		}
+		if df.OpCode != OpCodePing {
+			got = append(got, df.Message()...)
+		}
+	}
+	if !bytes.Equal(got, []byte("hello")) {
+		t.Errorf("message = %q, want %q", got, "hello")
+	}
+}
+
+func TestConn_NextMessage_TooBig(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxMessageSize int
+		frames         [][]byte
+	}{
+		{
+			// checked before the payload is allocated
+			name:   "huge payload length with the default limit",
+			frames: [][]byte{{0x80 | byte(OpCodeBinary), 0x80 | 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}},
+		},
+		{
+			name:           "fragments over the limit",
+			maxMessageSize: 4,
+			frames: [][]byte{
+				clientFrame(byte(OpCodeText), []byte("abc"), true),
+				clientFrame(0x80|byte(OpCodeContinuation), []byte("de"), true),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			c := NewConn(server)
+			c.MaxMessageSize = tt.maxMessageSize
+
+			closeFrame := make(chan *DataFrame, 1)
+			go func() {
+				for _, f := range tt.frames {
+					if _, err := client.Write(f); err != nil {
+						break
+					}
+				}
+				df, _ := NewDataFrameFromReader(client)
+				closeFrame <- df
+			}()
+
+			_, _, err := c.NextMessage()
+			var cerr *CloseError
+			if !errors.As(err, &cerr) || cerr.Code != StatusMessageTooBig {
+				t.Fatalf("NextMessage() error = %v, want close %d", err, StatusMessageTooBig)
+			}
+			df := <-closeFrame
+			if df == nil || df.OpCode != OpCodeClose {
+				t.Fatalf("server sent %+v, want close frame", df)
+			}
+			if code, _ := df.CloseStatusCode(); code != StatusMessageTooBig {
+				t.Errorf("close code = %d, want %d", code, StatusMessageTooBig)
+			}
+		})
+	}
+}
+
+func TestConn_ReadMessage_InvalidPayload(t *testing.T) {
+	closePayload := func(code int, reason string) []byte {
+		p := make([]byte, 2)
+		binary.BigEndian.PutUint16(p, uint16(code))
+		return append(p, reason...)
+	}
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		wantCode int
+	}{
+		{
+			name:     "invalid utf-8 text",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeText), []byte("\xce\xba\xff"), true)},
+			wantCode: StatusInvalidFramePayloadData,
+		},
+		{
+			name: "invalid utf-8 in later fragment",
+			frames: [][]byte{
+				clientFrame(byte(OpCodeText), []byte("\xce"), true),
+				clientFrame(byte(OpCodeContinuation), []byte("\xba\xed\xa0"), true),
+			},
+			wantCode: StatusInvalidFramePayloadData,
+		},
+		{
+			name: "truncated utf-8 at final fragment",
+			frames: [][]byte{
+				clientFrame(byte(OpCodeText), []byte("a"), true),
+				clientFrame(0x80|byte(OpCodeContinuation), []byte("\xce"), true),
+			},
+			wantCode: StatusInvalidFramePayloadData,
+		},
+		{
+			name:     "invalid utf-8 close reason",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeClose), closePayload(StatusNormalClosure, "\xff"), true)},
+			wantCode: StatusInvalidFramePayloadData,
+		},
+		{
+			name:     "close payload of 1 byte",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeClose), []byte{0x03}, true)},
+			wantCode: StatusProtocolError,
+		},
+		{
+			name:     "close code under 1000",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeClose), closePayload(999, ""), true)},
+			wantCode: StatusProtocolError,
+		},
+		{
+			name:     "close code 1005",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeClose), closePayload(StatusNoStatusReceived, ""), true)},
+			wantCode: StatusProtocolError,
+		},
+		{
+			name:     "close code 1006",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeClose), closePayload(StatusAbnormalClosure, ""), true)},
+			wantCode: StatusProtocolError,
+		},
+		{
+			name:     "close code 1015",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeClose), closePayload(StatusTLSHandShake, ""), true)},
+			wantCode: StatusProtocolError,
+		},
+		{
+			name:     "unassigned close code",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeClose), closePayload(2000, ""), true)},
+			wantCode: StatusProtocolError,
+		},
+		{
+			name:     "close code 5000",
+			frames:   [][]byte{clientFrame(0x80|byte(OpCodeClose), closePayload(5000, ""), true)},
+			wantCode: StatusProtocolError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			c := NewConn(server)
+
+			closeFrame := make(chan *DataFrame, 1)
+			go func() {
+				for _, f := range tt.frames {
+					if _, err := client.Write(f); err != nil {
+						break
+					}
+				}
+				df, _ := NewDataFrameFromReader(client)
+				closeFrame <- df
+			}()
+
+			var err error
+			for i := 0; i < len(tt.frames) && err == nil; i++ {
+				_, err = c.ReadMessage()
+			}
+			var cerr *CloseError
+			if !errors.As(err, &cerr) || cerr.Code != tt.wantCode {
+				t.Fatalf("ReadMessage() error = %v, want close %d", err, tt.wantCode)
+			}
+			df := <-closeFrame
+			if code, _ := df.CloseStatusCode(); code != tt.wantCode {
+				t.Errorf("close code = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestConn_ReadMessage_ValidClose(t *testing.T) {
+	for _, code := range []int{StatusNormalClosure, StatusGoingAway, StatusMissingExtension, 3000, 4999} {
+		server, client := net.Pipe()
+		c := NewConn(server)
+		p := make([]byte, 2)
+		binary.BigEndian.PutUint16(p, uint16(code))
+		go client.Write(clientFrame(0x80|byte(OpCodeClose), append(p, "κόσμε"...), true))
+
+		df, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("code %d: ReadMessage() error = %v", code, err)
+		}
+		if got, _ := df.CloseStatusCode(); got != code {
+			t.Errorf("CloseStatusCode() = %d, want %d", got, code)
+		}
+		if got := df.CloseReason(); got != "κόσμε" {
+			t.Errorf("CloseReason() = %q, want %q", got, "κόσμε")
+		}
+		client.Close()
+	}
+}
@@ -9,6 +9,7 @@ import (
 // DataFrame represents data frames of WebSocket protocol
 type DataFrame struct {
 	fin        bool
+	rsv        byte // RSV1-3 bits, 0b0111_0000 of the first byte
 	OpCode     OpCode
 	mask       bool
 	payloadLen int
@@ -30,6 +31,24 @@ const (
 	OpCodePong                = 0xA
 )
 
+// maxControlPayloadLen is max payload length of control frames
+// https://tools.ietf.org/html/rfc6455#section-5.5
+const maxControlPayloadLen = 125
+
+// IsControl reports whether the opcode is for a control frame
+func (o OpCode) IsControl() bool {
+	return o&0x8 != 0
+}
+
+// IsReserved reports whether the opcode is reserved for further frames
+func (o OpCode) IsReserved() bool {
+	switch o {
+	case OpCodeContinuation, OpCodeText, OpCodeBinary, OpCodeClose, OpCodePing, OpCodePong:
+		return false
+	}
+	return true
+}
+
 /*
     0                   1                   2                   3
     0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
@@ -51,38 +70,57 @@ const (
    +---------------------------------------------------------------+
 */
 
+// maxFrameHeaderLen is the max length of frame header including
+// extended payload length and masking key
+const maxFrameHeaderLen = 14
+
 // NewDataFrameFromReader read request and build DataFrame
 func NewDataFrameFromReader(r io.Reader) (*DataFrame, error) {
 	df := &DataFrame{}
+	if err := df.readHeader(r, make([]byte, 8)); err != nil {
+		return nil, err
+	}
+	if err := df.readPayload(r); err != nil {
+		return nil, err
+	}
+	return df, nil
+}
 
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return nil, fmt.Errorf("Failed to read first 16 bit %w", err)
+// readHeader reads a frame up to the masking key.
+// buf is a scratch buffer of at least 8 bytes, so that callers can reuse it.
+func (d *DataFrame) readHeader(r io.Reader, buf []byte) error {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return fmt.Errorf("Failed to read first 16 bit %w", err)
 	}
 
-	df.fin = buf[0]>>7 == 1
-	df.OpCode = OpCode(buf[0] & 0b00001111)
-	df.mask = buf[1]>>7 == 1
+	d.fin = buf[0]>>7 == 1
+	d.rsv = buf[0] & 0b01110000
+	d.OpCode = OpCode(buf[0] & 0b00001111)
+	d.mask = buf[1]>>7 == 1
 	leadingPayloadLen := int(buf[1] & 0b01111111)
-	payloadLen, err := readExtendedPayloadLen(r, leadingPayloadLen)
+	payloadLen, err := readExtendedPayloadLen(r, leadingPayloadLen, buf)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	df.payloadLen = payloadLen
+	d.payloadLen = payloadLen
 
-	mk := make([]byte, 4)
-	if _, err := io.ReadFull(r, mk); err != nil {
-		return nil, fmt.Errorf("Failed to read masking key %w", err)
+	if d.mask {
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return fmt.Errorf("Failed to read masking key %w", err)
+		}
+		copy(d.maskingKey[:], buf)
 	}
-	copy(df.maskingKey[:], mk)
 
-	encoded := make([]byte, df.payloadLen)
+	return nil
+}
+
+func (d *DataFrame) readPayload(r io.Reader) error {
+	encoded := make([]byte, d.payloadLen)
 	if _, err := io.ReadFull(r, encoded); err != nil {
-		return nil, fmt.Errorf("Failed to read payload %w", err)
+		return fmt.Errorf("Failed to read payload %w", err)
 	}
-	df.rawPayload = encoded
-
-	return df, nil
+	d.rawPayload = encoded
+	return nil
 }
 
 // NewDataFrameFromTextMessage build DataFrame from text message to send
@@ -109,27 +147,35 @@ func NewDataFrameFromBinaryMessage(msg []byte, mask bool) (*DataFrame, error) {
 	return df, nil
 }
 
+// Fin reports whether the frame is the final fragment of a message
+func (d *DataFrame) Fin() bool {
+	return d.fin
+}
+
 // Message returns payload value
 func (d *DataFrame) Message() []byte {
 	if d.payload != nil {
 		return d.payload
 	}
-
-	decoded := make([]byte, d.payloadLen)
-	for i := 0; i < d.payloadLen; i++ {
-		decoded[i] = d.rawPayload[i] ^ d.maskingKey[i%4]
+	// decode in place, rawPayload is not used any more
+	if d.mask {
+		maskBytes(d.maskingKey, 0, d.rawPayload)
 	}
-	d.payload = decoded
+	d.payload = d.rawPayload
 
 	return d.payload
 }
 
-// CloseStatusCode returns closure status code sent from client
+// CloseStatusCode returns closure status code sent from client.
+// StatusNoStatusReceived is returned if the close frame has no body.
 func (d *DataFrame) CloseStatusCode() (int, error) {
 	if d.OpCode != OpCodeClose {
 		return 0, fmt.Errorf("not close frame")
 	}
 	decoded := d.Message()
+	if len(decoded) == 0 {
+		return StatusNoStatusReceived, nil
+	}
 	if len(decoded) < 2 {
 		return 0, fmt.Errorf("invalid status code %v", decoded)
 	}
@@ -137,23 +183,80 @@ func (d *DataFrame) CloseStatusCode() (int, error) {
 	return int(status), nil
 }
 
+// CloseReason returns closure reason sent from client
+func (d *DataFrame) CloseReason() string {
+	if d.OpCode != OpCodeClose {
+		return ""
+	}
+	decoded := d.Message()
+	if len(decoded) <= 2 {
+		return ""
+	}
+	return string(decoded[2:])
+}
+
 // Frame build DataFrame binary representation
 func (d *DataFrame) Frame() []byte {
-	res := make([]byte, 2)
-	fin := 0
-	if d.fin {
-		fin = 1
+	res := make([]byte, 0, maxFrameHeaderLen+d.payloadLen)
+	res = appendFrameHeader(res, d.fin, d.OpCode, d.mask, d.payloadLen)
+	if !d.mask {
+		return append(res, d.payload...)
 	}
-	res[0] = byte((fin << 7) | int(d.OpCode))
-	res[1] = byte(d.payloadLen)
-	if d.mask {
-		res[1] = res[1] | 0b10000000
-	}
-	res = append(res, ([]byte)(d.payload)...)
+	res = append(res, d.maskingKey[:]...)
+	n := len(res)
+	res = append(res, d.payload...)
+	maskBytes(d.maskingKey, 0, res[n:])
 	return res
 }
 
-func readExtendedPayloadLen(r io.Reader, leadingPayloadLen int) (int, error) {
+// appendFrameHeader appends frame header without masking key to b
+func appendFrameHeader(b []byte, fin bool, op OpCode, mask bool, payloadLen int) []byte {
+	b0 := byte(op)
+	if fin {
+		b0 |= 0b10000000
+	}
+	var b1 byte
+	if mask {
+		b1 = 0b10000000
+	}
+	switch {
+	case payloadLen < 126:
+		return append(b, b0, b1|byte(payloadLen))
+	case payloadLen <= 0xffff:
+		return append(b, b0, b1|126, byte(payloadLen>>8), byte(payloadLen))
+	}
+	n := uint64(payloadLen)
+	return append(b, b0, b1|127,
+		byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+		byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// maskBytes masks or unmasks b in place with the masking key, where pos is
+// the offset of b[0] in the payload. It returns the offset following b.
+// https://tools.ietf.org/html/rfc6455#section-5.3
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	// XOR a word at a time. The key rotated by pos repeats every 4 bytes,
+	// so that a 8 bytes word is XORed with the key twice.
+	if len(b) >= 8 {
+		var k [4]byte
+		for i := range k {
+			k[i] = key[(pos+i)&3]
+		}
+		k32 := uint64(binary.LittleEndian.Uint32(k[:]))
+		kw := k32<<32 | k32
+		for len(b) >= 8 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^kw)
+			b = b[8:]
+		}
+	}
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
+
+func readExtendedPayloadLen(r io.Reader, leadingPayloadLen int, buf []byte) (int, error) {
 	if leadingPayloadLen < 126 {
 		return leadingPayloadLen, nil
 	}
@@ -161,20 +264,20 @@ func readExtendedPayloadLen(r io.Reader, leadingPayloadLen int) (int, error) {
 	var res int
 	switch leadingPayloadLen {
 	case 126:
-		bl := 2
-		buf := make([]byte, bl)
-		if _, err := io.ReadFull(r, buf); err != nil {
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
 			return 0, fmt.Errorf("Failed to read extended payload length %w", err)
 		}
 		l := binary.BigEndian.Uint16(buf)
 		res = int(l)
 	case 127:
-		bl := 8
-		buf := make([]byte, bl)
-		if _, err := io.ReadFull(r, buf); err != nil {
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
 			return 0, fmt.Errorf("Failed to read extended payload length %w", err)
 		}
 		l := binary.BigEndian.Uint64(buf)
+		// the most significant bit MUST be 0
+		if l>>63 != 0 {
+			return 0, &CloseError{Code: StatusProtocolError, Text: "invalid payload length"}
+		}
 		res = int(l)
 	}
 
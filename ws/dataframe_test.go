@@ -0,0 +1,63 @@
+package ws
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_maskBytes(t *testing.T) {
+	for size := 0; size < 40; size++ {
+		for pos := 0; pos < 4; pos++ {
+			in := make([]byte, size)
+			for i := range in {
+				in[i] = byte(i * 7)
+			}
+			want := make([]byte, size)
+			for i := range in {
+				want[i] = in[i] ^ testMaskingKey[(pos+i)%4]
+			}
+
+			got := append([]byte{}, in...)
+			if next := maskBytes(testMaskingKey, pos, got); next != (pos+size)%4 {
+				t.Errorf("size %d pos %d: maskBytes() = %d, want %d", size, pos, next, (pos+size)%4)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("size %d pos %d: masked = %v, want %v", size, pos, got, want)
+			}
+		}
+	}
+}
+
+func TestDataFrame_Frame(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte{'a'}, size)
+		df, _ := NewDataFrameFromBinaryMessage(payload, true)
+		df.maskingKey = testMaskingKey
+		want := clientFrame(0x80|byte(OpCodeBinary), payload, true)
+		if got := df.Frame(); !bytes.Equal(got, want) {
+			t.Errorf("size %d: Frame() header = %v, want %v", size, got[:8], want[:8])
+		}
+
+		read, err := NewDataFrameFromReader(bytes.NewReader(want))
+		if err != nil {
+			t.Fatalf("size %d: NewDataFrameFromReader() error = %v", size, err)
+		}
+		if got := read.Message(); !bytes.Equal(got, payload) {
+			t.Errorf("size %d: Message() differs from payload", size)
+		}
+	}
+}
+
+func TestNewPreparedMessage(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0x10000} {
+		payload := bytes.Repeat([]byte{'a'}, size)
+		df, _ := NewDataFrameFromBinaryMessage(payload, false)
+		pm := NewPreparedMessage(OpCodeBinary, payload)
+		if !bytes.Equal(pm.frame, df.Frame()) {
+			t.Errorf("size %d: prepared frame differs from Frame()", size)
+		}
+		if !bytes.Equal(pm.Payload(), payload) {
+			t.Errorf("size %d: Payload() differs", size)
+		}
+	}
+}
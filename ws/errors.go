@@ -0,0 +1,23 @@
+package ws
+
+import "fmt"
+
+// CloseError represents the reason why the connection was closed.
+// It is returned when the peer violates the protocol and the connection is
+// failed, or when a close frame is received.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d (%s): %s", e.Code, StatusText(e.Code), e.Text)
+}
+
+func protocolError(format string, a ...interface{}) error {
+	return &CloseError{Code: StatusProtocolError, Text: fmt.Sprintf(format, a...)}
+}
+
+func invalidPayloadError(format string, a ...interface{}) error {
+	return &CloseError{Code: StatusInvalidFramePayloadData, Text: fmt.Sprintf(format, a...)}
+}
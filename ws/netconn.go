@@ -0,0 +1,89 @@
+package ws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// closeTimeout bounds the wait for the close frame of the peer in Close
+const closeTimeout = 5 * time.Second
+
+// netConn adapts Conn to net.Conn
+type netConn struct {
+	c *Conn
+
+	// serializes reads, as a read may span messages
+	rmu  sync.Mutex
+	rbuf []byte // buffer of the current message
+	roff int    // bytes of rbuf already read
+}
+
+// NewNetConn returns net.Conn which tunnels a byte stream over c.
+// Read returns data of received messages regardless of message boundaries,
+// and Write sends each call as a binary message. Deadlines are set to the
+// underlying connection, and a read timeout before a message starts
+// leaves the connection usable. Close performs the closing handshake.
+func NewNetConn(c *Conn) net.Conn {
+	return &netConn{c: c}
+}
+
+func (nc *netConn) Read(p []byte) (int, error) {
+	nc.rmu.Lock()
+	defer nc.rmu.Unlock()
+	for nc.roff == len(nc.rbuf) {
+		_, b, err := nc.c.NextMessageInto(nc.rbuf[:0])
+		if err != nil {
+			return 0, readError(err)
+		}
+		nc.rbuf, nc.roff = b, 0
+	}
+	n := copy(p, nc.rbuf[nc.roff:])
+	nc.roff += n
+	return n, nil
+}
+
+// readError maps the normal closure to io.EOF
+func readError(err error) error {
+	var cerr *CloseError
+	if errors.As(err, &cerr) {
+		switch cerr.Code {
+		case StatusNormalClosure, StatusGoingAway, StatusNoStatusReceived:
+			return io.EOF
+		}
+	}
+	return err
+}
+
+func (nc *netConn) Write(p []byte) (int, error) {
+	if err := nc.c.SendBinaryMessage(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame and waits for the reply of the peer, then
+// closes the underlying connection
+func (nc *netConn) Close() error {
+	nc.c.Rwc.SetDeadline(time.Now().Add(closeTimeout))
+	nc.c.Close()
+	// a concurrent Read receives the reply and returns, and then the
+	// remaining messages are discarded here until the reply
+	nc.rmu.Lock()
+	defer nc.rmu.Unlock()
+	for {
+		if _, _, err := nc.c.NextMessage(); err != nil {
+			break
+		}
+	}
+	nc.c.setClosed()
+	return nil
+}
+
+func (nc *netConn) LocalAddr() net.Addr                { return nc.c.Rwc.LocalAddr() }
+func (nc *netConn) RemoteAddr() net.Addr               { return nc.c.Rwc.RemoteAddr() }
+func (nc *netConn) SetDeadline(t time.Time) error      { return nc.c.Rwc.SetDeadline(t) }
+func (nc *netConn) SetReadDeadline(t time.Time) error  { return nc.c.Rwc.SetReadDeadline(t) }
+func (nc *netConn) SetWriteDeadline(t time.Time) error { return nc.c.Rwc.SetWriteDeadline(t) }
@@ -0,0 +1,106 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// newNetConnPair returns connected pair, which is closed by the server
+// at the end of the test while the client is reading
+func newNetConnPair(t *testing.T) (net.Conn, net.Conn) {
+	server, client := net.Pipe()
+	s := NewNetConn(NewConn(server))
+	c := NewNetConn(NewClientConn(client, bufio.NewReader(client)))
+	t.Cleanup(func() {
+		go io.Copy(ioutil.Discard, c)
+		s.Close()
+	})
+	return s, c
+}
+
+func TestNetConn_Read(t *testing.T) {
+	s, c := newNetConnPair(t)
+
+	go func() {
+		c.Write([]byte("hello, "))
+		c.Write([]byte("world"))
+		c.Write(bytes.Repeat([]byte("x"), 100000))
+		c.Close()
+	}()
+
+	// reads span message boundaries
+	b := make([]byte, 3)
+	var got []byte
+	for len(got) < len("hello, world") {
+		n, err := s.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b[:n]...)
+	}
+	if string(got) != "hello, world" {
+		t.Errorf("Read() = %q", got)
+	}
+	rest, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if len(rest) != 100000 {
+		t.Errorf("read %d bytes, want 100000", len(rest))
+	}
+}
+
+func TestNetConn_Deadline(t *testing.T) {
+	s, c := newNetConnPair(t)
+
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := s.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read() error = %v, want timeout", err)
+	}
+
+	// the connection is still usable
+	s.SetReadDeadline(time.Time{})
+	go c.Write([]byte("a"))
+	b := make([]byte, 1)
+	if _, err := s.Read(b); err != nil || b[0] != 'a' {
+		t.Errorf("Read() = %q, %v after timeout", b, err)
+	}
+}
+
+func TestNetConn_Close(t *testing.T) {
+	server, client := net.Pipe()
+	sc := NewConn(server)
+	s := NewNetConn(sc)
+	cc := NewClientConn(client, bufio.NewReader(client))
+	c := NewNetConn(cc)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, s)
+		done <- err
+	}()
+	c.Write([]byte("bye"))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Copy() error = %v, want EOF", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not receive close")
+	}
+	if cc.State != Closed || sc.State != Closed {
+		t.Errorf("State = %d, %d, want Closed", cc.State, sc.State)
+	}
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Error("Write() after Close succeeded")
+	}
+}
@@ -0,0 +1,40 @@
+package ws
+
+// PreparedMessage is a message encoded to a frame once, to send the same
+// bytes to many connections
+type PreparedMessage struct {
+	op      OpCode
+	payload []byte
+	frame   []byte
+}
+
+// NewPreparedMessage encodes a text or binary message to a frame
+func NewPreparedMessage(op OpCode, msg []byte) *PreparedMessage {
+	frame := make([]byte, 0, maxFrameHeaderLen+len(msg))
+	frame = appendFrameHeader(frame, true, op, false, len(msg))
+	n := len(frame)
+	frame = append(frame, msg...)
+	return &PreparedMessage{op: op, payload: frame[n:], frame: frame}
+}
+
+// OpCode returns the opcode of the message
+func (pm *PreparedMessage) OpCode() OpCode {
+	return pm.op
+}
+
+// Payload returns the message. It must not be modified.
+func (pm *PreparedMessage) Payload() []byte {
+	return pm.payload
+}
+
+// WritePreparedMessage sends the prepared message. The encoded frame is
+// written as is on server side, and client side masks the payload.
+func (c *Conn) WritePreparedMessage(pm *PreparedMessage) error {
+	if c.client {
+		return c.writeFrame(pm.op, pm.payload)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Rwc.Write(pm.frame)
+	return err
+}
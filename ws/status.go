@@ -43,3 +43,19 @@ var statusText = map[int]string{
 func StatusText(code int) string {
 	return statusText[code]
 }
+
+// validCloseCode reports whether the code can be sent in a close frame.
+// 1005, 1006 and 1015 are reserved for reporting only, and codes under 3000
+// must be defined by the spec.
+// See: https://tools.ietf.org/html/rfc6455#section-7.4.2
+func validCloseCode(code int) bool {
+	switch code {
+	case StatusNoStatusReceived, StatusAbnormalClosure, StatusTLSHandShake:
+		return false
+	}
+	if 3000 <= code && code <= 4999 {
+		return true
+	}
+	_, ok := statusText[code]
+	return ok
+}
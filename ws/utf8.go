@@ -0,0 +1,55 @@
+package ws
+
+// utf8Validator validates UTF-8 byte sequence incrementally, so that a
+// text message split into several fragments can be checked frame by frame
+// and rejected as soon as an invalid byte arrives.
+// See: https://tools.ietf.org/html/rfc3629#section-4
+type utf8Validator struct {
+	need   int  // number of continuation bytes still expected
+	lo, hi byte // accepted range of the next continuation byte
+}
+
+// Write validates p following the bytes already written.
+// It returns false if the sequence can no longer be valid UTF-8.
+func (v *utf8Validator) Write(p []byte) bool {
+	for _, b := range p {
+		if v.need > 0 {
+			if b < v.lo || b > v.hi {
+				return false
+			}
+			v.need--
+			v.lo, v.hi = 0x80, 0xBF
+			continue
+		}
+		switch {
+		case b < 0x80:
+		case 0xC2 <= b && b <= 0xDF:
+			v.need, v.lo, v.hi = 1, 0x80, 0xBF
+		case b == 0xE0:
+			v.need, v.lo, v.hi = 2, 0xA0, 0xBF
+		case 0xE1 <= b && b <= 0xEC, b == 0xEE, b == 0xEF:
+			v.need, v.lo, v.hi = 2, 0x80, 0xBF
+		case b == 0xED: // exclude surrogates
+			v.need, v.lo, v.hi = 2, 0x80, 0x9F
+		case b == 0xF0:
+			v.need, v.lo, v.hi = 3, 0x90, 0xBF
+		case 0xF1 <= b && b <= 0xF3:
+			v.need, v.lo, v.hi = 3, 0x80, 0xBF
+		case b == 0xF4: // up to U+10FFFF
+			v.need, v.lo, v.hi = 3, 0x80, 0x8F
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Complete reports whether the written bytes end at a character boundary
+func (v *utf8Validator) Complete() bool {
+	return v.need == 0
+}
+
+// Reset clears the state to validate a new message
+func (v *utf8Validator) Reset() {
+	*v = utf8Validator{}
+}
@@ -0,0 +1,40 @@
+package ws
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func Test_utf8Validator(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"ascii", "Hello-µ@ßöäüàá-UTF-8!!"},
+		{"empty", ""},
+		{"multibyte", "κόσμε"},
+		{"4 bytes", "\xf0\x90\x80\x80"},
+		{"max code point", "\xf4\x8f\xbf\xbf"},
+		{"over max code point", "\xf4\x90\x80\x80"},
+		{"surrogate", "\xed\xa0\x80"},
+		{"overlong 2 bytes", "\xc0\xaf"},
+		{"overlong 3 bytes", "\xe0\x80\xaf"},
+		{"overlong 4 bytes", "\xf0\x80\x80\xaf"},
+		{"lone continuation", "\x80"},
+		{"truncated", "κ\xce"},
+		{"invalid byte", "a\xffb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := utf8.ValidString(tt.in)
+			// split the input at every position to emulate fragments
+			for i := 0; i <= len(tt.in); i++ {
+				var v utf8Validator
+				got := v.Write([]byte(tt.in[:i])) && v.Write([]byte(tt.in[i:])) && v.Complete()
+				if got != want {
+					t.Errorf("split at %d: valid = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}